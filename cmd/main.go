@@ -1,14 +1,24 @@
 package main
 
 import (
+	"context"
 	"log"
+	"net"
 
+	"cruder/internal/auth"
 	"cruder/internal/config"
 	"cruder/internal/controller"
+	"cruder/internal/events"
 	"cruder/internal/handler"
+	"cruder/internal/job"
+	"cruder/internal/middleware"
+	"cruder/internal/ratelimit"
 	"cruder/internal/repository"
+	"cruder/internal/rpc"
 	"cruder/internal/service"
+	"cruder/internal/webhook"
 	"cruder/pkg/logger"
+	"cruder/pkg/validation"
 
 	"github.com/easysy/envio"
 	"github.com/gin-gonic/gin"
@@ -31,8 +41,73 @@ func main() {
 	services := service.NewService(repositories)
 	controllers := controller.NewController(services)
 
+	ctx := context.Background()
+	go job.Every(ctx, "purge deleted users", cfg.GetPurgeInterval(), func(ctx context.Context) (int64, error) {
+		return services.Users.Purge(ctx, cfg.GetPurgeRetention())
+	})
+	go job.Every(ctx, "delete expired idempotency keys", cfg.GetPurgeInterval(), repositories.Idempotency.DeleteExpired)
+	go job.Every(ctx, "purge user events", cfg.GetPurgeInterval(), func(ctx context.Context) (int64, error) {
+		return services.Users.PurgeEvents(ctx, cfg.GetEventRetention())
+	})
+	go func() {
+		if err := events.Listen(ctx, cfg.GetPostgresDNS(), services.Events); err != nil {
+			log.Fatalf("failed to listen for user events: %v", err)
+		}
+	}()
+
+	go webhook.NewDispatcher(repositories.Webhooks, services.Events).Run(ctx)
+
+	// The configured key is kept as the admin key that creates the first
+	// managed keys.
+	authenticators := []auth.Authenticator{auth.APIKey(auth.Keys(auth.StaticKey(cfg.APIKey), services.APIKeys))}
+	if cfg.JWKS != "" {
+		if cfg.JWTIssuer == "" || cfg.JWTAudience == "" {
+			log.Fatal("JWT_ISSUER and JWT_AUDIENCE are required with JWT_JWKS")
+		}
+		authenticators = append(authenticators, auth.NewJWT(auth.NewJWKS(cfg.JWKS, cfg.GetJWKSRefresh()), auth.JWTConfig{
+			Issuer:     cfg.JWTIssuer,
+			Audience:   cfg.JWTAudience,
+			ScopeClaim: cfg.JWTScopeClaim,
+			Scopes:     cfg.JWTScopes,
+		}))
+	}
+	if err = validation.ValidateRole(cfg.GetDefaultRole()); err != nil {
+		log.Fatalf("invalid DEFAULT_ROLE: %v", err)
+	}
+	authenticator := auth.WithRoles(auth.Chain(authenticators...), services.Roles, cfg.GetDefaultRole())
+	idempotency := middleware.Idempotency(repositories.Idempotency, cfg.GetIdempotencyTTL())
+
+	lis, err := net.Listen("tcp", cfg.GetGRPCAddress())
+	if err != nil {
+		log.Fatalf("failed to listen for gRPC: %v", err)
+	}
+	go func() {
+		if err := rpc.NewServer(authenticator, services.Users).Serve(lis); err != nil {
+			log.Fatalf("failed to run gRPC server: %v", err)
+		}
+	}()
+
+	limits := handler.RateLimits{
+		Store:    ratelimit.NewMemoryStore(),
+		Users:    cfg.GetUsersRateLimit(),
+		GraphQL:  cfg.GetGraphQLRateLimit(),
+		Admin:    cfg.GetAdminRateLimit(),
+		SCIM:     cfg.GetSCIMRateLimit(),
+		Failures: cfg.GetFailuresRateLimit(),
+	}
+	if cfg.RateLimitRedis != "" {
+		if limits.Store, err = ratelimit.NewRedisStore(cfg.RateLimitRedis); err != nil {
+			log.Fatalf("invalid RATE_LIMIT_REDIS: %v", err)
+		}
+	}
+
+	// The client IP keys the rate limits, so X-Forwarded-For is only
+	// trusted from the configured proxies.
 	r := gin.Default()
-	handler.New(r, cfg.APIKey, controllers.Users)
+	if err = r.SetTrustedProxies(cfg.GetTrustedProxies()); err != nil {
+		log.Fatalf("invalid TRUSTED_PROXIES: %v", err)
+	}
+	handler.New(r, authenticator, cfg.SCIMToken, idempotency, limits, controllers)
 
 	if err = r.Run(); err != nil {
 		log.Fatalf("failed to run server: %v", err)
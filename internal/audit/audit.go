@@ -0,0 +1,40 @@
+package audit
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// SystemActor is the actor of the changes not made by a request.
+const SystemActor = "system"
+
+// Meta describes the request behind a change, as recorded in the audit log.
+type Meta struct {
+	Actor     string
+	RequestID string
+	ClientIP  string
+}
+
+type metaKey struct{}
+
+// WithMeta returns a copy of ctx carrying the request metadata.
+func WithMeta(ctx context.Context, meta Meta) context.Context {
+	return context.WithValue(ctx, metaKey{}, meta)
+}
+
+// FromContext returns the request metadata, with SystemActor if there is
+// none.
+func FromContext(ctx context.Context) Meta {
+	if meta, ok := ctx.Value(metaKey{}).(Meta); ok {
+		return meta
+	}
+	return Meta{Actor: SystemActor}
+}
+
+// KeyActor identifies a caller by a short fingerprint of its key, which can
+// be stored and shown unlike the key itself.
+func KeyActor(kind, key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return kind + ":" + hex.EncodeToString(sum[:6])
+}
@@ -0,0 +1,162 @@
+// Package auth resolves the credentials of a request to a principal and
+// checks the scopes it is granted.
+package auth
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+
+	"cruder/internal/audit"
+	"cruder/internal/model"
+	"cruder/pkg/validation"
+)
+
+type principalKey struct{}
+
+// WithPrincipal returns a copy of ctx carrying the authenticated principal.
+func WithPrincipal(ctx context.Context, principal *model.Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, principal)
+}
+
+// FromContext returns the authenticated principal, nil if there is none.
+func FromContext(ctx context.Context) *model.Principal {
+	principal, _ := ctx.Value(principalKey{}).(*model.Principal)
+	return principal
+}
+
+// Require returns validation.ErrMissingScope unless the principal of ctx is
+// granted the scope.
+func Require(ctx context.Context, scope string) error {
+	if principal := FromContext(ctx); principal == nil || !principal.Has(scope) {
+		return validation.ErrMissingScope{Scope: scope}
+	}
+	return nil
+}
+
+// Authorize returns validation.ErrMissingPermission unless a role of the
+// principal of ctx grants the permission.
+func Authorize(ctx context.Context, permission string) error {
+	if principal := FromContext(ctx); principal == nil || !principal.Can(permission) {
+		return validation.ErrMissingPermission{Permission: permission}
+	}
+	return nil
+}
+
+// Credentials reads a header of the request by its name, from the HTTP
+// headers or the gRPC metadata.
+type Credentials func(name string) string
+
+// Authenticator resolves the credentials of a request to its principal. It
+// returns validation.ErrNoCredentials if the request carries none of the kind
+// it checks.
+type Authenticator interface {
+	Authenticate(ctx context.Context, creds Credentials) (*model.Principal, error)
+}
+
+// AuthenticatorFunc adapts a function to an Authenticator.
+type AuthenticatorFunc func(ctx context.Context, creds Credentials) (*model.Principal, error)
+
+func (f AuthenticatorFunc) Authenticate(ctx context.Context, creds Credentials) (*model.Principal, error) {
+	return f(ctx, creds)
+}
+
+// Chain asks the authenticators in turn. The first one that finds its kind of
+// credentials decides.
+func Chain(authenticators ...Authenticator) Authenticator {
+	return AuthenticatorFunc(func(ctx context.Context, creds Credentials) (*model.Principal, error) {
+		for _, a := range authenticators {
+			principal, err := a.Authenticate(ctx, creds)
+			if !errors.Is(err, validation.ErrNoCredentials) {
+				return principal, err
+			}
+		}
+		return nil, validation.ErrNoCredentials
+	})
+}
+
+// RoleResolver returns the roles assigned to a principal.
+type RoleResolver interface {
+	RolesOf(ctx context.Context, principal string) ([]string, error)
+}
+
+// WithRoles looks up the roles of the principals the authenticator returns
+// without any. A principal with no role assigned is given the default role,
+// if any.
+func WithRoles(authenticator Authenticator, roles RoleResolver, defaultRole string) Authenticator {
+	return AuthenticatorFunc(func(ctx context.Context, creds Credentials) (*model.Principal, error) {
+		principal, err := authenticator.Authenticate(ctx, creds)
+		if err != nil || principal.Roles != nil {
+			return principal, err
+		}
+
+		assigned, err := roles.RolesOf(ctx, principal.ID)
+		if err != nil {
+			return nil, err
+		}
+		if len(assigned) == 0 && defaultRole != "" {
+			assigned = []string{defaultRole}
+		}
+
+		resolved := *principal
+		resolved.Roles = append([]string{}, assigned...)
+		return &resolved, nil
+	})
+}
+
+// APIKeyHeader carries the API key.
+const APIKeyHeader = "X-API-Key"
+
+// APIKey authenticates the API key of the request.
+func APIKey(keys KeyAuthenticator) Authenticator {
+	return AuthenticatorFunc(func(ctx context.Context, creds Credentials) (*model.Principal, error) {
+		key := creds(APIKeyHeader)
+		if key == "" {
+			return nil, validation.ErrNoCredentials
+		}
+		return keys.Authenticate(ctx, key)
+	})
+}
+
+// KeyAuthenticator resolves an API key to its principal. It returns
+// validation.ErrInvalidAPIKey if the key is unknown, expired or revoked.
+type KeyAuthenticator interface {
+	Authenticate(ctx context.Context, key string) (*model.Principal, error)
+}
+
+// KeyAuthenticatorFunc adapts a function to a KeyAuthenticator.
+type KeyAuthenticatorFunc func(ctx context.Context, key string) (*model.Principal, error)
+
+func (f KeyAuthenticatorFunc) Authenticate(ctx context.Context, key string) (*model.Principal, error) {
+	return f(ctx, key)
+}
+
+// StaticKey authenticates the single key of the configuration as an admin,
+// whatever the roles assigned. No key is accepted if it is empty.
+func StaticKey(key string) KeyAuthenticator {
+	principal := &model.Principal{
+		ID:     audit.KeyActor("api-key", key),
+		Name:   "static",
+		Scopes: []string{model.ScopeAdmin},
+		Roles:  []string{model.RoleAdmin},
+	}
+	return KeyAuthenticatorFunc(func(_ context.Context, got string) (*model.Principal, error) {
+		if key == "" || subtle.ConstantTimeCompare([]byte(got), []byte(key)) != 1 {
+			return nil, validation.ErrInvalidAPIKey
+		}
+		return principal, nil
+	})
+}
+
+// Keys tries the authenticators in turn until one accepts the key.
+func Keys(authenticators ...KeyAuthenticator) KeyAuthenticator {
+	return KeyAuthenticatorFunc(func(ctx context.Context, key string) (*model.Principal, error) {
+		for _, a := range authenticators {
+			principal, err := a.Authenticate(ctx, key)
+			if !errors.Is(err, validation.ErrInvalidAPIKey) {
+				return principal, err
+			}
+		}
+		return nil, validation.ErrInvalidAPIKey
+	})
+}
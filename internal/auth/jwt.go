@@ -0,0 +1,104 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"cruder/internal/model"
+	"cruder/pkg/validation"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// AuthorizationHeader carries the bearer token.
+const AuthorizationHeader = "Authorization"
+
+// leeway tolerates the clock skew between the issuer and the API.
+const leeway = 30 * time.Second
+
+// The asymmetric algorithms only, so that a public key cannot be used as an
+// HMAC secret.
+var signingMethods = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512", "EdDSA"}
+
+type JWTConfig struct {
+	Issuer   string
+	Audience string
+	// ScopeClaim names the claim holding the scopes, either a space-delimited
+	// string or an array. It is scope by default.
+	ScopeClaim string
+	// Scopes maps the scopes of the tokens to the scopes of the API. A scope
+	// without a mapping is kept as it is.
+	Scopes map[string]string
+}
+
+type jwtAuthenticator struct {
+	keys   *JWKS
+	config JWTConfig
+	parser *jwt.Parser
+}
+
+// NewJWT authenticates the bearer tokens signed by a key of the set. The
+// issuer, the audience and the expiry of the tokens are required.
+func NewJWT(keys *JWKS, config JWTConfig) Authenticator {
+	if config.ScopeClaim == "" {
+		config.ScopeClaim = "scope"
+	}
+	return &jwtAuthenticator{
+		keys:   keys,
+		config: config,
+		parser: jwt.NewParser(
+			jwt.WithValidMethods(signingMethods),
+			jwt.WithIssuer(config.Issuer),
+			jwt.WithAudience(config.Audience),
+			jwt.WithExpirationRequired(),
+			jwt.WithLeeway(leeway),
+		),
+	}
+}
+
+func (a *jwtAuthenticator) Authenticate(ctx context.Context, creds Credentials) (*model.Principal, error) {
+	scheme, token, _ := strings.Cut(creds(AuthorizationHeader), " ")
+	if !strings.EqualFold(scheme, "Bearer") || token == "" {
+		return nil, validation.ErrNoCredentials
+	}
+
+	claims := jwt.MapClaims{}
+	_, err := a.parser.ParseWithClaims(token, claims, func(t *jwt.Token) (any, error) {
+		kid, _ := t.Header["kid"].(string)
+		return a.keys.Key(ctx, kid)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", validation.ErrInvalidToken, err)
+	}
+
+	sub, _ := claims.GetSubject()
+	if sub == "" {
+		return nil, fmt.Errorf("%w: token has no subject", validation.ErrInvalidToken)
+	}
+	return &model.Principal{ID: "jwt:" + sub, Name: sub, Scopes: a.scopes(claims)}, nil
+}
+
+func (a *jwtAuthenticator) scopes(claims jwt.MapClaims) []string {
+	var raw []string
+	switch v := claims[a.config.ScopeClaim].(type) {
+	case string:
+		raw = strings.Fields(v)
+	case []any:
+		for _, s := range v {
+			if s, ok := s.(string); ok {
+				raw = append(raw, s)
+			}
+		}
+	}
+
+	scopes := make([]string, 0, len(raw))
+	for _, s := range raw {
+		if mapped, ok := a.config.Scopes[s]; ok {
+			s = mapped
+		}
+		scopes = append(scopes, s)
+	}
+	return scopes
+}
@@ -0,0 +1,321 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"cruder/internal/audit"
+	"cruder/internal/model"
+	"cruder/pkg/validation"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	testIssuer   = "https://gateway.example.com"
+	testAudience = "cruder"
+)
+
+func encode(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// jwkOf renders the public key of a locally generated key.
+func jwkOf(t *testing.T, kid string, key crypto.Signer) map[string]string {
+	t.Helper()
+	switch pub := key.Public().(type) {
+	case *rsa.PublicKey:
+		return map[string]string{"kty": "RSA", "kid": kid, "use": "sig", "n": encode(pub.N.Bytes()), "e": encode(big.NewInt(int64(pub.E)).Bytes())}
+	case *ecdsa.PublicKey:
+		point, err := pub.Bytes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		size := (len(point) - 1) / 2
+		return map[string]string{"kty": "EC", "kid": kid, "crv": pub.Curve.Params().Name, "x": encode(point[1 : 1+size]), "y": encode(point[1+size:])}
+	}
+	t.Fatalf("unsupported key %T", key)
+	return nil
+}
+
+func jwksOf(t *testing.T, keys map[string]crypto.Signer) []byte {
+	t.Helper()
+	set := struct {
+		Keys []map[string]string `json:"keys"`
+	}{}
+	for kid, key := range keys {
+		set.Keys = append(set.Keys, jwkOf(t, kid, key))
+	}
+	data, err := json.Marshal(set)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func sign(t *testing.T, method jwt.SigningMethod, kid string, key any, claims jwt.MapClaims) string {
+	t.Helper()
+	token := jwt.NewWithClaims(method, claims)
+	token.Header["kid"] = kid
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func claims(overrides jwt.MapClaims) jwt.MapClaims {
+	c := jwt.MapClaims{
+		"iss":   testIssuer,
+		"aud":   testAudience,
+		"sub":   "jdoe",
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"scope": "users.read users:write",
+	}
+	for k, v := range overrides {
+		if v == nil {
+			delete(c, k)
+		} else {
+			c[k] = v
+		}
+	}
+	return c
+}
+
+func bearer(token string) Credentials {
+	return func(name string) string {
+		if name == AuthorizationHeader {
+			return "Bearer " + token
+		}
+		return ""
+	}
+}
+
+func TestJWT(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	if err = os.WriteFile(path, jwksOf(t, map[string]crypto.Signer{"rsa": rsaKey, "ec": ecKey}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	authenticator := NewJWT(NewJWKS(path, time.Hour), JWTConfig{
+		Issuer:   testIssuer,
+		Audience: testAudience,
+		Scopes:   map[string]string{"users.read": model.ScopeUsersRead},
+	})
+
+	tests := []struct {
+		name  string
+		token string
+		err   error
+	}{
+		{"rsa", sign(t, jwt.SigningMethodRS256, "rsa", rsaKey, claims(nil)), nil},
+		{"ecdsa", sign(t, jwt.SigningMethodES256, "ec", ecKey, claims(nil)), nil},
+		{"audience list", sign(t, jwt.SigningMethodES256, "ec", ecKey, claims(jwt.MapClaims{"aud": []string{"other", testAudience}})), nil},
+		{"expired", sign(t, jwt.SigningMethodES256, "ec", ecKey, claims(jwt.MapClaims{"exp": time.Now().Add(-time.Minute).Unix()})), validation.ErrInvalidToken},
+		{"no expiry", sign(t, jwt.SigningMethodES256, "ec", ecKey, claims(jwt.MapClaims{"exp": nil})), validation.ErrInvalidToken},
+		{"wrong issuer", sign(t, jwt.SigningMethodES256, "ec", ecKey, claims(jwt.MapClaims{"iss": "https://evil.example.com"})), validation.ErrInvalidToken},
+		{"wrong audience", sign(t, jwt.SigningMethodES256, "ec", ecKey, claims(jwt.MapClaims{"aud": "billing"})), validation.ErrInvalidToken},
+		{"no subject", sign(t, jwt.SigningMethodES256, "ec", ecKey, claims(jwt.MapClaims{"sub": nil})), validation.ErrInvalidToken},
+		{"unknown key", sign(t, jwt.SigningMethodES256, "other", otherKey, claims(nil)), validation.ErrInvalidToken},
+		{"forged key id", sign(t, jwt.SigningMethodES256, "ec", otherKey, claims(nil)), validation.ErrInvalidToken},
+		{"hmac", sign(t, jwt.SigningMethodHS256, "ec", []byte("secret"), claims(nil)), validation.ErrInvalidToken},
+		{"unsigned", sign(t, jwt.SigningMethodNone, "ec", jwt.UnsafeAllowNoneSignatureType, claims(nil)), validation.ErrInvalidToken},
+		{"malformed", "not-a-token", validation.ErrInvalidToken},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			principal, err := authenticator.Authenticate(t.Context(), bearer(tt.token))
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("expected %v, got %v", tt.err, err)
+			}
+			if err != nil {
+				return
+			}
+			exp := &model.Principal{ID: "jwt:jdoe", Name: "jdoe", Scopes: []string{model.ScopeUsersRead, model.ScopeUsersWrite}}
+			if !reflect.DeepEqual(principal, exp) {
+				t.Errorf("expected %+v, got %+v", exp, principal)
+			}
+		})
+	}
+
+	t.Run("scope array", func(t *testing.T) {
+		a := NewJWT(NewJWKS(path, time.Hour), JWTConfig{Issuer: testIssuer, Audience: testAudience, ScopeClaim: "scp"})
+		token := sign(t, jwt.SigningMethodES256, "ec", ecKey, claims(jwt.MapClaims{"scp": []string{model.ScopeAdmin}}))
+		principal, err := a.Authenticate(t.Context(), bearer(token))
+		if err != nil || !principal.Has(model.ScopeUsersWrite) {
+			t.Errorf("expected an admin, got %+v: %v", principal, err)
+		}
+	})
+
+	t.Run("no bearer token", func(t *testing.T) {
+		for _, header := range []string{"", "Basic amRvZTpzZWNyZXQ=", "Bearer "} {
+			creds := func(string) string { return header }
+			if _, err := authenticator.Authenticate(t.Context(), creds); !errors.Is(err, validation.ErrNoCredentials) {
+				t.Errorf("%q: expected no credentials, got %v", header, err)
+			}
+		}
+	})
+}
+
+func TestJWKSRefresh(t *testing.T) {
+	oldKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	newKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	var (
+		mu      sync.Mutex
+		keys    = map[string]crypto.Signer{"old": oldKey}
+		fetches int
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		fetches++
+		_, _ = w.Write(jwksOf(t, keys))
+	}))
+	defer server.Close()
+
+	jwks := NewJWKS(server.URL, time.Hour)
+	authenticator := NewJWT(jwks, JWTConfig{Issuer: testIssuer, Audience: testAudience})
+	authenticate := func(kid string, key *ecdsa.PrivateKey) error {
+		_, err := authenticator.Authenticate(t.Context(), bearer(sign(t, jwt.SigningMethodES256, kid, key, claims(nil))))
+		return err
+	}
+
+	if err := authenticate("old", oldKey); err != nil {
+		t.Fatal(err)
+	}
+	if err := authenticate("old", oldKey); err != nil || fetches != 1 {
+		t.Fatalf("expected the keys to be cached, got %d fetches: %v", fetches, err)
+	}
+
+	// The issuer rotates its keys.
+	mu.Lock()
+	keys = map[string]crypto.Signer{"new": newKey}
+	mu.Unlock()
+
+	if err := authenticate("new", newKey); err == nil || fetches != 1 {
+		t.Fatalf("expected the unknown key to wait for the minimum refresh, got %d fetches: %v", fetches, err)
+	}
+
+	jwks.minRefresh = 0
+	if err := authenticate("new", newKey); err != nil || fetches != 2 {
+		t.Fatalf("expected the unknown key to refresh the keys, got %d fetches: %v", fetches, err)
+	}
+	if err := authenticate("old", oldKey); err == nil {
+		t.Error("expected the removed key to be refused")
+	}
+
+	// The cached keys are kept while the source is down.
+	server.Close()
+	jwks.refresh = 0
+	if err := authenticate("new", newKey); err != nil {
+		t.Errorf("expected the cached key to be used, got %v", err)
+	}
+}
+
+func TestChain(t *testing.T) {
+	keyAuthenticator := APIKey(Keys(StaticKey(""), StaticKey("secret")))
+	tokenAuthenticator := AuthenticatorFunc(func(_ context.Context, creds Credentials) (*model.Principal, error) {
+		if creds(AuthorizationHeader) == "" {
+			return nil, validation.ErrNoCredentials
+		}
+		return &model.Principal{ID: "jwt:jdoe"}, nil
+	})
+	chain := Chain(keyAuthenticator, tokenAuthenticator)
+
+	tests := []struct {
+		name    string
+		headers map[string]string
+		id      string
+		err     error
+	}{
+		{"api key", map[string]string{APIKeyHeader: "secret"}, audit.KeyActor("api-key", "secret"), nil},
+		{"bearer token", map[string]string{AuthorizationHeader: "Bearer token"}, "jwt:jdoe", nil},
+		{"api key first", map[string]string{APIKeyHeader: "wrong", AuthorizationHeader: "Bearer token"}, "", validation.ErrInvalidAPIKey},
+		{"empty api key", map[string]string{APIKeyHeader: ""}, "", validation.ErrNoCredentials},
+		{"nothing", nil, "", validation.ErrNoCredentials},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			principal, err := chain.Authenticate(t.Context(), func(name string) string { return tt.headers[name] })
+			if !errors.Is(err, tt.err) || err == nil && principal.ID != tt.id {
+				t.Errorf("expected %q %v, got %+v %v", tt.id, tt.err, principal, err)
+			}
+		})
+	}
+}
+
+type roleResolverFunc func(ctx context.Context, principal string) ([]string, error)
+
+func (f roleResolverFunc) RolesOf(ctx context.Context, principal string) ([]string, error) {
+	return f(ctx, principal)
+}
+
+func TestWithRoles(t *testing.T) {
+	tokens := AuthenticatorFunc(func(_ context.Context, creds Credentials) (*model.Principal, error) {
+		return &model.Principal{ID: "jwt:" + creds(AuthorizationHeader)}, nil
+	})
+	roles := roleResolverFunc(func(_ context.Context, principal string) ([]string, error) {
+		if principal == "jwt:jdoe" {
+			return []string{model.RoleOperator}, nil
+		}
+		return nil, nil
+	})
+	authenticator := Chain(APIKey(StaticKey("secret")), WithRoles(tokens, roles, model.RoleReadOnly))
+
+	tests := []struct {
+		name    string
+		headers map[string]string
+		roles   []string
+	}{
+		{"assigned", map[string]string{AuthorizationHeader: "jdoe"}, []string{model.RoleOperator}},
+		{"default", map[string]string{AuthorizationHeader: "asmith"}, []string{model.RoleReadOnly}},
+		{"implied", map[string]string{APIKeyHeader: "secret"}, []string{model.RoleAdmin}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			principal, err := authenticator.Authenticate(t.Context(), func(name string) string { return tt.headers[name] })
+			if err != nil || !slices.Equal(principal.Roles, tt.roles) {
+				t.Errorf("expected %v, got %+v %v", tt.roles, principal, err)
+			}
+		})
+	}
+
+	ctx := WithPrincipal(t.Context(), &model.Principal{Roles: []string{model.RoleOperator}})
+	var missing validation.ErrMissingPermission
+	if err := Authorize(ctx, model.PermUsersDelete); !errors.As(err, &missing) || missing.Permission != model.PermUsersDelete {
+		t.Errorf("expected the missing permission, got %v", err)
+	}
+	if err := Authorize(ctx, model.PermUsersUpdate); err != nil {
+		t.Errorf("expected the permission to be granted, got %v", err)
+	}
+}
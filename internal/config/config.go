@@ -2,13 +2,56 @@ package config
 
 import (
 	"fmt"
+	"sort"
+	"strings"
+	"time"
 
+	"cruder/internal/model"
+	"cruder/internal/ratelimit"
 	"cruder/pkg/logger"
 )
 
+const (
+	defaultPurgeRetention = 30 * 24 * time.Hour
+	defaultPurgeInterval  = time.Hour
+	defaultIdempotencyTTL = 24 * time.Hour
+	defaultEventRetention = 7 * 24 * time.Hour
+	defaultGRPCPort       = 9090
+	defaultJWKSRefresh    = time.Hour
+	defaultRole           = model.RoleReadOnly
+)
+
+var (
+	defaultUsersRateLimit    = ratelimit.Limit{Requests: 600, Period: time.Minute}
+	defaultGraphQLRateLimit  = ratelimit.Limit{Requests: 600, Period: time.Minute}
+	defaultAdminRateLimit    = ratelimit.Limit{Requests: 60, Period: time.Minute}
+	defaultSCIMRateLimit     = ratelimit.Limit{Requests: 600, Period: time.Minute}
+	defaultFailuresRateLimit = ratelimit.Limit{Requests: 20, Period: time.Minute}
+)
+
 type Config struct {
 	LogLevel logger.LogLevel `env:"LOG_LEVEL"`
-	APIKey   string          `env:"API_KEY,m"`
+	// APIKey is an admin key besides the managed ones, disabled if empty.
+	APIKey string `env:"API_KEY"`
+
+	// JWKS enables the bearer tokens signed by a key of the set, read from a
+	// file or an http(s) URL. The issuer and the audience are then required.
+	JWKS        string   `env:"JWT_JWKS"`
+	JWKSRefresh Duration `env:"JWT_JWKS_REFRESH"`
+	JWTIssuer   string   `env:"JWT_ISSUER"`
+	JWTAudience string   `env:"JWT_AUDIENCE"`
+	// JWTScopeClaim names the claim of the scopes, scope by default.
+	JWTScopeClaim string `env:"JWT_SCOPE_CLAIM"`
+	// JWTScopes maps the scopes of the tokens to the scopes of the API.
+	JWTScopes ScopeMap `env:"JWT_SCOPE_MAP"`
+
+	// DefaultRole is the role of the callers with no role assigned.
+	DefaultRole string `env:"DEFAULT_ROLE"`
+
+	// SCIMToken enables the SCIM endpoints if set.
+	SCIMToken string `env:"SCIM_TOKEN"`
+
+	GRPCPort uint16 `env:"GRPC_PORT"`
 
 	Host            string `env:"POSTGRES_HOST,m"`
 	Port            uint16 `env:"POSTGRES_PORT,m"`
@@ -16,9 +59,195 @@ type Config struct {
 	Password        string `env:"POSTGRES_PASSWORD,m"`
 	Database        string `env:"POSTGRES_DB,m"`
 	PostgresSSLMode string `env:"POSTGRES_SSL_MODE,m"`
+
+	PurgeRetention Duration `env:"PURGE_RETENTION"`
+	PurgeInterval  Duration `env:"PURGE_INTERVAL"`
+
+	IdempotencyTTL Duration `env:"IDEMPOTENCY_TTL"`
+
+	EventRetention Duration `env:"EVENT_RETENTION"`
+
+	// RateLimitRedis keeps the rate limits in a Redis server shared by the
+	// instances, or in memory if empty.
+	RateLimitRedis    string    `env:"RATE_LIMIT_REDIS"`
+	UsersRateLimit    RateLimit `env:"RATE_LIMIT_USERS"`
+	GraphQLRateLimit  RateLimit `env:"RATE_LIMIT_GRAPHQL"`
+	AdminRateLimit    RateLimit `env:"RATE_LIMIT_ADMIN"`
+	SCIMRateLimit     RateLimit `env:"RATE_LIMIT_SCIM"`
+	FailuresRateLimit RateLimit `env:"RATE_LIMIT_FAILURES"`
+
+	// TrustedProxies are the comma-separated addresses or CIDRs of the proxies
+	// whose X-Forwarded-For header gives the client IP.
+	TrustedProxies string `env:"TRUSTED_PROXIES"`
 }
 
 func (c *Config) GetPostgresDNS() string {
 	return fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=%s",
 		c.Host, c.Port, c.User, c.Password, c.Database, c.PostgresSSLMode)
 }
+
+// GetGRPCAddress returns the address the gRPC server listens on.
+func (c *Config) GetGRPCAddress() string {
+	port := c.GRPCPort
+	if port == 0 {
+		port = defaultGRPCPort
+	}
+	return fmt.Sprintf(":%d", port)
+}
+
+// GetPurgeRetention returns how long soft-deleted users are kept.
+func (c *Config) GetPurgeRetention() time.Duration {
+	return c.PurgeRetention.Or(defaultPurgeRetention)
+}
+
+// GetPurgeInterval returns how often soft-deleted users are purged.
+func (c *Config) GetPurgeInterval() time.Duration {
+	return c.PurgeInterval.Or(defaultPurgeInterval)
+}
+
+// GetIdempotencyTTL returns how long responses to idempotent requests are kept.
+func (c *Config) GetIdempotencyTTL() time.Duration {
+	return c.IdempotencyTTL.Or(defaultIdempotencyTTL)
+}
+
+// GetEventRetention returns how long user events can be resumed from.
+func (c *Config) GetEventRetention() time.Duration {
+	return c.EventRetention.Or(defaultEventRetention)
+}
+
+// GetJWKSRefresh returns how long the JWKS is cached.
+func (c *Config) GetJWKSRefresh() time.Duration {
+	return c.JWKSRefresh.Or(defaultJWKSRefresh)
+}
+
+// GetDefaultRole returns the role of the callers with no role assigned.
+func (c *Config) GetDefaultRole() string {
+	if c.DefaultRole == "" {
+		return defaultRole
+	}
+	return c.DefaultRole
+}
+
+// GetUsersRateLimit returns the limit of the requests of a caller to the
+// users routes.
+func (c *Config) GetUsersRateLimit() ratelimit.Limit {
+	return c.UsersRateLimit.Or(defaultUsersRateLimit)
+}
+
+// GetGraphQLRateLimit returns the limit of the requests of a caller to the
+// GraphQL endpoint.
+func (c *Config) GetGraphQLRateLimit() ratelimit.Limit {
+	return c.GraphQLRateLimit.Or(defaultGraphQLRateLimit)
+}
+
+// GetAdminRateLimit returns the limit of the requests of a caller to the
+// admin routes.
+func (c *Config) GetAdminRateLimit() ratelimit.Limit {
+	return c.AdminRateLimit.Or(defaultAdminRateLimit)
+}
+
+// GetSCIMRateLimit returns the limit of the requests to the SCIM endpoints.
+func (c *Config) GetSCIMRateLimit() ratelimit.Limit {
+	return c.SCIMRateLimit.Or(defaultSCIMRateLimit)
+}
+
+// GetFailuresRateLimit returns the limit of the requests of a client IP
+// failing to authenticate.
+func (c *Config) GetFailuresRateLimit() ratelimit.Limit {
+	return c.FailuresRateLimit.Or(defaultFailuresRateLimit)
+}
+
+// GetTrustedProxies returns the proxies whose X-Forwarded-For header is
+// trusted, none if not set.
+func (c *Config) GetTrustedProxies() []string {
+	if c.TrustedProxies == "" {
+		return nil
+	}
+	proxies := strings.Split(c.TrustedProxies, ",")
+	for i := range proxies {
+		proxies[i] = strings.TrimSpace(proxies[i])
+	}
+	return proxies
+}
+
+// Duration reads a time.Duration such as "720h" from the environment.
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) GetENV(p []byte) error {
+	if len(p) == 0 {
+		return nil
+	}
+	v, err := time.ParseDuration(string(p))
+	d.Duration = v
+	return err
+}
+
+func (d *Duration) SetENV() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+// Or returns def if the duration is not set.
+func (d Duration) Or(def time.Duration) time.Duration {
+	if d.Duration <= 0 {
+		return def
+	}
+	return d.Duration
+}
+
+// RateLimit reads a limit such as "100/1m" from the environment. A limit of
+// "0" disables the limiting.
+type RateLimit struct {
+	ratelimit.Limit
+	set bool
+}
+
+func (r *RateLimit) GetENV(p []byte) error {
+	if len(p) == 0 {
+		return nil
+	}
+	limit, err := ratelimit.ParseLimit(string(p))
+	r.Limit, r.set = limit, err == nil
+	return err
+}
+
+func (r *RateLimit) SetENV() ([]byte, error) {
+	return []byte(r.String()), nil
+}
+
+// Or returns def if the limit is not set.
+func (r RateLimit) Or(def ratelimit.Limit) ratelimit.Limit {
+	if !r.set {
+		return def
+	}
+	return r.Limit
+}
+
+// ScopeMap reads a list of from=to pairs such as
+// "users.read=users:read,users.write=users:write" from the environment.
+type ScopeMap map[string]string
+
+func (m *ScopeMap) GetENV(p []byte) error {
+	if len(p) == 0 {
+		return nil
+	}
+	*m = make(ScopeMap)
+	for _, pair := range strings.Split(string(p), ",") {
+		from, to, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok || from == "" || to == "" {
+			return fmt.Errorf("invalid scope mapping %q", pair)
+		}
+		(*m)[from] = to
+	}
+	return nil
+}
+
+func (m *ScopeMap) SetENV() ([]byte, error) {
+	pairs := make([]string, 0, len(*m))
+	for from, to := range *m {
+		pairs = append(pairs, from+"="+to)
+	}
+	sort.Strings(pairs)
+	return []byte(strings.Join(pairs, ",")), nil
+}
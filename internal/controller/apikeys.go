@@ -0,0 +1,95 @@
+package controller
+
+import (
+	"net/http"
+	"time"
+
+	"cruder/internal/model"
+	"cruder/internal/problem"
+	"cruder/internal/service"
+	"cruder/pkg/validation"
+
+	"github.com/gin-gonic/gin"
+)
+
+// defaultGrace is how long a rotated key remains valid unless told otherwise.
+const defaultGrace = 24 * time.Hour
+
+type APIKeyController struct {
+	service service.APIKeyService
+}
+
+func NewAPIKeyController(service service.APIKeyService) *APIKeyController {
+	return &APIKeyController{service: service}
+}
+
+func (c *APIKeyController) GetAPIKeys(ctx *gin.Context) {
+	keys, err := c.service.GetAll(ctx)
+	if err != nil {
+		problem.Error(ctx, err)
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{"api_keys": keys})
+}
+
+func (c *APIKeyController) GetAPIKey(ctx *gin.Context) {
+	key, err := c.service.Get(ctx, ctx.Param("id"))
+	if err != nil {
+		problem.Error(ctx, err)
+		return
+	}
+
+	ctx.JSON(http.StatusOK, key)
+}
+
+// PostAPIKey creates a key from its name, owner, scopes and expiry. The
+// response holds the key, which cannot be retrieved later.
+func (c *APIKeyController) PostAPIKey(ctx *gin.Context) {
+	input := new(model.APIKey)
+
+	if err := ctx.ShouldBindJSON(input); err != nil {
+		problem.Error(ctx, validation.MalformedRequest(err))
+		return
+	}
+
+	key := &model.APIKey{Name: input.Name, Owner: input.Owner, Scopes: input.Scopes, ExpiresAt: input.ExpiresAt}
+	if err := c.service.Post(ctx, key); err != nil {
+		problem.Error(ctx, err)
+		return
+	}
+
+	ctx.JSON(http.StatusCreated, key)
+}
+
+// RotateAPIKey replaces the key. The old key remains valid for the grace
+// period given as a duration such as 1h, 24h by default.
+func (c *APIKeyController) RotateAPIKey(ctx *gin.Context) {
+	grace := defaultGrace
+	if raw, ok := ctx.GetQuery("grace"); ok {
+		var err error
+		if grace, err = time.ParseDuration(raw); err != nil {
+			problem.Error(ctx, validation.ErrInvalidGrace)
+			return
+		}
+	}
+
+	key, err := c.service.Rotate(ctx, ctx.Param("id"), grace)
+	if err != nil {
+		problem.Error(ctx, err)
+		return
+	}
+
+	ctx.JSON(http.StatusCreated, key)
+}
+
+// RevokeAPIKey revokes the key at once. It stays listed with the time it was
+// revoked.
+func (c *APIKeyController) RevokeAPIKey(ctx *gin.Context) {
+	if err := c.service.Revoke(ctx, ctx.Param("id")); err != nil {
+		problem.Error(ctx, err)
+		return
+	}
+
+	ctx.Status(http.StatusNoContent)
+}
@@ -0,0 +1,50 @@
+package controller
+
+import (
+	"net/http"
+
+	"cruder/internal/model"
+	"cruder/internal/problem"
+	"cruder/internal/service"
+	"cruder/pkg/validation"
+
+	"github.com/gin-gonic/gin"
+)
+
+type AuditController struct {
+	service service.AuditService
+}
+
+func NewAuditController(service service.AuditService) *AuditController {
+	return &AuditController{service: service}
+}
+
+// GetAudit lists the audit entries newest first, filtered by user, actor and
+// time.
+func (c *AuditController) GetAudit(ctx *gin.Context) {
+	query := new(model.AuditQuery)
+
+	if err := ctx.ShouldBindQuery(query); err != nil {
+		problem.Error(ctx, validation.MalformedRequest(err))
+		return
+	}
+
+	entries, err := c.service.GetAll(ctx, query)
+	if err != nil {
+		problem.Error(ctx, err)
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{"entries": entries})
+}
+
+// VerifyAudit checks the hash chain of the whole audit log.
+func (c *AuditController) VerifyAudit(ctx *gin.Context) {
+	res, err := c.service.Verify(ctx)
+	if err != nil {
+		problem.Error(ctx, err)
+		return
+	}
+
+	ctx.JSON(http.StatusOK, res)
+}
@@ -0,0 +1,62 @@
+package controller
+
+import (
+	"net/http"
+	"strconv"
+
+	"cruder/internal/model"
+	"cruder/internal/problem"
+	"cruder/pkg/validation"
+
+	"github.com/gin-gonic/gin"
+)
+
+type batchItem struct {
+	Index  int              `json:"index"`
+	Op     string           `json:"op"`
+	Status int              `json:"status"`
+	User   *model.User      `json:"user,omitempty"`
+	Error  *problem.Problem `json:"error,omitempty"`
+}
+
+var batchStatus = map[string]int{
+	model.BatchCreate: http.StatusCreated,
+	model.BatchPatch:  http.StatusOK,
+	model.BatchDelete: http.StatusNoContent,
+}
+
+// BatchUsers applies several create, patch and delete operations at once.
+// The response is 200 if every operation succeeded and 207 otherwise, with
+// the status of each operation in the results.
+func (c *UserController) BatchUsers(ctx *gin.Context) {
+	atomic, err := strconv.ParseBool(ctx.DefaultQuery("atomic", "false"))
+	if err != nil {
+		problem.Error(ctx, validation.ErrInvalidAtomic)
+		return
+	}
+
+	req := new(model.BatchRequest)
+	if err = ctx.ShouldBindJSON(req); err != nil {
+		problem.Error(ctx, validation.MalformedRequest(err))
+		return
+	}
+
+	results, err := c.service.Batch(ctx, req.Operations, atomic)
+	if err != nil {
+		problem.Error(ctx, err)
+		return
+	}
+
+	status := http.StatusOK
+	items := make([]batchItem, len(results))
+	for i, res := range results {
+		items[i] = batchItem{Index: res.Index, Op: res.Op, Status: batchStatus[res.Op], User: res.User}
+		if res.Err != nil {
+			items[i].Error = problem.From(ctx, res.Err)
+			items[i].Status = items[i].Error.Status
+			status = http.StatusMultiStatus
+		}
+	}
+
+	ctx.JSON(status, gin.H{"atomic": atomic, "results": items})
+}
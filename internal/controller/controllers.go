@@ -3,11 +3,23 @@ package controller
 import "cruder/internal/service"
 
 type Controller struct {
-	Users *UserController
+	Users    *UserController
+	SCIM     *SCIMController
+	GraphQL  *GraphQLController
+	Webhooks *WebhookController
+	Audit    *AuditController
+	APIKeys  *APIKeyController
+	Roles    *RoleController
 }
 
 func NewController(services *service.Service) *Controller {
 	return &Controller{
-		Users: NewUserController(services.Users),
+		Users:    NewUserController(services.Users),
+		SCIM:     NewSCIMController(services.Users),
+		GraphQL:  NewGraphQLController(services.Users),
+		Webhooks: NewWebhookController(services.Webhooks),
+		Audit:    NewAuditController(services.Audit),
+		APIKeys:  NewAPIKeyController(services.APIKeys),
+		Roles:    NewRoleController(services.Roles),
 	}
 }
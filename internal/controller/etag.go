@@ -0,0 +1,67 @@
+package controller
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"cruder/internal/model"
+
+	"github.com/gin-gonic/gin"
+)
+
+// noMatch is an expected version no user can have.
+const noMatch = -1
+
+func etag(version int64) string {
+	return `"` + strconv.FormatInt(version, 10) + `"`
+}
+
+// writeUser responds with the user and its ETag, or with 304 Not Modified
+// if the client already has the current version.
+func writeUser(ctx *gin.Context, user *model.User) {
+	tag := etag(user.Version)
+	ctx.Header("ETag", tag)
+
+	if noneMatch(ctx.GetHeader("If-None-Match"), tag) {
+		ctx.Status(http.StatusNotModified)
+		return
+	}
+
+	ctx.JSON(http.StatusOK, user)
+}
+
+// noneMatch reports whether the If-None-Match header matches the tag, using
+// the weak comparison.
+func noneMatch(header, tag string) bool {
+	if header == "" {
+		return false
+	}
+	for _, t := range strings.Split(header, ",") {
+		t = strings.TrimSpace(t)
+		if t == "*" || strings.TrimPrefix(t, "W/") == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// ifMatch returns the version expected by the If-Match header, 0 if the
+// request is unconditional. Weak or malformed tags never match, as If-Match
+// uses the strong comparison.
+func ifMatch(ctx *gin.Context) int64 {
+	header := strings.TrimSpace(ctx.GetHeader("If-Match"))
+	if header == "" || header == "*" {
+		return 0
+	}
+
+	if len(header) < 2 || header[0] != '"' || header[len(header)-1] != '"' {
+		return noMatch
+	}
+
+	version, err := strconv.ParseInt(header[1:len(header)-1], 10, 64)
+	if err != nil || version < 1 {
+		return noMatch
+	}
+	return version
+}
@@ -0,0 +1,86 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"cruder/internal/model"
+	"cruder/internal/problem"
+	"cruder/pkg/validation"
+
+	"github.com/gin-gonic/gin"
+)
+
+// heartbeatInterval keeps idle streams open through proxies.
+const heartbeatInterval = 15 * time.Second
+
+// StreamUserEvents streams the changes of the users as server-sent events.
+// A client resumes after the last event it has seen with the Last-Event-ID
+// header, or with the last_event_id query parameter when it first connects.
+// Otherwise the stream starts with the next change.
+func (c *UserController) StreamUserEvents(ctx *gin.Context) {
+	after := int64(-1)
+
+	lastID := ctx.GetHeader("Last-Event-ID")
+	if lastID == "" {
+		lastID = ctx.Query("last_event_id")
+	}
+	if lastID != "" {
+		id, err := strconv.ParseInt(lastID, 10, 64)
+		if err != nil || id < 0 {
+			problem.Error(ctx, validation.ErrInvalidLastEventID)
+			return
+		}
+		after = id
+	}
+
+	watchCtx, cancel := context.WithCancel(ctx.Request.Context())
+	defer cancel()
+
+	// The watch runs aside, so that the heartbeats are written by this
+	// goroutine only.
+	events := make(chan *model.UserEvent)
+	done := make(chan error, 1)
+	go func() {
+		done <- c.service.Watch(watchCtx, after, func(event *model.UserEvent) error {
+			select {
+			case events <- event:
+				return nil
+			case <-watchCtx.Done():
+				return watchCtx.Err()
+			}
+		})
+	}()
+
+	ctx.Header("Content-Type", "text/event-stream")
+	ctx.Header("Cache-Control", "no-cache")
+	ctx.Header("X-Accel-Buffering", "no")
+	ctx.Status(http.StatusOK)
+	ctx.Writer.WriteHeaderNow()
+	ctx.Writer.Flush()
+
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case event := <-events:
+			data, _ := json.Marshal(event)
+			_, _ = fmt.Fprintf(ctx.Writer, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, data)
+		case <-heartbeat.C:
+			_, _ = ctx.Writer.WriteString(": heartbeat\n\n")
+		case err := <-done:
+			// The client reconnects and resumes after the last event sent.
+			if err != nil && watchCtx.Err() == nil {
+				slog.ErrorContext(ctx, "Event stream failed:", "error", err.Error())
+			}
+			return
+		}
+		ctx.Writer.Flush()
+	}
+}
@@ -0,0 +1,68 @@
+package controller
+
+import (
+	"log/slog"
+	"net/http"
+	"time"
+
+	"cruder/internal/model"
+	"cruder/internal/problem"
+	"cruder/pkg/exporter"
+	"cruder/pkg/validation"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ExportUsers streams every user matching the filters of the list endpoint
+// as a CSV, NDJSON or XLSX file.
+func (c *UserController) ExportUsers(ctx *gin.Context) {
+	format, err := exporter.Lookup(ctx.Query("format"))
+	if err != nil {
+		problem.Error(ctx, err)
+		return
+	}
+
+	query := new(model.UserQuery)
+	if err = ctx.ShouldBindQuery(query); err != nil {
+		problem.Error(ctx, validation.MalformedRequest(err))
+		return
+	}
+
+	// The response starts with the first user, so that errors raised before
+	// any data is read are still reported as a problem.
+	var w exporter.Writer
+	start := func() (err error) {
+		filename := "users-" + time.Now().UTC().Format("20060102T150405Z") + "." + format.Name
+		ctx.Header("Content-Type", format.ContentType)
+		ctx.Header("Content-Disposition", `attachment; filename="`+filename+`"`)
+		ctx.Status(http.StatusOK)
+
+		w, err = format.NewWriter(ctx.Writer)
+		return err
+	}
+
+	err = c.service.Export(ctx, query, func(user *model.User) error {
+		if w == nil {
+			if err := start(); err != nil {
+				return err
+			}
+		}
+		return w.Write(user)
+	})
+	if err == nil && w == nil {
+		err = start()
+	}
+
+	switch {
+	case err != nil && !ctx.Writer.Written():
+		ctx.Writer.Header().Del("Content-Disposition")
+		problem.Error(ctx, err)
+	case err != nil:
+		// The status has been sent, the client gets a truncated file.
+		slog.ErrorContext(ctx, "Export failed:", "error", err.Error())
+	default:
+		if err = w.Close(); err != nil {
+			slog.ErrorContext(ctx, "Export failed:", "error", err.Error())
+		}
+	}
+}
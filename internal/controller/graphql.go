@@ -0,0 +1,82 @@
+package controller
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"cruder/internal/gql"
+	"cruder/internal/service"
+	"cruder/pkg/logger"
+
+	"github.com/gin-gonic/gin"
+	"github.com/graphql-go/graphql/gqlerrors"
+)
+
+// persistedQueries is the number of persisted queries kept in memory.
+const persistedQueries = 1000
+
+type GraphQLController struct {
+	executor *gql.Executor
+}
+
+func NewGraphQLController(service service.UserService) *GraphQLController {
+	schema, err := gql.NewSchema(service)
+	if err != nil {
+		// The schema is static, so this is a bug rather than a runtime error.
+		panic("invalid graphql schema: " + err.Error())
+	}
+	return &GraphQLController{executor: gql.NewExecutor(schema, gql.NewMemoryStore(persistedQueries))}
+}
+
+// Query serves GET requests with the request in the query string, as sent for
+// persisted queries, and POST requests with a JSON body. Errors of the query
+// are reported in the body with a 200, as GraphQL clients expect.
+func (c *GraphQLController) Query(ctx *gin.Context) {
+	req := new(gql.Request)
+
+	if ctx.Request.Method == http.MethodGet {
+		req.Query = ctx.Query("query")
+		req.OperationName = ctx.Query("operationName")
+		if err := decodeParam(ctx, "variables", &req.Variables); err != nil {
+			badRequest(ctx, err)
+			return
+		}
+		if err := decodeParam(ctx, "extensions", &req.Extensions); err != nil {
+			badRequest(ctx, err)
+			return
+		}
+	} else if err := ctx.ShouldBindJSON(req); err != nil {
+		badRequest(ctx, err)
+		return
+	}
+
+	res := c.executor.Execute(ctx, req, ctx.Request.Method == http.MethodPost)
+	for i := range res.Errors {
+		withRequestID(ctx, &res.Errors[i])
+	}
+	ctx.JSON(http.StatusOK, res)
+}
+
+// withRequestID adds the request id to the extensions of the error, as the
+// REST API adds it to the problems.
+func withRequestID(ctx *gin.Context, err *gqlerrors.FormattedError) {
+	if err.Extensions == nil {
+		err.Extensions = make(map[string]any)
+	}
+	err.Extensions["request_id"] = logger.RequestID(ctx)
+}
+
+func decodeParam(ctx *gin.Context, name string, v any) error {
+	param := ctx.Query(name)
+	if param == "" {
+		return nil
+	}
+	return json.Unmarshal([]byte(param), v)
+}
+
+func badRequest(ctx *gin.Context, err error) {
+	e := gqlerrors.NewFormattedError(err.Error())
+	e.Extensions = map[string]any{"code": gql.CodeBadRequest}
+	withRequestID(ctx, &e)
+	ctx.JSON(http.StatusBadRequest, gin.H{"errors": []gqlerrors.FormattedError{e}})
+}
@@ -0,0 +1,120 @@
+package controller
+
+import (
+	"encoding/csv"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"cruder/internal/model"
+	"cruder/internal/problem"
+	"cruder/pkg/importer"
+	"cruder/pkg/validation"
+
+	"github.com/gin-gonic/gin"
+)
+
+const maxImportSize = 16 << 20
+
+type importReport struct {
+	DryRun    bool        `json:"dry_run"`
+	Created   int         `json:"created"`
+	Updated   int         `json:"updated"`
+	Unchanged int         `json:"unchanged"`
+	Rejected  int         `json:"rejected"`
+	Rows      []importRow `json:"rows"`
+}
+
+type importRow struct {
+	Line     int                         `json:"line"`
+	Username string                      `json:"username,omitempty"`
+	Action   string                      `json:"action"`
+	Errors   validation.ValidationErrors `json:"errors,omitempty"`
+}
+
+// ImportUsers creates or updates users from a CSV or NDJSON file. The report
+// is served as JSON, or as a CSV of the rejected rows if the client accepts
+// text/csv.
+func (c *UserController) ImportUsers(ctx *gin.Context) {
+	dryRun, err := strconv.ParseBool(ctx.DefaultQuery("dry_run", "false"))
+	if err != nil {
+		problem.Error(ctx, validation.ErrInvalidDryRun)
+		return
+	}
+
+	mapping, err := importer.ParseMapping(ctx.Query("mapping"))
+	if err != nil {
+		problem.Error(ctx, err)
+		return
+	}
+
+	body := http.MaxBytesReader(ctx.Writer, ctx.Request.Body, maxImportSize)
+	rows, err := importer.Read(ctx.ContentType(), body, mapping)
+	if errors.As(err, new(*http.MaxBytesError)) {
+		problem.Write(ctx, http.StatusRequestEntityTooLarge, "import file is too large")
+		return
+	}
+	if err != nil {
+		problem.Error(ctx, err)
+		return
+	}
+
+	report, err := c.service.Import(ctx, rows, dryRun)
+	if err != nil {
+		problem.Error(ctx, err)
+		return
+	}
+
+	if ctx.NegotiateFormat(gin.MIMEJSON, importer.CSVType) == importer.CSVType {
+		writeImportErrors(ctx, report)
+		return
+	}
+
+	resp := importReport{
+		DryRun:    report.DryRun,
+		Created:   report.Created,
+		Updated:   report.Updated,
+		Unchanged: report.Unchanged,
+		Rejected:  report.Rejected,
+		Rows:      make([]importRow, len(report.Results)),
+	}
+	for i, res := range report.Results {
+		resp.Rows[i] = importRow{Line: res.Line, Username: res.Username, Action: res.Action, Errors: reasons(res.Err)}
+	}
+
+	ctx.Header("Content-Disposition", `attachment; filename="import-report.json"`)
+	ctx.JSON(http.StatusOK, resp)
+}
+
+// writeImportErrors writes a line per reason a row was rejected.
+func writeImportErrors(ctx *gin.Context, report *model.ImportReport) {
+	ctx.Header("Content-Type", importer.CSVType)
+	ctx.Header("Content-Disposition", `attachment; filename="import-errors.csv"`)
+	ctx.Status(http.StatusOK)
+
+	w := csv.NewWriter(ctx.Writer)
+	_ = w.Write([]string{"line", "username", "field", "code", "message"})
+	for _, res := range report.Results {
+		for _, e := range reasons(res.Err) {
+			_ = w.Write([]string{strconv.Itoa(res.Line), res.Username, e.Field, e.Code, e.Message})
+		}
+	}
+	w.Flush()
+}
+
+func reasons(err error) validation.ValidationErrors {
+	var (
+		errs    validation.ValidationErrors
+		invalid validation.InvalidRequest
+	)
+	switch {
+	case err == nil:
+		return nil
+	case errors.As(err, &errs):
+		return errs
+	case errors.As(err, &invalid):
+		return validation.ValidationErrors{invalid}
+	default:
+		return validation.ValidationErrors{{Code: validation.CodeInvalidValue, Message: err.Error()}}
+	}
+}
@@ -0,0 +1,66 @@
+package controller
+
+import (
+	"net/http"
+
+	"cruder/internal/model"
+	"cruder/internal/problem"
+	"cruder/internal/service"
+	"cruder/pkg/validation"
+
+	"github.com/gin-gonic/gin"
+)
+
+type RoleController struct {
+	service service.RoleService
+}
+
+func NewRoleController(service service.RoleService) *RoleController {
+	return &RoleController{service: service}
+}
+
+// GetRoles lists the roles along with the permissions they grant.
+func (c *RoleController) GetRoles(ctx *gin.Context) {
+	ctx.JSON(http.StatusOK, gin.H{"roles": c.service.Roles()})
+}
+
+// GetAssignments lists the role assignments, of the principal query
+// parameter only if given.
+func (c *RoleController) GetAssignments(ctx *gin.Context) {
+	assignments, err := c.service.GetAssignments(ctx, ctx.Query("principal"))
+	if err != nil {
+		problem.Error(ctx, err)
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{"role_assignments": assignments})
+}
+
+func (c *RoleController) PostAssignment(ctx *gin.Context) {
+	input := new(model.RoleAssignment)
+
+	if err := ctx.ShouldBindJSON(input); err != nil {
+		problem.Error(ctx, validation.MalformedRequest(err))
+		return
+	}
+
+	assignment := &model.RoleAssignment{Principal: input.Principal, Role: input.Role}
+	if err := c.service.Assign(ctx, assignment); err != nil {
+		problem.Error(ctx, err)
+		return
+	}
+
+	ctx.JSON(http.StatusCreated, assignment)
+}
+
+// DeleteAssignment removes the role given by the role query parameter from
+// the principal given by the principal one. The principals contain colons
+// and slashes, hence the query rather than the path.
+func (c *RoleController) DeleteAssignment(ctx *gin.Context) {
+	if err := c.service.Unassign(ctx, ctx.Query("principal"), ctx.Query("role")); err != nil {
+		problem.Error(ctx, err)
+		return
+	}
+
+	ctx.Status(http.StatusNoContent)
+}
@@ -0,0 +1,238 @@
+package controller
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"cruder/internal/model"
+	"cruder/internal/scim"
+	"cruder/internal/service"
+	"cruder/pkg/patch"
+	"cruder/pkg/validation"
+
+	"github.com/gin-gonic/gin"
+)
+
+// SCIMController serves the users as SCIM 2.0 resources for identity
+// providers. Users are addressed by UUID, and a deactivated user is
+// soft-deleted.
+type SCIMController struct {
+	service service.UserService
+}
+
+func NewSCIMController(service service.UserService) *SCIMController {
+	return &SCIMController{service: service}
+}
+
+func (c *SCIMController) GetUsers(ctx *gin.Context) {
+	query := &model.UserQuery{Limit: scim.DefaultCount}
+	if err := scim.ApplyFilter(query, ctx.Query("filter")); err != nil {
+		scim.Write(ctx, err)
+		return
+	}
+
+	startIndex, _ := strconv.Atoi(ctx.DefaultQuery("startIndex", "1"))
+	startIndex = max(startIndex, 1)
+	query.Offset = startIndex - 1
+
+	// A count of 0 asks for the total only.
+	count := scim.DefaultCount
+	if v, ok := ctx.GetQuery("count"); ok {
+		count, _ = strconv.Atoi(v)
+		count = min(max(count, 0), validation.MaxLimit)
+	}
+	query.Limit = max(count, 1)
+
+	users, total, err := c.service.GetRange(ctx, query)
+	if err != nil {
+		scim.Write(ctx, err)
+		return
+	}
+	users = users[:min(len(users), count)]
+
+	resources := make([]*scim.User, len(users))
+	for i := range users {
+		resources[i] = c.resource(ctx, &users[i])
+	}
+
+	scim.Render(ctx, http.StatusOK, &scim.ListResponse{
+		Schemas:      []string{scim.ListSchema},
+		TotalResults: total,
+		StartIndex:   startIndex,
+		ItemsPerPage: len(resources),
+		Resources:    resources,
+	})
+}
+
+func (c *SCIMController) GetUser(ctx *gin.Context) {
+	user, err := c.lookup(ctx)
+	if err != nil {
+		scim.Write(ctx, err)
+		return
+	}
+
+	c.write(ctx, http.StatusOK, user)
+}
+
+func (c *SCIMController) PostUser(ctx *gin.Context) {
+	resource := new(scim.User)
+	if err := ctx.ShouldBindJSON(resource); err != nil {
+		scim.Write(ctx, scim.NewError(http.StatusBadRequest, scim.TypeInvalidSyntax, err.Error()))
+		return
+	}
+
+	user := resource.ToUser()
+	if _, err := c.service.Post(ctx, &user); err != nil {
+		scim.Write(ctx, err)
+		return
+	}
+
+	ctx.Header("Location", baseURL(ctx)+"/Users/"+user.UUID)
+	c.write(ctx, http.StatusCreated, &user)
+}
+
+// PutUser replaces the attributes of the user.
+func (c *SCIMController) PutUser(ctx *gin.Context) {
+	resource := new(scim.User)
+	if err := ctx.ShouldBindJSON(resource); err != nil {
+		scim.Write(ctx, scim.NewError(http.StatusBadRequest, scim.TypeInvalidSyntax, err.Error()))
+		return
+	}
+
+	c.update(ctx, resource.IsActive(), func(*scim.User) (*scim.User, error) {
+		return resource, nil
+	})
+}
+
+// PatchUser applies a SCIM PatchOp to the user.
+func (c *SCIMController) PatchUser(ctx *gin.Context) {
+	op := new(scim.PatchOp)
+	if err := ctx.ShouldBindJSON(op); err != nil {
+		scim.Write(ctx, scim.NewError(http.StatusBadRequest, scim.TypeInvalidSyntax, err.Error()))
+		return
+	}
+
+	// Whether the patch reactivates the user decides if a deactivated user
+	// is restored first.
+	probe := new(scim.User)
+	if err := op.Apply(probe); err != nil {
+		scim.Write(ctx, err)
+		return
+	}
+
+	c.update(ctx, probe.Active != nil && *probe.Active, func(current *scim.User) (*scim.User, error) {
+		return current, op.Apply(current)
+	})
+}
+
+// update applies the change to the current resource of the user and stores
+// the result. Deactivating the user soft-deletes it, activating a
+// deactivated user restores it.
+func (c *SCIMController) update(ctx *gin.Context, activate bool, change func(current *scim.User) (*scim.User, error)) {
+	user, err := c.lookup(ctx)
+	if errors.Is(err, validation.ErrUserNotFound) && activate {
+		user, err = c.service.RestoreByUUID(ctx, ctx.Param("id"))
+	}
+	if err != nil {
+		scim.Write(ctx, err)
+		return
+	}
+
+	resource, err := change(c.resource(ctx, user))
+	if err != nil {
+		scim.Write(ctx, err)
+		return
+	}
+
+	target := resource.ToUser()
+	body, _ := json.Marshal(map[string]string{
+		"username":  target.Username,
+		"email":     target.Email,
+		"full_name": target.FullName,
+	})
+
+	p := &model.UserPatch{ContentType: patch.MergePatchType, Body: body, IfMatch: ifMatch(ctx)}
+	if err = c.service.Patch(ctx, user, p); err != nil {
+		scim.Write(ctx, err)
+		return
+	}
+
+	if !resource.IsActive() {
+		if user, err = c.deactivate(ctx, user); err != nil {
+			scim.Write(ctx, err)
+			return
+		}
+	}
+
+	c.write(ctx, http.StatusOK, user)
+}
+
+func (c *SCIMController) deactivate(ctx *gin.Context, user *model.User) (*model.User, error) {
+	if err := c.service.DeleteByUUID(ctx, user.UUID, user.Version); err != nil {
+		return nil, err
+	}
+
+	// The deleted user can no longer be read, so its state is derived.
+	now := time.Now().UTC()
+	deleted := *user
+	deleted.Version++
+	deleted.UpdatedAt, deleted.DeletedAt = now, &now
+	return &deleted, nil
+}
+
+func (c *SCIMController) DeleteUser(ctx *gin.Context) {
+	if err := validation.ValidateUUID(ctx.Param("id")); err != nil {
+		scim.Write(ctx, validation.ErrUserNotFound)
+		return
+	}
+
+	if err := c.service.DeleteByUUID(ctx, ctx.Param("id"), ifMatch(ctx)); err != nil {
+		scim.Write(ctx, err)
+		return
+	}
+
+	ctx.Status(http.StatusNoContent)
+}
+
+func (c *SCIMController) ServiceProviderConfig(ctx *gin.Context) {
+	scim.Render(ctx, http.StatusOK, scim.ServiceProviderConfig(baseURL(ctx)))
+}
+
+func (c *SCIMController) Schemas(ctx *gin.Context) {
+	scim.Render(ctx, http.StatusOK, scim.List(scim.UserSchemaResource(baseURL(ctx))))
+}
+
+func (c *SCIMController) ResourceTypes(ctx *gin.Context) {
+	scim.Render(ctx, http.StatusOK, scim.List(scim.UserResourceType(baseURL(ctx))))
+}
+
+// lookup finds the user by the UUID of the route. Anything else is not a
+// SCIM id, so it is not found rather than invalid.
+func (c *SCIMController) lookup(ctx *gin.Context) (*model.User, error) {
+	id := ctx.Param("id")
+	if err := validation.ValidateUUID(id); err != nil {
+		return nil, validation.ErrUserNotFound
+	}
+	return c.service.GetByUUID(ctx, id)
+}
+
+func (c *SCIMController) resource(ctx *gin.Context, user *model.User) *scim.User {
+	return scim.FromUser(user, baseURL(ctx)+"/Users/"+user.UUID, etag(user.Version))
+}
+
+func (c *SCIMController) write(ctx *gin.Context, status int, user *model.User) {
+	ctx.Header("ETag", etag(user.Version))
+	scim.Render(ctx, status, c.resource(ctx, user))
+}
+
+// baseURL returns the absolute URL of the SCIM root the request was sent to.
+func baseURL(ctx *gin.Context) string {
+	scheme := "http"
+	if ctx.Request.TLS != nil || ctx.GetHeader("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return scheme + "://" + ctx.Request.Host + "/scim/v2"
+}
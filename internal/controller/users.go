@@ -1,11 +1,11 @@
 package controller
 
 import (
-	"errors"
 	"net/http"
 	"strconv"
 
 	"cruder/internal/model"
+	"cruder/internal/problem"
 	"cruder/internal/service"
 	"cruder/pkg/validation"
 
@@ -21,13 +21,38 @@ func NewUserController(service service.UserService) *UserController {
 }
 
 func (c *UserController) GetAllUsers(ctx *gin.Context) {
-	users, err := c.service.GetAll(ctx)
+	query := new(model.UserQuery)
+
+	if err := ctx.ShouldBindQuery(query); err != nil {
+		problem.Error(ctx, validation.MalformedRequest(err))
+		return
+	}
+
+	page, err := c.service.GetAll(ctx, query)
+	if err != nil {
+		problem.Error(ctx, err)
+		return
+	}
+
+	ctx.JSON(http.StatusOK, page)
+}
+
+// SearchUsers finds users by approximate username, email or full name.
+func (c *UserController) SearchUsers(ctx *gin.Context) {
+	search := new(model.UserSearch)
+
+	if err := ctx.ShouldBindQuery(search); err != nil {
+		problem.Error(ctx, validation.MalformedRequest(err))
+		return
+	}
+
+	matches, err := c.service.Search(ctx, search)
 	if err != nil {
-		ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		problem.Error(ctx, err)
 		return
 	}
 
-	ctx.JSON(http.StatusOK, users)
+	ctx.JSON(http.StatusOK, gin.H{"users": matches})
 }
 
 func (c *UserController) GetUserByUsername(ctx *gin.Context) {
@@ -35,102 +60,140 @@ func (c *UserController) GetUserByUsername(ctx *gin.Context) {
 
 	user, err := c.service.GetByUsername(ctx, username)
 	if err != nil {
-		ctx.JSON(code(err), gin.H{"error": err.Error()})
+		problem.Error(ctx, err)
 		return
 	}
 
-	ctx.JSON(http.StatusOK, user)
+	writeUser(ctx, user)
 }
 
+// GetUserByID is deprecated in favour of GetUser.
 func (c *UserController) GetUserByID(ctx *gin.Context) {
+	ctx.Header("Deprecation", "true")
+
 	idStr := ctx.Param("id")
 	id, err := strconv.ParseInt(idStr, 10, 64)
 	if err != nil {
-		ctx.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		problem.Error(ctx, validation.ErrMalformedID)
 		return
 	}
 
 	var user *model.User
 	if user, err = c.service.GetByID(ctx, id); err != nil {
-		ctx.JSON(code(err), gin.H{"error": err.Error()})
+		problem.Error(ctx, err)
 		return
 	}
 
-	ctx.JSON(http.StatusOK, user)
+	writeUser(ctx, user)
+}
+
+// GetUser addresses the user by UUID. Numeric ids are still accepted during
+// the deprecation period.
+func (c *UserController) GetUser(ctx *gin.Context) {
+	user, err := c.lookup(ctx)
+	if err != nil {
+		problem.Error(ctx, err)
+		return
+	}
+
+	writeUser(ctx, user)
 }
 
 func (c *UserController) PostUser(ctx *gin.Context) {
 	user := new(model.User)
 
-	if err := ctx.BindJSON(user); err != nil {
-		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	if err := ctx.ShouldBindJSON(user); err != nil {
+		problem.Error(ctx, validation.MalformedRequest(err))
 		return
 	}
 
 	id, err := c.service.Post(ctx, user)
 	if err != nil {
-		ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		problem.Error(ctx, err)
 		return
 	}
 
-	ctx.JSON(http.StatusOK, gin.H{"id": id})
+	ctx.JSON(http.StatusOK, gin.H{"id": id, "uuid": user.UUID})
 }
 
 func (c *UserController) PatchUser(ctx *gin.Context) {
-	idStr := ctx.Param("id")
-	id, err := strconv.ParseInt(idStr, 10, 64)
+	user, err := c.lookup(ctx)
 	if err != nil {
-		ctx.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		problem.Error(ctx, err)
 		return
 	}
 
-	var user *model.User
-	if user, err = c.service.GetByID(ctx, id); err != nil {
-		ctx.JSON(code(err), gin.H{"error": err.Error()})
+	body, err := ctx.GetRawData()
+	if err != nil {
+		problem.Error(ctx, validation.MalformedRequest(err))
 		return
 	}
 
-	if err = ctx.BindJSON(user); err != nil {
-		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	p := &model.UserPatch{ContentType: ctx.ContentType(), Body: body, IfMatch: ifMatch(ctx)}
+	if err = c.service.Patch(ctx, user, p); err != nil {
+		problem.Error(ctx, err)
 		return
 	}
 
-	// Avoid changing the id if it's included in the body and has a different value
-	user.ID = id
+	ctx.Header("ETag", etag(user.Version))
+	ctx.Status(http.StatusNoContent)
+}
 
-	if err = c.service.Patch(ctx, user); err != nil {
-		ctx.JSON(code(err), gin.H{"error": err.Error()})
+func (c *UserController) DeleteUser(ctx *gin.Context) {
+	param := ctx.Param("id")
+
+	var err error
+	if id, ok := numericID(ctx, param); ok {
+		err = c.service.Delete(ctx, id, ifMatch(ctx))
+	} else {
+		err = c.service.DeleteByUUID(ctx, param, ifMatch(ctx))
+	}
+
+	if err != nil {
+		problem.Error(ctx, err)
 		return
 	}
 
 	ctx.Status(http.StatusNoContent)
 }
 
-func (c *UserController) DeleteUser(ctx *gin.Context) {
-	idStr := ctx.Param("id")
-	id, err := strconv.ParseInt(idStr, 10, 64)
-	if err != nil {
-		ctx.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
-		return
+// RestoreUser undeletes a soft-deleted user.
+func (c *UserController) RestoreUser(ctx *gin.Context) {
+	param := ctx.Param("id")
+
+	var (
+		user *model.User
+		err  error
+	)
+	if id, ok := numericID(ctx, param); ok {
+		user, err = c.service.Restore(ctx, id)
+	} else {
+		user, err = c.service.RestoreByUUID(ctx, param)
 	}
 
-	if err = c.service.Delete(ctx, id); err != nil {
-		ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	if err != nil {
+		problem.Error(ctx, err)
 		return
 	}
 
-	ctx.Status(http.StatusNoContent)
+	writeUser(ctx, user)
 }
 
-var badRequest validation.InvalidRequest
+func (c *UserController) lookup(ctx *gin.Context) (*model.User, error) {
+	param := ctx.Param("id")
+	if id, ok := numericID(ctx, param); ok {
+		return c.service.GetByID(ctx, id)
+	}
+	return c.service.GetByUUID(ctx, param)
+}
 
-func code(err error) int {
-	switch {
-	case errors.Is(err, validation.ErrUserNotFound):
-		return http.StatusNotFound
-	case errors.As(err, &badRequest):
-		return http.StatusBadRequest
-	default:
-		return http.StatusInternalServerError
+// numericID reports whether the route addresses the user by the deprecated
+// numeric id and marks the response as deprecated if so.
+func numericID(ctx *gin.Context, param string) (int64, bool) {
+	id, err := strconv.ParseInt(param, 10, 64)
+	if err != nil {
+		return 0, false
 	}
+	ctx.Header("Deprecation", "true")
+	return id, true
 }
@@ -0,0 +1,137 @@
+package controller
+
+import (
+	"net/http"
+	"strconv"
+
+	"cruder/internal/model"
+	"cruder/internal/problem"
+	"cruder/internal/service"
+	"cruder/pkg/validation"
+
+	"github.com/gin-gonic/gin"
+)
+
+type WebhookController struct {
+	service service.WebhookService
+}
+
+func NewWebhookController(service service.WebhookService) *WebhookController {
+	return &WebhookController{service: service}
+}
+
+func (c *WebhookController) GetWebhooks(ctx *gin.Context) {
+	webhooks, err := c.service.GetAll(ctx)
+	if err != nil {
+		problem.Error(ctx, err)
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{"webhooks": webhooks})
+}
+
+func (c *WebhookController) GetWebhook(ctx *gin.Context) {
+	webhook, err := c.service.Get(ctx, ctx.Param("id"))
+	if err != nil {
+		problem.Error(ctx, err)
+		return
+	}
+
+	ctx.JSON(http.StatusOK, webhook)
+}
+
+// PostWebhook creates an active webhook. The response holds the signing
+// secret, which cannot be retrieved later.
+func (c *WebhookController) PostWebhook(ctx *gin.Context) {
+	webhook := &model.Webhook{Active: true}
+
+	if err := ctx.ShouldBindJSON(webhook); err != nil {
+		problem.Error(ctx, validation.MalformedRequest(err))
+		return
+	}
+
+	if err := c.service.Post(ctx, webhook); err != nil {
+		problem.Error(ctx, err)
+		return
+	}
+
+	ctx.JSON(http.StatusCreated, webhook)
+}
+
+func (c *WebhookController) PatchWebhook(ctx *gin.Context) {
+	update := new(model.WebhookUpdate)
+
+	if err := ctx.ShouldBindJSON(update); err != nil {
+		problem.Error(ctx, validation.MalformedRequest(err))
+		return
+	}
+
+	webhook, err := c.service.Update(ctx, ctx.Param("id"), update)
+	if err != nil {
+		problem.Error(ctx, err)
+		return
+	}
+
+	ctx.JSON(http.StatusOK, webhook)
+}
+
+func (c *WebhookController) DeleteWebhook(ctx *gin.Context) {
+	if err := c.service.Delete(ctx, ctx.Param("id")); err != nil {
+		problem.Error(ctx, err)
+		return
+	}
+
+	ctx.Status(http.StatusNoContent)
+}
+
+// GetDeliveries lists the deliveries of the webhook newest first.
+func (c *WebhookController) GetDeliveries(ctx *gin.Context) {
+	query := new(model.DeliveryQuery)
+
+	if err := ctx.ShouldBindQuery(query); err != nil {
+		problem.Error(ctx, validation.MalformedRequest(err))
+		return
+	}
+
+	deliveries, err := c.service.GetDeliveries(ctx, ctx.Param("id"), query)
+	if err != nil {
+		problem.Error(ctx, err)
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{"deliveries": deliveries})
+}
+
+// GetDelivery returns the delivery with the history of its attempts.
+func (c *WebhookController) GetDelivery(ctx *gin.Context) {
+	id, err := strconv.ParseInt(ctx.Param("delivery_id"), 10, 64)
+	if err != nil {
+		problem.Error(ctx, validation.ErrMalformedDeliveryID)
+		return
+	}
+
+	delivery, err := c.service.GetDelivery(ctx, ctx.Param("id"), id)
+	if err != nil {
+		problem.Error(ctx, err)
+		return
+	}
+
+	ctx.JSON(http.StatusOK, delivery)
+}
+
+// Redeliver queues the delivery again, whatever its status.
+func (c *WebhookController) Redeliver(ctx *gin.Context) {
+	id, err := strconv.ParseInt(ctx.Param("delivery_id"), 10, 64)
+	if err != nil {
+		problem.Error(ctx, validation.ErrMalformedDeliveryID)
+		return
+	}
+
+	delivery, err := c.service.Redeliver(ctx, ctx.Param("id"), id)
+	if err != nil {
+		problem.Error(ctx, err)
+		return
+	}
+
+	ctx.JSON(http.StatusAccepted, delivery)
+}
@@ -0,0 +1,47 @@
+// Package events wakes up the readers of the user event log when an event is
+// appended by this or another instance.
+package events
+
+import "sync"
+
+// Broker fans a wake-up out to the subscribers. A wake-up carries no event:
+// the subscribers read the log after the last event they have seen, so a
+// missed or repeated wake-up loses or duplicates nothing.
+type Broker struct {
+	mu   sync.Mutex
+	subs map[chan struct{}]struct{}
+}
+
+func NewBroker() *Broker {
+	return &Broker{subs: make(map[chan struct{}]struct{})}
+}
+
+// Subscribe returns a channel that receives a value after every Publish, and
+// a function that ends the subscription.
+func (b *Broker) Subscribe() (<-chan struct{}, func()) {
+	ch := make(chan struct{}, 1)
+
+	b.mu.Lock()
+	b.subs[ch] = struct{}{}
+	b.mu.Unlock()
+
+	return ch, func() {
+		b.mu.Lock()
+		delete(b.subs, ch)
+		b.mu.Unlock()
+	}
+}
+
+// Publish wakes up every subscriber. A subscriber that has not consumed the
+// previous wake-up yet is not woken twice.
+func (b *Broker) Publish() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for ch := range b.subs {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
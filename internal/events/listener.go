@@ -0,0 +1,49 @@
+package events
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Channel is the Postgres channel notified of every appended event.
+const Channel = "user_events"
+
+const (
+	minReconnect = 10 * time.Second
+	maxReconnect = time.Minute
+	pingInterval = 90 * time.Second
+)
+
+// Listen publishes to the broker whenever an event is appended by any
+// instance, until ctx is done. It also publishes after a reconnect, as
+// notifications may have been lost meanwhile.
+func Listen(ctx context.Context, dsn string, broker *Broker) error {
+	listener := pq.NewListener(dsn, minReconnect, maxReconnect, func(event pq.ListenerEventType, err error) {
+		if err != nil {
+			slog.ErrorContext(ctx, "Event listener failed:", "error", err.Error())
+		}
+	})
+	defer func(listener *pq.Listener) { _ = listener.Close() }(listener)
+
+	if err := listener.Listen(Channel); err != nil {
+		return err
+	}
+
+	ticker := time.NewTicker(pingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-listener.Notify:
+			// A nil notification reports a reconnect.
+			broker.Publish()
+		case <-ticker.C:
+			go func() { _ = listener.Ping() }()
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package gql
+
+import (
+	"errors"
+	"log/slog"
+
+	"cruder/pkg/validation"
+
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/gqlerrors"
+)
+
+// The codes of the extensions of an error.
+const (
+	CodeNotFound              = "NOT_FOUND"
+	CodeBadUserInput          = "BAD_USER_INPUT"
+	CodeForbidden             = "FORBIDDEN"
+	CodeConflict              = "CONFLICT"
+	CodePreconditionFailed    = "PRECONDITION_FAILED"
+	CodeInternal              = "INTERNAL_SERVER_ERROR"
+	CodeBadRequest            = "BAD_REQUEST"
+	CodeQueryTooComplex       = "QUERY_TOO_COMPLEX"
+	CodePersistedNotFound     = "PERSISTED_QUERY_NOT_FOUND"
+	CodePersistedNotSupported = "PERSISTED_QUERY_NOT_SUPPORTED"
+)
+
+// Error is an error of a resolver along with the extensions it is reported
+// with.
+type Error struct {
+	message    string
+	extensions map[string]any
+}
+
+func (e *Error) Error() string {
+	return e.message
+}
+
+func (e *Error) Extensions() map[string]any {
+	return e.extensions
+}
+
+func newError(code, message string) *Error {
+	return &Error{message: message, extensions: map[string]any{"code": code}}
+}
+
+// formatted returns a request error, which is not bound to a field.
+func formatted(code, message string) gqlerrors.FormattedError {
+	err := gqlerrors.NewFormattedError(message)
+	err.Extensions = map[string]any{"code": code}
+	return err
+}
+
+// resolveError maps err the way the REST API maps it to a problem. The failed
+// rules of a validation error are listed in the errors extension. Unknown
+// errors are logged and reported without details, so that database details
+// never reach the client.
+func resolveError(p graphql.ResolveParams, err error) error {
+	var (
+		invalid  validation.InvalidRequest
+		errs     validation.ValidationErrors
+		conflict validation.ErrConflict
+		scope    validation.ErrMissingScope
+		missing  validation.ErrMissingPermission
+		e        *Error
+	)
+
+	switch {
+	case errors.Is(err, validation.ErrUserNotFound):
+		e = newError(CodeNotFound, err.Error())
+	case errors.Is(err, validation.ErrPreconditionFailed):
+		e = newError(CodePreconditionFailed, err.Error())
+	case errors.As(err, &invalid):
+		e = newError(CodeBadUserInput, err.Error())
+		e.extensions["errors"] = validation.ValidationErrors{invalid}
+	case errors.As(err, &errs):
+		e = newError(CodeBadUserInput, err.Error())
+		e.extensions["errors"] = errs
+	case errors.As(err, &conflict):
+		e = newError(CodeConflict, err.Error())
+		e.extensions["field"] = conflict.Field
+	case errors.As(err, &scope):
+		e = newError(CodeForbidden, err.Error())
+	case errors.As(err, &missing):
+		e = newError(CodeForbidden, err.Error())
+		e.extensions["permission"] = missing.Permission
+	default:
+		slog.ErrorContext(p.Context, "Internal error:", "error", err.Error(), "graphql.field", p.Info.FieldName)
+		e = newError(CodeInternal, "internal error")
+	}
+	return e
+}
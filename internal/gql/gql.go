@@ -0,0 +1,153 @@
+// Package gql serves the users over GraphQL. A request is parsed, validated
+// and measured against the depth and complexity limits before it is executed.
+// Queries may be persisted by their hash, following the automatic persisted
+// queries protocol of Apollo.
+package gql
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+
+	"cruder/internal/auth"
+	"cruder/internal/model"
+
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/gqlerrors"
+	"github.com/graphql-go/graphql/language/ast"
+	"github.com/graphql-go/graphql/language/parser"
+	"github.com/graphql-go/graphql/language/source"
+)
+
+type Request struct {
+	Query         string         `json:"query"`
+	OperationName string         `json:"operationName"`
+	Variables     map[string]any `json:"variables"`
+	Extensions    Extensions     `json:"extensions"`
+}
+
+type Extensions struct {
+	PersistedQuery *PersistedQuery `json:"persistedQuery,omitempty"`
+}
+
+type PersistedQuery struct {
+	Version    int    `json:"version"`
+	SHA256Hash string `json:"sha256Hash"`
+}
+
+type Executor struct {
+	schema  graphql.Schema
+	queries QueryStore
+}
+
+func NewExecutor(schema graphql.Schema, queries QueryStore) *Executor {
+	return &Executor{schema: schema, queries: queries}
+}
+
+// Execute runs the request. Mutations are refused unless allowed, as a GET
+// request must not change anything, and unless the principal of ctx is
+// granted the users:write scope.
+func (e *Executor) Execute(ctx context.Context, req *Request, allowMutations bool) *graphql.Result {
+	query, err := e.query(req)
+	if err != nil {
+		return fail(*err)
+	}
+
+	doc, parseErr := parser.Parse(parser.ParseParams{
+		Source: source.NewSource(&source.Source{Body: []byte(query), Name: "GraphQL request"}),
+	})
+	if parseErr != nil {
+		return &graphql.Result{Errors: gqlerrors.FormatErrors(parseErr)}
+	}
+
+	if res := graphql.ValidateDocument(&e.schema, doc, nil); !res.IsValid {
+		return &graphql.Result{Errors: res.Errors}
+	}
+
+	// An unknown or ambiguous operation is reported by Execute.
+	if op := operation(doc, req.OperationName); op != nil {
+		if op.Operation == ast.OperationTypeMutation {
+			if !allowMutations {
+				return fail(formatted(CodeBadRequest, "mutations must be sent with POST"))
+			}
+			if err := auth.Require(ctx, model.ScopeUsersWrite); err != nil {
+				return fail(formatted(CodeForbidden, err.Error()))
+			}
+		}
+
+		depth, complexity := measure(doc, op, req.Variables)
+		if depth > MaxDepth {
+			return fail(formatted(CodeQueryTooComplex, fmt.Sprintf("query must not be nested more than %d levels deep", MaxDepth)))
+		}
+		if complexity > MaxComplexity {
+			return fail(formatted(CodeQueryTooComplex, fmt.Sprintf("query must not have a complexity of more than %d", MaxComplexity)))
+		}
+	}
+
+	return graphql.Execute(graphql.ExecuteParams{
+		Schema:        e.schema,
+		AST:           doc,
+		OperationName: req.OperationName,
+		Args:          req.Variables,
+		Context:       ctx,
+	})
+}
+
+// query returns the query of the request. A persisted query is looked up by
+// its hash if the query is omitted, and is stored otherwise.
+func (e *Executor) query(req *Request) (string, *gqlerrors.FormattedError) {
+	pq := req.Extensions.PersistedQuery
+	if pq == nil {
+		if req.Query == "" {
+			err := formatted(CodeBadRequest, "query is required")
+			return "", &err
+		}
+		return req.Query, nil
+	}
+
+	if pq.Version != 1 {
+		err := formatted(CodePersistedNotSupported, "PersistedQueryNotSupported")
+		return "", &err
+	}
+
+	if req.Query == "" {
+		query, ok := e.queries.Get(pq.SHA256Hash)
+		if !ok {
+			err := formatted(CodePersistedNotFound, "PersistedQueryNotFound")
+			return "", &err
+		}
+		return query, nil
+	}
+
+	sum := sha256.Sum256([]byte(req.Query))
+	if hex.EncodeToString(sum[:]) != pq.SHA256Hash {
+		err := formatted(CodeBadRequest, "provided sha does not match query")
+		return "", &err
+	}
+	e.queries.Put(pq.SHA256Hash, req.Query)
+	return req.Query, nil
+}
+
+func operation(doc *ast.Document, name string) *ast.OperationDefinition {
+	var found *ast.OperationDefinition
+	for _, def := range doc.Definitions {
+		op, ok := def.(*ast.OperationDefinition)
+		if !ok {
+			continue
+		}
+		if name == "" {
+			if found != nil {
+				return nil
+			}
+			found = op
+		} else if op.Name != nil && op.Name.Value == name {
+			return op
+		}
+	}
+	return found
+}
+
+func fail(err gqlerrors.FormattedError) *graphql.Result {
+	return &graphql.Result{Errors: []gqlerrors.FormattedError{err}}
+}
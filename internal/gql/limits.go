@@ -0,0 +1,123 @@
+package gql
+
+import (
+	"strconv"
+
+	"cruder/pkg/validation"
+
+	"github.com/graphql-go/graphql/language/ast"
+)
+
+const (
+	// MaxDepth is the deepest nesting of selections a query may have. It
+	// leaves room for the introspection query of the common clients.
+	MaxDepth = 15
+	// MaxComplexity bounds the number of fields a query may resolve. A field
+	// of a connection counts once for every user asked for.
+	MaxComplexity = 5000
+)
+
+// defaultFirst is the page size of the service, used when first is not set.
+const defaultFirst = 50
+
+// measure returns the depth and the complexity of the operation. The
+// fragments are inlined, and a cycle of fragments, which the validation
+// rejects anyway, is not followed.
+func measure(doc *ast.Document, op *ast.OperationDefinition, variables map[string]any) (depth, complexity int) {
+	fragments := make(map[string]*ast.FragmentDefinition)
+	for _, def := range doc.Definitions {
+		if f, ok := def.(*ast.FragmentDefinition); ok {
+			fragments[f.Name.Value] = f
+		}
+	}
+
+	defaults := make(map[string]ast.Value)
+	for _, def := range op.VariableDefinitions {
+		if def.DefaultValue != nil {
+			defaults[def.Variable.Name.Value] = def.DefaultValue
+		}
+	}
+
+	m := &measurer{fragments: fragments, variables: variables, defaults: defaults, visiting: make(map[string]bool)}
+	return m.selectionSet(op.SelectionSet, 0)
+}
+
+type measurer struct {
+	fragments map[string]*ast.FragmentDefinition
+	variables map[string]any
+	defaults  map[string]ast.Value
+	visiting  map[string]bool
+}
+
+func (m *measurer) selectionSet(set *ast.SelectionSet, level int) (depth, complexity int) {
+	if set == nil {
+		return level, 0
+	}
+
+	depth = level
+	for _, selection := range set.Selections {
+		var d, c int
+		switch s := selection.(type) {
+		case *ast.Field:
+			d, c = m.selectionSet(s.SelectionSet, level+1)
+			c = 1 + c*m.multiplier(s)
+		case *ast.InlineFragment:
+			d, c = m.selectionSet(s.SelectionSet, level)
+		case *ast.FragmentSpread:
+			name := s.Name.Value
+			f, ok := m.fragments[name]
+			if !ok || m.visiting[name] {
+				continue
+			}
+			m.visiting[name] = true
+			d, c = m.selectionSet(f.SelectionSet, level)
+			m.visiting[name] = false
+		}
+		depth = max(depth, d)
+		complexity += c
+	}
+	return depth, complexity
+}
+
+// multiplier returns how many times the selections of the field are resolved,
+// the page size for a connection and 1 otherwise.
+func (m *measurer) multiplier(field *ast.Field) int {
+	if field.Name.Value != "users" {
+		return 1
+	}
+
+	for _, arg := range field.Arguments {
+		if arg.Name.Value == "first" {
+			return m.pageSize(arg.Value)
+		}
+	}
+	return defaultFirst
+}
+
+// pageSize returns the value of first. A variable without a value takes its
+// default, and a value that cannot be read counts as the largest page, so
+// that it does not lower the complexity.
+func (m *measurer) pageSize(value ast.Value) int {
+	switch v := value.(type) {
+	case *ast.IntValue:
+		if n, err := strconv.Atoi(v.Value); err == nil {
+			return max(n, 1)
+		}
+	case *ast.Variable:
+		name := v.Name.Value
+		n, ok := m.variables[name]
+		if !ok {
+			if def, ok := m.defaults[name]; ok {
+				return m.pageSize(def)
+			}
+			return defaultFirst
+		}
+		switch n := n.(type) {
+		case nil:
+			return defaultFirst
+		case float64:
+			return max(int(n), 1)
+		}
+	}
+	return validation.MaxLimit
+}
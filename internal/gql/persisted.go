@@ -0,0 +1,59 @@
+package gql
+
+import (
+	"container/list"
+	"sync"
+)
+
+// QueryStore keeps the persisted queries by their SHA-256 hash.
+type QueryStore interface {
+	Get(hash string) (string, bool)
+	Put(hash, query string)
+}
+
+type memoryStore struct {
+	mu      sync.Mutex
+	size    int
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+type entry struct {
+	hash, query string
+}
+
+// NewMemoryStore returns a store that keeps the size most recently used
+// queries. The queries are lost on restart, after which the clients register
+// them again.
+func NewMemoryStore(size int) QueryStore {
+	return &memoryStore{size: size, order: list.New(), entries: make(map[string]*list.Element)}
+}
+
+func (s *memoryStore) Get(hash string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	el, ok := s.entries[hash]
+	if !ok {
+		return "", false
+	}
+	s.order.MoveToFront(el)
+	return el.Value.(*entry).query, true
+}
+
+func (s *memoryStore) Put(hash, query string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if el, ok := s.entries[hash]; ok {
+		s.order.MoveToFront(el)
+		return
+	}
+
+	s.entries[hash] = s.order.PushFront(&entry{hash: hash, query: query})
+	if s.order.Len() > s.size {
+		oldest := s.order.Back()
+		s.order.Remove(oldest)
+		delete(s.entries, oldest.Value.(*entry).hash)
+	}
+}
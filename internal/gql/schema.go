@@ -0,0 +1,311 @@
+package gql
+
+import (
+	"encoding/json"
+	"time"
+
+	"cruder/internal/model"
+	"cruder/internal/service"
+	"cruder/pkg/patch"
+	"cruder/pkg/validation"
+
+	"github.com/graphql-go/graphql"
+)
+
+// NewSchema returns the schema of the users, resolved through the service.
+func NewSchema(users service.UserService) (graphql.Schema, error) {
+	r := &resolver{service: users}
+
+	userType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "User",
+		Fields: graphql.Fields{
+			"id": &graphql.Field{
+				Type:        graphql.NewNonNull(graphql.ID),
+				Description: "The UUID of the user.",
+				Resolve: func(p graphql.ResolveParams) (any, error) {
+					return p.Source.(*model.User).UUID, nil
+				},
+			},
+			"username":  &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"email":     &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"fullName":  &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"createdAt": &graphql.Field{Type: graphql.NewNonNull(graphql.DateTime)},
+			"updatedAt": &graphql.Field{Type: graphql.NewNonNull(graphql.DateTime)},
+			"deletedAt": &graphql.Field{Type: graphql.DateTime},
+			"version": &graphql.Field{
+				Type:        graphql.NewNonNull(graphql.Int),
+				Description: "Incremented on every change, see the ifMatch arguments.",
+			},
+		},
+	})
+
+	edgeType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "UserEdge",
+		Fields: graphql.Fields{
+			"cursor": &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"node":   &graphql.Field{Type: graphql.NewNonNull(userType)},
+		},
+	})
+
+	pageInfoType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "PageInfo",
+		Fields: graphql.Fields{
+			"hasNextPage": &graphql.Field{Type: graphql.NewNonNull(graphql.Boolean)},
+			"endCursor":   &graphql.Field{Type: graphql.String},
+		},
+	})
+
+	connectionType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "UserConnection",
+		Fields: graphql.Fields{
+			"edges":    &graphql.Field{Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(edgeType)))},
+			"nodes":    &graphql.Field{Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(userType)))},
+			"pageInfo": &graphql.Field{Type: graphql.NewNonNull(pageInfoType)},
+		},
+	})
+
+	sortType := graphql.NewEnum(graphql.EnumConfig{
+		Name: "UserSort",
+		Values: graphql.EnumValueConfigMap{
+			"ID":         {Value: "id"},
+			"USERNAME":   {Value: "username"},
+			"EMAIL":      {Value: "email"},
+			"CREATED_AT": {Value: "created_at"},
+			"UPDATED_AT": {Value: "updated_at"},
+		},
+	})
+
+	orderType := graphql.NewEnum(graphql.EnumConfig{
+		Name: "SortOrder",
+		Values: graphql.EnumValueConfigMap{
+			"ASC":  {Value: "asc"},
+			"DESC": {Value: "desc"},
+		},
+	})
+
+	createInput := graphql.NewInputObject(graphql.InputObjectConfig{
+		Name: "CreateUserInput",
+		Fields: graphql.InputObjectConfigFieldMap{
+			"username": {Type: graphql.NewNonNull(graphql.String)},
+			"email":    {Type: graphql.NewNonNull(graphql.String)},
+			"fullName": {Type: graphql.String},
+		},
+	})
+
+	updateInput := graphql.NewInputObject(graphql.InputObjectConfig{
+		Name:        "UpdateUserInput",
+		Description: "The fields to change, the others are left as they are.",
+		Fields: graphql.InputObjectConfigFieldMap{
+			"username": {Type: graphql.String},
+			"email":    {Type: graphql.String},
+			"fullName": {Type: graphql.String},
+		},
+	})
+
+	query := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Query",
+		Fields: graphql.Fields{
+			"user": &graphql.Field{
+				Type:        userType,
+				Description: "The user with the UUID or the username, exactly one of which is required.",
+				Args: graphql.FieldConfigArgument{
+					"id":       {Type: graphql.ID},
+					"username": {Type: graphql.String},
+				},
+				Resolve: r.user,
+			},
+			"users": &graphql.Field{
+				Type: graphql.NewNonNull(connectionType),
+				Args: graphql.FieldConfigArgument{
+					"first":          {Type: graphql.Int},
+					"after":          {Type: graphql.String},
+					"sort":           {Type: sortType},
+					"order":          {Type: orderType},
+					"usernamePrefix": {Type: graphql.String},
+					"emailDomain":    {Type: graphql.String},
+					"createdAfter":   {Type: graphql.DateTime},
+					"createdBefore":  {Type: graphql.DateTime},
+					"updatedAfter":   {Type: graphql.DateTime},
+					"updatedBefore":  {Type: graphql.DateTime},
+					"includeDeleted": {Type: graphql.Boolean},
+				},
+				Resolve: r.users,
+			},
+		},
+	})
+
+	mutation := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Mutation",
+		Fields: graphql.Fields{
+			"createUser": &graphql.Field{
+				Type: graphql.NewNonNull(userType),
+				Args: graphql.FieldConfigArgument{
+					"input": {Type: graphql.NewNonNull(createInput)},
+				},
+				Resolve: r.createUser,
+			},
+			"updateUser": &graphql.Field{
+				Type: graphql.NewNonNull(userType),
+				Args: graphql.FieldConfigArgument{
+					"id":      {Type: graphql.NewNonNull(graphql.ID)},
+					"input":   {Type: graphql.NewNonNull(updateInput)},
+					"ifMatch": {Type: graphql.Int},
+				},
+				Resolve: r.updateUser,
+			},
+			"deleteUser": &graphql.Field{
+				Type:        graphql.NewNonNull(graphql.ID),
+				Description: "Soft-deletes the user and returns its UUID.",
+				Args: graphql.FieldConfigArgument{
+					"id":      {Type: graphql.NewNonNull(graphql.ID)},
+					"ifMatch": {Type: graphql.Int},
+				},
+				Resolve: r.deleteUser,
+			},
+		},
+	})
+
+	return graphql.NewSchema(graphql.SchemaConfig{Query: query, Mutation: mutation})
+}
+
+type resolver struct {
+	service service.UserService
+}
+
+type connection struct {
+	Edges    []edge        `graphql:"edges"`
+	Nodes    []*model.User `graphql:"nodes"`
+	PageInfo pageInfo      `graphql:"pageInfo"`
+}
+
+type edge struct {
+	Cursor string      `graphql:"cursor"`
+	Node   *model.User `graphql:"node"`
+}
+
+type pageInfo struct {
+	HasNextPage bool    `graphql:"hasNextPage"`
+	EndCursor   *string `graphql:"endCursor"`
+}
+
+func (r *resolver) user(p graphql.ResolveParams) (any, error) {
+	id, byID := p.Args["id"].(string)
+	username, byUsername := p.Args["username"].(string)
+	if byID == byUsername {
+		return nil, newError(CodeBadUserInput, "exactly one of id and username is required")
+	}
+
+	var (
+		user *model.User
+		err  error
+	)
+	if byID {
+		user, err = r.service.GetByUUID(p.Context, id)
+	} else {
+		user, err = r.service.GetByUsername(p.Context, username)
+	}
+	if err != nil {
+		return nil, resolveError(p, err)
+	}
+	return user, nil
+}
+
+func (r *resolver) users(p graphql.ResolveParams) (any, error) {
+	query := &model.UserQuery{
+		Cursor:         stringArg(p, "after"),
+		Sort:           stringArg(p, "sort"),
+		Order:          stringArg(p, "order"),
+		UsernamePrefix: stringArg(p, "usernamePrefix"),
+		EmailDomain:    stringArg(p, "emailDomain"),
+		CreatedAfter:   timeArg(p, "createdAfter"),
+		CreatedBefore:  timeArg(p, "createdBefore"),
+		UpdatedAfter:   timeArg(p, "updatedAfter"),
+		UpdatedBefore:  timeArg(p, "updatedBefore"),
+	}
+	query.IncludeDeleted, _ = p.Args["includeDeleted"].(bool)
+
+	// The service defaults a limit of 0, which is invalid if asked for.
+	if first, ok := p.Args["first"].(int); ok {
+		if first == 0 {
+			return nil, resolveError(p, validation.ErrInvalidLimit)
+		}
+		query.Limit = first
+	}
+
+	page, err := r.service.GetAll(p.Context, query)
+	if err != nil {
+		return nil, resolveError(p, err)
+	}
+
+	conn := &connection{
+		Edges:    make([]edge, len(page.Users)),
+		Nodes:    make([]*model.User, len(page.Users)),
+		PageInfo: pageInfo{HasNextPage: page.HasMore},
+	}
+	for i := range page.Users {
+		user := &page.Users[i]
+		cursor := model.NewCursor(query.Sort, query.Order, user).Encode()
+		conn.Edges[i] = edge{Cursor: cursor, Node: user}
+		conn.Nodes[i] = user
+		conn.PageInfo.EndCursor = &cursor
+	}
+	return conn, nil
+}
+
+func (r *resolver) createUser(p graphql.ResolveParams) (any, error) {
+	input := p.Args["input"].(map[string]any)
+	user := &model.User{}
+	user.Username, _ = input["username"].(string)
+	user.Email, _ = input["email"].(string)
+	user.FullName, _ = input["fullName"].(string)
+
+	if _, err := r.service.Post(p.Context, user); err != nil {
+		return nil, resolveError(p, err)
+	}
+	return user, nil
+}
+
+// updateUser applies the fields set in the input as a merge patch.
+func (r *resolver) updateUser(p graphql.ResolveParams) (any, error) {
+	user, err := r.service.GetByUUID(p.Context, p.Args["id"].(string))
+	if err != nil {
+		return nil, resolveError(p, err)
+	}
+
+	input := p.Args["input"].(map[string]any)
+	changes := make(map[string]any)
+	for field, column := range map[string]string{"username": "username", "email": "email", "fullName": "full_name"} {
+		if v, ok := input[field].(string); ok {
+			changes[column] = v
+		}
+	}
+	body, _ := json.Marshal(changes)
+
+	ifMatch, _ := p.Args["ifMatch"].(int)
+	up := &model.UserPatch{ContentType: patch.MergePatchType, Body: body, IfMatch: int64(ifMatch)}
+	if err = r.service.Patch(p.Context, user, up); err != nil {
+		return nil, resolveError(p, err)
+	}
+	return user, nil
+}
+
+func (r *resolver) deleteUser(p graphql.ResolveParams) (any, error) {
+	id := p.Args["id"].(string)
+	ifMatch, _ := p.Args["ifMatch"].(int)
+	if err := r.service.DeleteByUUID(p.Context, id, int64(ifMatch)); err != nil {
+		return nil, resolveError(p, err)
+	}
+	return id, nil
+}
+
+func stringArg(p graphql.ResolveParams, name string) string {
+	v, _ := p.Args[name].(string)
+	return v
+}
+
+func timeArg(p graphql.ResolveParams, name string) *time.Time {
+	if v, ok := p.Args[name].(time.Time); ok {
+		return &v
+	}
+	return nil
+}
@@ -1,24 +1,151 @@
 package handler
 
 import (
+	"net/http"
+
+	"cruder/internal/auth"
 	"cruder/internal/controller"
 	"cruder/internal/middleware"
+	"cruder/internal/model"
+	"cruder/internal/problem"
+	"cruder/internal/ratelimit"
 
 	"github.com/gin-gonic/gin"
 )
 
-func New(router *gin.Engine, apiKey string, userController *controller.UserController) *gin.Engine {
-	v1 := router.Group("/api/v1", middleware.APIKey(apiKey), middleware.Logging)
+// RateLimits are the limits of the requests of every caller to the route
+// groups, kept in the store. A zero limit disables the limiting.
+type RateLimits struct {
+	Store   ratelimit.Store
+	Users   ratelimit.Limit
+	GraphQL ratelimit.Limit
+	// Admin is shared by the webhooks, audit, API key and role routes.
+	Admin ratelimit.Limit
+	SCIM  ratelimit.Limit
+	// Failures limits the requests failing to authenticate by client IP.
+	Failures ratelimit.Limit
+}
+
+// New registers the routes. Every route declares the scope it requires of
+// the caller and, unless the service checks it, the permission a role of the
+// caller must grant. The idempotency middleware guards the mutating REST
+// routes, except for those returning a secret, which is not stored.
+// The SCIM routes are registered only if scimToken is set.
+func New(router *gin.Engine, authenticator auth.Authenticator, scimToken string, idempotency gin.HandlerFunc, limits RateLimits, controllers *controller.Controller) *gin.Engine {
+	// The services read the request metadata from the context they are
+	// passed, which is the gin context.
+	router.ContextWithFallback = true
+	router.Use(middleware.RequestID)
+
+	userController, scimController, webhookController := controllers.Users, controllers.SCIM, controllers.Webhooks
+
+	read := middleware.Require(model.ScopeUsersRead, model.PermUsersRead)
+	write := middleware.RequireScope(model.ScopeUsersWrite)
+	admin := middleware.Require(model.ScopeAdmin, model.PermManage)
+
+	if limits.Store == nil {
+		limits.Store = ratelimit.NewMemoryStore()
+	}
+	failures := middleware.RateLimitFailures(limits.Store, limits.Failures)
+	usersLimit := middleware.RateLimit(limits.Store, "users", limits.Users)
+	adminLimit := middleware.RateLimit(limits.Store, "admin", limits.Admin)
+
+	v1 := router.Group("/api/v1", failures, middleware.Authenticate(authenticator), middleware.Logging)
 	{
-		userGroup := v1.Group("/users")
+		userGroup := v1.Group("/users", usersLimit)
 		{
-			userGroup.GET("/", userController.GetAllUsers)
-			userGroup.GET("/username/:username", userController.GetUserByUsername)
-			userGroup.GET("/id/:id", userController.GetUserByID)
-			userGroup.POST("/", userController.PostUser)
-			userGroup.PATCH("/:id", userController.PatchUser)
-			userGroup.DELETE("/:id", userController.DeleteUser)
+			userGroup.GET("/", read, userController.GetAllUsers)
+			userGroup.GET("/export", read, userController.ExportUsers)
+			userGroup.GET("/events", read, userController.StreamUserEvents)
+			userGroup.GET("/search", read, userController.SearchUsers)
+			userGroup.GET("/username/:username", read, userController.GetUserByUsername)
+			userGroup.GET("/id/:id", read, userController.GetUserByID)
+			userGroup.GET("/:id", read, userController.GetUser)
+			userGroup.POST("/", write, idempotency, userController.PostUser)
+			userGroup.POST("/import", write, idempotency, userController.ImportUsers)
+			userGroup.PATCH("/:id", write, idempotency, userController.PatchUser)
+			userGroup.DELETE("/:id", write, idempotency, userController.DeleteUser)
+			userGroup.POST("/:id/restore", write, idempotency, userController.RestoreUser)
+		}
+		v1.POST("/users:method", usersLimit, write, idempotency, customMethods(map[string]gin.HandlerFunc{
+			"batch": userController.BatchUsers,
+		}))
+
+		webhookGroup := v1.Group("/webhooks", adminLimit, admin)
+		{
+			webhookGroup.GET("", webhookController.GetWebhooks)
+			webhookGroup.GET("/:id", webhookController.GetWebhook)
+			// The secret is shown once, and is not kept for replays.
+			webhookGroup.POST("", webhookController.PostWebhook)
+			webhookGroup.PATCH("/:id", idempotency, webhookController.PatchWebhook)
+			webhookGroup.DELETE("/:id", idempotency, webhookController.DeleteWebhook)
+			webhookGroup.GET("/:id/deliveries", webhookController.GetDeliveries)
+			webhookGroup.GET("/:id/deliveries/:delivery_id", webhookController.GetDelivery)
+			webhookGroup.POST("/:id/deliveries/:delivery_id/redeliver", idempotency, webhookController.Redeliver)
+		}
+
+		auditGroup := v1.Group("/audit", adminLimit, admin)
+		{
+			auditGroup.GET("", controllers.Audit.GetAudit)
+			auditGroup.GET("/verify", controllers.Audit.VerifyAudit)
+		}
+
+		apiKeyGroup := v1.Group("/api-keys", adminLimit, admin)
+		{
+			apiKeyGroup.GET("", controllers.APIKeys.GetAPIKeys)
+			apiKeyGroup.GET("/:id", controllers.APIKeys.GetAPIKey)
+			// The key is shown once, and is not kept for replays.
+			apiKeyGroup.POST("", controllers.APIKeys.PostAPIKey)
+			apiKeyGroup.POST("/:id/rotate", controllers.APIKeys.RotateAPIKey)
+			apiKeyGroup.DELETE("/:id", controllers.APIKeys.RevokeAPIKey)
+		}
+
+		v1.GET("/roles", adminLimit, admin, controllers.Roles.GetRoles)
+		roleGroup := v1.Group("/role-assignments", adminLimit, admin)
+		{
+			roleGroup.GET("", controllers.Roles.GetAssignments)
+			roleGroup.POST("", idempotency, controllers.Roles.PostAssignment)
+			roleGroup.DELETE("", idempotency, controllers.Roles.DeleteAssignment)
+		}
+	}
+
+	// Mutations additionally require the users:write scope, which the
+	// executor checks.
+	graphql := router.Group("/api/graphql", failures, middleware.Authenticate(authenticator), middleware.Logging,
+		middleware.RateLimit(limits.Store, "graphql", limits.GraphQL))
+	{
+		graphql.GET("", read, controllers.GraphQL.Query)
+		graphql.POST("", read, controllers.GraphQL.Query)
+	}
+
+	if scimToken != "" {
+		scimGroup := router.Group("/scim/v2", failures, middleware.SCIMToken(scimToken), middleware.Logging,
+			middleware.RateLimit(limits.Store, "scim", limits.SCIM))
+		{
+			scimGroup.GET("/ServiceProviderConfig", scimController.ServiceProviderConfig)
+			scimGroup.GET("/Schemas", scimController.Schemas)
+			scimGroup.GET("/ResourceTypes", scimController.ResourceTypes)
+			scimGroup.GET("/Users", scimController.GetUsers)
+			scimGroup.GET("/Users/:id", scimController.GetUser)
+			scimGroup.POST("/Users", scimController.PostUser)
+			scimGroup.PUT("/Users/:id", scimController.PutUser)
+			scimGroup.PATCH("/Users/:id", scimController.PatchUser)
+			scimGroup.DELETE("/Users/:id", scimController.DeleteUser)
 		}
 	}
 	return router
 }
+
+// customMethods dispatches collection methods such as /users:batch. gin only
+// resolves escaped colons in static routes when started with Run, so the
+// method is routed as a parameter instead.
+func customMethods(methods map[string]gin.HandlerFunc) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		param := ctx.Param("method")
+		if len(param) < 2 || param[0] != ':' || methods[param[1:]] == nil {
+			problem.Write(ctx, http.StatusNotFound, "")
+			return
+		}
+		methods[param[1:]](ctx)
+	}
+}
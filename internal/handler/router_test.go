@@ -1,337 +1,4203 @@
 package handler
 
 import (
+	"archive/zip"
+	"bufio"
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"log/slog"
+	"maps"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
 	"reflect"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+	"unicode"
 
+	"cruder/internal/audit"
+	"cruder/internal/auth"
 	"cruder/internal/controller"
+	"cruder/internal/events"
+	"cruder/internal/gql"
+	"cruder/internal/middleware"
 	"cruder/internal/model"
+	"cruder/internal/problem"
+	"cruder/internal/ratelimit"
 	"cruder/internal/repository"
+	"cruder/internal/scim"
 	"cruder/internal/service"
+	"cruder/internal/webhook"
+	"cruder/pkg/logger"
 	"cruder/pkg/validation"
 
 	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
 )
 
 type MockUserRepository struct {
 	counter int64
 	Users   []model.User
-}
+	Err     error
+
+	// The events are read by the event streams concurrently.
+	mu     sync.Mutex
+	Events []model.UserEvent
+	Audit  []model.AuditEntry
 
-func (m *MockUserRepository) GetAll(_ context.Context) ([]model.User, error) {
-	return m.Users, nil
+	// Webhooks receives the deliveries of the events if set, as the outbox.
+	Webhooks *MockWebhookRepository
 }
 
-func (m *MockUserRepository) GetByUsername(_ context.Context, username string) (*model.User, error) {
+func (m *MockUserRepository) GetAll(_ context.Context, query *model.UserQuery) ([]model.User, error) {
+	if m.Err != nil {
+		return nil, m.Err
+	}
+
+	key := func(u *model.User) string {
+		switch query.Sort {
+		case "username":
+			return u.Username
+		case "email":
+			return u.Email
+		case "created_at":
+			return u.CreatedAt.UTC().Format(time.RFC3339Nano)
+		case "updated_at":
+			return u.UpdatedAt.UTC().Format(time.RFC3339Nano)
+		}
+		return ""
+	}
+
+	less := func(a, b *model.User) bool {
+		if ka, kb := key(a), key(b); ka != kb {
+			return ka < kb
+		}
+		return a.ID < b.ID
+	}
+
+	var users []model.User
 	for _, u := range m.Users {
-		if u.Username == username {
-			return &u, nil
+		if u.DeletedAt != nil && !query.IncludeDeleted {
+			continue
+		}
+		if !strings.HasPrefix(u.Username, query.UsernamePrefix) {
+			continue
+		}
+		if query.Username != "" && u.Username != query.Username || query.Email != "" && u.Email != query.Email {
+			continue
+		}
+		if !strings.Contains(strings.ToLower(u.Email), strings.ToLower(query.EmailContains)) {
+			continue
+		}
+		if query.EmailDomain != "" && !strings.HasSuffix(strings.ToLower(u.Email), "@"+strings.ToLower(query.EmailDomain)) {
+			continue
+		}
+		if query.CreatedAfter != nil && !u.CreatedAt.After(*query.CreatedAfter) {
+			continue
+		}
+		if query.CreatedBefore != nil && !u.CreatedAt.Before(*query.CreatedBefore) {
+			continue
+		}
+		if query.UpdatedAfter != nil && !u.UpdatedAt.After(*query.UpdatedAfter) {
+			continue
+		}
+		if query.UpdatedBefore != nil && !u.UpdatedAt.Before(*query.UpdatedBefore) {
+			continue
+		}
+		if query.After != nil {
+			after := &model.User{ID: query.After.ID}
+			switch query.Sort {
+			case "username":
+				after.Username = query.After.Value
+			case "email":
+				after.Email = query.After.Value
+			case "created_at":
+				after.CreatedAt, _ = time.Parse(time.RFC3339Nano, query.After.Value)
+			case "updated_at":
+				after.UpdatedAt, _ = time.Parse(time.RFC3339Nano, query.After.Value)
+			}
+			if query.Order == "asc" && !less(after, &u) || query.Order == "desc" && !less(&u, after) {
+				continue
+			}
+		}
+		users = append(users, u)
+	}
+
+	sort.Slice(users, func(i, j int) bool {
+		if query.Order == "desc" {
+			return less(&users[j], &users[i])
+		}
+		return less(&users[i], &users[j])
+	})
+
+	users = users[min(query.Offset, len(users)):]
+	if len(users) > query.Limit+1 {
+		users = users[:query.Limit+1]
+	}
+	return users, nil
+}
+
+func (m *MockUserRepository) Count(ctx context.Context, query *model.UserQuery) (int64, error) {
+	q := *query
+	q.Limit, q.Offset, q.After = len(m.Users), 0, nil
+	users, err := m.GetAll(ctx, &q)
+	return int64(len(users)), err
+}
+
+// find returns the index of the first user matching the predicate, -1 if
+// there is none.
+func (m *MockUserRepository) find(deleted bool, match func(u *model.User) bool) int {
+	for i, u := range m.Users {
+		if (u.DeletedAt != nil) == deleted && match(&u) {
+			return i
 		}
 	}
+	return -1
+}
+
+func (m *MockUserRepository) get(match func(u *model.User) bool) (*model.User, error) {
+	if i := m.find(false, match); i >= 0 {
+		u := m.Users[i]
+		return &u, nil
+	}
 	return nil, validation.ErrUserNotFound
 }
 
+func (m *MockUserRepository) GetByUsername(_ context.Context, username string) (*model.User, error) {
+	return m.get(func(u *model.User) bool { return u.Username == username })
+}
+
 func (m *MockUserRepository) GetByID(_ context.Context, id int64) (*model.User, error) {
+	return m.get(func(u *model.User) bool { return u.ID == id })
+}
+
+func (m *MockUserRepository) GetByUUID(_ context.Context, uuid string) (*model.User, error) {
+	return m.get(func(u *model.User) bool { return u.UUID == uuid })
+}
+
+func (m *MockUserRepository) conflict(user *model.User) error {
 	for _, u := range m.Users {
-		if u.ID == id {
-			return &u, nil
+		if u.ID == user.ID || u.DeletedAt != nil {
+			continue
+		}
+		if u.Username == user.Username {
+			return validation.ErrConflict{Field: "username"}
+		}
+		if u.Email == user.Email {
+			return validation.ErrConflict{Field: "email"}
 		}
 	}
-	return nil, validation.ErrUserNotFound
+	return nil
 }
 
 func (m *MockUserRepository) Post(_ context.Context, user *model.User) (int64, error) {
+	user.ID = 0
+	if err := m.conflict(user); err != nil {
+		return 0, err
+	}
 	m.counter++
 	user.ID = m.counter
-	m.Users = append(m.Users, *user)
+	user.UUID = testUUID(m.counter)
+	user.CreatedAt = testTime.Add(time.Duration(m.counter) * time.Minute)
+	user.UpdatedAt = user.CreatedAt
+
+	stored := *user
+	stored.Version = 1
+	m.Users = append(m.Users, stored)
 	return user.ID, nil
 }
 
-func (m *MockUserRepository) Patch(_ context.Context, user *model.User) error {
-	fmt.Println(user)
-	for i, u := range m.Users {
-		if u.ID == user.ID {
-			m.Users[i] = *user
-			return nil
+func (m *MockUserRepository) Patch(_ context.Context, id, version int64, changes map[string]any) (int64, error) {
+	i := m.find(false, func(u *model.User) bool { return u.ID == id })
+	if i < 0 || version != 0 && version != m.Users[i].Version {
+		if version != 0 {
+			return 0, validation.ErrPreconditionFailed
 		}
+		return 0, validation.ErrUserNotFound
 	}
-	return validation.ErrUserNotFound
-}
 
-func (m *MockUserRepository) Delete(_ context.Context, id int64) error {
-	for i, u := range m.Users {
-		if u.ID == id {
-			m.Users = append(m.Users[:i], m.Users[i+1:]...)
-			break
+	u := m.Users[i]
+	for column, value := range changes {
+		switch column {
+		case "username":
+			u.Username = value.(string)
+		case "email":
+			u.Email = value.(string)
+		case "full_name":
+			u.FullName = value.(string)
 		}
 	}
-	return nil
+	if err := m.conflict(&u); err != nil {
+		return 0, err
+	}
+	touch(&u)
+	m.Users[i] = u
+	return u.Version, nil
 }
 
-const testApiKey = "testApiKey"
-
-var (
-	user1 = model.User{ID: 1, Username: "jdoe", Email: "jdoe@example.com", FullName: "John Doe"}
-	user2 = model.User{ID: 2, Username: "asmith", Email: "asmith@example.com", FullName: "Alice Smith"}
-	user3 = model.User{ID: 3, Username: "bjones", Email: "bjones@example.com", FullName: "Bob Jones"}
-)
-
-func insertTestUser(mock *MockUserRepository, user *model.User) {
-	_, _ = mock.Post(context.Background(), user)
+func (m *MockUserRepository) Delete(_ context.Context, id, version int64) (*model.User, error) {
+	return m.delete(func(u *model.User) bool { return u.ID == id }, version)
 }
 
-func userExists(mock *MockUserRepository, id int64) bool {
-	_, err := mock.GetByID(context.Background(), id)
-	return err == nil
+func (m *MockUserRepository) DeleteByUUID(_ context.Context, uuid string, version int64) (*model.User, error) {
+	return m.delete(func(u *model.User) bool { return u.UUID == uuid }, version)
 }
 
-func requester(method, url string, body any, mockRepo repository.UserRepository) *httptest.ResponseRecorder {
-	gin.SetMode(gin.TestMode)
+func (m *MockUserRepository) delete(match func(u *model.User) bool, version int64) (*model.User, error) {
+	i := m.find(false, match)
+	if i < 0 || version != 0 && version != m.Users[i].Version {
+		if version != 0 {
+			return nil, validation.ErrPreconditionFailed
+		}
+		return nil, nil
+	}
 
-	repositories := &repository.Repository{Users: mockRepo}
-	services := service.NewService(repositories)
-	controllers := controller.NewController(services)
+	now := time.Now()
+	m.Users[i].DeletedAt = &now
+	touch(&m.Users[i])
+	u := m.Users[i]
+	return &u, nil
+}
 
-	r := gin.Default()
-	router := New(r, testApiKey, controllers.Users)
+func (m *MockUserRepository) Restore(_ context.Context, id int64) (*model.User, error) {
+	return m.restore(func(u *model.User) bool { return u.ID == id })
+}
 
-	var reader io.Reader
-	if body != nil {
-		data, _ := json.Marshal(body)
-		reader = bytes.NewReader(data)
+func (m *MockUserRepository) RestoreByUUID(_ context.Context, uuid string) (*model.User, error) {
+	return m.restore(func(u *model.User) bool { return u.UUID == uuid })
+}
+
+func (m *MockUserRepository) restore(match func(u *model.User) bool) (*model.User, error) {
+	i := m.find(true, match)
+	if i < 0 {
+		return nil, validation.ErrUserNotFound
 	}
 
-	req, _ := http.NewRequest(method, url, reader)
-	req.Header.Set("x-api-key", testApiKey)
-	rr := httptest.NewRecorder()
-	router.ServeHTTP(rr, req)
+	if err := m.conflict(&m.Users[i]); err != nil {
+		return nil, err
+	}
 
-	return rr
+	m.Users[i].DeletedAt = nil
+	touch(&m.Users[i])
+	u := m.Users[i]
+	return &u, nil
 }
 
-func TestGetAllUsers(t *testing.T) {
-	mockRepo := new(MockUserRepository)
-
-	insertTestUser(mockRepo, &user1)
-	insertTestUser(mockRepo, &user2)
-	insertTestUser(mockRepo, &user3)
-
-	rr := requester(http.MethodGet, "/api/v1/users/", nil, mockRepo)
+func (m *MockUserRepository) Purge(_ context.Context, retention time.Duration) (int64, error) {
+	var (
+		n     int64
+		users []model.User
+	)
+	for _, u := range m.Users {
+		if u.DeletedAt != nil && time.Since(*u.DeletedAt) > retention {
+			n++
+			continue
+		}
+		users = append(users, u)
+	}
+	m.Users = users
+	return n, nil
+}
 
-	if rr.Code != http.StatusOK {
-		t.Errorf("expected status 200, got %d", rr.Code)
+func (m *MockUserRepository) GetByUsernamesOrEmails(_ context.Context, usernames, emails []string) ([]model.User, error) {
+	if m.Err != nil {
+		return nil, m.Err
 	}
 
 	var users []model.User
-	if err := json.Unmarshal(rr.Body.Bytes(), &users); err != nil {
-		t.Fatalf("failed to unmarshal response: %v", err)
+	for _, u := range m.Users {
+		if u.DeletedAt == nil && (slices.Contains(usernames, u.Username) || slices.Contains(emails, u.Email)) {
+			users = append(users, u)
+		}
 	}
+	return users, nil
+}
 
-	if len(users) != 3 {
-		t.Errorf("expected 3 users, got %d", len(users))
+func (m *MockUserRepository) Import(ctx context.Context, create, update []model.User) error {
+	for _, u := range update {
+		changes := map[string]any{"email": u.Email, "full_name": u.FullName}
+		if _, err := m.Patch(ctx, u.ID, 0, changes); err != nil {
+			return err
+		}
 	}
+	for _, u := range create {
+		if _, err := m.Post(ctx, &u); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-func TestGetUserByUsername(t *testing.T) {
-	mockRepo := new(MockUserRepository)
+func (m *MockUserRepository) Export(ctx context.Context, query *model.UserQuery, fn func(user *model.User) error) error {
+	q := *query
+	q.Limit, q.After = len(m.Users), nil
+	users, err := m.GetAll(ctx, &q)
+	if err != nil {
+		return err
+	}
+	for i := range users {
+		if err = fn(&users[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	insertTestUser(mockRepo, &user1)
+// Search emulates pg_trgm: the score is the best similarity of the trigrams
+// of the query and of any field.
+func (m *MockUserRepository) Search(_ context.Context, search *model.UserSearch) ([]model.UserMatch, error) {
+	if m.Err != nil {
+		return nil, m.Err
+	}
 
-	tests := []struct {
-		name    string
-		url     string
-		expCode int
-	}{
-		{
-			name:    "success",
-			url:     "/api/v1/users/username/jdoe",
-			expCode: http.StatusOK,
-		},
-		{
-			name:    "user not found",
-			url:     "/api/v1/users/username/asmith",
-			expCode: http.StatusNotFound,
-		},
-		{
-			name:    "bad request",
-			url:     "/api/v1/users/username/a",
-			expCode: http.StatusBadRequest,
-		},
+	var matches []model.UserMatch
+	for _, u := range m.Users {
+		if u.DeletedAt != nil {
+			continue
+		}
+		score := max(similarity(u.Username, search.Q), similarity(u.Email, search.Q), similarity(u.FullName, search.Q))
+		if score >= 0.3 {
+			matches = append(matches, model.UserMatch{User: u, Score: score})
+		}
 	}
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			rr := requester(http.MethodGet, tt.url, nil, mockRepo)
 
-			if rr.Code != tt.expCode {
-				t.Errorf("expected status %d, got %d", tt.expCode, rr.Code)
+	sort.SliceStable(matches, func(i, j int) bool { return matches[i].Score > matches[j].Score })
+	if len(matches) > search.Limit {
+		matches = matches[:search.Limit]
+	}
+	return matches, nil
+}
+
+func similarity(a, b string) float64 {
+	trigrams := func(s string) map[string]bool {
+		t := make(map[string]bool)
+		for _, word := range strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+		}) {
+			padded := "  " + word + " "
+			for i := 0; i+3 <= len(padded); i++ {
+				t[padded[i:i+3]] = true
 			}
+		}
+		return t
+	}
 
-			if tt.expCode == http.StatusOK {
-				var user model.User
-				if err := json.Unmarshal(rr.Body.Bytes(), &user); err != nil {
-					t.Fatalf("failed to unmarshal response: %v", err)
-				}
+	ta, tb := trigrams(a), trigrams(b)
+	var common int
+	for t := range ta {
+		if tb[t] {
+			common++
+		}
+	}
+	if total := len(ta) + len(tb) - common; total > 0 {
+		return float64(common) / float64(total)
+	}
+	return 0
+}
 
-				if !reflect.DeepEqual(user, user1) {
-					t.Errorf("expected %v users, got %v", user1, user)
-				}
+// WithTx emulates a transaction by restoring a snapshot of the users, the
+// events, the audit entries and the deliveries if fn fails.
+func (m *MockUserRepository) WithTx(_ context.Context, fn func(repo repository.UserRepository) error) error {
+	counter, users := m.counter, append([]model.User(nil), m.Users...)
+	m.mu.Lock()
+	events, entries := len(m.Events), len(m.Audit)
+	m.mu.Unlock()
+	var deliveries int
+	if m.Webhooks != nil {
+		deliveries = m.Webhooks.deliveries()
+	}
 
-			}
-		})
+	if err := fn(m); err != nil {
+		m.counter, m.Users = counter, users
+		m.mu.Lock()
+		m.Events, m.Audit = m.Events[:events], m.Audit[:entries]
+		m.mu.Unlock()
+		if m.Webhooks != nil {
+			m.Webhooks.truncate(deliveries)
+		}
+		return err
 	}
+	return nil
 }
 
-func TestGetUserByID(t *testing.T) {
-	mockRepo := new(MockUserRepository)
-
-	insertTestUser(mockRepo, &user1)
+func (m *MockUserRepository) AppendEvent(_ context.Context, event *model.UserEvent) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 
-	tests := []struct {
-		name    string
-		url     string
-		expCode int
-	}{
-		{
-			name:    "success",
-			url:     "/api/v1/users/id/1",
-			expCode: http.StatusOK,
-		},
-		{
-			name:    "user not found",
-			url:     "/api/v1/users/id/2",
-			expCode: http.StatusNotFound,
-		},
-		{
-			name:    "bad request",
-			url:     "/api/v1/users/id/0",
-			expCode: http.StatusBadRequest,
-		},
+	event.ID = int64(len(m.Events) + 1)
+	event.CreatedAt = testTime
+	m.Events = append(m.Events, *event)
+	if m.Webhooks != nil {
+		m.Webhooks.enqueue(event)
 	}
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			rr := requester(http.MethodGet, tt.url, nil, mockRepo)
-
-			if rr.Code != tt.expCode {
-				t.Errorf("expected status %d, got %d", tt.expCode, rr.Code)
-			}
+	return nil
+}
 
-			if tt.expCode == http.StatusOK {
-				var user model.User
-				if err := json.Unmarshal(rr.Body.Bytes(), &user); err != nil {
-					t.Fatalf("failed to unmarshal response: %v", err)
-				}
+func (m *MockUserRepository) GetEvents(_ context.Context, after int64, limit int) ([]model.UserEvent, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 
-				if !reflect.DeepEqual(user, user1) {
-					t.Errorf("expected %v users, got %v", user1, user)
-				}
+	start := min(int(max(after, 0)), len(m.Events))
+	return slices.Clone(m.Events[start:min(start+limit, len(m.Events))]), nil
+}
 
-			}
-		})
-	}
+func (m *MockUserRepository) LastEventID(_ context.Context) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return int64(len(m.Events)), nil
 }
 
-func TestPostUser(t *testing.T) {
-	mockRepo := new(MockUserRepository)
+func (m *MockUserRepository) PurgeEvents(_ context.Context, _ time.Duration) (int64, error) {
+	return 0, nil
+}
 
-	rr := requester(http.MethodPost, "/api/v1/users/", user1, mockRepo)
+// AppendAudit chains the entry like the database does. The entries are
+// created at testTime, which is the same for all of them.
+func (m *MockUserRepository) AppendAudit(_ context.Context, entry *model.AuditEntry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 
-	if rr.Code != http.StatusOK {
-		t.Errorf("expected status 200, got %d", rr.Code)
+	entry.PrevHash = model.AuditGenesis
+	if n := len(m.Audit); n > 0 {
+		entry.PrevHash = m.Audit[n-1].Hash
 	}
+	entry.ID = int64(len(m.Audit) + 1)
+	entry.CreatedAt = testTime
+	entry.Hash = entry.ComputeHash()
+	m.Audit = append(m.Audit, *entry)
+	return nil
+}
 
-	var id struct{ ID int64 }
-	if err := json.Unmarshal(rr.Body.Bytes(), &id); err != nil {
-		t.Fatalf("failed to unmarshal response: %v", err)
+func (m *MockUserRepository) GetAudit(_ context.Context, query *model.AuditQuery) ([]model.AuditEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var entries []model.AuditEntry
+	for i := len(m.Audit) - 1; i >= 0 && len(entries) < query.Limit; i-- {
+		e := m.Audit[i]
+		if query.ID != 0 && e.UserID != query.ID || query.UUID != "" && e.UserUUID != query.UUID ||
+			query.Actor != "" && e.Actor != query.Actor || query.Since != nil && e.CreatedAt.Before(*query.Since) ||
+			query.Before != 0 && e.ID >= query.Before {
+			continue
+		}
+		entries = append(entries, e)
 	}
+	return entries, nil
+}
 
-	rr = requester(http.MethodGet, fmt.Sprintf("/api/v1/users/id/%d", id.ID), nil, mockRepo)
+// WalkAudit round-trips the entries through JSON like the database does.
+func (m *MockUserRepository) WalkAudit(_ context.Context, fn func(entry *model.AuditEntry) error) error {
+	m.mu.Lock()
+	data, _ := json.Marshal(m.Audit)
+	m.mu.Unlock()
 
-	if rr.Code != http.StatusOK {
-		t.Errorf("expected status 200, got %d", rr.Code)
+	var entries []model.AuditEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return err
 	}
-
-	var user model.User
-	if err := json.Unmarshal(rr.Body.Bytes(), &user); err != nil {
-		t.Fatalf("failed to unmarshal response: %v", err)
+	for i := range entries {
+		if err := fn(&entries[i]); err != nil {
+			return err
+		}
 	}
+	return nil
+}
 
-	if !reflect.DeepEqual(user, user1) {
-		t.Errorf("expected %v users, got %v", user1, user)
+// testTime is the creation time of the first mock user. Every further user
+// is created a minute later, and every change happens an hour later.
+var testTime = time.Date(2025, 9, 23, 8, 43, 49, 0, time.UTC)
+
+// touch emulates the users_set_updated_at trigger.
+func touch(u *model.User) {
+	u.UpdatedAt = u.UpdatedAt.Add(time.Hour)
+	u.Version++
+}
+
+func testUUID(id int64) string {
+	return fmt.Sprintf("00000000-0000-4000-8000-%012d", id)
+}
+
+type MockIdempotencyRepository struct {
+	Records map[string]model.IdempotencyRecord
+}
+
+func (m *MockIdempotencyRepository) Reserve(_ context.Context, key, fingerprint string, _ time.Duration) (*model.IdempotencyRecord, error) {
+	if rec, ok := m.Records[key]; ok {
+		return &rec, nil
 	}
+	if m.Records == nil {
+		m.Records = make(map[string]model.IdempotencyRecord)
+	}
+	m.Records[key] = model.IdempotencyRecord{Key: key, Fingerprint: fingerprint}
+	return nil, nil
 }
 
-func TestPatchUser(t *testing.T) {
-	mockRepo := new(MockUserRepository)
+func (m *MockIdempotencyRepository) Complete(_ context.Context, record *model.IdempotencyRecord) error {
+	m.Records[record.Key] = *record
+	return nil
+}
 
-	insertTestUser(mockRepo, &user1)
+func (m *MockIdempotencyRepository) Release(_ context.Context, key string) error {
+	delete(m.Records, key)
+	return nil
+}
+
+func (m *MockIdempotencyRepository) DeleteExpired(_ context.Context) (int64, error) {
+	return 0, nil
+}
+
+// MockWebhookRepository keeps the webhooks and their deliveries. The
+// deliveries are sent by the dispatcher concurrently.
+type MockWebhookRepository struct {
+	mu         sync.Mutex
+	Webhooks   []model.Webhook
+	Deliveries []mockDelivery
+}
+
+type mockDelivery struct {
+	model.WebhookDelivery
+	webhookID int64
+	event     model.UserEvent
+	claimed   bool
+}
+
+func (m *MockWebhookRepository) enqueue(event *model.UserEvent) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, w := range m.Webhooks {
+		if !w.Active || len(w.Events) > 0 && !slices.Contains(w.Events, event.Type) {
+			continue
+		}
+		m.Deliveries = append(m.Deliveries, mockDelivery{
+			WebhookDelivery: model.WebhookDelivery{
+				ID:        int64(len(m.Deliveries) + 1),
+				EventID:   event.ID,
+				EventType: event.Type,
+				Status:    model.DeliveryPending,
+				CreatedAt: testTime,
+				UpdatedAt: testTime,
+			},
+			webhookID: w.ID,
+			event:     *event,
+		})
+	}
+}
+
+func (m *MockWebhookRepository) deliveries() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.Deliveries)
+}
+
+func (m *MockWebhookRepository) truncate(n int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.Deliveries = m.Deliveries[:n]
+}
+
+func (m *MockWebhookRepository) GetAll(_ context.Context) ([]model.Webhook, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	webhooks := slices.Clone(m.Webhooks)
+	for i := range webhooks {
+		webhooks[i].Secret = ""
+	}
+	return webhooks, nil
+}
+
+func (m *MockWebhookRepository) GetByUUID(_ context.Context, uuid string) (*model.Webhook, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, w := range m.Webhooks {
+		if w.UUID == uuid {
+			w.Secret = ""
+			return &w, nil
+		}
+	}
+	return nil, validation.ErrWebhookNotFound
+}
+
+func (m *MockWebhookRepository) Post(_ context.Context, webhook *model.Webhook) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	webhook.ID = int64(len(m.Webhooks) + 1)
+	webhook.UUID = fmt.Sprintf("00000000-0000-4000-9000-%012d", webhook.ID)
+	webhook.CreatedAt, webhook.UpdatedAt = testTime, testTime
+	m.Webhooks = append(m.Webhooks, *webhook)
+	return nil
+}
+
+func (m *MockWebhookRepository) Update(_ context.Context, webhook *model.Webhook) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i := range m.Webhooks {
+		if w := &m.Webhooks[i]; w.ID == webhook.ID {
+			webhook.UpdatedAt = w.UpdatedAt.Add(time.Hour)
+			w.URL, w.Events, w.Active, w.UpdatedAt = webhook.URL, webhook.Events, webhook.Active, webhook.UpdatedAt
+			return nil
+		}
+	}
+	return validation.ErrWebhookNotFound
+}
+
+func (m *MockWebhookRepository) Delete(_ context.Context, uuid string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i, w := range m.Webhooks {
+		if w.UUID == uuid {
+			m.Webhooks = slices.Delete(m.Webhooks, i, i+1)
+			m.Deliveries = slices.DeleteFunc(m.Deliveries, func(d mockDelivery) bool { return d.webhookID == w.ID })
+			return nil
+		}
+	}
+	return validation.ErrWebhookNotFound
+}
+
+func (m *MockWebhookRepository) GetDeliveries(_ context.Context, webhookID int64, query *model.DeliveryQuery) ([]model.WebhookDelivery, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var deliveries []model.WebhookDelivery
+	for i := len(m.Deliveries) - 1; i >= 0 && len(deliveries) < query.Limit; i-- {
+		d := m.Deliveries[i]
+		if d.webhookID != webhookID || query.Status != "" && d.Status != query.Status || query.Before != 0 && d.ID >= query.Before {
+			continue
+		}
+		d.History = nil
+		deliveries = append(deliveries, d.WebhookDelivery)
+	}
+	return deliveries, nil
+}
+
+func (m *MockWebhookRepository) GetDelivery(_ context.Context, webhookID, id int64) (*model.WebhookDelivery, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, d := range m.Deliveries {
+		if d.webhookID == webhookID && d.ID == id {
+			return &d.WebhookDelivery, nil
+		}
+	}
+	return nil, validation.ErrDeliveryNotFound
+}
+
+func (m *MockWebhookRepository) Redeliver(ctx context.Context, webhookID, id int64) (*model.WebhookDelivery, error) {
+	m.mu.Lock()
+	for i := range m.Deliveries {
+		if d := &m.Deliveries[i]; d.webhookID == webhookID && d.ID == id {
+			d.Status, d.Attempts = model.DeliveryPending, 0
+		}
+	}
+	m.mu.Unlock()
+	return m.GetDelivery(ctx, webhookID, id)
+}
+
+// Claim ignores the backoff, so every pending delivery is due.
+func (m *MockWebhookRepository) Claim(_ context.Context, limit int, _ time.Duration) ([]model.WebhookMessage, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var messages []model.WebhookMessage
+	for i := range m.Deliveries {
+		d := &m.Deliveries[i]
+		if len(messages) == limit || d.Status != model.DeliveryPending || d.claimed {
+			continue
+		}
+		w := m.Webhooks[slices.IndexFunc(m.Webhooks, func(w model.Webhook) bool { return w.ID == d.webhookID })]
+		if !w.Active {
+			continue
+		}
+		d.claimed = true
+		messages = append(messages, model.WebhookMessage{DeliveryID: d.ID, Attempts: d.Attempts, URL: w.URL, Secret: w.Secret, Event: d.event})
+	}
+	return messages, nil
+}
+
+func (m *MockWebhookRepository) RecordAttempt(_ context.Context, id int64, attempt *model.WebhookAttempt, status string, _ time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	d := &m.Deliveries[slices.IndexFunc(m.Deliveries, func(d mockDelivery) bool { return d.ID == id })]
+	attempt.CreatedAt = testTime
+	d.History = append(d.History, *attempt)
+	d.Attempts++
+	d.Status, d.claimed = status, false
+	return nil
+}
+
+// MockAPIKeyRepository keeps the salt and hash of the keys, which it only
+// returns by prefix like the repository.
+type MockAPIKeyRepository struct {
+	mu   sync.Mutex
+	Keys []model.APIKey
+}
+
+func (m *MockAPIKeyRepository) GetAll(_ context.Context) ([]model.APIKey, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var keys []model.APIKey
+	for _, k := range m.Keys {
+		k.Salt, k.Hash = nil, nil
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
+
+func (m *MockAPIKeyRepository) find(match func(k *model.APIKey) bool) *model.APIKey {
+	if i := slices.IndexFunc(m.Keys, func(k model.APIKey) bool { return match(&k) }); i >= 0 {
+		return &m.Keys[i]
+	}
+	return nil
+}
+
+func (m *MockAPIKeyRepository) GetByUUID(_ context.Context, uuid string) (*model.APIKey, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if k := m.find(func(k *model.APIKey) bool { return k.UUID == uuid }); k != nil {
+		key := *k
+		key.Salt, key.Hash = nil, nil
+		return &key, nil
+	}
+	return nil, validation.ErrAPIKeyNotFound
+}
+
+func (m *MockAPIKeyRepository) GetByPrefix(_ context.Context, prefix string) (*model.APIKey, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if k := m.find(func(k *model.APIKey) bool { return k.Prefix == prefix }); k != nil {
+		key := *k
+		return &key, nil
+	}
+	return nil, validation.ErrAPIKeyNotFound
+}
+
+func (m *MockAPIKeyRepository) Post(_ context.Context, key *model.APIKey) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.post(key)
+	return nil
+}
+
+func (m *MockAPIKeyRepository) post(key *model.APIKey) {
+	key.ID = int64(len(m.Keys) + 1)
+	key.UUID = testUUID(1000 + key.ID)
+	key.CreatedAt = testTime
+	stored := *key
+	stored.Key = ""
+	m.Keys = append(m.Keys, stored)
+}
+
+func (m *MockAPIKeyRepository) Rotate(_ context.Context, id int64, expiresAt time.Time, replacement *model.APIKey) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	k := m.find(func(k *model.APIKey) bool { return k.ID == id })
+	if k.ExpiresAt == nil || expiresAt.Before(*k.ExpiresAt) {
+		k.ExpiresAt = &expiresAt
+	}
+	m.post(replacement)
+	return nil
+}
+
+func (m *MockAPIKeyRepository) Revoke(_ context.Context, uuid string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	k := m.find(func(k *model.APIKey) bool { return k.UUID == uuid })
+	if k == nil {
+		return validation.ErrAPIKeyNotFound
+	}
+	if k.RevokedAt == nil {
+		now := time.Now()
+		k.RevokedAt = &now
+	}
+	return nil
+}
+
+func (m *MockAPIKeyRepository) Touch(_ context.Context, id int64, interval time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	k := m.find(func(k *model.APIKey) bool { return k.ID == id })
+	if now := time.Now(); k.LastUsedAt == nil || k.LastUsedAt.Before(now.Add(-interval)) {
+		k.LastUsedAt = &now
+	}
+	return nil
+}
+
+type MockRoleRepository struct {
+	mu          sync.Mutex
+	Assignments []model.RoleAssignment
+}
+
+func (m *MockRoleRepository) GetAssignments(_ context.Context, principal string) ([]model.RoleAssignment, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var assignments []model.RoleAssignment
+	for _, a := range m.Assignments {
+		if principal == "" || a.Principal == principal {
+			assignments = append(assignments, a)
+		}
+	}
+	return assignments, nil
+}
+
+func (m *MockRoleRepository) Assign(_ context.Context, assignment *model.RoleAssignment) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, a := range m.Assignments {
+		if a.Principal == assignment.Principal && a.Role == assignment.Role {
+			assignment.CreatedAt = a.CreatedAt
+			return nil
+		}
+	}
+	assignment.CreatedAt = time.Now()
+	m.Assignments = append(m.Assignments, *assignment)
+	return nil
+}
+
+func (m *MockRoleRepository) Unassign(_ context.Context, principal, role string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i, a := range m.Assignments {
+		if a.Principal == principal && a.Role == role {
+			m.Assignments = append(m.Assignments[:i], m.Assignments[i+1:]...)
+			return nil
+		}
+	}
+	return validation.ErrRoleAssignmentNotFound
+}
+
+const (
+	testApiKey    = "testApiKey"
+	testSCIMToken = "testSCIMToken"
+
+	// The tokens are signed by testdata/jwt_key.pem.
+	testJWKS     = "testdata/jwks.json"
+	testIssuer   = "https://gateway.example.com"
+	testAudience = "cruder"
+)
+
+var (
+	user1 = model.User{ID: 1, Username: "jdoe", Email: "jdoe@example.com", FullName: "John Doe"}
+	user2 = model.User{ID: 2, Username: "asmith", Email: "asmith@example.com", FullName: "Alice Smith"}
+	user3 = model.User{ID: 3, Username: "bjones", Email: "bjones@example.com", FullName: "Bob Jones"}
+)
+
+func insertTestUser(mock *MockUserRepository, user *model.User) {
+	_, _ = mock.Post(context.Background(), user)
+}
+
+func userExists(mock *MockUserRepository, id int64) bool {
+	_, err := mock.GetByID(context.Background(), id)
+	return err == nil
+}
+
+func newRouter(mockRepo repository.UserRepository) *gin.Engine {
+	return newRouterWith(mockRepo, new(MockIdempotencyRepository))
+}
+
+func newRouterWith(mockRepo repository.UserRepository, mockIdempotency repository.IdempotencyRepository) *gin.Engine {
+	return newRouterWithRepositories(&repository.Repository{Users: mockRepo, Idempotency: mockIdempotency})
+}
+
+func newRouterWithRepositories(repositories *repository.Repository) *gin.Engine {
+	return newRouterWithLimits(repositories, RateLimits{})
+}
+
+func newRouterWithLimits(repositories *repository.Repository, limits RateLimits) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+
+	if repositories.APIKeys == nil {
+		repositories.APIKeys = new(MockAPIKeyRepository)
+	}
+	if repositories.Roles == nil {
+		repositories.Roles = new(MockRoleRepository)
+	}
+	services := service.NewService(repositories)
+	controllers := controller.NewController(services)
+	authenticator := auth.WithRoles(auth.Chain(
+		auth.APIKey(auth.Keys(auth.StaticKey(testApiKey), services.APIKeys)),
+		auth.NewJWT(auth.NewJWKS(testJWKS, time.Hour), auth.JWTConfig{
+			Issuer:   testIssuer,
+			Audience: testAudience,
+			Scopes:   map[string]string{"users.read": model.ScopeUsersRead},
+		}),
+	), services.Roles, model.RoleReadOnly)
+
+	r := gin.Default()
+	return New(r, authenticator, testSCIMToken, middleware.Idempotency(repositories.Idempotency, time.Hour), limits, controllers)
+}
+
+func requester(method, url string, body any, mockRepo repository.UserRepository) *httptest.ResponseRecorder {
+	router := newRouter(mockRepo)
+
+	var reader io.Reader
+	if body != nil {
+		data, _ := json.Marshal(body)
+		reader = bytes.NewReader(data)
+	}
+
+	req, _ := http.NewRequest(method, url, reader)
+	req.Header.Set("x-api-key", testApiKey)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	return rr
+}
+
+func TestGetAllUsers(t *testing.T) {
+	mockRepo := new(MockUserRepository)
+
+	insertTestUser(mockRepo, &user1)
+	insertTestUser(mockRepo, &user2)
+	insertTestUser(mockRepo, &user3)
 
 	tests := []struct {
-		name    string
-		url     string
-		body    map[string]any
-		expCode int
+		name     string
+		url      string
+		expCode  int
+		expIDs   []int64
+		expMore  bool
+		nextPage []int64
 	}{
 		{
 			name:    "success",
-			url:     "/api/v1/users/1",
-			body:    map[string]any{"full_name": "John Doe Jr."},
-			expCode: http.StatusNoContent,
+			url:     "/api/v1/users/",
+			expCode: http.StatusOK,
+			expIDs:  []int64{1, 2, 3},
 		},
 		{
-			name:    "user not found",
-			url:     "/api/v1/users/2",
-			expCode: http.StatusNotFound,
+			name:     "paginated",
+			url:      "/api/v1/users/?limit=2",
+			expCode:  http.StatusOK,
+			expIDs:   []int64{1, 2},
+			expMore:  true,
+			nextPage: []int64{3},
 		},
 		{
-			name:    "bad request",
-			url:     "/api/v1/users/1",
-			body:    map[string]any{"email": ""},
+			name:     "sorted by username desc",
+			url:      "/api/v1/users/?limit=1&sort=username&order=desc",
+			expCode:  http.StatusOK,
+			expIDs:   []int64{1},
+			expMore:  true,
+			nextPage: []int64{3},
+		},
+		{
+			name:    "filtered by username prefix",
+			url:     "/api/v1/users/?username_prefix=as",
+			expCode: http.StatusOK,
+			expIDs:  []int64{2},
+		},
+		{
+			name:    "filtered by email domain",
+			url:     "/api/v1/users/?email_domain=EXAMPLE.com",
+			expCode: http.StatusOK,
+			expIDs:  []int64{1, 2, 3},
+		},
+		{
+			name:     "sorted by created_at desc",
+			url:      "/api/v1/users/?limit=2&sort=created_at&order=desc",
+			expCode:  http.StatusOK,
+			expIDs:   []int64{3, 2},
+			expMore:  true,
+			nextPage: []int64{1},
+		},
+		{
+			name:    "filtered by created_after with an offset",
+			url:     "/api/v1/users/?created_after=2025-09-23T10:45:00%2B02:00",
+			expCode: http.StatusOK,
+			expIDs:  []int64{2, 3},
+		},
+		{
+			name:    "filtered by updated_after",
+			url:     "/api/v1/users/?sort=updated_at&updated_after=2025-09-23T08:45:00Z",
+			expCode: http.StatusOK,
+			expIDs:  []int64{2, 3},
+		},
+		{
+			name:    "filtered by updated_at with an offset",
+			url:     "/api/v1/users/?updated_after=2025-09-23T10:44:00%2B02:00&updated_before=2025-09-23T04:16:00-04:30",
+			expCode: http.StatusOK,
+			expIDs:  []int64{1, 2},
+		},
+		{
+			name:    "invalid limit",
+			url:     "/api/v1/users/?limit=1001",
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:    "invalid sort",
+			url:     "/api/v1/users/?sort=full_name",
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:    "invalid cursor",
+			url:     "/api/v1/users/?cursor=abc",
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:    "invalid date",
+			url:     "/api/v1/users/?created_after=yesterday",
 			expCode: http.StatusBadRequest,
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			rr := requester(http.MethodPatch, tt.url, tt.body, mockRepo)
+			rr := requester(http.MethodGet, tt.url, nil, mockRepo)
 
 			if rr.Code != tt.expCode {
-				t.Errorf("expected status %d, got %d", tt.expCode, rr.Code)
+				t.Fatalf("expected status %d, got %d", tt.expCode, rr.Code)
 			}
 
-			if tt.expCode == http.StatusNoContent {
-				rr = requester(http.MethodGet, "/api/v1/users/id/1", nil, mockRepo)
+			if tt.expCode != http.StatusOK {
+				return
+			}
 
-				var user model.User
-				if err := json.Unmarshal(rr.Body.Bytes(), &user); err != nil {
-					t.Fatalf("failed to unmarshal response: %v", err)
-				}
+			page := unmarshalPage(t, rr)
+			if ids := pageIDs(page); !reflect.DeepEqual(ids, tt.expIDs) {
+				t.Errorf("expected %v users, got %v", tt.expIDs, ids)
+			}
 
-				if user.FullName != "John Doe Jr." {
-					t.Errorf("expected %v user full_name, got %v", "John Doe Jr.", user.FullName)
-				}
+			if page.HasMore != tt.expMore {
+				t.Errorf("expected has_more %v, got %v", tt.expMore, page.HasMore)
+			}
+
+			if !page.HasMore {
+				return
+			}
+
+			rr = requester(http.MethodGet, tt.url+"&cursor="+page.NextCursor, nil, mockRepo)
+			if rr.Code != http.StatusOK {
+				t.Fatalf("expected status 200, got %d", rr.Code)
+			}
+
+			page = unmarshalPage(t, rr)
+			if ids := pageIDs(page); !reflect.DeepEqual(ids, tt.nextPage) {
+				t.Errorf("expected %v users on the next page, got %v", tt.nextPage, ids)
 			}
 		})
 	}
 }
 
-func TestDeleteUser(t *testing.T) {
-	mockRepo := new(MockUserRepository)
+func unmarshalPage(t *testing.T, rr *httptest.ResponseRecorder) model.UserPage {
+	var page model.UserPage
+	if err := json.Unmarshal(rr.Body.Bytes(), &page); err != nil {
+		t.Fatalf("failed to unmarshal response: %v", err)
+	}
+	return page
+}
 
-	insertTestUser(mockRepo, &user1)
+func pageIDs(page model.UserPage) []int64 {
+	ids := make([]int64, 0, len(page.Users))
+	for _, u := range page.Users {
+		ids = append(ids, u.ID)
+	}
+	return ids
+}
 
-	rr := requester(http.MethodDelete, "/api/v1/users/1", nil, mockRepo)
+func TestGetUserByUsername(t *testing.T) {
+	mockRepo := new(MockUserRepository)
 
-	if rr.Code != http.StatusNoContent {
-		t.Errorf("expected status 204, got %d", rr.Code)
-	}
+	insertTestUser(mockRepo, &user1)
 
-	if userExists(mockRepo, 1) {
-		t.Errorf("user was not deleted from the database")
-	}
+	tests := []struct {
+		name    string
+		url     string
+		expCode int
+	}{
+		{
+			name:    "success",
+			url:     "/api/v1/users/username/jdoe",
+			expCode: http.StatusOK,
+		},
+		{
+			name:    "user not found",
+			url:     "/api/v1/users/username/asmith",
+			expCode: http.StatusNotFound,
+		},
+		{
+			name:    "bad request",
+			url:     "/api/v1/users/username/a",
+			expCode: http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := requester(http.MethodGet, tt.url, nil, mockRepo)
+
+			if rr.Code != tt.expCode {
+				t.Errorf("expected status %d, got %d", tt.expCode, rr.Code)
+			}
+
+			if tt.expCode == http.StatusOK {
+				var user model.User
+				if err := json.Unmarshal(rr.Body.Bytes(), &user); err != nil {
+					t.Fatalf("failed to unmarshal response: %v", err)
+				}
+
+				if !reflect.DeepEqual(user, user1) {
+					t.Errorf("expected %v users, got %v", user1, user)
+				}
+
+			}
+		})
+	}
+}
+
+func TestGetUserByID(t *testing.T) {
+	mockRepo := new(MockUserRepository)
+
+	insertTestUser(mockRepo, &user1)
+
+	tests := []struct {
+		name    string
+		url     string
+		expCode int
+	}{
+		{
+			name:    "success",
+			url:     "/api/v1/users/id/1",
+			expCode: http.StatusOK,
+		},
+		{
+			name:    "user not found",
+			url:     "/api/v1/users/id/2",
+			expCode: http.StatusNotFound,
+		},
+		{
+			name:    "bad request",
+			url:     "/api/v1/users/id/0",
+			expCode: http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := requester(http.MethodGet, tt.url, nil, mockRepo)
+
+			if rr.Code != tt.expCode {
+				t.Errorf("expected status %d, got %d", tt.expCode, rr.Code)
+			}
+
+			if tt.expCode == http.StatusOK {
+				var user model.User
+				if err := json.Unmarshal(rr.Body.Bytes(), &user); err != nil {
+					t.Fatalf("failed to unmarshal response: %v", err)
+				}
+
+				if !reflect.DeepEqual(user, user1) {
+					t.Errorf("expected %v users, got %v", user1, user)
+				}
+
+			}
+		})
+	}
+}
+
+func TestGetUser(t *testing.T) {
+	mockRepo := new(MockUserRepository)
+
+	insertTestUser(mockRepo, &user1)
+
+	tests := []struct {
+		name          string
+		url           string
+		expCode       int
+		expDeprecated bool
+	}{
+		{
+			name:    "success",
+			url:     "/api/v1/users/" + testUUID(1),
+			expCode: http.StatusOK,
+		},
+		{
+			name:          "success by deprecated numeric id",
+			url:           "/api/v1/users/1",
+			expCode:       http.StatusOK,
+			expDeprecated: true,
+		},
+		{
+			name:    "user not found",
+			url:     "/api/v1/users/" + testUUID(2),
+			expCode: http.StatusNotFound,
+		},
+		{
+			name:    "bad request",
+			url:     "/api/v1/users/not-a-uuid",
+			expCode: http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := requester(http.MethodGet, tt.url, nil, mockRepo)
+
+			if rr.Code != tt.expCode {
+				t.Errorf("expected status %d, got %d", tt.expCode, rr.Code)
+			}
+
+			if deprecated := rr.Header().Get("Deprecation") != ""; deprecated != tt.expDeprecated {
+				t.Errorf("expected deprecation %v, got %v", tt.expDeprecated, deprecated)
+			}
+
+			if tt.expCode == http.StatusOK {
+				var user model.User
+				if err := json.Unmarshal(rr.Body.Bytes(), &user); err != nil {
+					t.Fatalf("failed to unmarshal response: %v", err)
+				}
+
+				if !reflect.DeepEqual(user, user1) {
+					t.Errorf("expected %v users, got %v", user1, user)
+				}
+			}
+		})
+	}
+}
+
+func TestPostUser(t *testing.T) {
+	mockRepo := new(MockUserRepository)
+
+	rr := requester(http.MethodPost, "/api/v1/users/", user1, mockRepo)
+
+	if rr.Code != http.StatusOK {
+		t.Errorf("expected status 200, got %d", rr.Code)
+	}
+
+	var id struct{ ID int64 }
+	if err := json.Unmarshal(rr.Body.Bytes(), &id); err != nil {
+		t.Fatalf("failed to unmarshal response: %v", err)
+	}
+
+	rr = requester(http.MethodGet, fmt.Sprintf("/api/v1/users/id/%d", id.ID), nil, mockRepo)
+
+	if rr.Code != http.StatusOK {
+		t.Errorf("expected status 200, got %d", rr.Code)
+	}
+
+	var user model.User
+	if err := json.Unmarshal(rr.Body.Bytes(), &user); err != nil {
+		t.Fatalf("failed to unmarshal response: %v", err)
+	}
+
+	if !reflect.DeepEqual(user, user1) {
+		t.Errorf("expected %v users, got %v", user1, user)
+	}
+}
+
+func TestPatchUser(t *testing.T) {
+	mockRepo := new(MockUserRepository)
+
+	insertTestUser(mockRepo, &user1)
+	insertTestUser(mockRepo, &user2)
+
+	tests := []struct {
+		name    string
+		url     string
+		body    map[string]any
+		expCode int
+		expErrs []string
+	}{
+		{
+			name:    "success",
+			url:     "/api/v1/users/" + testUUID(1),
+			body:    map[string]any{"full_name": "John Doe Jr."},
+			expCode: http.StatusNoContent,
+		},
+		{
+			name:    "success by deprecated numeric id",
+			url:     "/api/v1/users/1",
+			body:    map[string]any{"full_name": "John Doe Jr."},
+			expCode: http.StatusNoContent,
+		},
+		{
+			name:    "user not found",
+			url:     "/api/v1/users/3",
+			expCode: http.StatusNotFound,
+		},
+		{
+			name:    "bad request",
+			url:     "/api/v1/users/1",
+			body:    map[string]any{"email": ""},
+			expCode: http.StatusBadRequest,
+		},
+		{
+			name:    "every invalid field is reported",
+			url:     "/api/v1/users/1",
+			body:    map[string]any{"username": "jd", "email": "mail.com"},
+			expCode: http.StatusBadRequest,
+			expErrs: []string{"username", "email"},
+		},
+		{
+			name:    "email already exists",
+			url:     "/api/v1/users/1",
+			body:    map[string]any{"email": user2.Email},
+			expCode: http.StatusConflict,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := requester(http.MethodPatch, tt.url, tt.body, mockRepo)
+
+			if rr.Code != tt.expCode {
+				t.Errorf("expected status %d, got %d", tt.expCode, rr.Code)
+			}
+
+			if tt.expErrs != nil {
+				var resp struct{ Errors validation.ValidationErrors }
+				if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+					t.Fatalf("failed to unmarshal response: %v", err)
+				}
+
+				fields := make([]string, 0, len(resp.Errors))
+				for _, e := range resp.Errors {
+					fields = append(fields, e.Field)
+				}
+
+				if !reflect.DeepEqual(fields, tt.expErrs) {
+					t.Errorf("expected errors for %v, got %v", tt.expErrs, fields)
+				}
+			}
+
+			if tt.expCode == http.StatusNoContent {
+				rr = requester(http.MethodGet, "/api/v1/users/"+testUUID(1), nil, mockRepo)
+
+				var user model.User
+				if err := json.Unmarshal(rr.Body.Bytes(), &user); err != nil {
+					t.Fatalf("failed to unmarshal response: %v", err)
+				}
+
+				if user.FullName != "John Doe Jr." {
+					t.Errorf("expected %v user full_name, got %v", "John Doe Jr.", user.FullName)
+				}
+			}
+		})
+	}
+}
+
+func TestPatchUserFormats(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		expCode     int
+		expFullName string
+	}{
+		{
+			name:        "merge patch clears full_name",
+			contentType: "application/merge-patch+json",
+			body:        `{"full_name": null}`,
+			expCode:     http.StatusNoContent,
+			expFullName: "",
+		},
+		{
+			name:        "merge patch cannot change id",
+			contentType: "application/merge-patch+json",
+			body:        `{"id": 2}`,
+			expCode:     http.StatusBadRequest,
+			expFullName: user1.FullName,
+		},
+		{
+			name:        "merge patch rejects unknown fields",
+			contentType: "application/merge-patch+json",
+			body:        `{"password": "secret"}`,
+			expCode:     http.StatusBadRequest,
+			expFullName: user1.FullName,
+		},
+		{
+			name:        "merge patch cannot change created_at",
+			contentType: "application/merge-patch+json",
+			body:        `{"created_at": "2020-01-01T00:00:00Z"}`,
+			expCode:     http.StatusBadRequest,
+			expFullName: user1.FullName,
+		},
+		{
+			name:        "json patch replaces full_name",
+			contentType: "application/json-patch+json",
+			body:        `[{"op": "test", "path": "/username", "value": "jdoe"}, {"op": "replace", "path": "/full_name", "value": "Johnny"}]`,
+			expCode:     http.StatusNoContent,
+			expFullName: "Johnny",
+		},
+		{
+			name:        "json patch removes full_name",
+			contentType: "application/json-patch+json",
+			body:        `[{"op": "remove", "path": "/full_name"}]`,
+			expCode:     http.StatusNoContent,
+			expFullName: "",
+		},
+		{
+			name:        "json patch test fails",
+			contentType: "application/json-patch+json",
+			body:        `[{"op": "test", "path": "/username", "value": "asmith"}, {"op": "replace", "path": "/full_name", "value": "Johnny"}]`,
+			expCode:     http.StatusConflict,
+			expFullName: user1.FullName,
+		},
+		{
+			name:        "json patch cannot remove uuid",
+			contentType: "application/json-patch+json",
+			body:        `[{"op": "remove", "path": "/uuid"}]`,
+			expCode:     http.StatusBadRequest,
+			expFullName: user1.FullName,
+		},
+		{
+			name:        "json patch op is not supported",
+			contentType: "application/json-patch+json",
+			body:        `[{"op": "move", "from": "/email", "path": "/full_name"}]`,
+			expCode:     http.StatusBadRequest,
+			expFullName: user1.FullName,
+		},
+		{
+			name:        "unsupported content type",
+			contentType: "text/plain",
+			body:        `full_name=Johnny`,
+			expCode:     http.StatusUnsupportedMediaType,
+			expFullName: user1.FullName,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockRepo := new(MockUserRepository)
+			insertTestUser(mockRepo, &user1)
+
+			router := newRouter(mockRepo)
+
+			req, _ := http.NewRequest(http.MethodPatch, "/api/v1/users/"+testUUID(1), strings.NewReader(tt.body))
+			req.Header.Set("x-api-key", testApiKey)
+			req.Header.Set("Content-Type", tt.contentType)
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+
+			if rr.Code != tt.expCode {
+				t.Errorf("expected status %d, got %d", tt.expCode, rr.Code)
+			}
+
+			user, _ := mockRepo.GetByID(context.Background(), 1)
+			if user.FullName != tt.expFullName {
+				t.Errorf("expected %q user full_name, got %q", tt.expFullName, user.FullName)
+			}
+		})
+	}
+}
+
+func TestDeleteUser(t *testing.T) {
+	mockRepo := new(MockUserRepository)
+
+	insertTestUser(mockRepo, &user1)
+	insertTestUser(mockRepo, &user2)
+
+	tests := []struct {
+		name    string
+		url     string
+		id      int64
+		expCode int
+	}{
+		{
+			name:    "success",
+			url:     "/api/v1/users/" + testUUID(1),
+			id:      1,
+			expCode: http.StatusNoContent,
+		},
+		{
+			name:    "success by deprecated numeric id",
+			url:     "/api/v1/users/2",
+			id:      2,
+			expCode: http.StatusNoContent,
+		},
+		{
+			name:    "bad request",
+			url:     "/api/v1/users/not-a-uuid",
+			expCode: http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := requester(http.MethodDelete, tt.url, nil, mockRepo)
+
+			if rr.Code != tt.expCode {
+				t.Errorf("expected status %d, got %d", tt.expCode, rr.Code)
+			}
+
+			if tt.id != 0 && userExists(mockRepo, tt.id) {
+				t.Errorf("user was not deleted from the database")
+			}
+		})
+	}
+}
+
+func TestProblemDetails(t *testing.T) {
+	tests := []struct {
+		name      string
+		apiKey    string
+		url       string
+		repoErr   error
+		expCode   int
+		expType   string
+		expDetail string
+	}{
+		{
+			name:      "missing api key",
+			url:       "/api/v1/users/",
+			expCode:   http.StatusUnauthorized,
+			expType:   problem.TypeBlank,
+			expDetail: "missing api key or bearer token",
+		},
+		{
+			name:      "wrong api key",
+			apiKey:    "wrong",
+			url:       "/api/v1/users/",
+			expCode:   http.StatusForbidden,
+			expType:   problem.TypeBlank,
+			expDetail: "forbidden",
+		},
+		{
+			name:      "user not found",
+			apiKey:    testApiKey,
+			url:       "/api/v1/users/username/jdoe",
+			expCode:   http.StatusNotFound,
+			expType:   problem.TypeNotFound,
+			expDetail: validation.ErrUserNotFound.Error(),
+		},
+		{
+			name:      "validation error",
+			apiKey:    testApiKey,
+			url:       "/api/v1/users/username/a",
+			expCode:   http.StatusBadRequest,
+			expType:   problem.TypeValidation,
+			expDetail: validation.ErrShortUsername.Error(),
+		},
+		{
+			name:    "internal error is not leaked",
+			apiKey:  testApiKey,
+			url:     "/api/v1/users/",
+			repoErr: errors.New(`pq: relation "users" does not exist`),
+			expCode: http.StatusInternalServerError,
+			expType: problem.TypeBlank,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			router := newRouter(&MockUserRepository{Err: tt.repoErr})
+
+			req, _ := http.NewRequest(http.MethodGet, tt.url, nil)
+			if tt.apiKey != "" {
+				req.Header.Set("x-api-key", tt.apiKey)
+			}
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+
+			if rr.Code != tt.expCode {
+				t.Errorf("expected status %d, got %d", tt.expCode, rr.Code)
+			}
+
+			if ct := rr.Header().Get("Content-Type"); ct != problem.ContentType {
+				t.Errorf("expected content type %v, got %v", problem.ContentType, ct)
+			}
+
+			var p problem.Problem
+			if err := json.Unmarshal(rr.Body.Bytes(), &p); err != nil {
+				t.Fatalf("failed to unmarshal response: %v", err)
+			}
+
+			// A request id is generated if the client sends none.
+			requestID := rr.Header().Get("X-Request-ID")
+			if requestID == "" {
+				t.Error("expected a request id to be generated")
+			}
+
+			exp := problem.Problem{
+				Type:      tt.expType,
+				Title:     http.StatusText(tt.expCode),
+				Status:    tt.expCode,
+				Detail:    tt.expDetail,
+				Instance:  tt.url,
+				RequestID: requestID,
+			}
+			p.Errors = nil
+
+			if !reflect.DeepEqual(p, exp) {
+				t.Errorf("expected %+v problem, got %+v", exp, p)
+			}
+		})
+	}
+}
+
+func TestConditionalRequests(t *testing.T) {
+	mockRepo := new(MockUserRepository)
+
+	insertTestUser(mockRepo, &user1)
+
+	url := "/api/v1/users/" + testUUID(1)
+
+	tests := []struct {
+		name    string
+		method  string
+		header  string
+		value   string
+		body    string
+		expCode int
+		expETag string
+	}{
+		{
+			name:    "get returns etag",
+			method:  http.MethodGet,
+			expCode: http.StatusOK,
+			expETag: `"1"`,
+		},
+		{
+			name:    "get not modified",
+			method:  http.MethodGet,
+			header:  "If-None-Match",
+			value:   `W/"1"`,
+			expCode: http.StatusNotModified,
+			expETag: `"1"`,
+		},
+		{
+			name:    "patch with current version",
+			method:  http.MethodPatch,
+			header:  "If-Match",
+			value:   `"1"`,
+			body:    `{"full_name": "John Doe Jr."}`,
+			expCode: http.StatusNoContent,
+			expETag: `"2"`,
+		},
+		{
+			name:    "patch with stale version",
+			method:  http.MethodPatch,
+			header:  "If-Match",
+			value:   `"1"`,
+			body:    `{"full_name": "Johnny"}`,
+			expCode: http.StatusPreconditionFailed,
+		},
+		{
+			name:    "get modified",
+			method:  http.MethodGet,
+			header:  "If-None-Match",
+			value:   `"1"`,
+			expCode: http.StatusOK,
+			expETag: `"2"`,
+		},
+		{
+			name:    "delete with weak etag",
+			method:  http.MethodDelete,
+			header:  "If-Match",
+			value:   `W/"2"`,
+			expCode: http.StatusPreconditionFailed,
+		},
+		{
+			name:    "delete with current version",
+			method:  http.MethodDelete,
+			header:  "If-Match",
+			value:   `"2"`,
+			expCode: http.StatusNoContent,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			router := newRouter(mockRepo)
+
+			req, _ := http.NewRequest(tt.method, url, strings.NewReader(tt.body))
+			req.Header.Set("x-api-key", testApiKey)
+			if tt.header != "" {
+				req.Header.Set(tt.header, tt.value)
+			}
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+
+			if rr.Code != tt.expCode {
+				t.Errorf("expected status %d, got %d", tt.expCode, rr.Code)
+			}
+
+			if got := rr.Header().Get("ETag"); got != tt.expETag {
+				t.Errorf("expected etag %v, got %v", tt.expETag, got)
+			}
+		})
+	}
+}
+
+func TestIncludeDeleted(t *testing.T) {
+	mockRepo := new(MockUserRepository)
+	insertTestUser(mockRepo, &user1)
+	insertTestUser(mockRepo, &user2)
+	_, _ = mockRepo.Delete(context.Background(), 1, 0)
+	router := newRouter(mockRepo)
+
+	send := func(key, method, path, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("x-api-key", key)
+		req.Header.Set("Content-Type", "application/json")
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	var reader model.APIKey
+	rr := send(testApiKey, http.MethodPost, "/api/v1/api-keys", `{"name":"billing","scopes":["users:read"]}`)
+	if err := json.Unmarshal(rr.Body.Bytes(), &reader); err != nil || rr.Code != http.StatusCreated {
+		t.Fatalf("unexpected response %d: %s", rr.Code, rr.Body)
+	}
+
+	tests := []struct {
+		name    string
+		key     string
+		path    string
+		expCode int
+		expIDs  []int64
+	}{
+		{"read-only key lists the live users", reader.Key, "/api/v1/users/", http.StatusOK, []int64{2}},
+		{"read-only key is refused the deleted users", reader.Key, "/api/v1/users/?include_deleted=true", http.StatusForbidden, nil},
+		{"read-only key is refused the deleted users on export", reader.Key, "/api/v1/users/export?include_deleted=true", http.StatusForbidden, nil},
+		{"admin lists the deleted users", testApiKey, "/api/v1/users/?include_deleted=true", http.StatusOK, []int64{1, 2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := send(tt.key, http.MethodGet, tt.path, "")
+			if rr.Code != tt.expCode {
+				t.Fatalf("expected status %d, got %d: %s", tt.expCode, rr.Code, rr.Body)
+			}
+			if tt.expIDs != nil {
+				if ids := pageIDs(unmarshalPage(t, rr)); !reflect.DeepEqual(ids, tt.expIDs) {
+					t.Errorf("expected users %v, got %v", tt.expIDs, ids)
+				}
+			}
+		})
+	}
+
+	rr = send(reader.Key, http.MethodPost, "/api/graphql", `{"query":"{ users(includeDeleted: true) { edges { node { id } } } }"}`)
+	if !strings.Contains(rr.Body.String(), `"code":"FORBIDDEN"`) {
+		t.Errorf("expected the graphql query to be forbidden, got %s", rr.Body)
+	}
+}
+
+func TestSoftDelete(t *testing.T) {
+	mockRepo := new(MockUserRepository)
+
+	insertTestUser(mockRepo, &user1)
+	insertTestUser(mockRepo, &user2)
+
+	url := "/api/v1/users/" + testUUID(1)
+
+	tests := []struct {
+		name    string
+		method  string
+		url     string
+		body    any
+		expCode int
+		expIDs  []int64
+	}{
+		{
+			name:    "delete",
+			method:  http.MethodDelete,
+			url:     url,
+			expCode: http.StatusNoContent,
+		},
+		{
+			name:    "deleted user is hidden",
+			method:  http.MethodGet,
+			url:     url,
+			expCode: http.StatusNotFound,
+		},
+		{
+			name:    "deleted user is not listed",
+			method:  http.MethodGet,
+			url:     "/api/v1/users/",
+			expCode: http.StatusOK,
+			expIDs:  []int64{2},
+		},
+		{
+			name:    "deleted user is listed on demand",
+			method:  http.MethodGet,
+			url:     "/api/v1/users/?include_deleted=true",
+			expCode: http.StatusOK,
+			expIDs:  []int64{1, 2},
+		},
+		{
+			name:    "restore",
+			method:  http.MethodPost,
+			url:     url + "/restore",
+			expCode: http.StatusOK,
+		},
+		{
+			name:    "restore live user",
+			method:  http.MethodPost,
+			url:     url + "/restore",
+			expCode: http.StatusNotFound,
+		},
+		{
+			name:    "delete again",
+			method:  http.MethodDelete,
+			url:     url,
+			expCode: http.StatusNoContent,
+		},
+		{
+			name:    "username of deleted user is reused",
+			method:  http.MethodPost,
+			url:     "/api/v1/users/",
+			body:    model.User{Username: user1.Username, Email: "john@example.com"},
+			expCode: http.StatusOK,
+		},
+		{
+			name:    "restore taken username",
+			method:  http.MethodPost,
+			url:     url + "/restore",
+			expCode: http.StatusConflict,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := requester(tt.method, tt.url, tt.body, mockRepo)
+
+			if rr.Code != tt.expCode {
+				t.Fatalf("expected status %d, got %d", tt.expCode, rr.Code)
+			}
+
+			if tt.expIDs != nil {
+				if ids := pageIDs(unmarshalPage(t, rr)); !reflect.DeepEqual(ids, tt.expIDs) {
+					t.Errorf("expected %v users, got %v", tt.expIDs, ids)
+				}
+			}
+		})
+	}
+}
+
+func TestIdempotency(t *testing.T) {
+	mockRepo := new(MockUserRepository)
+	router := newRouterWith(mockRepo, new(MockIdempotencyRepository))
+
+	tests := []struct {
+		name        string
+		key         string
+		body        string
+		expCode     int
+		expReplayed bool
+		expUsers    int
+	}{
+		{
+			name:     "first request",
+			key:      "key-1",
+			body:     `{"username": "jdoe", "email": "jdoe@example.com"}`,
+			expCode:  http.StatusOK,
+			expUsers: 1,
+		},
+		{
+			name:        "retry is replayed",
+			key:         "key-1",
+			body:        `{"username": "jdoe", "email": "jdoe@example.com"}`,
+			expCode:     http.StatusOK,
+			expReplayed: true,
+			expUsers:    1,
+		},
+		{
+			name:     "same key with different body",
+			key:      "key-1",
+			body:     `{"username": "asmith", "email": "asmith@example.com"}`,
+			expCode:  http.StatusUnprocessableEntity,
+			expUsers: 1,
+		},
+		{
+			name:     "failed request is stored",
+			key:      "key-2",
+			body:     `{"username": "jdoe", "email": "jdoe@example.com"}`,
+			expCode:  http.StatusConflict,
+			expUsers: 1,
+		},
+		{
+			name:        "failed request is replayed",
+			key:         "key-2",
+			body:        `{"username": "jdoe", "email": "jdoe@example.com"}`,
+			expCode:     http.StatusConflict,
+			expReplayed: true,
+			expUsers:    1,
+		},
+		{
+			name:     "key is too long",
+			key:      strings.Repeat("k", 256),
+			body:     `{"username": "asmith", "email": "asmith@example.com"}`,
+			expCode:  http.StatusBadRequest,
+			expUsers: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodPost, "/api/v1/users/", strings.NewReader(tt.body))
+			req.Header.Set("x-api-key", testApiKey)
+			req.Header.Set("Idempotency-Key", tt.key)
+			requestID := "req-" + strings.ReplaceAll(tt.name, " ", "-")
+			req.Header.Set("X-Request-ID", requestID)
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+
+			if rr.Code != tt.expCode {
+				t.Errorf("expected status %d, got %d", tt.expCode, rr.Code)
+			}
+
+			if replayed := rr.Header().Get("Idempotent-Replayed") != ""; replayed != tt.expReplayed {
+				t.Errorf("expected replayed %v, got %v", tt.expReplayed, replayed)
+			}
+
+			if id := rr.Header().Get("X-Request-ID"); id != requestID {
+				t.Errorf("expected the request id of the request, got %q", id)
+			}
+
+			if len(mockRepo.Users) != tt.expUsers {
+				t.Errorf("expected %d users, got %d", tt.expUsers, len(mockRepo.Users))
+			}
+		})
+	}
+}
+
+func TestIdempotencyScope(t *testing.T) {
+	mockRepo, mockIdempotency := new(MockUserRepository), new(MockIdempotencyRepository)
+	router := newRouterWith(mockRepo, mockIdempotency)
+
+	send := func(apiKey, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(http.MethodPost, "/api/v1/users/", strings.NewReader(body))
+		req.Header.Set("x-api-key", apiKey)
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Idempotency-Key", "key-1")
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	var key model.APIKey
+	req, _ := http.NewRequest(http.MethodPost, "/api/v1/api-keys", strings.NewReader(`{"name":"crm","scopes":["users:write"]}`))
+	req.Header.Set("x-api-key", testApiKey)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if err := json.Unmarshal(rr.Body.Bytes(), &key); err != nil || rr.Code != http.StatusCreated {
+		t.Fatalf("unexpected response %d: %s", rr.Code, rr.Body)
+	}
+
+	body := `{"username": "jdoe", "email": "jdoe@example.com"}`
+	if rr = send(testApiKey, body); rr.Code != http.StatusOK {
+		t.Fatalf("expected the user to be created, got %d: %s", rr.Code, rr.Body)
+	}
+
+	// The read-only key is refused rather than replayed the response to the
+	// admin key.
+	rr = send(key.Key, body)
+	if rr.Code != http.StatusForbidden || rr.Header().Get("Idempotent-Replayed") != "" {
+		t.Errorf("expected the other principal not to be replayed, got %d %v", rr.Code, rr.Header())
+	}
+	if rr = send(testApiKey, body); rr.Header().Get("Idempotent-Replayed") == "" {
+		t.Errorf("expected the same principal to be replayed, got %d", rr.Code)
+	}
+
+	rr = send(testApiKey, `{"username": "`+strings.Repeat("a", 17<<20)+`"}`)
+	if rr.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected the body to be too large, got %d", rr.Code)
+	}
+}
+
+// panickingRepository panics in every transaction.
+type panickingRepository struct {
+	*MockUserRepository
+}
+
+func (panickingRepository) WithTx(context.Context, func(repo repository.UserRepository) error) error {
+	panic("connection pool exhausted")
+}
+
+func TestIdempotencyPanic(t *testing.T) {
+	mockIdempotency := new(MockIdempotencyRepository)
+	router := newRouterWith(panickingRepository{new(MockUserRepository)}, mockIdempotency)
+
+	for range 2 {
+		req, _ := http.NewRequest(http.MethodPost, "/api/v1/users/", strings.NewReader(`{"username": "jdoe", "email": "jdoe@example.com"}`))
+		req.Header.Set("x-api-key", testApiKey)
+		req.Header.Set("Idempotency-Key", "key-1")
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+
+		// The retry runs again rather than being refused as in progress.
+		if rr.Code != http.StatusInternalServerError {
+			t.Errorf("expected status %d, got %d", http.StatusInternalServerError, rr.Code)
+		}
+	}
+	if len(mockIdempotency.Records) != 0 {
+		t.Errorf("expected the key to be released, got %v", mockIdempotency.Records)
+	}
+}
+
+func TestBatchUsers(t *testing.T) {
+	type item struct {
+		Index  int             `json:"index"`
+		Op     string          `json:"op"`
+		Status int             `json:"status"`
+		User   *model.User     `json:"user"`
+		Error  problem.Problem `json:"error"`
+	}
+
+	tests := []struct {
+		name        string
+		query       string
+		body        string
+		expCode     int
+		expStatuses []int
+		expUsers    []string
+	}{
+		{
+			name:  "best effort",
+			query: "",
+			body: `{"operations": [
+				{"op": "create", "user": {"username": "bjones", "email": "bjones@example.com"}},
+				{"op": "patch", "id": "1", "patch": {"full_name": "Johnny Doe"}},
+				{"op": "patch", "id": "` + testUUID(2) + `", "patch": [{"op": "replace", "path": "/email", "value": "alice@example.com"}]},
+				{"op": "delete", "id": "` + testUUID(2) + `"}
+			]}`,
+			expCode:     http.StatusOK,
+			expStatuses: []int{http.StatusCreated, http.StatusOK, http.StatusOK, http.StatusNoContent},
+			expUsers:    []string{"jdoe", "bjones"},
+		},
+		{
+			name:  "best effort partial failure",
+			query: "?atomic=false",
+			body: `{"operations": [
+				{"op": "create", "user": {"username": "bjones", "email": "bjones@example.com"}},
+				{"op": "create", "user": {"username": "asmith", "email": "alice@example.com"}},
+				{"op": "patch", "id": "42", "patch": {"full_name": "Nobody"}},
+				{"op": "create", "user": {"username": "x", "email": "x"}},
+				{"op": "rename"}
+			]}`,
+			expCode: http.StatusMultiStatus,
+			expStatuses: []int{http.StatusCreated, http.StatusConflict, http.StatusNotFound,
+				http.StatusBadRequest, http.StatusBadRequest},
+			expUsers: []string{"jdoe", "asmith", "bjones"},
+		},
+		{
+			name:  "atomic",
+			query: "?atomic=true",
+			body: `{"operations": [
+				{"op": "create", "user": {"username": "bjones", "email": "bjones@example.com"}},
+				{"op": "delete", "id": "1"}
+			]}`,
+			expCode:     http.StatusOK,
+			expStatuses: []int{http.StatusCreated, http.StatusNoContent},
+			expUsers:    []string{"asmith", "bjones"},
+		},
+		{
+			name:  "atomic rollback",
+			query: "?atomic=true",
+			body: `{"operations": [
+				{"op": "create", "user": {"username": "bjones", "email": "bjones@example.com"}},
+				{"op": "delete", "id": "1"},
+				{"op": "patch", "id": "2", "patch": {"username": "x"}},
+				{"op": "delete", "id": "2"}
+			]}`,
+			expCode: http.StatusMultiStatus,
+			expStatuses: []int{http.StatusFailedDependency, http.StatusFailedDependency,
+				http.StatusBadRequest, http.StatusFailedDependency},
+			expUsers: []string{"jdoe", "asmith"},
+		},
+		{
+			name:     "empty batch",
+			body:     `{"operations": []}`,
+			expCode:  http.StatusBadRequest,
+			expUsers: []string{"jdoe", "asmith"},
+		},
+		{
+			name:     "invalid atomic",
+			query:    "?atomic=maybe",
+			body:     `{"operations": [{"op": "delete", "id": "1"}]}`,
+			expCode:  http.StatusBadRequest,
+			expUsers: []string{"jdoe", "asmith"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockRepo := new(MockUserRepository)
+			insertTestUser(mockRepo, &user1)
+			insertTestUser(mockRepo, &user2)
+
+			req, _ := http.NewRequest(http.MethodPost, "/api/v1/users:batch"+tt.query, strings.NewReader(tt.body))
+			req.Header.Set("x-api-key", testApiKey)
+			rr := httptest.NewRecorder()
+			newRouter(mockRepo).ServeHTTP(rr, req)
+
+			if rr.Code != tt.expCode {
+				t.Fatalf("expected status %d, got %d: %s", tt.expCode, rr.Code, rr.Body.String())
+			}
+
+			if tt.expStatuses != nil {
+				var resp struct {
+					Results []item `json:"results"`
+				}
+				if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+					t.Fatalf("failed to unmarshal response: %v", err)
+				}
+				statuses := make([]int, len(resp.Results))
+				for i, res := range resp.Results {
+					statuses[i] = res.Status
+					if res.Status == http.StatusCreated && (res.User == nil || res.User.UUID == "") {
+						t.Errorf("expected created user in result %d", i)
+					}
+					if res.Status >= 400 && res.Error.Status != res.Status {
+						t.Errorf("expected error with status %d in result %d, got %d", res.Status, i, res.Error.Status)
+					}
+				}
+				if !reflect.DeepEqual(statuses, tt.expStatuses) {
+					t.Errorf("expected statuses %v, got %v", tt.expStatuses, statuses)
+				}
+			}
+
+			var usernames []string
+			for _, u := range mockRepo.Users {
+				if u.DeletedAt == nil {
+					usernames = append(usernames, u.Username)
+				}
+			}
+			if !reflect.DeepEqual(usernames, tt.expUsers) {
+				t.Errorf("expected users %v, got %v", tt.expUsers, usernames)
+			}
+		})
+	}
+
+	t.Run("unknown method", func(t *testing.T) {
+		rr := requester(http.MethodPost, "/api/v1/users:merge", nil, new(MockUserRepository))
+		if rr.Code != http.StatusNotFound {
+			t.Errorf("expected status %d, got %d", http.StatusNotFound, rr.Code)
+		}
+	})
+}
+
+func TestImportUsers(t *testing.T) {
+	type row struct {
+		Line     int                         `json:"line"`
+		Username string                      `json:"username"`
+		Action   string                      `json:"action"`
+		Errors   validation.ValidationErrors `json:"errors"`
+	}
+	type report struct {
+		DryRun    bool  `json:"dry_run"`
+		Created   int   `json:"created"`
+		Updated   int   `json:"updated"`
+		Unchanged int   `json:"unchanged"`
+		Rejected  int   `json:"rejected"`
+		Rows      []row `json:"rows"`
+	}
+
+	const csvBody = "Login,E-mail,Name\n" +
+		"jdoe,jdoe@example.com,Johnny Doe\n" +
+		"asmith,asmith@example.com,Alice Smith\n" +
+		"dgreen,dgreen@example.com,Dan Green\n" +
+		"x,invalid\n" +
+		"cbrown,bjones@example.com,Charlie Brown\n" +
+		"dgreen,dan@example.com,Dan Green\n"
+	const mapping = "?mapping=Login:username,E-mail:email,Name:full_name"
+
+	tests := []struct {
+		name        string
+		url         string
+		contentType string
+		body        string
+		expCode     int
+		expReport   report
+		expUsers    []string
+	}{
+		{
+			name:        "csv",
+			url:         "/api/v1/users/import" + mapping,
+			contentType: "text/csv",
+			body:        csvBody,
+			expCode:     http.StatusOK,
+			expReport: report{
+				Created: 1, Updated: 1, Unchanged: 1, Rejected: 3,
+				Rows: []row{
+					{Line: 2, Username: "jdoe", Action: "update"},
+					{Line: 3, Username: "asmith", Action: "unchanged"},
+					{Line: 4, Username: "dgreen", Action: "create"},
+					{Line: 5, Action: "reject", Errors: validation.ValidationErrors{validation.MalformedRequest(csv.ErrFieldCount)}},
+					{Line: 6, Username: "cbrown", Action: "reject", Errors: validation.ValidationErrors{validation.ErrTakenEmail}},
+					{Line: 7, Username: "dgreen", Action: "reject", Errors: validation.ValidationErrors{validation.ErrDuplicateUsername}},
+				},
+			},
+			expUsers: []string{"jdoe:Johnny Doe", "asmith:Alice Smith", "bjones:Bob Jones", "dgreen:Dan Green"},
+		},
+		{
+			name:        "dry run",
+			url:         "/api/v1/users/import" + mapping + "&dry_run=true",
+			contentType: "text/csv",
+			body:        csvBody,
+			expCode:     http.StatusOK,
+			expReport: report{
+				DryRun: true, Created: 1, Updated: 1, Unchanged: 1, Rejected: 3,
+				Rows: []row{
+					{Line: 2, Username: "jdoe", Action: "update"},
+					{Line: 3, Username: "asmith", Action: "unchanged"},
+					{Line: 4, Username: "dgreen", Action: "create"},
+					{Line: 5, Action: "reject", Errors: validation.ValidationErrors{validation.MalformedRequest(csv.ErrFieldCount)}},
+					{Line: 6, Username: "cbrown", Action: "reject", Errors: validation.ValidationErrors{validation.ErrTakenEmail}},
+					{Line: 7, Username: "dgreen", Action: "reject", Errors: validation.ValidationErrors{validation.ErrDuplicateUsername}},
+				},
+			},
+			expUsers: []string{"jdoe:John Doe", "asmith:Alice Smith", "bjones:Bob Jones"},
+		},
+		{
+			name:        "ndjson",
+			url:         "/api/v1/users/import?mapping=login:username",
+			contentType: "application/x-ndjson",
+			body: `{"login": "dgreen", "email": "dgreen@example.com"}` + "\n\n" +
+				`{"login": "cbrown", "email": "cbrown"}` + "\n" +
+				`{"login": 42}` + "\n" +
+				`not json` + "\n",
+			expCode: http.StatusOK,
+			expReport: report{
+				Created: 1, Rejected: 3,
+				Rows: []row{
+					{Line: 1, Username: "dgreen", Action: "create"},
+					{Line: 3, Username: "cbrown", Action: "reject", Errors: validation.ValidationErrors{validation.ErrInvalidEmail}},
+					{Line: 4, Action: "reject", Errors: validation.ValidationErrors{validation.ErrInvalidRow}},
+					{Line: 5, Action: "reject", Errors: validation.ValidationErrors{validation.ErrInvalidRow}},
+				},
+			},
+			expUsers: []string{"jdoe:John Doe", "asmith:Alice Smith", "bjones:Bob Jones", "dgreen:"},
+		},
+		{
+			name:        "unsupported content type",
+			url:         "/api/v1/users/import",
+			contentType: "application/json",
+			body:        `[]`,
+			expCode:     http.StatusUnsupportedMediaType,
+			expUsers:    []string{"jdoe:John Doe", "asmith:Alice Smith", "bjones:Bob Jones"},
+		},
+		{
+			name:        "invalid mapping",
+			url:         "/api/v1/users/import?mapping=Login:id",
+			contentType: "text/csv",
+			body:        csvBody,
+			expCode:     http.StatusBadRequest,
+			expUsers:    []string{"jdoe:John Doe", "asmith:Alice Smith", "bjones:Bob Jones"},
+		},
+		{
+			name:        "empty file",
+			url:         "/api/v1/users/import",
+			contentType: "text/csv",
+			body:        "username,email\n",
+			expCode:     http.StatusBadRequest,
+			expUsers:    []string{"jdoe:John Doe", "asmith:Alice Smith", "bjones:Bob Jones"},
+		},
+		{
+			name:        "too large",
+			url:         "/api/v1/users/import",
+			contentType: "text/csv",
+			body:        "username,email\n" + strings.Repeat("a", 17<<20),
+			expCode:     http.StatusRequestEntityTooLarge,
+			expUsers:    []string{"jdoe:John Doe", "asmith:Alice Smith", "bjones:Bob Jones"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockRepo := new(MockUserRepository)
+			insertTestUser(mockRepo, &user1)
+			insertTestUser(mockRepo, &user2)
+			insertTestUser(mockRepo, &user3)
+
+			req, _ := http.NewRequest(http.MethodPost, tt.url, strings.NewReader(tt.body))
+			req.Header.Set("x-api-key", testApiKey)
+			req.Header.Set("Content-Type", tt.contentType)
+			rr := httptest.NewRecorder()
+			newRouter(mockRepo).ServeHTTP(rr, req)
+
+			if rr.Code != tt.expCode {
+				t.Fatalf("expected status %d, got %d: %s", tt.expCode, rr.Code, rr.Body.String())
+			}
+
+			if tt.expCode == http.StatusOK {
+				var got report
+				if err := json.Unmarshal(rr.Body.Bytes(), &got); err != nil {
+					t.Fatalf("failed to unmarshal response: %v", err)
+				}
+				if !reflect.DeepEqual(got, tt.expReport) {
+					t.Errorf("expected report %+v, got %+v", tt.expReport, got)
+				}
+			}
+
+			var users []string
+			for _, u := range mockRepo.Users {
+				users = append(users, u.Username+":"+u.FullName)
+			}
+			if !reflect.DeepEqual(users, tt.expUsers) {
+				t.Errorf("expected users %v, got %v", tt.expUsers, users)
+			}
+		})
+	}
+
+	t.Run("csv error report", func(t *testing.T) {
+		req, _ := http.NewRequest(http.MethodPost, "/api/v1/users/import"+mapping+"&dry_run=true", strings.NewReader(csvBody))
+		req.Header.Set("x-api-key", testApiKey)
+		req.Header.Set("Content-Type", "text/csv")
+		req.Header.Set("Accept", "text/csv")
+		rr := httptest.NewRecorder()
+		newRouter(new(MockUserRepository)).ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status %d, got %d", http.StatusOK, rr.Code)
+		}
+		if cd := rr.Header().Get("Content-Disposition"); !strings.Contains(cd, "import-errors.csv") {
+			t.Errorf("expected csv attachment, got %q", cd)
+		}
+
+		exp := "line,username,field,code,message\n" +
+			"5,,,invalid_format,wrong number of fields\n" +
+			"7,dgreen,username,invalid_value,username appears more than once in the import\n"
+		if rr.Body.String() != exp {
+			t.Errorf("expected report %q, got %q", exp, rr.Body.String())
+		}
+	})
+}
+
+func TestExportUsers(t *testing.T) {
+	mockRepo := new(MockUserRepository)
+	insertTestUser(mockRepo, &user1)
+	insertTestUser(mockRepo, &user2)
+	insertTestUser(mockRepo, &user3)
+
+	tests := []struct {
+		name       string
+		url        string
+		repoErr    error
+		expCode    int
+		expType    string
+		expRecords [][]string
+	}{
+		{
+			name:    "csv",
+			url:     "/api/v1/users/export?sort=username",
+			expCode: http.StatusOK,
+			expType: "text/csv",
+			expRecords: [][]string{
+				{"id", "uuid", "username", "email", "full_name", "created_at", "updated_at", "deleted_at"},
+				{"2", testUUID(2), "asmith", "asmith@example.com", "Alice Smith", "2025-09-23T08:45:49Z", "2025-09-23T08:45:49Z", ""},
+				{"3", testUUID(3), "bjones", "bjones@example.com", "Bob Jones", "2025-09-23T08:46:49Z", "2025-09-23T08:46:49Z", ""},
+				{"1", testUUID(1), "jdoe", "jdoe@example.com", "John Doe", "2025-09-23T08:44:49Z", "2025-09-23T08:44:49Z", ""},
+			},
+		},
+		{
+			name:    "filters and pagination",
+			url:     "/api/v1/users/export?format=csv&username_prefix=j&limit=1&cursor=ignored",
+			expCode: http.StatusOK,
+			expType: "text/csv",
+			expRecords: [][]string{
+				{"id", "uuid", "username", "email", "full_name", "created_at", "updated_at", "deleted_at"},
+				{"1", testUUID(1), "jdoe", "jdoe@example.com", "John Doe", "2025-09-23T08:44:49Z", "2025-09-23T08:44:49Z", ""},
+			},
+		},
+		{
+			name:    "no users",
+			url:     "/api/v1/users/export?username_prefix=x",
+			expCode: http.StatusOK,
+			expType: "text/csv",
+			expRecords: [][]string{
+				{"id", "uuid", "username", "email", "full_name", "created_at", "updated_at", "deleted_at"},
+			},
+		},
+		{
+			name:    "ndjson",
+			url:     "/api/v1/users/export?format=ndjson&order=desc",
+			expCode: http.StatusOK,
+			expType: "application/x-ndjson",
+		},
+		{
+			name:    "xlsx",
+			url:     "/api/v1/users/export?format=xlsx",
+			expCode: http.StatusOK,
+			expType: "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+		},
+		{
+			name:    "unknown format",
+			url:     "/api/v1/users/export?format=pdf",
+			expCode: http.StatusBadRequest,
+			expType: problem.ContentType,
+		},
+		{
+			name:    "invalid filter",
+			url:     "/api/v1/users/export?sort=full_name",
+			expCode: http.StatusBadRequest,
+			expType: problem.ContentType,
+		},
+		{
+			name:    "repository error",
+			url:     "/api/v1/users/export",
+			repoErr: errors.New("connection refused"),
+			expCode: http.StatusInternalServerError,
+			expType: problem.ContentType,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockRepo.Err = tt.repoErr
+			defer func() { mockRepo.Err = nil }()
+
+			rr := requester(http.MethodGet, tt.url, nil, mockRepo)
+
+			if rr.Code != tt.expCode {
+				t.Fatalf("expected status %d, got %d: %s", tt.expCode, rr.Code, rr.Body.String())
+			}
+			if ct := rr.Header().Get("Content-Type"); ct != tt.expType {
+				t.Errorf("expected content type %q, got %q", tt.expType, ct)
+			}
+			if cd := rr.Header().Get("Content-Disposition"); (tt.expCode == http.StatusOK) != strings.HasPrefix(cd, "attachment;") {
+				t.Errorf("unexpected content disposition %q", cd)
+			}
+
+			if tt.expRecords != nil {
+				records, err := csv.NewReader(rr.Body).ReadAll()
+				if err != nil {
+					t.Fatalf("failed to read csv: %v", err)
+				}
+				if !reflect.DeepEqual(records, tt.expRecords) {
+					t.Errorf("expected records %v, got %v", tt.expRecords, records)
+				}
+			}
+		})
+	}
+
+	t.Run("csv formulas are escaped", func(t *testing.T) {
+		formulas := new(MockUserRepository)
+		insertTestUser(formulas, &model.User{Username: "@sum", Email: "sum@example.com", FullName: `=HYPERLINK("http://example.com")`})
+		insertTestUser(formulas, &model.User{Username: "plain", Email: "plain@example.com", FullName: "-1+2"})
+
+		records, err := csv.NewReader(requester(http.MethodGet, "/api/v1/users/export", nil, formulas).Body).ReadAll()
+		if err != nil {
+			t.Fatalf("failed to read csv: %v", err)
+		}
+		exp := [][]string{{"'@sum", `'=HYPERLINK("http://example.com")`}, {"plain", "'-1+2"}}
+		for i, e := range exp {
+			if rec := records[i+1]; rec[2] != e[0] || rec[4] != e[1] {
+				t.Errorf("expected the formulas to be escaped, got %v", rec)
+			}
+		}
+	})
+
+	t.Run("ndjson lines", func(t *testing.T) {
+		rr := requester(http.MethodGet, "/api/v1/users/export?format=ndjson&order=desc", nil, mockRepo)
+
+		var ids []int64
+		dec := json.NewDecoder(rr.Body)
+		for dec.More() {
+			var u model.User
+			if err := dec.Decode(&u); err != nil {
+				t.Fatalf("failed to decode line: %v", err)
+			}
+			ids = append(ids, u.ID)
+		}
+		if exp := []int64{3, 2, 1}; !reflect.DeepEqual(ids, exp) {
+			t.Errorf("expected ids %v, got %v", exp, ids)
+		}
+	})
+
+	t.Run("xlsx sheet", func(t *testing.T) {
+		rr := requester(http.MethodGet, "/api/v1/users/export?format=xlsx", nil, mockRepo)
+
+		zr, err := zip.NewReader(bytes.NewReader(rr.Body.Bytes()), int64(rr.Body.Len()))
+		if err != nil {
+			t.Fatalf("failed to open workbook: %v", err)
+		}
+
+		var sheet []byte
+		for _, f := range zr.File {
+			if f.Name == "xl/worksheets/sheet1.xml" {
+				r, _ := f.Open()
+				sheet, _ = io.ReadAll(r)
+			}
+		}
+		if n := bytes.Count(sheet, []byte("<row>")); n != 4 {
+			t.Errorf("expected 4 rows, got %d", n)
+		}
+		if !bytes.Contains(sheet, []byte("<t xml:space=\"preserve\">asmith@example.com</t>")) {
+			t.Errorf("expected email in sheet")
+		}
+	})
+}
+
+func TestSearchUsers(t *testing.T) {
+	mockRepo := new(MockUserRepository)
+	insertTestUser(mockRepo, &user1)
+	insertTestUser(mockRepo, &user2)
+	insertTestUser(mockRepo, &user3)
+
+	tests := []struct {
+		name    string
+		url     string
+		expCode int
+		expIDs  []int64
+		expErrs validation.ValidationErrors
+	}{
+		{
+			name:    "typo in full name",
+			url:     "/api/v1/users/search?q=jon+doe",
+			expCode: http.StatusOK,
+			expIDs:  []int64{1},
+		},
+		{
+			name:    "part of email",
+			url:     "/api/v1/users/search?q=asmith",
+			expCode: http.StatusOK,
+			expIDs:  []int64{2},
+		},
+		{
+			name:    "no match",
+			url:     "/api/v1/users/search?q=zzz",
+			expCode: http.StatusOK,
+			expIDs:  []int64{},
+		},
+		{
+			name:    "query is too short",
+			url:     "/api/v1/users/search?q=+j+",
+			expCode: http.StatusBadRequest,
+			expErrs: validation.ValidationErrors{validation.ErrShortSearch},
+		},
+		{
+			name:    "every invalid parameter is reported",
+			url:     "/api/v1/users/search?q=" + strings.Repeat("a", 101) + "&limit=101",
+			expCode: http.StatusBadRequest,
+			expErrs: validation.ValidationErrors{validation.ErrLongSearch, validation.ErrInvalidSearchLimit},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := requester(http.MethodGet, tt.url, nil, mockRepo)
+
+			if rr.Code != tt.expCode {
+				t.Fatalf("expected status %d, got %d: %s", tt.expCode, rr.Code, rr.Body.String())
+			}
+
+			if tt.expErrs != nil {
+				var p problem.Problem
+				_ = json.Unmarshal(rr.Body.Bytes(), &p)
+				if !reflect.DeepEqual(p.Errors, tt.expErrs) {
+					t.Errorf("expected errors %v, got %v", tt.expErrs, p.Errors)
+				}
+				return
+			}
+
+			var resp struct {
+				Users []model.UserMatch `json:"users"`
+			}
+			if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("failed to unmarshal response: %v", err)
+			}
+			ids := []int64{}
+			for _, m := range resp.Users {
+				ids = append(ids, m.ID)
+				if m.Score <= 0 {
+					t.Errorf("expected positive score for user %d, got %v", m.ID, m.Score)
+				}
+			}
+			if !reflect.DeepEqual(ids, tt.expIDs) {
+				t.Errorf("expected ids %v, got %v", tt.expIDs, ids)
+			}
+		})
+	}
+}
+
+func scimRequester(router *gin.Engine, method, url, body string) *httptest.ResponseRecorder {
+	var reader io.Reader
+	if body != "" {
+		reader = strings.NewReader(body)
+	}
+
+	req, _ := http.NewRequest(method, url, reader)
+	req.Host = "example.com"
+	req.Header.Set("Authorization", "Bearer "+testSCIMToken)
+	req.Header.Set("Content-Type", scim.ContentType)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	return rr
+}
+
+func TestSCIMAuth(t *testing.T) {
+	router := newRouter(new(MockUserRepository))
+
+	tests := []struct {
+		name   string
+		header string
+	}{
+		{name: "missing token"},
+		{name: "wrong token", header: "Bearer wrong"},
+		{name: "api key is not accepted", header: "Bearer " + testApiKey},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodGet, "/scim/v2/Users", nil)
+			if tt.header != "" {
+				req.Header.Set("Authorization", tt.header)
+			}
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+
+			if rr.Code != http.StatusUnauthorized {
+				t.Errorf("expected status %d, got %d", http.StatusUnauthorized, rr.Code)
+			}
+			if ct := rr.Header().Get("Content-Type"); ct != scim.ContentType {
+				t.Errorf("expected content type %q, got %q", scim.ContentType, ct)
+			}
+			if rr.Header().Get("WWW-Authenticate") == "" {
+				t.Error("expected WWW-Authenticate header")
+			}
+		})
+	}
+}
+
+func TestSCIMGetUsers(t *testing.T) {
+	mockRepo := new(MockUserRepository)
+	insertTestUser(mockRepo, &user1)
+	insertTestUser(mockRepo, &user2)
+	insertTestUser(mockRepo, &user3)
+	router := newRouter(mockRepo)
+
+	tests := []struct {
+		name         string
+		query        string
+		expCode      int
+		expTotal     int64
+		expStart     int
+		expUserNames []string
+		expScimType  string
+	}{
+		{
+			name:         "all users",
+			expCode:      http.StatusOK,
+			expTotal:     3,
+			expStart:     1,
+			expUserNames: []string{"jdoe", "asmith", "bjones"},
+		},
+		{
+			name:         "userName eq",
+			query:        `?filter=userName+eq+"asmith"`,
+			expCode:      http.StatusOK,
+			expTotal:     1,
+			expStart:     1,
+			expUserNames: []string{"asmith"},
+		},
+		{
+			name:         "emails.value co",
+			query:        `?filter=emails.value+co+"JONES@"`,
+			expCode:      http.StatusOK,
+			expTotal:     1,
+			expStart:     1,
+			expUserNames: []string{"bjones"},
+		},
+		{
+			name:         "startIndex and count",
+			query:        "?startIndex=2&count=1",
+			expCode:      http.StatusOK,
+			expTotal:     3,
+			expStart:     2,
+			expUserNames: []string{"asmith"},
+		},
+		{
+			name:         "count of 0",
+			query:        "?count=0",
+			expCode:      http.StatusOK,
+			expTotal:     3,
+			expStart:     1,
+			expUserNames: []string{},
+		},
+		{
+			name:        "unsupported filter",
+			query:       `?filter=displayName+eq+"John"`,
+			expCode:     http.StatusBadRequest,
+			expScimType: scim.TypeInvalidFilter,
+		},
+		{
+			name:        "unquoted value",
+			query:       `?filter=userName+eq+jdoe`,
+			expCode:     http.StatusBadRequest,
+			expScimType: scim.TypeInvalidFilter,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := scimRequester(router, http.MethodGet, "/scim/v2/Users"+tt.query, "")
+
+			if rr.Code != tt.expCode {
+				t.Fatalf("expected status %d, got %d: %s", tt.expCode, rr.Code, rr.Body.String())
+			}
+
+			if tt.expScimType != "" {
+				var e scim.Error
+				_ = json.Unmarshal(rr.Body.Bytes(), &e)
+				if e.ScimType != tt.expScimType || e.Status != strconv.Itoa(tt.expCode) {
+					t.Errorf("expected %s error with status %d, got %+v", tt.expScimType, tt.expCode, e)
+				}
+				return
+			}
+
+			var list struct {
+				TotalResults int64       `json:"totalResults"`
+				StartIndex   int         `json:"startIndex"`
+				ItemsPerPage int         `json:"itemsPerPage"`
+				Resources    []scim.User `json:"Resources"`
+			}
+			if err := json.Unmarshal(rr.Body.Bytes(), &list); err != nil {
+				t.Fatalf("failed to unmarshal response: %v", err)
+			}
+
+			userNames := []string{}
+			for _, u := range list.Resources {
+				userNames = append(userNames, u.UserName)
+			}
+			if list.TotalResults != tt.expTotal || list.StartIndex != tt.expStart || list.ItemsPerPage != len(userNames) {
+				t.Errorf("expected total %d from %d, got %d from %d with %d items",
+					tt.expTotal, tt.expStart, list.TotalResults, list.StartIndex, list.ItemsPerPage)
+			}
+			if !reflect.DeepEqual(userNames, tt.expUserNames) {
+				t.Errorf("expected users %v, got %v", tt.expUserNames, userNames)
+			}
+		})
+	}
+}
+
+func TestSCIMUsers(t *testing.T) {
+	mockRepo := new(MockUserRepository)
+	insertTestUser(mockRepo, &user1)
+	insertTestUser(mockRepo, &user2)
+	router := newRouter(mockRepo)
+
+	tests := []struct {
+		name        string
+		method      string
+		url         string
+		body        string
+		expCode     int
+		expScimType string
+		expUser     *model.User
+		expActive   bool
+	}{
+		{
+			name:      "get",
+			method:    http.MethodGet,
+			url:       "/scim/v2/Users/" + testUUID(1),
+			expCode:   http.StatusOK,
+			expUser:   &model.User{Username: "jdoe", Email: "jdoe@example.com", FullName: "John Doe"},
+			expActive: true,
+		},
+		{
+			name:    "numeric id is not found",
+			method:  http.MethodGet,
+			url:     "/scim/v2/Users/1",
+			expCode: http.StatusNotFound,
+		},
+		{
+			name:   "create",
+			method: http.MethodPost,
+			url:    "/scim/v2/Users",
+			body: `{"schemas": ["` + scim.UserSchema + `"], "userName": "bjones",
+				"name": {"givenName": "Bob", "familyName": "Jones"},
+				"emails": [{"value": "bob@home.example"}, {"value": "bjones@example.com", "primary": true}]}`,
+			expCode:   http.StatusCreated,
+			expUser:   &model.User{Username: "bjones", Email: "bjones@example.com", FullName: "Bob Jones"},
+			expActive: true,
+		},
+		{
+			name:        "create with taken userName",
+			method:      http.MethodPost,
+			url:         "/scim/v2/Users",
+			body:        `{"userName": "jdoe", "emails": [{"value": "john@example.com"}]}`,
+			expCode:     http.StatusConflict,
+			expScimType: scim.TypeUniqueness,
+		},
+		{
+			name:        "create with invalid email",
+			method:      http.MethodPost,
+			url:         "/scim/v2/Users",
+			body:        `{"userName": "cbrown", "emails": [{"value": "cbrown"}]}`,
+			expCode:     http.StatusBadRequest,
+			expScimType: scim.TypeInvalidValue,
+		},
+		{
+			name:      "replace",
+			method:    http.MethodPut,
+			url:       "/scim/v2/Users/" + testUUID(1),
+			body:      `{"userName": "jdoe", "displayName": "Johnny Doe", "emails": [{"value": "jdoe@example.com"}]}`,
+			expCode:   http.StatusOK,
+			expUser:   &model.User{Username: "jdoe", Email: "jdoe@example.com", FullName: "Johnny Doe"},
+			expActive: true,
+		},
+		{
+			name:   "patch",
+			method: http.MethodPatch,
+			url:    "/scim/v2/Users/" + testUUID(2),
+			body: `{"schemas": ["` + scim.PatchOpSchema + `"], "Operations": [
+				{"op": "Replace", "path": "emails[type eq \"work\"].value", "value": "alice@example.com"},
+				{"op": "replace", "value": {"name.formatted": "Alice Smith-Jones"}}]}`,
+			expCode:   http.StatusOK,
+			expUser:   &model.User{Username: "asmith", Email: "alice@example.com", FullName: "Alice Smith-Jones"},
+			expActive: true,
+		},
+		{
+			name:   "patch unsupported path",
+			method: http.MethodPatch,
+			url:    "/scim/v2/Users/" + testUUID(2),
+			body: `{"schemas": ["` + scim.PatchOpSchema + `"], "Operations": [
+				{"op": "replace", "path": "title", "value": "CEO"}]}`,
+			expCode:     http.StatusBadRequest,
+			expScimType: scim.TypeInvalidPath,
+		},
+		{
+			name:   "deactivate",
+			method: http.MethodPatch,
+			url:    "/scim/v2/Users/" + testUUID(2),
+			body: `{"schemas": ["` + scim.PatchOpSchema + `"], "Operations": [
+				{"op": "replace", "path": "active", "value": "False"}]}`,
+			expCode:   http.StatusOK,
+			expUser:   &model.User{Username: "asmith", Email: "alice@example.com", FullName: "Alice Smith-Jones"},
+			expActive: false,
+		},
+		{
+			name:    "deactivated user is not found",
+			method:  http.MethodGet,
+			url:     "/scim/v2/Users/" + testUUID(2),
+			expCode: http.StatusNotFound,
+		},
+		{
+			name:   "reactivate",
+			method: http.MethodPatch,
+			url:    "/scim/v2/Users/" + testUUID(2),
+			body: `{"schemas": ["` + scim.PatchOpSchema + `"], "Operations": [
+				{"op": "replace", "path": "active", "value": true}]}`,
+			expCode:   http.StatusOK,
+			expUser:   &model.User{Username: "asmith", Email: "alice@example.com", FullName: "Alice Smith-Jones"},
+			expActive: true,
+		},
+		{
+			name:    "delete",
+			method:  http.MethodDelete,
+			url:     "/scim/v2/Users/" + testUUID(1),
+			expCode: http.StatusNoContent,
+		},
+		{
+			name:    "deleted user is not found",
+			method:  http.MethodGet,
+			url:     "/scim/v2/Users/" + testUUID(1),
+			expCode: http.StatusNotFound,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := scimRequester(router, tt.method, tt.url, tt.body)
+
+			if rr.Code != tt.expCode {
+				t.Fatalf("expected status %d, got %d: %s", tt.expCode, rr.Code, rr.Body.String())
+			}
+
+			if tt.expScimType != "" {
+				var e scim.Error
+				_ = json.Unmarshal(rr.Body.Bytes(), &e)
+				if e.ScimType != tt.expScimType {
+					t.Errorf("expected scimType %q, got %q", tt.expScimType, e.ScimType)
+				}
+			}
+
+			if tt.expUser == nil {
+				return
+			}
+
+			var res scim.User
+			if err := json.Unmarshal(rr.Body.Bytes(), &res); err != nil {
+				t.Fatalf("failed to unmarshal response: %v", err)
+			}
+			got := res.ToUser()
+			if got != *tt.expUser {
+				t.Errorf("expected user %+v, got %+v", *tt.expUser, got)
+			}
+			if res.IsActive() != tt.expActive {
+				t.Errorf("expected active %v, got %v", tt.expActive, res.IsActive())
+			}
+			if res.Meta == nil || res.Meta.Location != "http://example.com/scim/v2/Users/"+res.ID || res.Meta.Version != rr.Header().Get("ETag") {
+				t.Errorf("unexpected meta %+v", res.Meta)
+			}
+		})
+	}
+}
+
+func TestSCIMDiscovery(t *testing.T) {
+	router := newRouter(new(MockUserRepository))
+
+	for _, path := range []string{"/ServiceProviderConfig", "/Schemas", "/ResourceTypes"} {
+		t.Run(path, func(t *testing.T) {
+			rr := scimRequester(router, http.MethodGet, "/scim/v2"+path, "")
+
+			if rr.Code != http.StatusOK {
+				t.Fatalf("expected status %d, got %d", http.StatusOK, rr.Code)
+			}
+			if !strings.Contains(rr.Body.String(), `"schemas":["urn:ietf:params:scim:`) {
+				t.Errorf("expected SCIM schemas, got %s", rr.Body.String())
+			}
+		})
+	}
+}
+
+type graphQLResponse struct {
+	Data   map[string]json.RawMessage `json:"data"`
+	Errors []struct {
+		Message    string `json:"message"`
+		Extensions struct {
+			Code   string                      `json:"code"`
+			Field  string                      `json:"field"`
+			Errors validation.ValidationErrors `json:"errors"`
+		} `json:"extensions"`
+	} `json:"errors"`
+}
+
+func graphQLRequester(t *testing.T, router *gin.Engine, method string, req map[string]any) *graphQLResponse {
+	t.Helper()
+
+	var httpReq *http.Request
+	if method == http.MethodGet {
+		params := make([]string, 0, len(req))
+		for k, v := range req {
+			s, ok := v.(string)
+			if !ok {
+				data, _ := json.Marshal(v)
+				s = string(data)
+			}
+			params = append(params, k+"="+url.QueryEscape(s))
+		}
+		httpReq, _ = http.NewRequest(method, "/api/graphql?"+strings.Join(params, "&"), nil)
+	} else {
+		data, _ := json.Marshal(req)
+		httpReq, _ = http.NewRequest(method, "/api/graphql", bytes.NewReader(data))
+	}
+	httpReq.Header.Set("x-api-key", testApiKey)
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httpReq)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	res := new(graphQLResponse)
+	if err := json.Unmarshal(rr.Body.Bytes(), res); err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+func TestGraphQL(t *testing.T) {
+	tests := []struct {
+		name      string
+		method    string
+		query     string
+		variables map[string]any
+		expData   string
+		expCode   string
+		expField  string
+		expErrs   validation.ValidationErrors
+	}{
+		{
+			name:    "only the selected fields are returned",
+			query:   `{ user(username: "asmith") { id fullName } }`,
+			expData: `{"user":{"id":"` + testUUID(2) + `","fullName":"Alice Smith"}}`,
+		},
+		{
+			name:    "user by id",
+			method:  http.MethodGet,
+			query:   `{ user(id: "` + testUUID(3) + `") { username version } }`,
+			expData: `{"user":{"username":"bjones","version":1}}`,
+		},
+		{
+			name:    "user requires exactly one key",
+			query:   `{ user(id: "` + testUUID(3) + `", username: "bjones") { username } }`,
+			expData: `{"user":null}`,
+			expCode: gql.CodeBadUserInput,
+		},
+		{
+			name:    "unknown user",
+			query:   `{ user(username: "nobody") { id } }`,
+			expData: `{"user":null}`,
+			expCode: gql.CodeNotFound,
+		},
+		{
+			name:    "invalid uuid",
+			query:   `{ user(id: "42") { id } }`,
+			expData: `{"user":null}`,
+			expCode: gql.CodeBadUserInput,
+			expErrs: validation.ValidationErrors{validation.ErrInvalidUUID},
+		},
+		{
+			name:    "connection",
+			query:   `{ users(first: 2, sort: USERNAME, order: DESC) { nodes { username } pageInfo { hasNextPage } } }`,
+			expData: `{"users":{"nodes":[{"username":"jdoe"},{"username":"bjones"}],"pageInfo":{"hasNextPage":true}}}`,
+		},
+		{
+			name:      "connection with filters",
+			query:     `query($prefix: String) { users(usernamePrefix: $prefix) { edges { node { username } } pageInfo { hasNextPage endCursor } } }`,
+			variables: map[string]any{"prefix": "as"},
+			expData: `{"users":{"edges":[{"node":{"username":"asmith"}}],"pageInfo":{"hasNextPage":false,"endCursor":"` +
+				model.NewCursor("id", "asc", &model.User{ID: 2}).Encode() + `"}}}`,
+		},
+		{
+			name:    "connection filtered by updatedAfter with an offset",
+			query:   `{ users(updatedAfter: "2025-09-23T10:45:00+02:00") { nodes { username } } }`,
+			expData: `{"users":{"nodes":[{"username":"asmith"},{"username":"bjones"}]}}`,
+		},
+		{
+			name:    "invalid page size",
+			query:   `{ users(first: 0) { nodes { id } } }`,
+			expData: `null`,
+			expCode: gql.CodeBadUserInput,
+			expErrs: validation.ValidationErrors{validation.ErrInvalidLimit},
+		},
+		{
+			name:    "create user",
+			query:   `mutation { createUser(input: {username: "dgreen", email: "dgreen@example.com"}) { id username fullName } }`,
+			expData: `{"createUser":{"id":"` + testUUID(4) + `","username":"dgreen","fullName":""}}`,
+		},
+		{
+			name:    "every invalid field is reported",
+			query:   `mutation { createUser(input: {username: "x", email: "invalid"}) { id } }`,
+			expData: `null`,
+			expCode: gql.CodeBadUserInput,
+			expErrs: validation.ValidationErrors{validation.ErrShortUsername, validation.ErrInvalidEmail},
+		},
+		{
+			name:     "taken username",
+			query:    `mutation { createUser(input: {username: "jdoe", email: "john@example.com"}) { id } }`,
+			expData:  `null`,
+			expCode:  gql.CodeConflict,
+			expField: "username",
+		},
+		{
+			name:    "update changes the given fields only",
+			query:   `mutation { updateUser(id: "` + testUUID(1) + `", input: {fullName: "Johnny Doe"}, ifMatch: 1) { username fullName version } }`,
+			expData: `{"updateUser":{"username":"jdoe","fullName":"Johnny Doe","version":2}}`,
+		},
+		{
+			name:    "update of a modified user",
+			query:   `mutation { updateUser(id: "` + testUUID(1) + `", input: {fullName: "John Doe"}, ifMatch: 5) { version } }`,
+			expData: `null`,
+			expCode: gql.CodePreconditionFailed,
+		},
+		{
+			name:    "delete user",
+			query:   `mutation { deleteUser(id: "` + testUUID(3) + `") }`,
+			expData: `{"deleteUser":"` + testUUID(3) + `"}`,
+		},
+		{
+			name:    "mutations are refused with GET",
+			method:  http.MethodGet,
+			query:   `mutation { deleteUser(id: "` + testUUID(2) + `") }`,
+			expCode: gql.CodeBadRequest,
+		},
+		{
+			name:    "query is too deep",
+			query:   `{ __schema { types { fields { type { ofType { ofType { ofType { ofType { ofType { ofType { ofType { ofType { ofType { ofType { ofType { name } } } } } } } } } } } } } } } }`,
+			expCode: gql.CodeQueryTooComplex,
+		},
+		{
+			name:    "query is too complex",
+			query:   `{ users(first: 1000) { edges { cursor node { id username email fullName createdAt } } } }`,
+			expCode: gql.CodeQueryTooComplex,
+		},
+		{
+			name:      "complexity of a variable page size",
+			query:     `query($first: Int) { users(first: $first) { nodes { id username email fullName createdAt updatedAt } } }`,
+			variables: map[string]any{"first": 1000},
+			expCode:   gql.CodeQueryTooComplex,
+		},
+		{
+			name:    "complexity of a default page size",
+			query:   `query($first: Int = 100000) { users(first: $first) { nodes { id username email fullName createdAt updatedAt } } }`,
+			expCode: gql.CodeQueryTooComplex,
+		},
+		{
+			name:      "complexity of an unreadable page size",
+			query:     `query($first: Int) { users(first: $first) { nodes { id username email fullName createdAt updatedAt } } }`,
+			variables: map[string]any{"first": "many"},
+			expCode:   gql.CodeQueryTooComplex,
+		},
+	}
+
+	mockRepo := new(MockUserRepository)
+	insertTestUser(mockRepo, &user1)
+	insertTestUser(mockRepo, &user2)
+	insertTestUser(mockRepo, &user3)
+	router := newRouter(mockRepo)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			method := tt.method
+			if method == "" {
+				method = http.MethodPost
+			}
+			req := map[string]any{"query": tt.query}
+			if tt.variables != nil {
+				req["variables"] = tt.variables
+			}
+
+			res := graphQLRequester(t, router, method, req)
+
+			if tt.expCode == "" {
+				if len(res.Errors) != 0 {
+					t.Fatalf("unexpected errors %+v", res.Errors)
+				}
+			} else {
+				if len(res.Errors) != 1 || res.Errors[0].Extensions.Code != tt.expCode {
+					t.Fatalf("expected error %s, got %+v", tt.expCode, res.Errors)
+				}
+				ext := res.Errors[0].Extensions
+				if !reflect.DeepEqual(ext.Errors, tt.expErrs) {
+					t.Errorf("expected errors %v, got %v", tt.expErrs, ext.Errors)
+				}
+				if ext.Field != tt.expField {
+					t.Errorf("expected field %q, got %q", tt.expField, ext.Field)
+				}
+			}
+
+			if tt.expData != "" {
+				data, _ := json.Marshal(res.Data)
+				var got, exp any
+				_ = json.Unmarshal(data, &got)
+				_ = json.Unmarshal([]byte(tt.expData), &exp)
+				if !reflect.DeepEqual(got, exp) {
+					t.Errorf("expected data %s, got %s", tt.expData, data)
+				}
+			}
+		})
+	}
+}
+
+func TestGraphQLPagination(t *testing.T) {
+	mockRepo := new(MockUserRepository)
+	insertTestUser(mockRepo, &user1)
+	insertTestUser(mockRepo, &user2)
+	insertTestUser(mockRepo, &user3)
+	router := newRouter(mockRepo)
+
+	query := `query($after: String) { users(first: 2, after: $after) { edges { cursor node { username } } pageInfo { hasNextPage endCursor } } }`
+
+	var (
+		usernames []string
+		after     any
+	)
+	for range 3 {
+		res := graphQLRequester(t, router, http.MethodPost, map[string]any{"query": query, "variables": map[string]any{"after": after}})
+		if len(res.Errors) != 0 {
+			t.Fatalf("unexpected errors %+v", res.Errors)
+		}
+
+		var page struct {
+			Edges []struct {
+				Cursor string `json:"cursor"`
+				Node   struct {
+					Username string `json:"username"`
+				} `json:"node"`
+			} `json:"edges"`
+			PageInfo struct {
+				HasNextPage bool   `json:"hasNextPage"`
+				EndCursor   string `json:"endCursor"`
+			} `json:"pageInfo"`
+		}
+		_ = json.Unmarshal(res.Data["users"], &page)
+
+		for _, edge := range page.Edges {
+			usernames = append(usernames, edge.Node.Username)
+		}
+		if page.PageInfo.EndCursor != page.Edges[len(page.Edges)-1].Cursor {
+			t.Errorf("expected endCursor to be the cursor of the last edge")
+		}
+		if !page.PageInfo.HasNextPage {
+			break
+		}
+		after = page.PageInfo.EndCursor
+	}
+
+	if got := strings.Join(usernames, ","); got != "jdoe,asmith,bjones" {
+		t.Errorf("expected jdoe,asmith,bjones, got %s", got)
+	}
+}
+
+func TestGraphQLPersistedQueries(t *testing.T) {
+	mockRepo := new(MockUserRepository)
+	insertTestUser(mockRepo, &user1)
+	router := newRouter(mockRepo)
+
+	query := `{ user(username: "jdoe") { fullName } }`
+	sum := sha256.Sum256([]byte(query))
+	hash := hex.EncodeToString(sum[:])
+	persisted := map[string]any{"persistedQuery": map[string]any{"version": 1, "sha256Hash": hash}}
+
+	res := graphQLRequester(t, router, http.MethodGet, map[string]any{"extensions": persisted})
+	if len(res.Errors) != 1 || res.Errors[0].Extensions.Code != gql.CodePersistedNotFound {
+		t.Fatalf("expected %s, got %+v", gql.CodePersistedNotFound, res.Errors)
+	}
+
+	wrong := map[string]any{"persistedQuery": map[string]any{"version": 1, "sha256Hash": strings.Repeat("0", 64)}}
+	res = graphQLRequester(t, router, http.MethodPost, map[string]any{"query": query, "extensions": wrong})
+	if len(res.Errors) != 1 || res.Errors[0].Extensions.Code != gql.CodeBadRequest {
+		t.Fatalf("expected %s, got %+v", gql.CodeBadRequest, res.Errors)
+	}
+
+	res = graphQLRequester(t, router, http.MethodPost, map[string]any{"query": query, "extensions": persisted})
+	if len(res.Errors) != 0 {
+		t.Fatalf("unexpected errors %+v", res.Errors)
+	}
+
+	res = graphQLRequester(t, router, http.MethodGet, map[string]any{"extensions": persisted})
+	if len(res.Errors) != 0 {
+		t.Fatalf("unexpected errors %+v", res.Errors)
+	}
+	if got := string(res.Data["user"]); got != `{"fullName":"John Doe"}` {
+		t.Errorf("unexpected data %s", got)
+	}
+}
+
+func TestGraphQLAuth(t *testing.T) {
+	router := newRouter(new(MockUserRepository))
+
+	req, _ := http.NewRequest(http.MethodPost, "/api/graphql", strings.NewReader(`{"query":"{ user(username: \"jdoe\") { id } }"}`))
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected status 401, got %d", rr.Code)
+	}
+}
+
+type sseEvent struct {
+	ID    string
+	Event string
+	Data  model.UserEvent
+}
+
+// readEvents reads n events from the stream, skipping the comments.
+func readEvents(t *testing.T, r *bufio.Reader, n int) []sseEvent {
+	t.Helper()
+
+	var (
+		events []sseEvent
+		event  sseEvent
+	)
+	for len(events) < n {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("reading the stream: %v", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+
+		switch {
+		case line == "":
+			if event.Event != "" {
+				events = append(events, event)
+			}
+			event = sseEvent{}
+		case strings.HasPrefix(line, "id: "):
+			event.ID = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "event: "):
+			event.Event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			if err = json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &event.Data); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	return events
+}
+
+func TestUserEvents(t *testing.T) {
+	mockRepo := new(MockUserRepository)
+	server := httptest.NewServer(newRouter(mockRepo))
+	defer server.Close()
+
+	send := func(method, path string, body string, header ...string) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequestWithContext(t.Context(), method, server.URL+path, strings.NewReader(body))
+		req.Header.Set("x-api-key", testApiKey)
+		req.Header.Set("Content-Type", "application/json")
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	mutate := func(method, path, body string, expCode int) {
+		t.Helper()
+		resp := send(method, path, body)
+		_ = resp.Body.Close()
+		if resp.StatusCode != expCode {
+			t.Fatalf("%s %s: expected status %d, got %d", method, path, expCode, resp.StatusCode)
+		}
+	}
+
+	mutate(http.MethodPost, "/api/v1/users/", `{"username":"jdoe","email":"jdoe@example.com","full_name":"John Doe"}`, http.StatusOK)
+	mutate(http.MethodPatch, "/api/v1/users/"+testUUID(1), `{"full_name":"Johnny Doe"}`, http.StatusNoContent)
+	mutate(http.MethodPost, "/api/v1/users/", `{"username":"jdoe","email":"other@example.com"}`, http.StatusConflict)
+	mutate(http.MethodDelete, "/api/v1/users/"+testUUID(1), ``, http.StatusNoContent)
+	mutate(http.MethodDelete, "/api/v1/users/"+testUUID(1), ``, http.StatusNoContent)
+
+	t.Run("replay after Last-Event-ID", func(t *testing.T) {
+		resp := send(http.MethodGet, "/api/v1/users/events", "", "Last-Event-ID", "0")
+		defer func() { _ = resp.Body.Close() }()
+
+		if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+			t.Fatalf("expected text/event-stream, got %s", ct)
+		}
+
+		events := readEvents(t, bufio.NewReader(resp.Body), 3)
+		exp := []struct {
+			id, event string
+			version   int64
+			changes   map[string]any
+		}{
+			{"1", model.UserCreated, 1, map[string]any{"username": "jdoe", "email": "jdoe@example.com", "full_name": "John Doe"}},
+			{"2", model.UserUpdated, 2, map[string]any{"full_name": "Johnny Doe"}},
+			{"3", model.UserDeleted, 3, nil},
+		}
+		for i, e := range exp {
+			got := events[i]
+			if got.ID != e.id || got.Event != e.event || got.Data.Type != e.event || got.Data.UUID != testUUID(1) {
+				t.Errorf("event %d: unexpected %+v", i, got)
+			}
+			if e.changes != nil && !reflect.DeepEqual(got.Data.Changes, e.changes) {
+				t.Errorf("event %d: expected changes %v, got %v", i, e.changes, got.Data.Changes)
+			}
+		}
+		if _, ok := events[2].Data.Changes["deleted_at"]; !ok {
+			t.Errorf("expected deleted_at in the changes of the deletion")
+		}
+	})
+
+	t.Run("live events", func(t *testing.T) {
+		resp := send(http.MethodGet, "/api/v1/users/events", "")
+		defer func() { _ = resp.Body.Close() }()
+		r := bufio.NewReader(resp.Body)
+
+		mutate(http.MethodPost, "/api/v1/users/"+testUUID(1)+"/restore", ``, http.StatusOK)
+		mutate(http.MethodPost, "/api/v1/users:batch?atomic=true", `{"operations":[`+
+			`{"op":"create","user":{"username":"asmith","email":"asmith@example.com"}},`+
+			`{"op":"patch","id":"`+testUUID(1)+`","patch":{"email":"john@example.com"}}]}`, http.StatusOK)
+
+		events := readEvents(t, r, 3)
+		var got []string
+		for _, e := range events {
+			got = append(got, e.ID+":"+e.Event)
+		}
+		if exp := "4:user.updated,5:user.created,6:user.updated"; strings.Join(got, ",") != exp {
+			t.Errorf("expected %s, got %s", exp, strings.Join(got, ","))
+		}
+		if v, ok := events[0].Data.Changes["deleted_at"]; !ok || v != nil {
+			t.Errorf("expected deleted_at to be cleared on restore, got %v", events[0].Data.Changes)
+		}
+	})
+
+	t.Run("rolled back batch emits nothing", func(t *testing.T) {
+		mutate(http.MethodPost, "/api/v1/users:batch?atomic=true", `{"operations":[`+
+			`{"op":"create","user":{"username":"bjones","email":"bjones@example.com"}},`+
+			`{"op":"create","user":{"username":"x","email":"x@example.com"}}]}`, http.StatusMultiStatus)
+
+		if id, _ := mockRepo.LastEventID(t.Context()); id != 6 {
+			t.Errorf("expected 6 events, got %d", id)
+		}
+	})
+
+	t.Run("invalid Last-Event-ID", func(t *testing.T) {
+		resp := send(http.MethodGet, "/api/v1/users/events?last_event_id=abc", "")
+		_ = resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d", resp.StatusCode)
+		}
+	})
+}
+
+func TestWebhooks(t *testing.T) {
+	var (
+		secret   string
+		received []model.UserEvent
+	)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		timestamp, _ := strconv.ParseInt(r.Header.Get(webhook.TimestampHeader), 10, 64)
+		if !webhook.Verify(secret, timestamp, body, r.Header.Get(webhook.SignatureHeader)) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var event model.UserEvent
+		_ = json.Unmarshal(body, &event)
+		received = append(received, event)
+	}))
+	defer receiver.Close()
+
+	mockWebhooks := new(MockWebhookRepository)
+	mockRepo := &MockUserRepository{Webhooks: mockWebhooks}
+	repositories := &repository.Repository{Users: mockRepo, Idempotency: new(MockIdempotencyRepository), Webhooks: mockWebhooks}
+	router := newRouterWithRepositories(repositories)
+
+	send := func(method, path string, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("x-api-key", testApiKey)
+		req.Header.Set("Content-Type", "application/json")
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+	decode := func(rr *httptest.ResponseRecorder, v any) {
+		t.Helper()
+		if err := json.Unmarshal(rr.Body.Bytes(), v); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Run("create", func(t *testing.T) {
+		rr := send(http.MethodPost, "/api/v1/webhooks", `{"url":"ftp://crm","events":["user.renamed"]}`)
+		var p problem.Problem
+		decode(rr, &p)
+		if rr.Code != http.StatusBadRequest || !reflect.DeepEqual(p.Errors, validation.ValidationErrors{validation.ErrInvalidWebhookURL, validation.ErrInvalidWebhookEvent}) {
+			t.Fatalf("expected 400 with the url and events errors, got %d: %s", rr.Code, rr.Body)
+		}
+
+		rr = send(http.MethodPost, "/api/v1/webhooks", `{"url":"`+receiver.URL+`/crm","events":["user.created","user.deleted"]}`)
+		var created model.Webhook
+		decode(rr, &created)
+		if rr.Code != http.StatusCreated || !created.Active || created.UUID != "00000000-0000-4000-9000-000000000001" ||
+			!strings.HasPrefix(created.Secret, "whsec_") {
+			t.Fatalf("unexpected webhook %d: %s", rr.Code, rr.Body)
+		}
+		secret = created.Secret
+
+		if rr = send(http.MethodPost, "/api/v1/webhooks", `{"url":"`+receiver.URL+`/billing"}`); rr.Code != http.StatusCreated {
+			t.Fatalf("expected status 201, got %d", rr.Code)
+		}
+	})
+
+	t.Run("list without secrets", func(t *testing.T) {
+		rr := send(http.MethodGet, "/api/v1/webhooks", "")
+		if rr.Code != http.StatusOK || strings.Contains(rr.Body.String(), "whsec_") {
+			t.Fatalf("unexpected response %d: %s", rr.Code, rr.Body)
+		}
+		var res struct{ Webhooks []model.Webhook }
+		decode(rr, &res)
+		if len(res.Webhooks) != 2 || len(res.Webhooks[1].Events) != 0 || res.Webhooks[1].Events == nil {
+			t.Errorf("unexpected webhooks %s", rr.Body)
+		}
+	})
+
+	t.Run("update", func(t *testing.T) {
+		path := "/api/v1/webhooks/00000000-0000-4000-9000-000000000002"
+		rr := send(http.MethodPatch, path, `{"active":false}`)
+		var updated model.Webhook
+		decode(rr, &updated)
+		if rr.Code != http.StatusOK || updated.Active || updated.URL != receiver.URL+"/billing" {
+			t.Fatalf("unexpected webhook %d: %s", rr.Code, rr.Body)
+		}
+
+		if rr = send(http.MethodPatch, path, `{"url":""}`); rr.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d", rr.Code)
+		}
+		if rr = send(http.MethodPatch, "/api/v1/webhooks/00000000-0000-4000-9000-000000000009", `{}`); rr.Code != http.StatusNotFound {
+			t.Errorf("expected status 404, got %d", rr.Code)
+		}
+		if rr = send(http.MethodGet, "/api/v1/webhooks/42", ""); rr.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d", rr.Code)
+		}
+	})
+
+	// Only the creation matches the events of the active webhook, and the
+	// failed batch leaves nothing in the outbox.
+	send(http.MethodPost, "/api/v1/users/", `{"username":"jdoe","email":"jdoe@example.com"}`)
+	send(http.MethodPatch, "/api/v1/users/"+testUUID(1), `{"full_name":"John Doe"}`)
+	send(http.MethodPost, "/api/v1/users:batch?atomic=true", `{"operations":[`+
+		`{"op":"create","user":{"username":"asmith","email":"asmith@example.com"}},`+
+		`{"op":"create","user":{"username":"x","email":"x@example.com"}}]}`)
+
+	crm := "/api/v1/webhooks/00000000-0000-4000-9000-000000000001"
+
+	t.Run("outbox", func(t *testing.T) {
+		rr := send(http.MethodGet, crm+"/deliveries", "")
+		var res struct{ Deliveries []model.WebhookDelivery }
+		decode(rr, &res)
+		if rr.Code != http.StatusOK || len(res.Deliveries) != 1 ||
+			res.Deliveries[0].EventType != model.UserCreated || res.Deliveries[0].Status != model.DeliveryPending {
+			t.Fatalf("unexpected deliveries %d: %s", rr.Code, rr.Body)
+		}
+
+		rr = send(http.MethodGet, "/api/v1/webhooks/00000000-0000-4000-9000-000000000002/deliveries", "")
+		if rr.Code != http.StatusOK || rr.Body.String() != `{"deliveries":[]}` {
+			t.Errorf("expected no deliveries for the inactive webhook, got %s", rr.Body)
+		}
+
+		if rr = send(http.MethodGet, crm+"/deliveries?status=failed", ""); rr.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d", rr.Code)
+		}
+	})
+
+	t.Run("dispatch", func(t *testing.T) {
+		n, err := webhook.NewDispatcher(mockWebhooks, events.NewBroker()).Dispatch(t.Context())
+		if err != nil || n != 1 {
+			t.Fatalf("expected 1 delivery, got %d: %v", n, err)
+		}
+		if len(received) != 1 || received[0].Type != model.UserCreated || received[0].UUID != testUUID(1) {
+			t.Fatalf("unexpected events received %v", received)
+		}
+
+		rr := send(http.MethodGet, crm+"/deliveries/1", "")
+		var delivery model.WebhookDelivery
+		decode(rr, &delivery)
+		if rr.Code != http.StatusOK || delivery.Status != model.DeliveryDelivered || delivery.Attempts != 1 ||
+			len(delivery.History) != 1 || delivery.History[0].StatusCode != http.StatusOK {
+			t.Fatalf("unexpected delivery %d: %s", rr.Code, rr.Body)
+		}
+	})
+
+	t.Run("redeliver", func(t *testing.T) {
+		rr := send(http.MethodPost, crm+"/deliveries/1/redeliver", "")
+		var delivery model.WebhookDelivery
+		decode(rr, &delivery)
+		if rr.Code != http.StatusAccepted || delivery.Status != model.DeliveryPending || delivery.Attempts != 0 || len(delivery.History) != 1 {
+			t.Fatalf("unexpected delivery %d: %s", rr.Code, rr.Body)
+		}
+
+		if rr = send(http.MethodGet, crm+"/deliveries/abc", ""); rr.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400, got %d", rr.Code)
+		}
+		if rr = send(http.MethodPost, crm+"/deliveries/9/redeliver", ""); rr.Code != http.StatusNotFound {
+			t.Errorf("expected status 404, got %d", rr.Code)
+		}
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		if rr := send(http.MethodDelete, crm, ""); rr.Code != http.StatusNoContent {
+			t.Fatalf("expected status 204, got %d", rr.Code)
+		}
+		if rr := send(http.MethodGet, crm+"/deliveries/1", ""); rr.Code != http.StatusNotFound {
+			t.Errorf("expected status 404, got %d", rr.Code)
+		}
+		if rr := send(http.MethodDelete, crm, ""); rr.Code != http.StatusNotFound {
+			t.Errorf("expected status 404, got %d", rr.Code)
+		}
+	})
+}
+
+func TestAudit(t *testing.T) {
+	mockRepo := new(MockUserRepository)
+	router := newRouter(mockRepo)
+
+	send := func(method, path, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("x-api-key", testApiKey)
+		req.Header.Set("X-Request-ID", "req-"+method)
+		req.RemoteAddr = "192.0.2.1:1234"
+		req.Header.Set("Content-Type", "application/json")
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	send(http.MethodPost, "/api/v1/users/", `{"username":"jdoe","email":"jdoe@example.com","full_name":"John Doe"}`)
+	send(http.MethodPost, "/api/v1/users/", `{"username":"asmith","email":"asmith@example.com"}`)
+	send(http.MethodPatch, "/api/v1/users/"+testUUID(1), `{"email":"john@example.com"}`)
+	send(http.MethodPatch, "/api/v1/users/"+testUUID(1), `{"email":"asmith@example.com"}`)
+	send(http.MethodDelete, "/api/v1/users/"+testUUID(1), ``)
+	send(http.MethodPost, "/api/v1/users/"+testUUID(1)+"/restore", ``)
+
+	actor := audit.KeyActor("api-key", testApiKey)
+	user := map[string]any{"username": "jdoe", "email": "john@example.com", "full_name": "John Doe"}
+
+	t.Run("entries of the user", func(t *testing.T) {
+		rr := send(http.MethodGet, "/api/v1/audit?user_id="+testUUID(1), "")
+		var res struct{ Entries []model.AuditEntry }
+		if err := json.Unmarshal(rr.Body.Bytes(), &res); err != nil || rr.Code != http.StatusOK {
+			t.Fatalf("unexpected response %d: %s", rr.Code, rr.Body)
+		}
+
+		exp := []struct {
+			action, requestID string
+			before, after     map[string]any
+		}{
+			{model.AuditRestore, "req-POST", nil, user},
+			{model.AuditDelete, "req-DELETE", user, nil},
+			{model.AuditUpdate, "req-PATCH", map[string]any{"email": "jdoe@example.com"}, map[string]any{"email": "john@example.com"}},
+			{model.AuditCreate, "req-POST", nil, map[string]any{"username": "jdoe", "email": "jdoe@example.com", "full_name": "John Doe"}},
+		}
+		if len(res.Entries) != len(exp) {
+			t.Fatalf("expected %d entries, got %s", len(exp), rr.Body)
+		}
+		for i, e := range exp {
+			got := res.Entries[i]
+			if got.Action != e.action || got.Actor != actor || got.RequestID != e.requestID || got.ClientIP != "192.0.2.1" ||
+				got.UserID != 1 || !reflect.DeepEqual(got.Before, e.before) || !reflect.DeepEqual(got.After, e.after) {
+				t.Errorf("entry %d: unexpected %+v", i, got)
+			}
+		}
+	})
+
+	t.Run("filters", func(t *testing.T) {
+		tests := []struct {
+			query   string
+			entries int
+		}{
+			{"", 5},
+			{"?user_id=2", 1},
+			{"?actor=" + actor, 5},
+			{"?actor=scim:000000000000", 0},
+			{"?since=" + testTime.Format(time.RFC3339), 5},
+			{"?since=" + testTime.Add(time.Second).Format(time.RFC3339), 0},
+			{"?limit=2", 2},
+			{"?before=3", 2},
+		}
+		for _, tt := range tests {
+			rr := send(http.MethodGet, "/api/v1/audit"+tt.query, "")
+			var res struct{ Entries []model.AuditEntry }
+			_ = json.Unmarshal(rr.Body.Bytes(), &res)
+			if rr.Code != http.StatusOK || len(res.Entries) != tt.entries {
+				t.Errorf("%q: expected %d entries, got %d: %s", tt.query, tt.entries, rr.Code, rr.Body)
+			}
+		}
+
+		for _, query := range []string{"?user_id=abc", "?user_id=0", "?limit=1001", "?since=yesterday"} {
+			if rr := send(http.MethodGet, "/api/v1/audit"+query, ""); rr.Code != http.StatusBadRequest {
+				t.Errorf("%q: expected status 400, got %d", query, rr.Code)
+			}
+		}
+	})
+
+	t.Run("verify", func(t *testing.T) {
+		rr := send(http.MethodGet, "/api/v1/audit/verify", "")
+		if rr.Code != http.StatusOK || rr.Body.String() != `{"valid":true,"entries":5}` {
+			t.Fatalf("unexpected verification %d: %s", rr.Code, rr.Body)
+		}
+
+		mockRepo.Audit[2].After["email"] = "someone@example.com"
+		if rr = send(http.MethodGet, "/api/v1/audit/verify", ""); rr.Body.String() != `{"valid":false,"entries":3,"broken_at":3}` {
+			t.Errorf("expected the tampered entry to break the chain, got %s", rr.Body)
+		}
+
+		mockRepo.Audit[2].After["email"] = "john@example.com"
+		mockRepo.Audit = slices.Delete(mockRepo.Audit, 1, 2)
+		if rr = send(http.MethodGet, "/api/v1/audit/verify", ""); rr.Body.String() != `{"valid":false,"entries":2,"broken_at":3}` {
+			t.Errorf("expected the removed entry to break the chain, got %s", rr.Body)
+		}
+	})
+}
+
+func TestAPIKeys(t *testing.T) {
+	mockRepo, mockKeys := new(MockUserRepository), new(MockAPIKeyRepository)
+	insertTestUser(mockRepo, &user1)
+	router := newRouterWithRepositories(&repository.Repository{
+		Users: mockRepo, Idempotency: new(MockIdempotencyRepository), APIKeys: mockKeys,
+	})
+
+	send := func(key, method, path, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("x-api-key", key)
+		req.Header.Set("Content-Type", "application/json")
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+	create := func(t *testing.T, body string) model.APIKey {
+		t.Helper()
+		rr := send(testApiKey, http.MethodPost, "/api/v1/api-keys", body)
+		var key model.APIKey
+		if err := json.Unmarshal(rr.Body.Bytes(), &key); err != nil || rr.Code != http.StatusCreated {
+			t.Fatalf("unexpected response %d: %s", rr.Code, rr.Body)
+		}
+		return key
+	}
+	expect := func(t *testing.T, rr *httptest.ResponseRecorder, code int, detail string) {
+		t.Helper()
+		var p problem.Problem
+		_ = json.Unmarshal(rr.Body.Bytes(), &p)
+		if rr.Code != code || detail != "" && p.Detail != detail {
+			t.Errorf("expected %d %q, got %d: %s", code, detail, rr.Code, rr.Body)
+		}
+	}
+
+	reader := create(t, `{"name":"billing","owner":"billing@example.com","scopes":["users:read"]}`)
+	writer := create(t, `{"name":"crm","scopes":["users:write"]}`)
+	expect(t, send(testApiKey, http.MethodPost, "/api/v1/role-assignments", `{"principal":"api-key:`+writer.UUID+`","role":"operator"}`),
+		http.StatusCreated, "")
+
+	t.Run("create", func(t *testing.T) {
+		if !strings.HasPrefix(reader.Key, "ck_"+reader.Prefix+"_") || reader.UUID == "" || reader.Name != "billing" ||
+			!reflect.DeepEqual(reader.Scopes, []string{model.ScopeUsersRead}) {
+			t.Errorf("unexpected key %+v", reader)
+		}
+		if stored := mockKeys.Keys[0]; len(stored.Salt) == 0 || len(stored.Hash) == 0 || strings.Contains(string(stored.Hash), reader.Key) {
+			t.Errorf("expected a salted hash to be stored, got %+v", stored)
+		}
+
+		expect(t, send(testApiKey, http.MethodPost, "/api/v1/api-keys", `{"name":"ops"}`), http.StatusBadRequest, "scopes not specified")
+		expect(t, send(testApiKey, http.MethodPost, "/api/v1/api-keys", `{"name":"ops","scopes":["users:delete"]}`),
+			http.StatusBadRequest, "scopes must be some of users:read, users:write, admin")
+		expect(t, send(testApiKey, http.MethodPost, "/api/v1/api-keys", `{"name":"ops","scopes":["admin"],"expires_at":"2020-01-01T00:00:00Z"}`),
+			http.StatusBadRequest, "expires_at must be in the future")
+	})
+
+	t.Run("plaintext is not kept for replays", func(t *testing.T) {
+		var keys []string
+		for range 2 {
+			req, _ := http.NewRequest(http.MethodPost, "/api/v1/api-keys", strings.NewReader(`{"name":"ops","scopes":["users:read"]}`))
+			req.Header.Set("x-api-key", testApiKey)
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("Idempotency-Key", "ops")
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+
+			var key model.APIKey
+			_ = json.Unmarshal(rr.Body.Bytes(), &key)
+			if rr.Code != http.StatusCreated || rr.Header().Get("Idempotent-Replayed") != "" {
+				t.Fatalf("expected a new key, got %d %v", rr.Code, rr.Header())
+			}
+			keys = append(keys, key.Key)
+		}
+		if keys[0] == keys[1] {
+			t.Error("expected the key not to be replayed")
+		}
+	})
+
+	t.Run("plaintext is only shown at creation", func(t *testing.T) {
+		rr := send(testApiKey, http.MethodGet, "/api/v1/api-keys", "")
+		if rr.Code != http.StatusOK || strings.Contains(rr.Body.String(), reader.Key) || strings.Contains(rr.Body.String(), `"key"`) {
+			t.Errorf("unexpected list %d: %s", rr.Code, rr.Body)
+		}
+		rr = send(testApiKey, http.MethodGet, "/api/v1/api-keys/"+reader.UUID, "")
+		if rr.Code != http.StatusOK || strings.Contains(rr.Body.String(), `"key"`) {
+			t.Errorf("unexpected key %d: %s", rr.Code, rr.Body)
+		}
+		expect(t, send(testApiKey, http.MethodGet, "/api/v1/api-keys/"+testUUID(9), ""), http.StatusNotFound, "api key not found")
+	})
+
+	t.Run("scopes", func(t *testing.T) {
+		expect(t, send(reader.Key, http.MethodGet, "/api/v1/users/"+testUUID(1), ""), http.StatusOK, "")
+		expect(t, send(reader.Key, http.MethodPatch, "/api/v1/users/"+testUUID(1), `{"full_name":"J. Doe"}`),
+			http.StatusForbidden, "missing scope users:write")
+		expect(t, send(reader.Key, http.MethodGet, "/api/v1/api-keys", ""), http.StatusForbidden, "missing scope admin")
+		expect(t, send(reader.Key, http.MethodGet, "/api/v1/audit", ""), http.StatusForbidden, "missing scope admin")
+
+		expect(t, send(writer.Key, http.MethodGet, "/api/v1/users/", ""), http.StatusForbidden, "missing scope users:read")
+		expect(t, send(writer.Key, http.MethodPatch, "/api/v1/users/"+testUUID(1), `{"full_name":"J. Doe"}`), http.StatusNoContent, "")
+
+		rr := send(reader.Key, http.MethodPost, "/api/graphql", `{"query":"mutation { deleteUser(id: \"`+testUUID(1)+`\") }"}`)
+		if !strings.Contains(rr.Body.String(), `"code":"FORBIDDEN"`) || !userExists(mockRepo, 1) {
+			t.Errorf("expected the mutation to be forbidden, got %s", rr.Body)
+		}
+	})
+
+	t.Run("use is recorded", func(t *testing.T) {
+		if mockKeys.Keys[0].LastUsedAt == nil {
+			t.Error("expected last_used_at to be set")
+		}
+		if entry := mockRepo.Audit[len(mockRepo.Audit)-1]; entry.Actor != "api-key:"+writer.UUID {
+			t.Errorf("expected the key to be the actor, got %q", entry.Actor)
+		}
+	})
+
+	t.Run("wrong secret", func(t *testing.T) {
+		expect(t, send(reader.Key+"x", http.MethodGet, "/api/v1/users/", ""), http.StatusForbidden, "forbidden")
+		expect(t, send("ck_000000000000_secret", http.MethodGet, "/api/v1/users/", ""), http.StatusForbidden, "forbidden")
+	})
+
+	t.Run("rotate", func(t *testing.T) {
+		rr := send(testApiKey, http.MethodPost, "/api/v1/api-keys/"+reader.UUID+"/rotate", "")
+		var rotated model.APIKey
+		if err := json.Unmarshal(rr.Body.Bytes(), &rotated); err != nil || rr.Code != http.StatusCreated ||
+			rotated.Key == reader.Key || rotated.Name != reader.Name || !reflect.DeepEqual(rotated.Scopes, reader.Scopes) {
+			t.Fatalf("unexpected response %d: %s", rr.Code, rr.Body)
+		}
+		expect(t, send(rotated.Key, http.MethodGet, "/api/v1/users/", ""), http.StatusOK, "")
+		expect(t, send(reader.Key, http.MethodGet, "/api/v1/users/", ""), http.StatusOK, "")
+
+		rr = send(testApiKey, http.MethodPost, "/api/v1/api-keys/"+rotated.UUID+"/rotate?grace=0s", "")
+		expect(t, rr, http.StatusCreated, "")
+		expect(t, send(rotated.Key, http.MethodGet, "/api/v1/users/", ""), http.StatusForbidden, "forbidden")
+
+		expect(t, send(testApiKey, http.MethodPost, "/api/v1/api-keys/"+reader.UUID+"/rotate?grace=1y", ""),
+			http.StatusBadRequest, "grace must be a duration between 0s and 720h")
+	})
+
+	t.Run("revoke", func(t *testing.T) {
+		expect(t, send(testApiKey, http.MethodDelete, "/api/v1/api-keys/"+writer.UUID, ""), http.StatusNoContent, "")
+		expect(t, send(writer.Key, http.MethodPatch, "/api/v1/users/"+testUUID(1), `{"full_name":"John Doe"}`), http.StatusForbidden, "forbidden")
+		expect(t, send(testApiKey, http.MethodPost, "/api/v1/api-keys/"+writer.UUID+"/rotate", ""),
+			http.StatusConflict, "api key has been revoked or has expired")
+		expect(t, send(testApiKey, http.MethodDelete, "/api/v1/api-keys/"+testUUID(9), ""), http.StatusNotFound, "")
+
+		var key model.APIKey
+		rr := send(testApiKey, http.MethodGet, "/api/v1/api-keys/"+writer.UUID, "")
+		if err := json.Unmarshal(rr.Body.Bytes(), &key); err != nil || key.RevokedAt == nil {
+			t.Errorf("expected the key to be listed as revoked, got %s", rr.Body)
+		}
+	})
+}
+
+func signToken(t *testing.T, claims jwt.MapClaims) string {
+	t.Helper()
+	data, err := os.ReadFile("testdata/jwt_key.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := jwt.ParseECPrivateKeyFromPEM(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.MapClaims{
+		"iss": testIssuer, "aud": testAudience, "sub": "jdoe", "exp": time.Now().Add(time.Hour).Unix(),
+	})
+	maps.Copy(token.Claims.(jwt.MapClaims), claims)
+	token.Header["kid"] = "test"
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func TestBearerAuth(t *testing.T) {
+	mockRepo := new(MockUserRepository)
+	insertTestUser(mockRepo, &user1)
+	router := newRouterWithRepositories(&repository.Repository{
+		Users: mockRepo, Idempotency: new(MockIdempotencyRepository),
+		Roles: &MockRoleRepository{Assignments: []model.RoleAssignment{{Principal: "jwt:jdoe", Role: model.RoleOperator}}},
+	})
+
+	send := func(token, method, path, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("Content-Type", "application/json")
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	reader := signToken(t, jwt.MapClaims{"scope": "users.read"})
+	writer := signToken(t, jwt.MapClaims{"scope": "users:read users:write"})
+
+	tests := []struct {
+		name      string
+		token     string
+		method    string
+		path      string
+		expCode   int
+		expDetail string
+	}{
+		{"read", reader, http.MethodGet, "/api/v1/users/" + testUUID(1), http.StatusOK, ""},
+		{"missing scope", reader, http.MethodPatch, "/api/v1/users/" + testUUID(1), http.StatusForbidden, "missing scope users:write"},
+		{"write", writer, http.MethodPatch, "/api/v1/users/" + testUUID(1), http.StatusNoContent, ""},
+		{"graphql", reader, http.MethodGet, "/api/graphql?query={user(username:\"jdoe\"){id}}", http.StatusOK, ""},
+		{
+			"expired", signToken(t, jwt.MapClaims{"scope": "users:read", "exp": time.Now().Add(-time.Hour).Unix()}),
+			http.MethodGet, "/api/v1/users/", http.StatusUnauthorized, "invalid bearer token: token has invalid claims: token is expired",
+		},
+		{
+			"wrong audience", signToken(t, jwt.MapClaims{"scope": "users:read", "aud": "billing"}),
+			http.MethodGet, "/api/v1/users/", http.StatusUnauthorized, "invalid bearer token: token has invalid claims: token has invalid audience",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := send(tt.token, tt.method, tt.path, `{"full_name":"J. Doe"}`)
+			var p problem.Problem
+			_ = json.Unmarshal(rr.Body.Bytes(), &p)
+			if rr.Code != tt.expCode || p.Detail != tt.expDetail {
+				t.Fatalf("expected %d %q, got %d: %s", tt.expCode, tt.expDetail, rr.Code, rr.Body)
+			}
+			if rr.Code == http.StatusUnauthorized && rr.Header().Get("WWW-Authenticate") != `Bearer error="invalid_token"` {
+				t.Errorf("unexpected WWW-Authenticate %q", rr.Header().Get("WWW-Authenticate"))
+			}
+		})
+	}
+
+	if entry := mockRepo.Audit[len(mockRepo.Audit)-1]; entry.Action != model.AuditUpdate || entry.Actor != "jwt:jdoe" {
+		t.Errorf("expected the subject to be the actor, got %+v", entry)
+	}
+}
+
+func TestRoles(t *testing.T) {
+	mockRepo, mockRoles := new(MockUserRepository), new(MockRoleRepository)
+	insertTestUser(mockRepo, &user1)
+	router := newRouterWithRepositories(&repository.Repository{
+		Users: mockRepo, Idempotency: new(MockIdempotencyRepository), Roles: mockRoles,
+	})
+
+	send := func(key, method, path, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("x-api-key", key)
+		req.Header.Set("Content-Type", "application/json")
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+	expect := func(t *testing.T, rr *httptest.ResponseRecorder, code int, detail string) {
+		t.Helper()
+		var p problem.Problem
+		_ = json.Unmarshal(rr.Body.Bytes(), &p)
+		if rr.Code != code || detail != "" && p.Detail != detail {
+			t.Errorf("expected %d %q, got %d: %s", code, detail, rr.Code, rr.Body)
+		}
+	}
+
+	var key model.APIKey
+	rr := send(testApiKey, http.MethodPost, "/api/v1/api-keys", `{"name":"ops","scopes":["users:read","users:write","admin"]}`)
+	if err := json.Unmarshal(rr.Body.Bytes(), &key); err != nil || rr.Code != http.StatusCreated {
+		t.Fatalf("unexpected response %d: %s", rr.Code, rr.Body)
+	}
+	principal := "api-key:" + key.UUID
+
+	t.Run("roles", func(t *testing.T) {
+		rr := send(testApiKey, http.MethodGet, "/api/v1/roles", "")
+		var body struct{ Roles []model.Role }
+		if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil || rr.Code != http.StatusOK || len(body.Roles) != 3 ||
+			body.Roles[1].Name != model.RoleOperator || !reflect.DeepEqual(body.Roles[1].Permissions, model.RolePermissions[model.RoleOperator]) {
+			t.Errorf("unexpected roles %d: %s", rr.Code, rr.Body)
+		}
+	})
+
+	t.Run("default role", func(t *testing.T) {
+		expect(t, send(key.Key, http.MethodGet, "/api/v1/users/"+testUUID(1), ""), http.StatusOK, "")
+		rr := send(key.Key, http.MethodPatch, "/api/v1/users/"+testUUID(1), `{"full_name":"J. Doe"}`)
+		var p problem.Problem
+		_ = json.Unmarshal(rr.Body.Bytes(), &p)
+		if rr.Code != http.StatusForbidden || p.Detail != "missing permission users.update" || p.Permission != model.PermUsersUpdate {
+			t.Errorf("expected the missing permission, got %d: %s", rr.Code, rr.Body)
+		}
+	})
+
+	t.Run("assign", func(t *testing.T) {
+		expect(t, send(testApiKey, http.MethodPost, "/api/v1/role-assignments", `{"principal":"`+principal+`","role":"operator"}`),
+			http.StatusCreated, "")
+		expect(t, send(testApiKey, http.MethodPost, "/api/v1/role-assignments", `{"principal":"`+principal+`","role":"owner"}`),
+			http.StatusBadRequest, "role must be one of admin, operator, read-only")
+		expect(t, send(testApiKey, http.MethodPost, "/api/v1/role-assignments", `{"role":"admin"}`),
+			http.StatusBadRequest, "principal not specified")
+
+		rr := send(testApiKey, http.MethodGet, "/api/v1/role-assignments?principal="+principal, "")
+		var body struct {
+			RoleAssignments []model.RoleAssignment `json:"role_assignments"`
+		}
+		if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil || len(body.RoleAssignments) != 1 ||
+			body.RoleAssignments[0].Role != model.RoleOperator || body.RoleAssignments[0].CreatedAt.IsZero() {
+			t.Errorf("unexpected assignments %d: %s", rr.Code, rr.Body)
+		}
+	})
+
+	t.Run("operator", func(t *testing.T) {
+		expect(t, send(key.Key, http.MethodPatch, "/api/v1/users/"+testUUID(1), `{"full_name":"J. Doe"}`), http.StatusNoContent, "")
+		expect(t, send(key.Key, http.MethodDelete, "/api/v1/users/"+testUUID(1), ""), http.StatusForbidden, "missing permission users.delete")
+		expect(t, send(key.Key, http.MethodGet, "/api/v1/audit", ""), http.StatusForbidden, "missing permission manage")
+		expect(t, send(key.Key, http.MethodPost, "/api/v1/role-assignments", `{"principal":"`+principal+`","role":"admin"}`),
+			http.StatusForbidden, "missing permission manage")
+
+		rr := send(key.Key, http.MethodPost, "/api/graphql", `{"query":"mutation { deleteUser(id: \"`+testUUID(1)+`\") }"}`)
+		if !strings.Contains(rr.Body.String(), `"permission":"users.delete"`) || !userExists(mockRepo, 1) {
+			t.Errorf("expected the mutation to be forbidden, got %s", rr.Body)
+		}
+	})
+
+	t.Run("unassign", func(t *testing.T) {
+		expect(t, send(testApiKey, http.MethodDelete, "/api/v1/role-assignments?principal="+principal+"&role=operator", ""),
+			http.StatusNoContent, "")
+		expect(t, send(testApiKey, http.MethodDelete, "/api/v1/role-assignments?principal="+principal+"&role=operator", ""),
+			http.StatusNotFound, "role assignment not found")
+		expect(t, send(key.Key, http.MethodPatch, "/api/v1/users/"+testUUID(1), `{"full_name":"John Doe"}`),
+			http.StatusForbidden, "missing permission users.update")
+	})
+}
+
+func TestRateLimit(t *testing.T) {
+	mockRepo := new(MockUserRepository)
+	insertTestUser(mockRepo, &user1)
+	router := newRouterWithLimits(&repository.Repository{Users: mockRepo, Idempotency: new(MockIdempotencyRepository)}, RateLimits{
+		Users:    ratelimit.Limit{Requests: 2, Period: time.Minute},
+		Failures: ratelimit.Limit{Requests: 1, Period: time.Minute},
+	})
+
+	send := func(key, addr, path string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(http.MethodGet, path, nil)
+		if key != "" {
+			req.Header.Set("x-api-key", key)
+		}
+		req.RemoteAddr = addr
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	t.Run("per principal", func(t *testing.T) {
+		for _, remaining := range []string{"1", "0"} {
+			rr := send(testApiKey, "192.0.2.1:1234", "/api/v1/users/"+testUUID(1))
+			if rr.Code != http.StatusOK || rr.Header().Get("RateLimit-Limit") != "2" || rr.Header().Get("RateLimit-Remaining") != remaining ||
+				rr.Header().Get("RateLimit-Policy") != "2;w=60" {
+				t.Fatalf("expected %s remaining, got %d %v", remaining, rr.Code, rr.Header())
+			}
+		}
+
+		// The principal is limited from any address.
+		rr := send(testApiKey, "192.0.2.2:1234", "/api/v1/users/")
+		var p problem.Problem
+		_ = json.Unmarshal(rr.Body.Bytes(), &p)
+		if rr.Code != http.StatusTooManyRequests || p.Detail != "rate limit exceeded" || rr.Header().Get("Retry-After") != "30" ||
+			rr.Header().Get("RateLimit-Remaining") != "0" || rr.Header().Get("RateLimit-Reset") != "60" {
+			t.Errorf("expected to be limited, got %d %v: %s", rr.Code, rr.Header(), rr.Body)
+		}
+
+		if rr = send(testApiKey, "192.0.2.1:1234", "/api/v1/audit"); rr.Code != http.StatusOK || rr.Header().Get("RateLimit-Limit") != "" {
+			t.Errorf("expected the other groups not to be limited, got %d %v", rr.Code, rr.Header())
+		}
+	})
+
+	t.Run("unauthenticated by ip", func(t *testing.T) {
+		if rr := send("", "192.0.2.3:1234", "/api/v1/users/"); rr.Code != http.StatusUnauthorized {
+			t.Fatalf("expected the credentials to be checked, got %d", rr.Code)
+		}
+		if rr := send("wrong", "192.0.2.3:1234", "/api/v1/users/"); rr.Code != http.StatusTooManyRequests || rr.Header().Get("Retry-After") != "60" {
+			t.Errorf("expected the failures to be limited, got %d %v", rr.Code, rr.Header())
+		}
+		if rr := send("wrong", "192.0.2.4:1234", "/api/v1/users/"); rr.Code != http.StatusForbidden {
+			t.Errorf("expected another address not to be limited, got %d", rr.Code)
+		}
+	})
+
+	t.Run("replays report the current quota", func(t *testing.T) {
+		router := newRouterWithLimits(&repository.Repository{Users: new(MockUserRepository), Idempotency: new(MockIdempotencyRepository)}, RateLimits{
+			Users: ratelimit.Limit{Requests: 3, Period: time.Minute},
+		})
+		for _, tt := range []struct{ remaining, replayed string }{{"2", ""}, {"1", "true"}} {
+			req, _ := http.NewRequest(http.MethodPost, "/api/v1/users/", strings.NewReader(`{"username": "jdoe", "email": "jdoe@example.com"}`))
+			req.Header.Set("x-api-key", testApiKey)
+			req.Header.Set("Idempotency-Key", "key-1")
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+
+			if rr.Header().Get("Idempotent-Replayed") != tt.replayed || rr.Header().Get("RateLimit-Remaining") != tt.remaining {
+				t.Errorf("expected %s remaining, got %d %v", tt.remaining, rr.Code, rr.Header())
+			}
+		}
+	})
+}
+
+func TestRequestID(t *testing.T) {
+	mockRepo := new(MockUserRepository)
+	insertTestUser(mockRepo, &user1)
+	router := newRouter(mockRepo)
+
+	var logs bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(logger.NewHandler(slog.NewJSONHandler(&logs, nil))))
+
+	send := func(method, path, requestID, auth, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("x-api-key", testApiKey)
+		if auth != "" {
+			req.Header.Set("Authorization", "Bearer "+auth)
+		}
+		if requestID != "" {
+			req.Header.Set("X-Request-ID", requestID)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	t.Run("echoed in the response and the problem", func(t *testing.T) {
+		rr := send(http.MethodGet, "/api/v1/users/"+testUUID(9), "req-42", "", "")
+		var p problem.Problem
+		_ = json.Unmarshal(rr.Body.Bytes(), &p)
+		if rr.Header().Get("X-Request-ID") != "req-42" || p.RequestID != "req-42" {
+			t.Errorf("expected the request id to be echoed, got %q %+v", rr.Header().Get("X-Request-ID"), p)
+		}
+	})
+
+	t.Run("invalid id is replaced", func(t *testing.T) {
+		rr := send(http.MethodGet, "/api/v1/users/"+testUUID(1), strings.Repeat("a", 200), "", "")
+		if id := rr.Header().Get("X-Request-ID"); rr.Code != http.StatusOK || id == "" || len(id) > 128 {
+			t.Errorf("expected a new request id, got %d %q", rr.Code, id)
+		}
+	})
+
+	t.Run("graphql and scim errors", func(t *testing.T) {
+		rr := send(http.MethodPost, "/api/graphql", "req-gql", "", `{"query":"{ user(username: \"nobody\") { id } }"}`)
+		if !strings.Contains(rr.Body.String(), `"request_id":"req-gql"`) {
+			t.Errorf("expected the request id in the extensions, got %s", rr.Body)
+		}
+
+		rr = send(http.MethodGet, "/scim/v2/Users/"+testUUID(9), "req-scim", testSCIMToken, "")
+		if rr.Code != http.StatusNotFound || !strings.Contains(rr.Body.String(), `"request_id":"req-scim"`) {
+			t.Errorf("expected the request id in the scim error, got %d %s", rr.Code, rr.Body)
+		}
+	})
+
+	t.Run("log lines carry the request", func(t *testing.T) {
+		rr := send(http.MethodPost, "/api/v1/api-keys", "", "", `{"name":"crm","scopes":["users:write"]}`)
+		var key model.APIKey
+		if err := json.Unmarshal(rr.Body.Bytes(), &key); err != nil {
+			t.Fatal(err)
+		}
+
+		logs.Reset()
+		req, _ := http.NewRequest(http.MethodPatch, "/api/v1/users/"+testUUID(1), strings.NewReader(`{"full_name":"J. Doe"}`))
+		req.Header.Set("x-api-key", key.Key)
+		req.Header.Set("X-Request-ID", "req-log")
+		router.ServeHTTP(httptest.NewRecorder(), req)
+
+		// The service denies the read-only key, and the request is logged.
+		var lines []map[string]any
+		for _, raw := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+			var line map[string]any
+			if err := json.Unmarshal([]byte(raw), &line); err != nil {
+				t.Fatalf("unexpected log line %q", raw)
+			}
+			lines = append(lines, line)
+		}
+		if len(lines) != 2 || lines[0]["msg"] != "Permission denied:" || lines[1]["msg"] != "Incoming request:" {
+			t.Fatalf("unexpected log lines %v", lines)
+		}
+		for _, line := range lines {
+			if line["request_id"] != "req-log" || line["http.route"] != "/api/v1/users/:id" || line["principal"] != "api-key:"+key.UUID {
+				t.Errorf("expected the request in the log line, got %v", line)
+			}
+		}
+	})
+
+	t.Run("unmatched request is logged under its path", func(t *testing.T) {
+		// The routes of New log the matched requests only.
+		r := gin.New()
+		r.ContextWithFallback = true
+		r.Use(middleware.RequestID, middleware.Logging)
+
+		logs.Reset()
+		req, _ := http.NewRequest(http.MethodGet, "/api/v1/nowhere", nil)
+		req.Header.Set("X-Request-ID", "req-404")
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+		if rr.Code != http.StatusNotFound {
+			t.Fatalf("expected the route not to be found, got %d", rr.Code)
+		}
+
+		var line map[string]any
+		if err := json.Unmarshal(logs.Bytes(), &line); err != nil || line["http.route"] != "/api/v1/nowhere" || line["request_id"] != "req-404" {
+			t.Errorf("expected the path in the log line, got %s", logs.String())
+		}
+	})
 }
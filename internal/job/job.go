@@ -0,0 +1,32 @@
+package job
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// Task does a unit of periodic cleanup and returns the number of rows it
+// affected.
+type Task func(ctx context.Context) (int64, error)
+
+// Every runs the task every interval until ctx is done.
+func Every(ctx context.Context, name string, interval time.Duration, task Task) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		n, err := task(ctx)
+		if err != nil {
+			slog.ErrorContext(ctx, "Job failed:", "job", name, "error", err.Error())
+		} else if n > 0 {
+			slog.InfoContext(ctx, "Job done:", "job", name, "count", n)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"cruder/internal/auth"
+	"cruder/internal/model"
+	"cruder/internal/problem"
+	"cruder/internal/repository"
+	"cruder/pkg/validation"
+
+	"github.com/gin-gonic/gin"
+)
+
+const maxIdempotencyKey = 255
+
+// maxIdempotentBody caps the bodies buffered to be fingerprinted, the size of
+// the largest request, an import.
+const maxIdempotentBody = 16 << 20
+
+// Idempotency replays the stored response to a request repeated with the
+// same Idempotency-Key header by the same principal. Requests without the
+// header pass through.
+func Idempotency(store repository.IdempotencyRepository, ttl time.Duration) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := c.GetHeader("Idempotency-Key")
+		if key == "" {
+			c.Next()
+			return
+		}
+
+		if len(key) > maxIdempotencyKey {
+			problem.Error(c, validation.ErrInvalidIdempotencyKey)
+			c.Abort()
+			return
+		}
+
+		body, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, maxIdempotentBody))
+		if err != nil {
+			if errors.As(err, new(*http.MaxBytesError)) {
+				problem.Write(c, http.StatusRequestEntityTooLarge, "request body is too large")
+			} else {
+				problem.Error(c, validation.MalformedRequest(err))
+			}
+			c.Abort()
+			return
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+		fingerprint := requestFingerprint(c.Request.Method, c.Request.URL.RequestURI(), body)
+		// The keys of the principals are apart, so that a principal cannot be
+		// replayed the response to another.
+		key = scopedKey(c, key)
+
+		var rec *model.IdempotencyRecord
+		if rec, err = store.Reserve(c, key, fingerprint, ttl); err != nil {
+			problem.Error(c, err)
+			c.Abort()
+			return
+		}
+
+		if rec != nil {
+			switch {
+			case rec.Fingerprint != fingerprint:
+				problem.Error(c, validation.ErrIdempotencyKeyReused)
+			case rec.Status == 0:
+				problem.Error(c, validation.ErrIdempotencyInProgress)
+			default:
+				replay(c, rec)
+			}
+			c.Abort()
+			return
+		}
+
+		w := &bodyRecorder{ResponseWriter: c.Writer}
+		c.Writer = w
+
+		// A panic is a server error too, and the recovery further up the
+		// chain answers it.
+		defer func() {
+			if p := recover(); p != nil {
+				if err := store.Release(context.WithoutCancel(c.Request.Context()), key); err != nil {
+					slog.ErrorContext(c, "Failed to release idempotency key:", "error", err.Error())
+				}
+				panic(p)
+			}
+		}()
+
+		c.Next()
+
+		// The response is stored even if the client has gone away meanwhile.
+		ctx := context.WithoutCancel(c.Request.Context())
+
+		// Server errors are not stored, so that the client can retry.
+		if status := w.Status(); status >= 500 {
+			err = store.Release(ctx, key)
+		} else {
+			err = store.Complete(ctx, &model.IdempotencyRecord{
+				Key:         key,
+				Fingerprint: fingerprint,
+				Status:      status,
+				Headers:     w.Header().Clone(),
+				Body:        w.body.Bytes(),
+			})
+		}
+
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to store idempotent response:", "error", err.Error())
+		}
+	}
+}
+
+// scopedKey returns the key of the principal of the request, hashed to fit the
+// stored keys.
+func scopedKey(c *gin.Context, key string) string {
+	principal := ""
+	if p := auth.FromContext(c); p != nil {
+		principal = p.ID
+	}
+	sum := sha256.Sum256([]byte(principal + "\n" + key))
+	return hex.EncodeToString(sum[:])
+}
+
+func requestFingerprint(method, uri string, body []byte) string {
+	h := sha256.New()
+	h.Write([]byte(method + " " + uri + "\n"))
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func replay(c *gin.Context, rec *model.IdempotencyRecord) {
+	for k, v := range rec.Headers {
+		if replayed(k) {
+			c.Writer.Header()[k] = v
+		}
+	}
+	c.Header("Idempotent-Replayed", "true")
+	c.Status(rec.Status)
+	_, _ = c.Writer.Write(rec.Body)
+}
+
+// replayed reports whether a stored header is replayed. The replay is a
+// request of its own, with its own request id and rate limit, whose headers
+// are set already.
+func replayed(header string) bool {
+	switch header = http.CanonicalHeaderKey(header); {
+	case header == http.CanonicalHeaderKey(RequestIDHeader), header == "Retry-After":
+		return false
+	default:
+		return !strings.HasPrefix(header, "Ratelimit-")
+	}
+}
+
+type bodyRecorder struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *bodyRecorder) Write(b []byte) (int, error) {
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *bodyRecorder) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
@@ -1,14 +1,27 @@
 package middleware
 
 import (
+	"crypto/subtle"
+	"errors"
 	"log/slog"
 	"net/http"
 	"strings"
 	"time"
 
+	"cruder/internal/audit"
+	"cruder/internal/auth"
+	"cruder/internal/model"
+	"cruder/internal/problem"
+	"cruder/internal/scim"
+	"cruder/pkg/logger"
+	"cruder/pkg/validation"
+
 	"github.com/gin-gonic/gin"
 )
 
+// RequestIDHeader carries the request id.
+const RequestIDHeader = "X-Request-ID"
+
 func Logging(c *gin.Context) {
 	start := time.Now()
 
@@ -30,37 +43,130 @@ func Logging(c *gin.Context) {
 		key.Value = slog.StringValue(c.Param("username"))
 	}
 
-	slog.Info("Incoming request:",
+	// The request id, the route and the principal come from the context. An
+	// unmatched request has no route there, and is logged under its path.
+	route := slog.Attr{}
+	if c.FullPath() == "" {
+		route = slog.String(logger.RouteKey, path)
+	}
+
+	slog.InfoContext(c, "Incoming request:",
 		"http.server.request.duration", time.Since(start).String(),
 		"http.request.method", c.Request.Method,
 		"http.response.status_code", c.Writer.Status(),
-		"http.route", path,
 		"server.address", c.Request.URL.Path,
 		"http.request.host", c.Request.Host,
+		route,
 		key,
 	)
 }
 
-func APIKey(key string) gin.HandlerFunc {
+// Authenticate resolves the credentials of the request, an X-API-Key header
+// or a bearer token, to the principal stored in the request context.
+func Authenticate(authenticator auth.Authenticator) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		principal, err := authenticator.Authenticate(c, c.GetHeader)
+
+		switch {
+		case errors.Is(err, validation.ErrNoCredentials):
+			problem.Write(c, http.StatusUnauthorized, err.Error())
+		case errors.Is(err, validation.ErrInvalidAPIKey):
+			problem.Write(c, http.StatusForbidden, "forbidden")
+		case errors.Is(err, validation.ErrInvalidToken):
+			c.Header("WWW-Authenticate", `Bearer error="invalid_token"`)
+			problem.Write(c, http.StatusUnauthorized, err.Error())
+		case err != nil:
+			problem.Error(c, err)
+		default:
+			withPrincipal(c, principal)
+			c.Next()
+			return
+		}
+		c.Abort()
+	}
+}
+
+// Require refuses the request unless the principal is granted the scope and
+// a role of the principal grants the permission.
+func Require(scope, permission string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		err := auth.Require(c, scope)
+		if err == nil {
+			err = auth.Authorize(c, permission)
+		}
+		if err != nil {
+			problem.Error(c, err)
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// RequireScope refuses the request unless the principal is granted the
+// scope.
+func RequireScope(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if err := auth.Require(c, scope); err != nil {
+			problem.Error(c, err)
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// SCIMToken authenticates identity providers by the bearer token of the SCIM
+// endpoints, which is separate from the API key.
+func SCIMToken(token string) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		got := c.GetHeader("X-API-Key")
+		got, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
 
-		if got == "" {
-			c.JSON(http.StatusUnauthorized, gin.H{
-				"error": "missing api key",
-			})
+		if !ok || got == "" {
+			scim.Write(c, scim.NewError(http.StatusUnauthorized, "", "missing bearer token"))
 			c.Abort()
 			return
 		}
 
-		if got != key {
-			c.JSON(http.StatusForbidden, gin.H{
-				"error": "forbidden",
-			})
+		if subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			scim.Write(c, scim.NewError(http.StatusUnauthorized, "", "invalid bearer token"))
 			c.Abort()
 			return
 		}
 
+		// The identity provider provisions and deprovisions the users.
+		principal := &model.Principal{
+			ID:     audit.KeyActor("scim", token),
+			Name:   "scim",
+			Scopes: []string{model.ScopeUsersRead, model.ScopeUsersWrite},
+			Roles:  []string{model.RoleAdmin},
+		}
+		withPrincipal(c, principal)
 		c.Next()
 	}
 }
+
+// withPrincipal stores the principal of the authenticated request in its
+// context, along with the metadata for the audit log and the principal for
+// the log lines.
+func withPrincipal(c *gin.Context, principal *model.Principal) {
+	ctx := auth.WithPrincipal(c.Request.Context(), principal)
+	ctx = audit.WithMeta(ctx, audit.Meta{Actor: principal.ID, RequestID: logger.RequestID(ctx), ClientIP: c.ClientIP()})
+	c.Request = c.Request.WithContext(logger.WithAttrs(ctx, slog.String(logger.PrincipalKey, principal.ID)))
+}
+
+// RequestID takes the X-Request-ID header of the request, or a new id if it
+// is missing or invalid, and echoes it in the response. The id is stored in
+// the request context along with the route, so that the log lines and the
+// error bodies of the request carry it.
+func RequestID(c *gin.Context) {
+	id := logger.EnsureRequestID(c.GetHeader(RequestIDHeader))
+	c.Header(RequestIDHeader, id)
+
+	ctx := logger.WithRequestID(c.Request.Context(), id)
+	if route := c.FullPath(); route != "" {
+		ctx = logger.WithAttrs(ctx, slog.String(logger.RouteKey, route))
+	}
+	c.Request = c.Request.WithContext(ctx)
+	c.Next()
+}
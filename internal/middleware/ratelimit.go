@@ -0,0 +1,96 @@
+package middleware
+
+import (
+	"log/slog"
+	"math"
+	"strconv"
+	"time"
+
+	"cruder/internal/auth"
+	"cruder/internal/problem"
+	"cruder/internal/ratelimit"
+	"cruder/pkg/validation"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RateLimit limits the requests of every principal to the route group, or of
+// every client IP for the requests without a principal. The state of the
+// bucket is reported in the RateLimit headers. The requests pass through if
+// the store fails, so that the API does not depend on it.
+func RateLimit(store ratelimit.Store, group string, limit ratelimit.Limit) gin.HandlerFunc {
+	if limit.IsZero() {
+		return func(c *gin.Context) { c.Next() }
+	}
+	return func(c *gin.Context) {
+		key := "ip:" + c.ClientIP()
+		if principal := auth.FromContext(c); principal != nil {
+			key = principal.ID
+		}
+
+		result, err := store.Take(c, group+":"+key, limit, 1)
+		if err != nil {
+			slog.ErrorContext(c, "Failed to take a rate limit token:", "error", err.Error())
+			c.Next()
+			return
+		}
+
+		if !rateLimited(c, result) {
+			c.Next()
+		}
+	}
+}
+
+// RateLimitFailures limits the requests that fail to authenticate by client
+// IP, which slows down guessing the credentials. Every failure takes a token,
+// and a client without one left is refused before its credentials are
+// checked. It goes before Authenticate.
+func RateLimitFailures(store ratelimit.Store, limit ratelimit.Limit) gin.HandlerFunc {
+	if limit.IsZero() {
+		return func(c *gin.Context) { c.Next() }
+	}
+	return func(c *gin.Context) {
+		key := "unauthenticated:ip:" + c.ClientIP()
+
+		result, err := store.Take(c, key, limit, 0)
+		if err != nil {
+			slog.ErrorContext(c, "Failed to take a rate limit token:", "error", err.Error())
+			c.Next()
+			return
+		}
+		if !result.Allowed {
+			rateLimited(c, result)
+			return
+		}
+
+		c.Next()
+
+		if auth.FromContext(c) == nil {
+			if _, err = store.Take(c, key, limit, 1); err != nil {
+				slog.ErrorContext(c, "Failed to take a rate limit token:", "error", err.Error())
+			}
+		}
+	}
+}
+
+// rateLimited sets the RateLimit headers of draft-ietf-httpapi-ratelimit-headers
+// and refuses the request with Retry-After if it is over the limit.
+func rateLimited(c *gin.Context, result ratelimit.Result) bool {
+	c.Header("RateLimit-Policy", strconv.Itoa(result.Limit.Requests)+";w="+seconds(result.Limit.Period))
+	c.Header("RateLimit-Limit", strconv.Itoa(result.Limit.Requests))
+	c.Header("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+	c.Header("RateLimit-Reset", seconds(result.Reset))
+	if result.Allowed {
+		return false
+	}
+
+	c.Header("Retry-After", seconds(result.RetryAfter))
+	problem.Error(c, validation.ErrRateLimited)
+	c.Abort()
+	return true
+}
+
+// seconds rounds d up to whole seconds.
+func seconds(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
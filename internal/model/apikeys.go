@@ -0,0 +1,56 @@
+package model
+
+import (
+	"slices"
+	"time"
+)
+
+const (
+	ScopeUsersRead  = "users:read"
+	ScopeUsersWrite = "users:write"
+	// ScopeAdmin grants every scope.
+	ScopeAdmin = "admin"
+)
+
+// APIKey is a managed API key. Only a salted hash of the key is stored, the
+// plaintext is returned once when the key is created. The prefix is not
+// secret and tells the keys apart.
+type APIKey struct {
+	ID         int64      `json:"-"`
+	UUID       string     `json:"id"`
+	Name       string     `json:"name"`
+	Owner      string     `json:"owner"`
+	Prefix     string     `json:"prefix"`
+	Scopes     []string   `json:"scopes"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+
+	// Key is the plaintext, only set when the key is created.
+	Key string `json:"key,omitempty"`
+
+	Salt []byte `json:"-"`
+	Hash []byte `json:"-"`
+}
+
+// Active reports whether the key can be used at the given time.
+func (k *APIKey) Active(now time.Time) bool {
+	return k.RevokedAt == nil && (k.ExpiresAt == nil || now.Before(*k.ExpiresAt))
+}
+
+// Principal is the authenticated caller of a request. The scopes limit what
+// its credentials may be used for, the roles what the caller may do.
+type Principal struct {
+	// ID identifies the caller in the audit log.
+	ID     string
+	Name   string
+	Scopes []string
+	// Roles are looked up by the ID unless the credentials imply them.
+	Roles []string
+}
+
+// Has reports whether the principal is granted the scope.
+func (p *Principal) Has(scope string) bool {
+	return slices.Contains(p.Scopes, scope) || slices.Contains(p.Scopes, ScopeAdmin)
+}
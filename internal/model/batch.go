@@ -0,0 +1,32 @@
+package model
+
+import "encoding/json"
+
+const (
+	BatchCreate = "create"
+	BatchPatch  = "patch"
+	BatchDelete = "delete"
+)
+
+type BatchRequest struct {
+	Operations []BatchOperation `json:"operations"`
+}
+
+// BatchOperation is a single item of a batch. ID addresses the user by UUID
+// or by the deprecated numeric id, Patch is a merge patch or a JSON patch.
+type BatchOperation struct {
+	Op      string          `json:"op"`
+	ID      string          `json:"id,omitempty"`
+	User    *User           `json:"user,omitempty"`
+	Patch   json.RawMessage `json:"patch,omitempty"`
+	IfMatch int64           `json:"if_match,omitempty"`
+}
+
+// BatchResult is the outcome of the operation at Index. User is set for
+// successful creates and patches.
+type BatchResult struct {
+	Index int
+	Op    string
+	User  *User
+	Err   error
+}
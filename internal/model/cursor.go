@@ -0,0 +1,56 @@
+package model
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"time"
+)
+
+// Cursor is the keyset of the last row of a page. It is handed to clients
+// as an opaque base64 string and must be used with the same sort and order.
+type Cursor struct {
+	Sort  string `json:"s"`
+	Order string `json:"o"`
+	Value string `json:"v,omitempty"`
+	ID    int64  `json:"i"`
+}
+
+func NewCursor(sort, order string, user *User) *Cursor {
+	c := &Cursor{Sort: sort, Order: order, ID: user.ID}
+	switch sort {
+	case "username":
+		c.Value = user.Username
+	case "email":
+		c.Value = user.Email
+	case "created_at":
+		c.Value = user.CreatedAt.UTC().Format(time.RFC3339Nano)
+	case "updated_at":
+		c.Value = user.UpdatedAt.UTC().Format(time.RFC3339Nano)
+	}
+	return c
+}
+
+func DecodeCursor(s string) (*Cursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+
+	c := new(Cursor)
+	if err = json.Unmarshal(data, c); err != nil {
+		return nil, err
+	}
+
+	if c.Sort == "created_at" || c.Sort == "updated_at" {
+		if _, err = time.Parse(time.RFC3339Nano, c.Value); err != nil {
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+func (c *Cursor) Encode() string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
@@ -0,0 +1,20 @@
+package model
+
+import "time"
+
+const (
+	UserCreated = "user.created"
+	UserUpdated = "user.updated"
+	UserDeleted = "user.deleted"
+)
+
+// UserEvent is a change of a user in the event log. Changes holds the
+// changed fields with their new values.
+type UserEvent struct {
+	ID        int64          `json:"id"`
+	Type      string         `json:"type"`
+	UUID      string         `json:"uuid"`
+	Version   int64          `json:"version"`
+	Changes   map[string]any `json:"changes"`
+	CreatedAt time.Time      `json:"created_at"`
+}
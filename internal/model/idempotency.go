@@ -0,0 +1,14 @@
+package model
+
+import "net/http"
+
+// IdempotencyRecord is the stored response to a request with an
+// Idempotency-Key header.
+type IdempotencyRecord struct {
+	Key         string
+	Fingerprint string
+	// Status is 0 while the original request is in flight.
+	Status  int
+	Headers http.Header
+	Body    []byte
+}
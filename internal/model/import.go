@@ -0,0 +1,33 @@
+package model
+
+const (
+	ImportCreate    = "create"
+	ImportUpdate    = "update"
+	ImportUnchanged = "unchanged"
+	ImportReject    = "reject"
+)
+
+// ImportRow is a user read from the line of an import file. Err is set if
+// the line could not be parsed.
+type ImportRow struct {
+	Line int
+	User User
+	Err  error
+}
+
+// ImportResult is what happened, or would happen on a dry run, to a row.
+type ImportResult struct {
+	Line     int
+	Username string
+	Action   string
+	Err      error
+}
+
+type ImportReport struct {
+	DryRun    bool
+	Created   int
+	Updated   int
+	Unchanged int
+	Rejected  int
+	Results   []ImportResult
+}
@@ -0,0 +1,54 @@
+package model
+
+import (
+	"slices"
+	"time"
+)
+
+const (
+	RoleAdmin    = "admin"
+	RoleOperator = "operator"
+	RoleReadOnly = "read-only"
+)
+
+const (
+	PermUsersRead   = "users.read"
+	PermUsersCreate = "users.create"
+	PermUsersUpdate = "users.update"
+	// PermUsersDelete also covers restoring a deleted user.
+	PermUsersDelete = "users.delete"
+	// PermManage covers the webhooks, the audit log, the API keys and the
+	// role assignments.
+	PermManage = "manage"
+)
+
+// RolePermissions are the permissions each role grants.
+var RolePermissions = map[string][]string{
+	RoleAdmin:    {PermUsersRead, PermUsersCreate, PermUsersUpdate, PermUsersDelete, PermManage},
+	RoleOperator: {PermUsersRead, PermUsersCreate, PermUsersUpdate},
+	RoleReadOnly: {PermUsersRead},
+}
+
+// Role is a role along with the permissions it grants, as listed by the API.
+type Role struct {
+	Name        string   `json:"name"`
+	Permissions []string `json:"permissions"`
+}
+
+// RoleAssignment grants a role to a principal, identified as in the audit
+// log, such as api-key:<id> or jwt:<subject>.
+type RoleAssignment struct {
+	Principal string    `json:"principal"`
+	Role      string    `json:"role"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Can reports whether a role of the principal grants the permission.
+func (p *Principal) Can(permission string) bool {
+	for _, role := range p.Roles {
+		if slices.Contains(RolePermissions[role], permission) {
+			return true
+		}
+	}
+	return false
+}
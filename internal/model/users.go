@@ -1,8 +1,67 @@
 package model
 
+import "time"
+
 type User struct {
 	ID       int64  `json:"id"`
+	UUID     string `json:"uuid"`
 	Username string `json:"username"`
 	Email    string `json:"email"`
 	FullName string `json:"full_name"`
+
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+
+	// Version is incremented on every change and served as the ETag.
+	Version int64 `json:"-"`
+}
+
+type UserQuery struct {
+	Limit  int    `form:"limit"`
+	Cursor string `form:"cursor"`
+	Sort   string `form:"sort"`
+	Order  string `form:"order"`
+
+	UsernamePrefix string     `form:"username_prefix"`
+	EmailDomain    string     `form:"email_domain"`
+	CreatedAfter   *time.Time `form:"created_after" time_format:"2006-01-02T15:04:05Z07:00"`
+	CreatedBefore  *time.Time `form:"created_before" time_format:"2006-01-02T15:04:05Z07:00"`
+	UpdatedAfter   *time.Time `form:"updated_after" time_format:"2006-01-02T15:04:05Z07:00"`
+	UpdatedBefore  *time.Time `form:"updated_before" time_format:"2006-01-02T15:04:05Z07:00"`
+	IncludeDeleted bool       `form:"include_deleted"`
+
+	// After is the decoded Cursor, the last row of the previous page.
+	After *Cursor `form:"-"`
+
+	// The filters and the offset used by SCIM only.
+	Username      string `form:"-"`
+	Email         string `form:"-"`
+	EmailContains string `form:"-"`
+	Offset        int    `form:"-"`
+}
+
+type UserPage struct {
+	Users      []User `json:"users"`
+	NextCursor string `json:"next_cursor,omitempty"`
+	HasMore    bool   `json:"has_more"`
+}
+
+// UserPatch is a raw merge patch or JSON patch document.
+type UserPatch struct {
+	ContentType string
+	Body        []byte
+	// IfMatch is the expected version of the user, 0 if unconditional.
+	IfMatch int64
+}
+
+type UserSearch struct {
+	Q     string `form:"q"`
+	Limit int    `form:"limit"`
+}
+
+// UserMatch is a search result. Score is the relevance, higher is better.
+type UserMatch struct {
+	User
+	Score float64 `json:"score"`
 }
@@ -0,0 +1,75 @@
+package model
+
+import "time"
+
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	// DeliveryDead is a delivery that failed every attempt. It is only sent
+	// again if redelivered through the API.
+	DeliveryDead = "dead"
+)
+
+// Webhook is a subscription to the user events. The events are delivered to
+// the URL signed with the secret. No events means every event type.
+type Webhook struct {
+	ID     int64    `json:"-"`
+	UUID   string   `json:"id"`
+	URL    string   `json:"url"`
+	Events []string `json:"events"`
+	Active bool     `json:"active"`
+	// Secret is only returned when the webhook is created.
+	Secret string `json:"secret,omitempty"`
+
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// WebhookUpdate holds the fields of a webhook to change. A nil field is left
+// as it is.
+type WebhookUpdate struct {
+	URL    *string   `json:"url"`
+	Events *[]string `json:"events"`
+	Active *bool     `json:"active"`
+}
+
+// WebhookDelivery is an event queued for a webhook. Attempts are only listed
+// when a single delivery is fetched.
+type WebhookDelivery struct {
+	ID            int64            `json:"id"`
+	EventID       int64            `json:"event_id"`
+	EventType     string           `json:"event_type"`
+	Status        string           `json:"status"`
+	Attempts      int              `json:"attempts"`
+	NextAttemptAt *time.Time       `json:"next_attempt_at,omitempty"`
+	CreatedAt     time.Time        `json:"created_at"`
+	UpdatedAt     time.Time        `json:"updated_at"`
+	History       []WebhookAttempt `json:"history,omitempty"`
+}
+
+// WebhookAttempt is a single try to deliver an event. StatusCode is 0 if no
+// response was received, in which case Error tells why.
+type WebhookAttempt struct {
+	StatusCode int       `json:"status_code,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	DurationMS int64     `json:"duration_ms"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+type DeliveryQuery struct {
+	Status string `form:"status"`
+	Limit  int    `form:"limit"`
+	// Before is the id of the last delivery of the previous page, as the
+	// deliveries are listed newest first.
+	Before int64 `form:"before"`
+}
+
+// WebhookMessage is a pending delivery claimed by the dispatcher, with what
+// it needs to send it.
+type WebhookMessage struct {
+	DeliveryID int64
+	Attempts   int
+	URL        string
+	Secret     string
+	Event      UserEvent
+}
@@ -0,0 +1,122 @@
+package problem
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+
+	"cruder/pkg/logger"
+	"cruder/pkg/validation"
+
+	"github.com/gin-gonic/gin"
+)
+
+const ContentType = "application/problem+json"
+
+const (
+	TypeBlank      = "about:blank"
+	TypeNotFound   = "/problems/user-not-found"
+	TypeValidation = "/problems/validation-error"
+	TypeConflict   = "/problems/conflict"
+	TypeTestFailed = "/problems/patch-test-failed"
+)
+
+// Problem is an RFC 9457 problem details object.
+type Problem struct {
+	Type      string `json:"type"`
+	Title     string `json:"title"`
+	Status    int    `json:"status"`
+	Detail    string `json:"detail,omitempty"`
+	Instance  string `json:"instance,omitempty"`
+	RequestID string `json:"request_id,omitempty"`
+	Field     string `json:"field,omitempty"`
+	// Permission is the permission the caller is missing.
+	Permission string                      `json:"permission,omitempty"`
+	Errors     validation.ValidationErrors `json:"errors,omitempty"`
+}
+
+// Error renders err, mapping the validation errors to their status codes.
+func Error(ctx *gin.Context, err error) {
+	Render(ctx, From(ctx, err))
+}
+
+// From maps err to a problem without rendering it. Unknown errors are logged
+// and reported as a bare 500, so that database details never reach the client.
+func From(ctx *gin.Context, err error) *Problem {
+	var (
+		invalid  validation.InvalidRequest
+		errs     validation.ValidationErrors
+		conflict validation.ErrConflict
+		scope    validation.ErrMissingScope
+		missing  validation.ErrMissingPermission
+		p        *Problem
+	)
+
+	switch {
+	case errors.Is(err, validation.ErrUserNotFound):
+		p = New(ctx, http.StatusNotFound, err.Error())
+		p.Type = TypeNotFound
+	case errors.Is(err, validation.ErrWebhookNotFound), errors.Is(err, validation.ErrDeliveryNotFound),
+		errors.Is(err, validation.ErrAPIKeyNotFound), errors.Is(err, validation.ErrRoleAssignmentNotFound):
+		p = New(ctx, http.StatusNotFound, err.Error())
+	case errors.Is(err, validation.ErrUnsupportedPatch), errors.Is(err, validation.ErrUnsupportedImport):
+		p = New(ctx, http.StatusUnsupportedMediaType, err.Error())
+	case errors.Is(err, validation.ErrPreconditionFailed):
+		p = New(ctx, http.StatusPreconditionFailed, err.Error())
+	case errors.Is(err, validation.ErrIdempotencyKeyReused):
+		p = New(ctx, http.StatusUnprocessableEntity, err.Error())
+	case errors.Is(err, validation.ErrIdempotencyInProgress):
+		p = New(ctx, http.StatusConflict, err.Error())
+	case errors.Is(err, validation.ErrInactiveAPIKey):
+		p = New(ctx, http.StatusConflict, err.Error())
+	case errors.Is(err, validation.ErrRateLimited):
+		p = New(ctx, http.StatusTooManyRequests, err.Error())
+	case errors.As(err, &scope):
+		p = New(ctx, http.StatusForbidden, err.Error())
+	case errors.As(err, &missing):
+		p = New(ctx, http.StatusForbidden, err.Error())
+		p.Permission = missing.Permission
+	case errors.Is(err, validation.ErrBatchRolledBack):
+		p = New(ctx, http.StatusFailedDependency, err.Error())
+	case errors.Is(err, validation.ErrPatchTestFailed):
+		p = New(ctx, http.StatusConflict, err.Error())
+		p.Type = TypeTestFailed
+	case errors.As(err, &invalid):
+		p = New(ctx, http.StatusBadRequest, err.Error())
+		p.Type = TypeValidation
+		p.Errors = validation.ValidationErrors{invalid}
+	case errors.As(err, &errs):
+		p = New(ctx, http.StatusBadRequest, err.Error())
+		p.Type = TypeValidation
+		p.Errors = errs
+	case errors.As(err, &conflict):
+		p = New(ctx, http.StatusConflict, err.Error())
+		p.Type = TypeConflict
+		p.Field = conflict.Field
+	default:
+		slog.ErrorContext(ctx, "Internal error:", "error", err.Error())
+		p = New(ctx, http.StatusInternalServerError, "")
+	}
+	return p
+}
+
+// Write renders a generic problem with the given status and detail.
+func Write(ctx *gin.Context, status int, detail string) {
+	Render(ctx, New(ctx, status, detail))
+}
+
+func New(ctx *gin.Context, status int, detail string) *Problem {
+	return &Problem{
+		Type:      TypeBlank,
+		Title:     http.StatusText(status),
+		Status:    status,
+		Detail:    detail,
+		Instance:  ctx.Request.URL.Path,
+		RequestID: logger.RequestID(ctx),
+	}
+}
+
+func Render(ctx *gin.Context, p *Problem) {
+	ctx.Header("Content-Type", ContentType)
+	ctx.JSON(p.Status, p)
+}
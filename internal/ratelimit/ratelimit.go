@@ -0,0 +1,108 @@
+// Package ratelimit limits the rate of requests with token buckets kept in a
+// store shared by the instances, or in memory for a single instance.
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Limit allows Requests requests per Period. The bucket holds Requests
+// tokens and is refilled evenly over the period, so a burst of Requests is
+// allowed after a quiet period. A zero limit disables the limiting.
+type Limit struct {
+	Requests int
+	Period   time.Duration
+}
+
+// ParseLimit parses a limit such as "100/1m". An empty string or "0" is the
+// zero limit.
+func ParseLimit(s string) (Limit, error) {
+	if s == "" || s == "0" {
+		return Limit{}, nil
+	}
+	requests, period, ok := strings.Cut(s, "/")
+	n, err := strconv.Atoi(requests)
+	if !ok || err != nil || n <= 0 {
+		return Limit{}, fmt.Errorf("invalid rate limit %q", s)
+	}
+	d, err := time.ParseDuration(period)
+	if err != nil || d <= 0 {
+		return Limit{}, fmt.Errorf("invalid rate limit %q", s)
+	}
+	return Limit{Requests: n, Period: d}, nil
+}
+
+func (l Limit) String() string {
+	if l.IsZero() {
+		return "0"
+	}
+	return fmt.Sprintf("%d/%s", l.Requests, l.Period)
+}
+
+func (l Limit) IsZero() bool {
+	return l.Requests <= 0 || l.Period <= 0
+}
+
+// interval is the time it takes to refill a token.
+func (l Limit) interval() time.Duration {
+	return l.Period / time.Duration(l.Requests)
+}
+
+// Result is the state of a bucket after taking tokens from it.
+type Result struct {
+	Limit   Limit
+	Allowed bool
+	// Remaining is the number of whole tokens left.
+	Remaining int
+	// RetryAfter is how long until the tokens taken would be allowed, zero if
+	// they were.
+	RetryAfter time.Duration
+	// Reset is how long until the bucket is full again.
+	Reset time.Duration
+}
+
+// Store keeps the buckets by key.
+type Store interface {
+	// Take takes n tokens from the bucket of the key if it holds as many. A
+	// Take of zero tokens takes nothing and reports whether a token could be
+	// taken.
+	Take(ctx context.Context, key string, limit Limit, n int) (Result, error)
+}
+
+// refill returns the tokens of a bucket that held tokens elapsed ago.
+func refill(limit Limit, tokens float64, elapsed time.Duration) float64 {
+	if elapsed > 0 {
+		tokens += float64(elapsed) / float64(limit.interval())
+	}
+	return math.Min(tokens, float64(limit.Requests))
+}
+
+// take takes n tokens, at least one being required, and returns the tokens
+// left.
+func take(limit Limit, tokens float64, n int) (float64, Result) {
+	allowed := tokens >= float64(max(n, 1))
+	if allowed {
+		tokens -= float64(n)
+	}
+	return tokens, result(limit, tokens, n, allowed)
+}
+
+// result describes a bucket left with tokens after a Take of n tokens.
+func result(limit Limit, tokens float64, n int, allowed bool) Result {
+	interval := float64(limit.interval())
+	r := Result{
+		Limit:     limit,
+		Allowed:   allowed,
+		Remaining: int(math.Floor(tokens)),
+		Reset:     time.Duration(math.Ceil((float64(limit.Requests) - tokens) * interval)),
+	}
+	if !allowed {
+		r.RetryAfter = time.Duration(math.Ceil((float64(max(n, 1)) - tokens) * interval))
+	}
+	return r
+}
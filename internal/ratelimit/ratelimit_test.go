@@ -0,0 +1,251 @@
+package ratelimit
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseLimit(t *testing.T) {
+	tests := []struct {
+		in    string
+		limit Limit
+		err   bool
+	}{
+		{"100/1m", Limit{Requests: 100, Period: time.Minute}, false},
+		{"5/1s", Limit{Requests: 5, Period: time.Second}, false},
+		{"0", Limit{}, false},
+		{"", Limit{}, false},
+		{"100", Limit{}, true},
+		{"-1/1m", Limit{}, true},
+		{"10/0s", Limit{}, true},
+		{"ten/1m", Limit{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			limit, err := ParseLimit(tt.in)
+			if (err != nil) != tt.err || limit != tt.limit {
+				t.Errorf("expected %v %v, got %v %v", tt.limit, tt.err, limit, err)
+			}
+		})
+	}
+}
+
+// testBuckets runs the same scenario against every store, on a clock the
+// stores read through now.
+func testBuckets(t *testing.T, store Store, advance func(d time.Duration)) {
+	t.Helper()
+	limit := Limit{Requests: 3, Period: 3 * time.Second}
+	ctx := t.Context()
+
+	for i := 2; i >= 0; i-- {
+		r, err := store.Take(ctx, "jdoe", limit, 1)
+		if err != nil || !r.Allowed || r.Remaining != i {
+			t.Fatalf("expected %d remaining, got %+v %v", i, r, err)
+		}
+	}
+
+	r, err := store.Take(ctx, "jdoe", limit, 1)
+	if err != nil || r.Allowed || r.Remaining != 0 || r.RetryAfter != time.Second || r.Reset != 3*time.Second {
+		t.Fatalf("expected to be limited for a second, got %+v %v", r, err)
+	}
+	if r, _ = store.Take(ctx, "asmith", limit, 1); !r.Allowed || r.Remaining != 2 {
+		t.Fatalf("expected another key to have its own bucket, got %+v", r)
+	}
+
+	advance(1500 * time.Millisecond)
+	if r, _ = store.Take(ctx, "jdoe", limit, 0); !r.Allowed || r.Remaining != 1 {
+		t.Fatalf("expected a token to be refilled, got %+v", r)
+	}
+	if r, _ = store.Take(ctx, "jdoe", limit, 1); !r.Allowed || r.Remaining != 0 || r.Reset != 2500*time.Millisecond {
+		t.Fatalf("expected the refilled token to be taken, got %+v", r)
+	}
+
+	advance(time.Hour)
+	if r, _ = store.Take(ctx, "jdoe", limit, 1); !r.Allowed || r.Remaining != 2 {
+		t.Fatalf("expected the bucket to be full, got %+v", r)
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	store := NewMemoryStore()
+	now := time.Now()
+	store.now = func() time.Time { return now }
+
+	testBuckets(t, store, func(d time.Duration) { now = now.Add(d) })
+
+	if len(store.buckets) != 1 {
+		t.Errorf("expected the full buckets to be swept, got %d", len(store.buckets))
+	}
+}
+
+func TestRedisStore(t *testing.T) {
+	server := newRedisStandIn(t, "secret")
+	store, err := NewRedisStore("redis://:secret@" + server.addr + "/2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testBuckets(t, store, server.advance)
+
+	if server.evals != 1 {
+		t.Errorf("expected the script to be sent once, got %d", server.evals)
+	}
+	if server.db != "2" {
+		t.Errorf("expected the database to be selected, got %q", server.db)
+	}
+	if _, ok := server.hashes["ratelimit:jdoe"]; !ok {
+		t.Errorf("expected the bucket to be stored under its prefix, got %v", server.hashes)
+	}
+
+	if _, err = NewRedisStore("http://localhost"); err == nil {
+		t.Error("expected an unsupported scheme to be refused")
+	}
+	store, _ = NewRedisStore("redis://:wrong@" + server.addr)
+	if _, err = store.Take(t.Context(), "jdoe", Limit{Requests: 1, Period: time.Second}, 1); err == nil {
+		t.Error("expected a wrong password to fail")
+	}
+}
+
+// redisStandIn speaks enough of the Redis protocol to run the script of the
+// store, which it runs natively on a fake clock.
+type redisStandIn struct {
+	addr     string
+	password string
+
+	mu     sync.Mutex
+	now    time.Time
+	hashes map[string]map[string]string
+	loaded bool
+	evals  int
+	db     string
+}
+
+func newRedisStandIn(t *testing.T, password string) *redisStandIn {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = lis.Close() })
+
+	s := &redisStandIn{addr: lis.Addr().String(), password: password, now: time.Now(), hashes: make(map[string]map[string]string)}
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *redisStandIn) advance(d time.Duration) {
+	s.mu.Lock()
+	s.now = s.now.Add(d)
+	s.mu.Unlock()
+}
+
+func (s *redisStandIn) serve(conn net.Conn) {
+	defer func() { _ = conn.Close() }()
+	r := bufio.NewReader(conn)
+	authenticated := s.password == ""
+
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+
+		var reply string
+		switch cmd := strings.ToUpper(args[0]); {
+		case cmd == "AUTH":
+			authenticated = args[len(args)-1] == s.password
+			reply = "+OK\r\n"
+			if !authenticated {
+				reply = "-WRONGPASS invalid username-password pair\r\n"
+			}
+		case !authenticated:
+			reply = "-NOAUTH Authentication required.\r\n"
+		case cmd == "SELECT":
+			s.mu.Lock()
+			s.db = args[1]
+			s.mu.Unlock()
+			reply = "+OK\r\n"
+		case cmd == "EVALSHA" || cmd == "EVAL":
+			reply = s.eval(cmd, args)
+		default:
+			reply = "-ERR unknown command\r\n"
+		}
+		if _, err = io.WriteString(conn, reply); err != nil {
+			return
+		}
+	}
+}
+
+func (s *redisStandIn) eval(cmd string, args []string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch {
+	case cmd == "EVAL" && args[1] != takeScript:
+		return "-ERR unknown script\r\n"
+	case cmd == "EVAL":
+		s.loaded = true
+		s.evals++
+	case args[1] != takeScriptSHA || !s.loaded:
+		return "-NOSCRIPT No matching script.\r\n"
+	}
+
+	key := args[3]
+	capacity, _ := strconv.Atoi(args[4])
+	interval, _ := strconv.ParseFloat(args[5], 64)
+	n, _ := strconv.Atoi(args[6])
+	limit := Limit{Requests: capacity, Period: time.Duration(interval * float64(capacity) * float64(time.Millisecond))}
+
+	now := float64(s.now.UnixMicro()) / 1000
+	bucket := s.hashes[key]
+	tokens, updated := float64(capacity), now
+	if bucket != nil {
+		tokens, _ = strconv.ParseFloat(bucket["tokens"], 64)
+		updated, _ = strconv.ParseFloat(bucket["updated"], 64)
+	}
+	tokens, r := take(limit, refill(limit, tokens, time.Duration((now-updated)*float64(time.Millisecond))), n)
+	if n > 0 {
+		s.hashes[key] = map[string]string{
+			"tokens":  strconv.FormatFloat(tokens, 'f', -1, 64),
+			"updated": strconv.FormatFloat(now, 'f', -1, 64),
+		}
+	}
+
+	allowed := 0
+	if r.Allowed {
+		allowed = 1
+	}
+	raw := strconv.FormatFloat(tokens, 'f', -1, 64)
+	return fmt.Sprintf("*2\r\n:%d\r\n$%d\r\n%s\r\n", allowed, len(raw), raw)
+}
+
+func readCommand(r *bufio.Reader) ([]string, error) {
+	reply, err := readReply(r)
+	if err != nil {
+		return nil, err
+	}
+	values, ok := reply.([]any)
+	if !ok || len(values) == 0 {
+		return nil, errors.New("expected a command")
+	}
+	args := make([]string, len(values))
+	for i, v := range values {
+		args[i], _ = v.(string)
+	}
+	return args, nil
+}
@@ -0,0 +1,151 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"cruder/internal/model"
+	"cruder/pkg/validation"
+
+	"github.com/lib/pq"
+)
+
+type APIKeyRepository interface {
+	GetAll(ctx context.Context) ([]model.APIKey, error)
+	GetByUUID(ctx context.Context, uuid string) (*model.APIKey, error)
+	// GetByPrefix returns the key with its salt and hash, to authenticate it.
+	GetByPrefix(ctx context.Context, prefix string) (*model.APIKey, error)
+	Post(ctx context.Context, key *model.APIKey) error
+	// Rotate creates the replacement of the key and makes the key expire at
+	// expiresAt at the latest, in one transaction.
+	Rotate(ctx context.Context, id int64, expiresAt time.Time, replacement *model.APIKey) error
+	// Revoke revokes the key, which stays listed. Revoking it again keeps the
+	// time of the first revocation.
+	Revoke(ctx context.Context, uuid string) error
+	// Touch records that the key has been used, at most once per interval.
+	Touch(ctx context.Context, id int64, interval time.Duration) error
+}
+
+type apiKeyRepository struct {
+	db *sql.DB
+}
+
+func NewAPIKeyRepository(db *sql.DB) APIKeyRepository {
+	return &apiKeyRepository{db: db}
+}
+
+const apiKeyColumns = `id, uuid, name, owner, prefix, scopes, expires_at, last_used_at, revoked_at, created_at`
+
+// scanAPIKey scans the apiKeyColumns and then the extra columns, if any.
+func scanAPIKey(row scanner, extra ...any) (*model.APIKey, error) {
+	var k model.APIKey
+	dest := append([]any{&k.ID, &k.UUID, &k.Name, &k.Owner, &k.Prefix, (*pq.StringArray)(&k.Scopes),
+		&k.ExpiresAt, &k.LastUsedAt, &k.RevokedAt, &k.CreatedAt}, extra...)
+	if err := row.Scan(dest...); err != nil {
+		return nil, err
+	}
+	return &k, nil
+}
+
+const getAPIKeysStm = `SELECT ` + apiKeyColumns + ` FROM api_keys ORDER BY id`
+
+func (r *apiKeyRepository) GetAll(ctx context.Context) ([]model.APIKey, error) {
+	rows, err := r.db.QueryContext(ctx, getAPIKeysStm)
+	if err != nil {
+		return nil, err
+	}
+	defer func(rows *sql.Rows) { _ = rows.Close() }(rows)
+
+	var keys []model.APIKey
+	for rows.Next() {
+		k, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, *k)
+	}
+	return keys, rows.Err()
+}
+
+const getAPIKeyStm = `SELECT ` + apiKeyColumns + ` FROM api_keys WHERE uuid = $1`
+
+func (r *apiKeyRepository) GetByUUID(ctx context.Context, uuid string) (*model.APIKey, error) {
+	k, err := scanAPIKey(r.db.QueryRowContext(ctx, getAPIKeyStm, uuid))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, validation.ErrAPIKeyNotFound
+	}
+	return k, err
+}
+
+const getAPIKeyByPrefixStm = `SELECT ` + apiKeyColumns + `, salt, hash FROM api_keys WHERE prefix = $1`
+
+func (r *apiKeyRepository) GetByPrefix(ctx context.Context, prefix string) (*model.APIKey, error) {
+	var salt, hash []byte
+	k, err := scanAPIKey(r.db.QueryRowContext(ctx, getAPIKeyByPrefixStm, prefix), &salt, &hash)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, validation.ErrAPIKeyNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	k.Salt, k.Hash = salt, hash
+	return k, nil
+}
+
+const postAPIKeyStm = `INSERT INTO api_keys (name, owner, prefix, salt, hash, scopes, expires_at)
+	VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id, uuid, created_at`
+
+func postAPIKey(ctx context.Context, q querier, key *model.APIKey) error {
+	return q.QueryRowContext(ctx, postAPIKeyStm, key.Name, key.Owner, key.Prefix, key.Salt, key.Hash,
+		pq.StringArray(key.Scopes), key.ExpiresAt).Scan(&key.ID, &key.UUID, &key.CreatedAt)
+}
+
+func (r *apiKeyRepository) Post(ctx context.Context, key *model.APIKey) error {
+	return postAPIKey(ctx, r.db, key)
+}
+
+// expireAPIKeyStm keeps an earlier expiry, as least ignores a null one.
+const expireAPIKeyStm = `UPDATE api_keys SET expires_at = least(expires_at, $2) WHERE id = $1`
+
+func (r *apiKeyRepository) Rotate(ctx context.Context, id int64, expiresAt time.Time, replacement *model.APIKey) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func(tx *sql.Tx) { _ = tx.Rollback() }(tx)
+
+	if _, err = tx.ExecContext(ctx, expireAPIKeyStm, id, expiresAt); err != nil {
+		return err
+	}
+	if err = postAPIKey(ctx, tx, replacement); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+const revokeAPIKeyStm = `UPDATE api_keys SET revoked_at = coalesce(revoked_at, now()) WHERE uuid = $1`
+
+func (r *apiKeyRepository) Revoke(ctx context.Context, uuid string) error {
+	res, err := r.db.ExecContext(ctx, revokeAPIKeyStm, uuid)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return validation.ErrAPIKeyNotFound
+	}
+	return nil
+}
+
+// touchAPIKeyStm skips the write while last_used_at is recent, so that a busy
+// key does not update its row on every request.
+const touchAPIKeyStm = `UPDATE api_keys SET last_used_at = now()
+	WHERE id = $1 AND (last_used_at IS NULL OR last_used_at < now() - make_interval(secs => $2))`
+
+func (r *apiKeyRepository) Touch(ctx context.Context, id int64, interval time.Duration) error {
+	_, err := r.db.ExecContext(ctx, touchAPIKeyStm, id, interval.Seconds())
+	return err
+}
@@ -0,0 +1,28 @@
+package repository
+
+import (
+	"errors"
+
+	"cruder/pkg/validation"
+
+	"github.com/lib/pq"
+)
+
+const uniqueViolation = "23505"
+
+var uniqueFields = map[string]string{
+	"users_uuid_key":     "uuid",
+	"users_username_key": "username",
+	"users_email_key":    "email",
+}
+
+// mapError translates unique constraint violations into validation.ErrConflict.
+func mapError(err error) error {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == uniqueViolation {
+		if field, ok := uniqueFields[pqErr.Constraint]; ok {
+			return validation.ErrConflict{Field: field}
+		}
+	}
+	return err
+}
@@ -0,0 +1,94 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"cruder/internal/model"
+)
+
+type IdempotencyRepository interface {
+	Reserve(ctx context.Context, key, fingerprint string, ttl time.Duration) (*model.IdempotencyRecord, error)
+	Complete(ctx context.Context, record *model.IdempotencyRecord) error
+	Release(ctx context.Context, key string) error
+	DeleteExpired(ctx context.Context) (int64, error)
+}
+
+type idempotencyRepository struct {
+	db *sql.DB
+}
+
+func NewIdempotencyRepository(db *sql.DB) IdempotencyRepository {
+	return &idempotencyRepository{db: db}
+}
+
+// An expired key is taken over as if it never existed.
+const reserveStm = `INSERT INTO idempotency_keys (key, fingerprint, expires_at)
+	VALUES ($1, $2, now() + make_interval(secs => $3))
+	ON CONFLICT (key) DO UPDATE SET
+		fingerprint = EXCLUDED.fingerprint, status = 0, headers = NULL, body = NULL,
+		created_at = now(), expires_at = EXCLUDED.expires_at
+	WHERE idempotency_keys.expires_at < now()
+	RETURNING key`
+
+const getRecordStm = `SELECT key, fingerprint, status, headers, body FROM idempotency_keys WHERE key = $1`
+
+// Reserve claims the key for a new request and returns nil. If the key is
+// already taken, it returns the stored record instead.
+func (r *idempotencyRepository) Reserve(ctx context.Context, key, fingerprint string, ttl time.Duration) (*model.IdempotencyRecord, error) {
+	err := r.db.QueryRowContext(ctx, reserveStm, key, fingerprint, ttl.Seconds()).Scan(&key)
+	if err == nil {
+		return nil, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+
+	var (
+		rec     model.IdempotencyRecord
+		headers []byte
+	)
+	if err = r.db.QueryRowContext(ctx, getRecordStm, key).
+		Scan(&rec.Key, &rec.Fingerprint, &rec.Status, &headers, &rec.Body); err != nil {
+		return nil, err
+	}
+
+	if headers != nil {
+		if err = json.Unmarshal(headers, &rec.Headers); err != nil {
+			return nil, err
+		}
+	}
+
+	return &rec, nil
+}
+
+const completeStm = `UPDATE idempotency_keys SET status = $2, headers = $3, body = $4 WHERE key = $1`
+
+func (r *idempotencyRepository) Complete(ctx context.Context, record *model.IdempotencyRecord) error {
+	headers, err := json.Marshal(record.Headers)
+	if err != nil {
+		return err
+	}
+	_, err = r.db.ExecContext(ctx, completeStm, record.Key, record.Status, headers, record.Body)
+	return err
+}
+
+const releaseStm = `DELETE FROM idempotency_keys WHERE key = $1`
+
+func (r *idempotencyRepository) Release(ctx context.Context, key string) error {
+	_, err := r.db.ExecContext(ctx, releaseStm, key)
+	return err
+}
+
+const deleteExpiredStm = `DELETE FROM idempotency_keys WHERE expires_at < now()`
+
+func (r *idempotencyRepository) DeleteExpired(ctx context.Context) (int64, error) {
+	res, err := r.db.ExecContext(ctx, deleteExpiredStm)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
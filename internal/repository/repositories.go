@@ -3,11 +3,19 @@ package repository
 import "database/sql"
 
 type Repository struct {
-	Users UserRepository
+	Users       UserRepository
+	Idempotency IdempotencyRepository
+	Webhooks    WebhookRepository
+	APIKeys     APIKeyRepository
+	Roles       RoleRepository
 }
 
 func NewRepository(db *sql.DB) *Repository {
 	return &Repository{
-		Users: NewUserRepository(db),
+		Users:       NewUserRepository(db),
+		Idempotency: NewIdempotencyRepository(db),
+		Webhooks:    NewWebhookRepository(db),
+		APIKeys:     NewAPIKeyRepository(db),
+		Roles:       NewRoleRepository(db),
 	}
 }
@@ -0,0 +1,72 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+
+	"cruder/internal/model"
+	"cruder/pkg/validation"
+)
+
+type RoleRepository interface {
+	// GetAssignments lists the role assignments, of the principal only if it
+	// is not empty.
+	GetAssignments(ctx context.Context, principal string) ([]model.RoleAssignment, error)
+	// Assign stores the assignment. Assigning a role again keeps the time it
+	// was first assigned.
+	Assign(ctx context.Context, assignment *model.RoleAssignment) error
+	Unassign(ctx context.Context, principal, role string) error
+}
+
+type roleRepository struct {
+	db *sql.DB
+}
+
+func NewRoleRepository(db *sql.DB) RoleRepository {
+	return &roleRepository{db: db}
+}
+
+const getAssignmentsStm = `SELECT principal, role, created_at FROM role_assignments
+	WHERE $1::text = '' OR principal = $1 ORDER BY principal, role`
+
+func (r *roleRepository) GetAssignments(ctx context.Context, principal string) ([]model.RoleAssignment, error) {
+	rows, err := r.db.QueryContext(ctx, getAssignmentsStm, principal)
+	if err != nil {
+		return nil, err
+	}
+	defer func(rows *sql.Rows) { _ = rows.Close() }(rows)
+
+	var assignments []model.RoleAssignment
+	for rows.Next() {
+		var a model.RoleAssignment
+		if err = rows.Scan(&a.Principal, &a.Role, &a.CreatedAt); err != nil {
+			return nil, err
+		}
+		assignments = append(assignments, a)
+	}
+	return assignments, rows.Err()
+}
+
+// assignStm updates the row on conflict only to return it.
+const assignStm = `INSERT INTO role_assignments (principal, role) VALUES ($1, $2)
+	ON CONFLICT (principal, role) DO UPDATE SET principal = excluded.principal
+	RETURNING created_at`
+
+func (r *roleRepository) Assign(ctx context.Context, assignment *model.RoleAssignment) error {
+	return r.db.QueryRowContext(ctx, assignStm, assignment.Principal, assignment.Role).Scan(&assignment.CreatedAt)
+}
+
+const unassignStm = `DELETE FROM role_assignments WHERE principal = $1 AND role = $2`
+
+func (r *roleRepository) Unassign(ctx context.Context, principal, role string) error {
+	res, err := r.db.ExecContext(ctx, unassignStm, principal, role)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return validation.ErrRoleAssignmentNotFound
+	}
+	return nil
+}
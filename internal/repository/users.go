@@ -3,33 +3,109 @@ package repository
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
 	"cruder/internal/model"
 	"cruder/pkg/validation"
+
+	"github.com/lib/pq"
 )
 
 type UserRepository interface {
-	GetAll(ctx context.Context) ([]model.User, error)
+	GetAll(ctx context.Context, query *model.UserQuery) ([]model.User, error)
+	Count(ctx context.Context, query *model.UserQuery) (int64, error)
 	GetByUsername(ctx context.Context, username string) (*model.User, error)
 	GetByID(ctx context.Context, id int64) (*model.User, error)
+	GetByUUID(ctx context.Context, uuid string) (*model.User, error)
 	Post(ctx context.Context, user *model.User) (int64, error)
-	Patch(ctx context.Context, user *model.User) error
-	Delete(ctx context.Context, id int64) error
+	Patch(ctx context.Context, id, version int64, changes map[string]any) (int64, error)
+	Delete(ctx context.Context, id, version int64) (*model.User, error)
+	DeleteByUUID(ctx context.Context, uuid string, version int64) (*model.User, error)
+	Restore(ctx context.Context, id int64) (*model.User, error)
+	RestoreByUUID(ctx context.Context, uuid string) (*model.User, error)
+	Purge(ctx context.Context, retention time.Duration) (int64, error)
+	Search(ctx context.Context, search *model.UserSearch) ([]model.UserMatch, error)
+	GetByUsernamesOrEmails(ctx context.Context, usernames, emails []string) ([]model.User, error)
+	Import(ctx context.Context, create, update []model.User) error
+	Export(ctx context.Context, query *model.UserQuery, fn func(user *model.User) error) error
+	AppendEvent(ctx context.Context, event *model.UserEvent) error
+	GetEvents(ctx context.Context, after int64, limit int) ([]model.UserEvent, error)
+	LastEventID(ctx context.Context) (int64, error)
+	PurgeEvents(ctx context.Context, retention time.Duration) (int64, error)
+	AppendAudit(ctx context.Context, entry *model.AuditEntry) error
+	GetAudit(ctx context.Context, query *model.AuditQuery) ([]model.AuditEntry, error)
+	WalkAudit(ctx context.Context, fn func(entry *model.AuditEntry) error) error
+	// WithTx runs fn with a repository bound to a single transaction, which
+	// is committed if fn succeeds and rolled back otherwise.
+	WithTx(ctx context.Context, fn func(repo UserRepository) error) error
+}
+
+// querier is implemented by both *sql.DB and *sql.Tx.
+type querier interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
 }
 
 type userRepository struct {
-	db *sql.DB
+	db querier
 }
 
 func NewUserRepository(db *sql.DB) UserRepository {
 	return &userRepository{db: db}
 }
 
-const getAllStm = `SELECT id, username, email, full_name FROM users`
+const userColumns = `id, uuid, username, email, full_name, created_at, updated_at, deleted_at, version`
+
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+// scanUser scans the userColumns and then the extra columns, if any.
+func scanUser(row scanner, extra ...any) (*model.User, error) {
+	var u model.User
+	dest := append([]any{&u.ID, &u.UUID, &u.Username, &u.Email, &u.FullName, &u.CreatedAt, &u.UpdatedAt, &u.DeletedAt, &u.Version}, extra...)
+	if err := row.Scan(dest...); err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+// getOne returns the single user selected by stm.
+func (r *userRepository) getOne(ctx context.Context, stm string, args ...any) (*model.User, error) {
+	u, err := scanUser(r.db.QueryRowContext(ctx, stm, args...))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, validation.ErrUserNotFound
+		}
+		return nil, mapError(err)
+	}
+	return u, nil
+}
+
+const getAllStm = `SELECT ` + userColumns + ` FROM users`
+
+var sortColumns = map[string]string{
+	"id":         "id",
+	"username":   "username",
+	"email":      "email",
+	"created_at": "created_at",
+	"updated_at": "updated_at",
+}
+
+// GetAll returns up to query.Limit+1 users, so the caller can tell whether
+// another page follows.
+func (r *userRepository) GetAll(ctx context.Context, query *model.UserQuery) ([]model.User, error) {
+	stm, args := buildSelect(query, true)
 
-func (r *userRepository) GetAll(ctx context.Context) ([]model.User, error) {
-	rows, err := r.db.QueryContext(ctx, getAllStm)
+	rows, err := r.db.QueryContext(ctx, stm, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -37,11 +113,11 @@ func (r *userRepository) GetAll(ctx context.Context) ([]model.User, error) {
 
 	var users []model.User
 	for rows.Next() {
-		var u model.User
-		if err = rows.Scan(&u.ID, &u.Username, &u.Email, &u.FullName); err != nil {
+		var u *model.User
+		if u, err = scanUser(rows); err != nil {
 			return nil, err
 		}
-		users = append(users, u)
+		users = append(users, *u)
 	}
 
 	if err = rows.Err(); err != nil {
@@ -51,55 +127,637 @@ func (r *userRepository) GetAll(ctx context.Context) ([]model.User, error) {
 	return users, nil
 }
 
-const getByUsernameStm = `SELECT id, username, email, full_name FROM users WHERE username = $1`
+// buildSelect builds the query of the filtered and sorted users. Only a
+// paginated query is limited and starts after the cursor or at the offset.
+func buildSelect(query *model.UserQuery, paginate bool) (string, []any) {
+	var args []any
+	arg := func(v any) string {
+		args = append(args, v)
+		return "$" + strconv.Itoa(len(args))
+	}
 
-func (r *userRepository) GetByUsername(ctx context.Context, username string) (*model.User, error) {
-	var u model.User
-	if err := r.db.QueryRowContext(ctx, getByUsernameStm, username).
-		Scan(&u.ID, &u.Username, &u.Email, &u.FullName); err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			return nil, validation.ErrUserNotFound
+	conds := buildWhere(query, arg)
+
+	column := sortColumns[query.Sort]
+	op, dir := ">", "ASC"
+	if query.Order == "desc" {
+		op, dir = "<", "DESC"
+	}
+
+	if paginate && query.After != nil {
+		if column == "id" {
+			conds = append(conds, "id "+op+" "+arg(query.After.ID))
+		} else {
+			conds = append(conds, "("+column+", id) "+op+" ("+arg(query.After.Value)+", "+arg(query.After.ID)+")")
 		}
-		return nil, err
 	}
-	return &u, nil
+
+	var b strings.Builder
+	b.WriteString(getAllStm)
+	if len(conds) > 0 {
+		b.WriteString(" WHERE ")
+		b.WriteString(strings.Join(conds, " AND "))
+	}
+	b.WriteString(" ORDER BY ")
+	if column != "id" {
+		b.WriteString(column + " " + dir + ", ")
+	}
+	b.WriteString("id " + dir)
+	if paginate {
+		b.WriteString(" LIMIT " + arg(query.Limit+1))
+		if query.Offset > 0 {
+			b.WriteString(" OFFSET " + arg(query.Offset))
+		}
+	}
+
+	return b.String(), args
 }
 
-const getByIDStm = `SELECT id, username, email, full_name FROM users WHERE id = $1`
+// buildWhere returns the conditions of the filters of the query. arg adds
+// an argument and returns its placeholder.
+func buildWhere(query *model.UserQuery, arg func(v any) string) []string {
+	var conds []string
+
+	if !query.IncludeDeleted {
+		conds = append(conds, "deleted_at IS NULL")
+	}
+	if query.Username != "" {
+		conds = append(conds, "username = "+arg(query.Username))
+	}
+	if query.UsernamePrefix != "" {
+		conds = append(conds, "username LIKE "+arg(likeEscaper.Replace(query.UsernamePrefix)+"%"))
+	}
+	if query.Email != "" {
+		conds = append(conds, "email = "+arg(query.Email))
+	}
+	if query.EmailContains != "" {
+		conds = append(conds, "email ILIKE "+arg("%"+likeEscaper.Replace(query.EmailContains)+"%"))
+	}
+	if query.EmailDomain != "" {
+		conds = append(conds, "lower(split_part(email, '@', 2)) = lower("+arg(query.EmailDomain)+")")
+	}
+	// The columns are timestamps without time zone, in UTC, which would
+	// ignore the offset of a time.
+	if query.CreatedAfter != nil {
+		conds = append(conds, "created_at > "+arg(query.CreatedAfter.UTC()))
+	}
+	if query.CreatedBefore != nil {
+		conds = append(conds, "created_at < "+arg(query.CreatedBefore.UTC()))
+	}
+	if query.UpdatedAfter != nil {
+		conds = append(conds, "updated_at > "+arg(query.UpdatedAfter.UTC()))
+	}
+	if query.UpdatedBefore != nil {
+		conds = append(conds, "updated_at < "+arg(query.UpdatedBefore.UTC()))
+	}
+
+	return conds
+}
+
+// Count returns the number of users matching the filters of the query.
+func (r *userRepository) Count(ctx context.Context, query *model.UserQuery) (int64, error) {
+	var args []any
+	conds := buildWhere(query, func(v any) string {
+		args = append(args, v)
+		return "$" + strconv.Itoa(len(args))
+	})
+
+	stm := "SELECT count(*) FROM users"
+	if len(conds) > 0 {
+		stm += " WHERE " + strings.Join(conds, " AND ")
+	}
+
+	var n int64
+	err := r.db.QueryRowContext(ctx, stm, args...).Scan(&n)
+	return n, err
+}
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+const getByUsernameStm = `SELECT ` + userColumns + ` FROM users WHERE username = $1 AND deleted_at IS NULL`
+
+func (r *userRepository) GetByUsername(ctx context.Context, username string) (*model.User, error) {
+	return r.getOne(ctx, getByUsernameStm, username)
+}
+
+const getByIDStm = `SELECT ` + userColumns + ` FROM users WHERE id = $1 AND deleted_at IS NULL`
 
 func (r *userRepository) GetByID(ctx context.Context, id int64) (*model.User, error) {
-	var u model.User
-	if err := r.db.QueryRowContext(ctx, getByIDStm, id).
-		Scan(&u.ID, &u.Username, &u.Email, &u.FullName); err != nil {
+	return r.getOne(ctx, getByIDStm, id)
+}
+
+const getByUUIDStm = `SELECT ` + userColumns + ` FROM users WHERE uuid = $1 AND deleted_at IS NULL`
+
+func (r *userRepository) GetByUUID(ctx context.Context, uuid string) (*model.User, error) {
+	return r.getOne(ctx, getByUUIDStm, uuid)
+}
+
+const postStm = `INSERT INTO users (username, email, full_name) VALUES ($1, $2, $3) RETURNING id, uuid, created_at, updated_at, version`
+
+func (r *userRepository) Post(ctx context.Context, user *model.User) (int64, error) {
+	if err := r.db.QueryRowContext(ctx, postStm, user.Username, user.Email, user.FullName).
+		Scan(&user.ID, &user.UUID, &user.CreatedAt, &user.UpdatedAt, &user.Version); err != nil {
+		return 0, mapError(err)
+	}
+	return user.ID, nil
+}
+
+var patchColumns = map[string]bool{
+	"username":  true,
+	"email":     true,
+	"full_name": true,
+}
+
+// Patch updates only the given columns of the user and returns its new
+// version. A non-zero version makes the update conditional on it.
+func (r *userRepository) Patch(ctx context.Context, id, version int64, changes map[string]any) (int64, error) {
+	columns := make([]string, 0, len(changes))
+	for column := range changes {
+		if !patchColumns[column] {
+			return 0, fmt.Errorf("column %q cannot be patched", column)
+		}
+		columns = append(columns, column)
+	}
+	sort.Strings(columns)
+
+	args := make([]any, 0, len(columns)+2)
+	sets := make([]string, 0, len(columns)+1)
+	for _, column := range columns {
+		args = append(args, changes[column])
+		sets = append(sets, column+" = $"+strconv.Itoa(len(args)))
+	}
+	sets = append(sets, "version = version + 1")
+	args = append(args, id, version)
+
+	stm := "UPDATE users SET " + strings.Join(sets, ", ") +
+		" WHERE id = $" + strconv.Itoa(len(args)-1) + " AND deleted_at IS NULL" +
+		" AND ($" + strconv.Itoa(len(args)) + " = 0 OR version = $" + strconv.Itoa(len(args)) + ")" +
+		" RETURNING version"
+
+	var newVersion int64
+	if err := r.db.QueryRowContext(ctx, stm, args...).Scan(&newVersion); err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			return nil, validation.ErrUserNotFound
+			return 0, missing(version)
+		}
+		return 0, mapError(err)
+	}
+	return newVersion, nil
+}
+
+// missing explains why a statement conditional on version affected no rows.
+// A failed If-Match precondition is also reported for a missing user.
+func missing(version int64) error {
+	if version != 0 {
+		return validation.ErrPreconditionFailed
+	}
+	return validation.ErrUserNotFound
+}
+
+const deleteStm = `UPDATE users SET deleted_at = now(), version = version + 1
+	WHERE id = $1 AND deleted_at IS NULL AND ($2 = 0 OR version = $2) RETURNING ` + userColumns
+
+func (r *userRepository) Delete(ctx context.Context, id, version int64) (*model.User, error) {
+	return r.delete(ctx, deleteStm, id, version)
+}
+
+const deleteByUUIDStm = `UPDATE users SET deleted_at = now(), version = version + 1
+	WHERE uuid = $1 AND deleted_at IS NULL AND ($2 = 0 OR version = $2) RETURNING ` + userColumns
+
+func (r *userRepository) DeleteByUUID(ctx context.Context, uuid string, version int64) (*model.User, error) {
+	return r.delete(ctx, deleteByUUIDStm, uuid, version)
+}
+
+// delete soft-deletes the user and returns it. It is idempotent: deleting a
+// missing user returns nil unless a version was expected.
+func (r *userRepository) delete(ctx context.Context, stm string, key any, version int64) (*model.User, error) {
+	user, err := r.getOne(ctx, stm, key, version)
+	if errors.Is(err, validation.ErrUserNotFound) {
+		if version == 0 {
+			return nil, nil
 		}
+		return nil, missing(version)
+	}
+	return user, err
+}
+
+const restoreStm = `UPDATE users SET deleted_at = NULL, version = version + 1
+	WHERE id = $1 AND deleted_at IS NOT NULL RETURNING ` + userColumns
+
+// Restore undeletes a soft-deleted user. It fails with a conflict if its
+// username or email has been taken in the meantime.
+func (r *userRepository) Restore(ctx context.Context, id int64) (*model.User, error) {
+	return r.getOne(ctx, restoreStm, id)
+}
+
+const restoreByUUIDStm = `UPDATE users SET deleted_at = NULL, version = version + 1
+	WHERE uuid = $1 AND deleted_at IS NOT NULL RETURNING ` + userColumns
+
+func (r *userRepository) RestoreByUUID(ctx context.Context, uuid string) (*model.User, error) {
+	return r.getOne(ctx, restoreByUUIDStm, uuid)
+}
+
+const purgeStm = `DELETE FROM users WHERE deleted_at < now() - make_interval(secs => $1)`
+
+// Purge hard-deletes the users soft-deleted longer than retention ago.
+func (r *userRepository) Purge(ctx context.Context, retention time.Duration) (int64, error) {
+	res, err := r.db.ExecContext(ctx, purgeStm, retention.Seconds())
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+const eventColumns = `id, type, user_uuid, version, changes, created_at`
+
+// lockEventsStm serializes the appends until commit, so that the events
+// become visible in the order of their ids and a reader after an id never
+// misses one committed late.
+const lockEventsStm = `SELECT pg_advisory_xact_lock(hashtext('user_events'))`
+
+// appendEventStm also adds a webhook delivery for every active subscription
+// to the event type, which makes the deliveries the outbox of the change.
+const appendEventStm = `WITH event AS (
+		INSERT INTO user_events (type, user_uuid, version, changes)
+		VALUES ($1, $2, $3, $4) RETURNING id, type, created_at
+	), deliveries AS (
+		INSERT INTO webhook_deliveries (subscription_id, event_id)
+		SELECT s.id, event.id FROM webhook_subscriptions s, event
+		WHERE s.active AND (cardinality(s.events) = 0 OR event.type = ANY(s.events))
+	)
+	SELECT id, created_at FROM event`
+
+// AppendEvent adds the event to the log and the webhook outbox and sets its
+// id. It must be called in a transaction, see WithTx.
+func (r *userRepository) AppendEvent(ctx context.Context, event *model.UserEvent) error {
+	changes, err := json.Marshal(event.Changes)
+	if err != nil {
+		return err
+	}
+
+	if _, err = r.db.ExecContext(ctx, lockEventsStm); err != nil {
+		return err
+	}
+	return r.db.QueryRowContext(ctx, appendEventStm, event.Type, event.UUID, event.Version, changes).
+		Scan(&event.ID, &event.CreatedAt)
+}
+
+const getEventsStm = `SELECT ` + eventColumns + ` FROM user_events WHERE id > $1 ORDER BY id LIMIT $2`
+
+// GetEvents returns the events after the given id in order.
+func (r *userRepository) GetEvents(ctx context.Context, after int64, limit int) ([]model.UserEvent, error) {
+	rows, err := r.db.QueryContext(ctx, getEventsStm, after, limit)
+	if err != nil {
 		return nil, err
 	}
-	return &u, nil
+	defer func(rows *sql.Rows) { _ = rows.Close() }(rows)
+
+	var events []model.UserEvent
+	for rows.Next() {
+		var (
+			event   model.UserEvent
+			changes []byte
+		)
+		if err = rows.Scan(&event.ID, &event.Type, &event.UUID, &event.Version, &changes, &event.CreatedAt); err != nil {
+			return nil, err
+		}
+		if err = json.Unmarshal(changes, &event.Changes); err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	return events, rows.Err()
 }
 
-const postStm = `INSERT INTO users (username, email, full_name) VALUES ($1, $2, $3) RETURNING id`
+const lastEventIDStm = `SELECT coalesce(max(id), 0) FROM user_events`
 
-func (r *userRepository) Post(ctx context.Context, user *model.User) (int64, error) {
+func (r *userRepository) LastEventID(ctx context.Context) (int64, error) {
 	var id int64
-	if err := r.db.QueryRowContext(ctx, postStm, user.Username, user.Email, user.FullName).
-		Scan(&id); err != nil {
-		return 0, err
+	err := r.db.QueryRowContext(ctx, lastEventIDStm).Scan(&id)
+	return id, err
+}
+
+const (
+	purgeDeliveriesStm = `DELETE FROM webhook_deliveries d USING user_events e
+		WHERE e.id = d.event_id AND e.created_at < now() - make_interval(secs => $1) AND d.status = 'delivered'`
+	purgeEventsStm = `DELETE FROM user_events e WHERE e.created_at < now() - make_interval(secs => $1)
+		AND NOT EXISTS (SELECT 1 FROM webhook_deliveries d WHERE d.event_id = e.id)`
+)
+
+// PurgeEvents deletes the events older than retention, which can no longer
+// be resumed from, along with their delivered webhooks. An event is kept as
+// long as a delivery of it is pending or dead, so that it can still be
+// delivered.
+func (r *userRepository) PurgeEvents(ctx context.Context, retention time.Duration) (int64, error) {
+	var n int64
+	err := r.WithTx(ctx, func(repo UserRepository) error {
+		tx := repo.(*userRepository)
+		if _, err := tx.db.ExecContext(ctx, purgeDeliveriesStm, retention.Seconds()); err != nil {
+			return err
+		}
+		res, err := tx.db.ExecContext(ctx, purgeEventsStm, retention.Seconds())
+		if err != nil {
+			return err
+		}
+		n, err = res.RowsAffected()
+		return err
+	})
+	return n, err
+}
+
+const auditColumns = `id, action, user_id, user_uuid, actor, request_id, client_ip, before, after, created_at, prev_hash, hash`
+
+const (
+	lockAuditStm   = `SELECT pg_advisory_xact_lock(hashtext('audit_log'))`
+	lastAuditStm   = `SELECT hash FROM audit_log ORDER BY id DESC LIMIT 1`
+	appendAuditStm = `INSERT INTO audit_log (action, user_id, user_uuid, actor, request_id, client_ip, before, after, created_at, prev_hash, hash)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11) RETURNING id`
+)
+
+// AppendAudit chains the entry to the last one and adds it to the audit log.
+// It must be called in a transaction, see WithTx, as the lock that keeps the
+// chain linear is held until the commit.
+func (r *userRepository) AppendAudit(ctx context.Context, entry *model.AuditEntry) error {
+	before, err := json.Marshal(entry.Before)
+	if err != nil {
+		return err
+	}
+	after, err := json.Marshal(entry.After)
+	if err != nil {
+		return err
+	}
+
+	if _, err = r.db.ExecContext(ctx, lockAuditStm); err != nil {
+		return err
+	}
+	err = r.db.QueryRowContext(ctx, lastAuditStm).Scan(&entry.PrevHash)
+	if errors.Is(err, sql.ErrNoRows) {
+		entry.PrevHash = model.AuditGenesis
+	} else if err != nil {
+		return err
+	}
+
+	// The hash covers the time as stored, to the microsecond.
+	entry.CreatedAt = time.Now().UTC().Truncate(time.Microsecond)
+	entry.Hash = entry.ComputeHash()
+
+	return r.db.QueryRowContext(ctx, appendAuditStm, entry.Action, entry.UserID, entry.UserUUID, entry.Actor,
+		entry.RequestID, entry.ClientIP, nullJSON(before), nullJSON(after), entry.CreatedAt, entry.PrevHash, entry.Hash).
+		Scan(&entry.ID)
+}
+
+// nullJSON stores a nil map as NULL rather than the JSON null.
+func nullJSON(data []byte) []byte {
+	if string(data) == "null" {
+		return nil
+	}
+	return data
+}
+
+func scanAudit(row scanner) (*model.AuditEntry, error) {
+	var (
+		e             model.AuditEntry
+		before, after []byte
+	)
+	if err := row.Scan(&e.ID, &e.Action, &e.UserID, &e.UserUUID, &e.Actor, &e.RequestID, &e.ClientIP,
+		&before, &after, &e.CreatedAt, &e.PrevHash, &e.Hash); err != nil {
+		return nil, err
+	}
+	for _, m := range []struct {
+		data []byte
+		dst  *map[string]any
+	}{{before, &e.Before}, {after, &e.After}} {
+		if m.data == nil {
+			continue
+		}
+		if err := json.Unmarshal(m.data, m.dst); err != nil {
+			return nil, err
+		}
+	}
+	return &e, nil
+}
+
+const getAuditStm = `SELECT ` + auditColumns + ` FROM audit_log
+	WHERE ($1::bigint = 0 OR user_id = $1) AND ($2::text = '' OR user_uuid = nullif($2::text, '')::uuid)
+		AND ($3::text = '' OR actor = $3) AND ($4::timestamp IS NULL OR created_at >= $4)
+		AND ($5::bigint = 0 OR id < $5)
+	ORDER BY id DESC LIMIT $6`
+
+// GetAudit returns the entries matching the query newest first.
+func (r *userRepository) GetAudit(ctx context.Context, query *model.AuditQuery) ([]model.AuditEntry, error) {
+	var since *time.Time
+	if query.Since != nil {
+		t := query.Since.UTC()
+		since = &t
+	}
+
+	rows, err := r.db.QueryContext(ctx, getAuditStm, query.ID, query.UUID, query.Actor, since, query.Before, query.Limit)
+	if err != nil {
+		return nil, err
+	}
+	defer func(rows *sql.Rows) { _ = rows.Close() }(rows)
+
+	var entries []model.AuditEntry
+	for rows.Next() {
+		e, err := scanAudit(rows)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, *e)
+	}
+	return entries, rows.Err()
+}
+
+const walkAuditStm = `SELECT ` + auditColumns + ` FROM audit_log ORDER BY id`
+
+// WalkAudit calls fn for every entry from the oldest.
+func (r *userRepository) WalkAudit(ctx context.Context, fn func(entry *model.AuditEntry) error) error {
+	rows, err := r.db.QueryContext(ctx, walkAuditStm)
+	if err != nil {
+		return err
+	}
+	defer func(rows *sql.Rows) { _ = rows.Close() }(rows)
+
+	for rows.Next() {
+		e, err := scanAudit(rows)
+		if err != nil {
+			return err
+		}
+		if err = fn(e); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// searchStm matches the users by trigram similarity of any field, which
+// tolerates typos, or by the words of the search vector. The score adds up
+// both.
+const searchStm = `SELECT ` + userColumns + `, score FROM (
+		SELECT *, greatest(similarity(username, $1), similarity(email, $1), similarity(coalesce(full_name, ''), $1))
+			+ ts_rank(search, plainto_tsquery('simple', $1)) AS score
+		FROM users
+		WHERE deleted_at IS NULL
+			AND (username % $1 OR email % $1 OR full_name % $1 OR search @@ plainto_tsquery('simple', $1))
+	) AS matches
+	ORDER BY score DESC, id LIMIT $2`
+
+func (r *userRepository) Search(ctx context.Context, search *model.UserSearch) ([]model.UserMatch, error) {
+	rows, err := r.db.QueryContext(ctx, searchStm, search.Q, search.Limit)
+	if err != nil {
+		return nil, err
+	}
+	defer func(rows *sql.Rows) { _ = rows.Close() }(rows)
+
+	var matches []model.UserMatch
+	for rows.Next() {
+		var (
+			u     *model.User
+			score float64
+		)
+		if u, err = scanUser(rows, &score); err != nil {
+			return nil, err
+		}
+		matches = append(matches, model.UserMatch{User: *u, Score: score})
+	}
+	return matches, rows.Err()
+}
+
+const getByUsernamesOrEmailsStm = `SELECT ` + userColumns + ` FROM users
+	WHERE deleted_at IS NULL AND (username = ANY($1) OR email = ANY($2))`
+
+// GetByUsernamesOrEmails returns the users holding any of the usernames or
+// emails.
+func (r *userRepository) GetByUsernamesOrEmails(ctx context.Context, usernames, emails []string) ([]model.User, error) {
+	rows, err := r.db.QueryContext(ctx, getByUsernamesOrEmailsStm, pq.Array(usernames), pq.Array(emails))
+	if err != nil {
+		return nil, err
+	}
+	defer func(rows *sql.Rows) { _ = rows.Close() }(rows)
+
+	var users []model.User
+	for rows.Next() {
+		var u *model.User
+		if u, err = scanUser(rows); err != nil {
+			return nil, err
+		}
+		users = append(users, *u)
+	}
+	return users, rows.Err()
+}
+
+// importBatchSize keeps the statements well below the limit of 65535
+// parameters.
+const importBatchSize = 500
+
+// Import inserts the new users and updates the email and full name of the
+// existing ones, matched by id, with one statement per batch.
+func (r *userRepository) Import(ctx context.Context, create, update []model.User) error {
+	for start := 0; start < len(update); start += importBatchSize {
+		batch := update[start:min(start+importBatchSize, len(update))]
+
+		args := make([]any, 0, len(batch)*3)
+		values := make([]string, 0, len(batch))
+		for _, u := range batch {
+			args = append(args, u.ID, u.Email, u.FullName)
+			n := len(args)
+			values = append(values, fmt.Sprintf("($%d::bigint, $%d, $%d)", n-2, n-1, n))
+		}
+
+		stm := `UPDATE users AS u SET email = v.email, full_name = v.full_name, version = u.version + 1
+			FROM (VALUES ` + strings.Join(values, ", ") + `) AS v (id, email, full_name)
+			WHERE u.id = v.id AND u.deleted_at IS NULL`
+		if _, err := r.db.ExecContext(ctx, stm, args...); err != nil {
+			return mapError(err)
+		}
+	}
+
+	for start := 0; start < len(create); start += importBatchSize {
+		batch := create[start:min(start+importBatchSize, len(create))]
+
+		args := make([]any, 0, len(batch)*3)
+		values := make([]string, 0, len(batch))
+		for _, u := range batch {
+			args = append(args, u.Username, u.Email, u.FullName)
+			n := len(args)
+			values = append(values, fmt.Sprintf("($%d, $%d, $%d)", n-2, n-1, n))
+		}
+
+		stm := `INSERT INTO users (username, email, full_name) VALUES ` + strings.Join(values, ", ")
+		if _, err := r.db.ExecContext(ctx, stm, args...); err != nil {
+			return mapError(err)
+		}
 	}
-	return id, nil
+	return nil
 }
 
-const patchStm = `UPDATE users SET username = $1, email = $2, full_name = $3 WHERE id = $4`
+// exportBatchSize is the number of rows fetched from the cursor at once.
+const exportBatchSize = 1000
+
+// Export calls fn for every user matching the filters of the query, in its
+// order. The rows are read in batches from a server-side cursor, so the
+// memory use does not depend on the number of users.
+func (r *userRepository) Export(ctx context.Context, query *model.UserQuery, fn func(user *model.User) error) error {
+	return r.WithTx(ctx, func(repo UserRepository) error {
+		db := repo.(*userRepository).db
+
+		stm, args := buildSelect(query, false)
+		if _, err := db.ExecContext(ctx, "DECLARE users_export NO SCROLL CURSOR FOR "+stm, args...); err != nil {
+			return err
+		}
+
+		fetchStm := "FETCH " + strconv.Itoa(exportBatchSize) + " FROM users_export"
+		for {
+			n, err := fetch(ctx, db, fetchStm, fn)
+			if err != nil {
+				return err
+			}
+			if n < exportBatchSize {
+				break
+			}
+		}
 
-func (r *userRepository) Patch(ctx context.Context, user *model.User) error {
-	_, err := r.db.ExecContext(ctx, patchStm, user.Username, user.Email, user.FullName, user.ID)
-	return err
+		_, err := db.ExecContext(ctx, "CLOSE users_export")
+		return err
+	})
 }
 
-const deleteStm = `DELETE FROM users WHERE id = $1`
+func fetch(ctx context.Context, db querier, stm string, fn func(user *model.User) error) (int, error) {
+	rows, err := db.QueryContext(ctx, stm)
+	if err != nil {
+		return 0, err
+	}
+	defer func(rows *sql.Rows) { _ = rows.Close() }(rows)
+
+	var n int
+	for ; rows.Next(); n++ {
+		var u *model.User
+		if u, err = scanUser(rows); err != nil {
+			return 0, err
+		}
+		if err = fn(u); err != nil {
+			return 0, err
+		}
+	}
+	return n, rows.Err()
+}
 
-func (r *userRepository) Delete(ctx context.Context, id int64) error {
-	_, err := r.db.ExecContext(ctx, deleteStm, id)
-	return err
+func (r *userRepository) WithTx(ctx context.Context, fn func(repo UserRepository) error) error {
+	db, ok := r.db.(*sql.DB)
+	if !ok {
+		// Already in a transaction.
+		return fn(r)
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	if err = fn(&userRepository{db: tx}); err != nil {
+		if rbErr := tx.Rollback(); rbErr != nil && !errors.Is(rbErr, sql.ErrTxDone) {
+			slog.ErrorContext(ctx, "Failed to roll back:", "error", rbErr.Error())
+		}
+		return err
+	}
+	return tx.Commit()
 }
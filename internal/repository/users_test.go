@@ -0,0 +1,33 @@
+package repository
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"cruder/internal/model"
+)
+
+func TestBuildWhereTimes(t *testing.T) {
+	paris := time.FixedZone("CEST", 2*60*60)
+	after := time.Date(2026, 1, 1, 0, 0, 0, 0, paris)
+	before := time.Date(2026, 1, 2, 0, 0, 0, 0, paris)
+
+	var args []any
+	query := &model.UserQuery{CreatedAfter: &after, CreatedBefore: &before, UpdatedAfter: &after, UpdatedBefore: &before}
+	conds := buildWhere(query, func(v any) string {
+		args = append(args, v)
+		return "$" + strconv.Itoa(len(args))
+	})
+
+	expConds := []string{"deleted_at IS NULL", "created_at > $1", "created_at < $2", "updated_at > $3", "updated_at < $4"}
+	if !reflect.DeepEqual(conds, expConds) {
+		t.Errorf("expected conditions %v, got %v", expConds, conds)
+	}
+	utcAfter, utcBefore := time.Date(2025, 12, 31, 22, 0, 0, 0, time.UTC), time.Date(2026, 1, 1, 22, 0, 0, 0, time.UTC)
+	expArgs := []any{utcAfter, utcBefore, utcAfter, utcBefore}
+	if !reflect.DeepEqual(args, expArgs) {
+		t.Errorf("expected the times in UTC, got %v", args)
+	}
+}
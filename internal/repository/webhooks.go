@@ -0,0 +1,260 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"cruder/internal/model"
+	"cruder/pkg/validation"
+
+	"github.com/lib/pq"
+)
+
+type WebhookRepository interface {
+	GetAll(ctx context.Context) ([]model.Webhook, error)
+	GetByUUID(ctx context.Context, uuid string) (*model.Webhook, error)
+	Post(ctx context.Context, webhook *model.Webhook) error
+	Update(ctx context.Context, webhook *model.Webhook) error
+	Delete(ctx context.Context, uuid string) error
+	GetDeliveries(ctx context.Context, webhookID int64, query *model.DeliveryQuery) ([]model.WebhookDelivery, error)
+	GetDelivery(ctx context.Context, webhookID, id int64) (*model.WebhookDelivery, error)
+	Redeliver(ctx context.Context, webhookID, id int64) (*model.WebhookDelivery, error)
+	// Claim takes up to limit due deliveries of the active webhooks and
+	// postpones them by lease, so that no other dispatcher takes them while
+	// they are sent.
+	Claim(ctx context.Context, limit int, lease time.Duration) ([]model.WebhookMessage, error)
+	// RecordAttempt stores the attempt and moves the delivery to status. A
+	// pending delivery is tried again after retryIn.
+	RecordAttempt(ctx context.Context, deliveryID int64, attempt *model.WebhookAttempt, status string, retryIn time.Duration) error
+}
+
+type webhookRepository struct {
+	db *sql.DB
+}
+
+func NewWebhookRepository(db *sql.DB) WebhookRepository {
+	return &webhookRepository{db: db}
+}
+
+// The secret is only read by the dispatcher.
+const webhookColumns = `id, uuid, url, events, active, created_at, updated_at`
+
+func scanWebhook(row scanner) (*model.Webhook, error) {
+	var w model.Webhook
+	if err := row.Scan(&w.ID, &w.UUID, &w.URL, (*pq.StringArray)(&w.Events), &w.Active, &w.CreatedAt, &w.UpdatedAt); err != nil {
+		return nil, err
+	}
+	return &w, nil
+}
+
+const getWebhooksStm = `SELECT ` + webhookColumns + ` FROM webhook_subscriptions ORDER BY id`
+
+func (r *webhookRepository) GetAll(ctx context.Context) ([]model.Webhook, error) {
+	rows, err := r.db.QueryContext(ctx, getWebhooksStm)
+	if err != nil {
+		return nil, err
+	}
+	defer func(rows *sql.Rows) { _ = rows.Close() }(rows)
+
+	var webhooks []model.Webhook
+	for rows.Next() {
+		w, err := scanWebhook(rows)
+		if err != nil {
+			return nil, err
+		}
+		webhooks = append(webhooks, *w)
+	}
+	return webhooks, rows.Err()
+}
+
+const getWebhookStm = `SELECT ` + webhookColumns + ` FROM webhook_subscriptions WHERE uuid = $1`
+
+func (r *webhookRepository) GetByUUID(ctx context.Context, uuid string) (*model.Webhook, error) {
+	w, err := scanWebhook(r.db.QueryRowContext(ctx, getWebhookStm, uuid))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, validation.ErrWebhookNotFound
+	}
+	return w, err
+}
+
+const postWebhookStm = `INSERT INTO webhook_subscriptions (url, secret, events, active)
+	VALUES ($1, $2, $3, $4) RETURNING id, uuid, created_at, updated_at`
+
+func (r *webhookRepository) Post(ctx context.Context, webhook *model.Webhook) error {
+	return r.db.QueryRowContext(ctx, postWebhookStm, webhook.URL, webhook.Secret, pq.StringArray(webhook.Events), webhook.Active).
+		Scan(&webhook.ID, &webhook.UUID, &webhook.CreatedAt, &webhook.UpdatedAt)
+}
+
+const updateWebhookStm = `UPDATE webhook_subscriptions SET url = $2, events = $3, active = $4, updated_at = now()
+	WHERE id = $1 RETURNING updated_at`
+
+func (r *webhookRepository) Update(ctx context.Context, webhook *model.Webhook) error {
+	err := r.db.QueryRowContext(ctx, updateWebhookStm, webhook.ID, webhook.URL, pq.StringArray(webhook.Events), webhook.Active).
+		Scan(&webhook.UpdatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return validation.ErrWebhookNotFound
+	}
+	return err
+}
+
+const deleteWebhookStm = `DELETE FROM webhook_subscriptions WHERE uuid = $1`
+
+// Delete removes the webhook together with its deliveries.
+func (r *webhookRepository) Delete(ctx context.Context, uuid string) error {
+	res, err := r.db.ExecContext(ctx, deleteWebhookStm, uuid)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return validation.ErrWebhookNotFound
+	}
+	return nil
+}
+
+// deliveryColumns reads next_attempt_at only while the delivery is pending.
+const deliveryColumns = `d.id, d.event_id, e.type, d.status, d.attempts,
+	CASE WHEN d.status = 'pending' THEN d.next_attempt_at END, d.created_at, d.updated_at`
+
+const deliveryFrom = ` FROM webhook_deliveries d JOIN user_events e ON e.id = d.event_id`
+
+func scanDelivery(row scanner) (*model.WebhookDelivery, error) {
+	var d model.WebhookDelivery
+	if err := row.Scan(&d.ID, &d.EventID, &d.EventType, &d.Status, &d.Attempts, &d.NextAttemptAt, &d.CreatedAt, &d.UpdatedAt); err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+const getDeliveriesStm = `SELECT ` + deliveryColumns + deliveryFrom + `
+	WHERE d.subscription_id = $1 AND ($2::text = '' OR d.status = $2) AND ($3::bigint = 0 OR d.id < $3)
+	ORDER BY d.id DESC LIMIT $4`
+
+// GetDeliveries lists the deliveries of the webhook newest first.
+func (r *webhookRepository) GetDeliveries(ctx context.Context, webhookID int64, query *model.DeliveryQuery) ([]model.WebhookDelivery, error) {
+	rows, err := r.db.QueryContext(ctx, getDeliveriesStm, webhookID, query.Status, query.Before, query.Limit)
+	if err != nil {
+		return nil, err
+	}
+	defer func(rows *sql.Rows) { _ = rows.Close() }(rows)
+
+	var deliveries []model.WebhookDelivery
+	for rows.Next() {
+		d, err := scanDelivery(rows)
+		if err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, *d)
+	}
+	return deliveries, rows.Err()
+}
+
+const (
+	getDeliveryStm = `SELECT ` + deliveryColumns + deliveryFrom + ` WHERE d.subscription_id = $1 AND d.id = $2`
+	getAttemptsStm = `SELECT coalesce(status_code, 0), error, duration_ms, created_at
+		FROM webhook_attempts WHERE delivery_id = $1 ORDER BY id`
+)
+
+// GetDelivery returns the delivery with its attempts.
+func (r *webhookRepository) GetDelivery(ctx context.Context, webhookID, id int64) (*model.WebhookDelivery, error) {
+	d, err := scanDelivery(r.db.QueryRowContext(ctx, getDeliveryStm, webhookID, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, validation.ErrDeliveryNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := r.db.QueryContext(ctx, getAttemptsStm, id)
+	if err != nil {
+		return nil, err
+	}
+	defer func(rows *sql.Rows) { _ = rows.Close() }(rows)
+
+	for rows.Next() {
+		var a model.WebhookAttempt
+		if err = rows.Scan(&a.StatusCode, &a.Error, &a.DurationMS, &a.CreatedAt); err != nil {
+			return nil, err
+		}
+		d.History = append(d.History, a)
+	}
+	return d, rows.Err()
+}
+
+// redeliverStm resets the attempts, so that the backoff starts over. The
+// history of the attempts is kept.
+const redeliverStm = `UPDATE webhook_deliveries
+	SET status = 'pending', attempts = 0, next_attempt_at = now(), updated_at = now()
+	WHERE subscription_id = $1 AND id = $2`
+
+func (r *webhookRepository) Redeliver(ctx context.Context, webhookID, id int64) (*model.WebhookDelivery, error) {
+	res, err := r.db.ExecContext(ctx, redeliverStm, webhookID, id)
+	if err != nil {
+		return nil, err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return nil, err
+	} else if n == 0 {
+		return nil, validation.ErrDeliveryNotFound
+	}
+	return r.GetDelivery(ctx, webhookID, id)
+}
+
+// claimStm skips the rows locked by another dispatcher, so that every
+// instance can run one.
+const claimStm = `WITH claimed AS (
+		UPDATE webhook_deliveries SET next_attempt_at = now() + make_interval(secs => $2)
+		WHERE id IN (
+			SELECT d.id FROM webhook_deliveries d JOIN webhook_subscriptions s ON s.id = d.subscription_id
+			WHERE d.status = 'pending' AND d.next_attempt_at <= now() AND s.active
+			ORDER BY d.next_attempt_at, d.id LIMIT $1
+			FOR UPDATE OF d SKIP LOCKED
+		)
+		RETURNING id, subscription_id, event_id, attempts
+	)
+	SELECT c.id, c.attempts, s.url, s.secret, e.id, e.type, e.user_uuid, e.version, e.changes, e.created_at
+	FROM claimed c
+		JOIN webhook_subscriptions s ON s.id = c.subscription_id
+		JOIN user_events e ON e.id = c.event_id
+	ORDER BY c.event_id`
+
+func (r *webhookRepository) Claim(ctx context.Context, limit int, lease time.Duration) ([]model.WebhookMessage, error) {
+	rows, err := r.db.QueryContext(ctx, claimStm, limit, lease.Seconds())
+	if err != nil {
+		return nil, err
+	}
+	defer func(rows *sql.Rows) { _ = rows.Close() }(rows)
+
+	var messages []model.WebhookMessage
+	for rows.Next() {
+		var (
+			m       model.WebhookMessage
+			e       = &m.Event
+			changes []byte
+		)
+		if err = rows.Scan(&m.DeliveryID, &m.Attempts, &m.URL, &m.Secret,
+			&e.ID, &e.Type, &e.UUID, &e.Version, &changes, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		if err = json.Unmarshal(changes, &e.Changes); err != nil {
+			return nil, err
+		}
+		messages = append(messages, m)
+	}
+	return messages, rows.Err()
+}
+
+const recordAttemptStm = `WITH attempt AS (
+		INSERT INTO webhook_attempts (delivery_id, status_code, error, duration_ms) VALUES ($1, nullif($2, 0), $3, $4)
+	)
+	UPDATE webhook_deliveries SET attempts = attempts + 1, status = $5, next_attempt_at = now() + make_interval(secs => $6), updated_at = now()
+	WHERE id = $1`
+
+func (r *webhookRepository) RecordAttempt(ctx context.Context, deliveryID int64, attempt *model.WebhookAttempt, status string, retryIn time.Duration) error {
+	_, err := r.db.ExecContext(ctx, recordAttemptStm, deliveryID, attempt.StatusCode, attempt.Error, attempt.DurationMS, status, retryIn.Seconds())
+	return err
+}
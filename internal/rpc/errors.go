@@ -0,0 +1,65 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+
+	"cruder/pkg/validation"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Error maps err to a gRPC status the way the REST API maps it to a problem.
+// Validation errors carry their fields as BadRequest details. Unknown errors
+// are logged and reported as a bare Internal, so that database details never
+// reach the client.
+func Error(ctx context.Context, err error) error {
+	var (
+		invalid  validation.InvalidRequest
+		errs     validation.ValidationErrors
+		conflict validation.ErrConflict
+		scope    validation.ErrMissingScope
+		missing  validation.ErrMissingPermission
+	)
+
+	switch {
+	case errors.Is(err, validation.ErrUserNotFound):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, validation.ErrUnsupportedPatch), errors.Is(err, validation.ErrPatchTestFailed):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, validation.ErrPreconditionFailed):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	case errors.As(err, &invalid):
+		return invalidArgument(err, validation.ValidationErrors{invalid})
+	case errors.As(err, &errs):
+		return invalidArgument(err, errs)
+	case errors.As(err, &conflict):
+		return status.Error(codes.AlreadyExists, err.Error())
+	case errors.As(err, &scope), errors.As(err, &missing):
+		return status.Error(codes.PermissionDenied, err.Error())
+	default:
+		slog.ErrorContext(ctx, "Internal error:", "error", err.Error())
+		return status.Error(codes.Internal, "")
+	}
+}
+
+func invalidArgument(err error, errs validation.ValidationErrors) error {
+	violations := make([]*errdetails.BadRequest_FieldViolation, len(errs))
+	for i, e := range errs {
+		violations[i] = &errdetails.BadRequest_FieldViolation{
+			Field:       e.Field,
+			Description: e.Message,
+			Reason:      e.Code,
+		}
+	}
+
+	st, detailErr := status.New(codes.InvalidArgument, err.Error()).
+		WithDetails(&errdetails.BadRequest{FieldViolations: violations})
+	if detailErr != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	return st.Err()
+}
@@ -0,0 +1,194 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"time"
+
+	"cruder/internal/audit"
+	"cruder/internal/auth"
+	"cruder/internal/model"
+	"cruder/internal/service"
+	"cruder/pkg/logger"
+	userv1 "cruder/pkg/pb/user/v1"
+	"cruder/pkg/validation"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// APIKeyHeader is the metadata key of the API key, the gRPC counterpart of
+// the X-API-Key header. A bearer token is sent in authorization.
+const APIKeyHeader = "x-api-key"
+
+// RequestIDHeader is the metadata key of the request id.
+const RequestIDHeader = "x-request-id"
+
+// methodScopes are the scopes the methods require of the caller, as the
+// routes of the REST API declare them.
+var methodScopes = map[string]string{
+	userv1.UserService_GetUser_FullMethodName:    model.ScopeUsersRead,
+	userv1.UserService_ListUsers_FullMethodName:  model.ScopeUsersRead,
+	userv1.UserService_CreateUser_FullMethodName: model.ScopeUsersWrite,
+	userv1.UserService_UpdateUser_FullMethodName: model.ScopeUsersWrite,
+	userv1.UserService_DeleteUser_FullMethodName: model.ScopeUsersWrite,
+}
+
+// methodPermissions are the permissions the reads require of the roles of
+// the caller. The service checks the permissions of the changes itself.
+var methodPermissions = map[string]string{
+	userv1.UserService_GetUser_FullMethodName:   model.PermUsersRead,
+	userv1.UserService_ListUsers_FullMethodName: model.PermUsersRead,
+}
+
+// NewServer returns a gRPC server of the user service that requires the
+// credentials of a caller granted the scope of the method on every call.
+func NewServer(authenticator auth.Authenticator, users service.UserService) *grpc.Server {
+	server := grpc.NewServer(
+		grpc.ChainUnaryInterceptor(unaryRequestID, unaryAuth(authenticator), logging),
+		grpc.ChainStreamInterceptor(streamRequestID, streamAuth(authenticator), streamLogging),
+	)
+	userv1.RegisterUserServiceServer(server, NewUserServer(users))
+	return server
+}
+
+// authenticate checks the credentials and the scope of the caller and
+// returns ctx with the principal and the metadata of the call for the audit
+// log. A method without a declared scope requires admin and the permission
+// to manage.
+func authenticate(ctx context.Context, authenticator auth.Authenticator, method string) (context.Context, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+
+	// The metadata keys are lower case, which md.Get takes care of.
+	principal, err := authenticator.Authenticate(ctx, func(name string) string { return first(md, name) })
+	switch {
+	case errors.Is(err, validation.ErrNoCredentials), errors.Is(err, validation.ErrInvalidToken):
+		return nil, status.Error(codes.Unauthenticated, err.Error())
+	case errors.Is(err, validation.ErrInvalidAPIKey):
+		return nil, status.Error(codes.PermissionDenied, "forbidden")
+	case err != nil:
+		return nil, Error(ctx, err)
+	}
+
+	ctx = auth.WithPrincipal(ctx, principal)
+	scope, ok := methodScopes[method]
+	if !ok {
+		scope = model.ScopeAdmin
+	}
+	if err = auth.Require(ctx, scope); err != nil {
+		return nil, Error(ctx, err)
+	}
+	permission, ok := methodPermissions[method]
+	if !ok && scope == model.ScopeAdmin {
+		permission, ok = model.PermManage, true
+	}
+	if ok {
+		if err = auth.Authorize(ctx, permission); err != nil {
+			return nil, Error(ctx, err)
+		}
+	}
+
+	ctx = logger.WithAttrs(ctx, slog.String(logger.PrincipalKey, principal.ID))
+	meta := audit.Meta{Actor: principal.ID, RequestID: logger.RequestID(ctx)}
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		meta.ClientIP = p.Addr.String()
+		if host, _, err := net.SplitHostPort(meta.ClientIP); err == nil {
+			meta.ClientIP = host
+		}
+	}
+	return audit.WithMeta(ctx, meta), nil
+}
+
+func first(md metadata.MD, key string) string {
+	if values := md.Get(key); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// withRequestID takes the request id of the metadata, or a new one, and
+// returns it along with ctx carrying it and the method for the log lines.
+func withRequestID(ctx context.Context, method string) (context.Context, string) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	id := logger.EnsureRequestID(first(md, RequestIDHeader))
+	ctx = logger.WithRequestID(ctx, id)
+	return logger.WithAttrs(ctx, slog.String(logger.MethodKey, method)), id
+}
+
+// unaryRequestID echoes the request id in the header of the response.
+func unaryRequestID(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	ctx, id := withRequestID(ctx, info.FullMethod)
+	_ = grpc.SetHeader(ctx, metadata.Pairs(RequestIDHeader, id))
+	return handler(ctx, req)
+}
+
+func streamRequestID(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, id := withRequestID(ss.Context(), info.FullMethod)
+	_ = ss.SetHeader(metadata.Pairs(RequestIDHeader, id))
+	return handler(srv, &serverStream{ServerStream: ss, ctx: ctx})
+}
+
+// unaryAuth authenticates the call ahead of logging, so that the log line
+// carries the principal. A refused call is logged here.
+func unaryAuth(authenticator auth.Authenticator) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		start := time.Now()
+		authCtx, err := authenticate(ctx, authenticator, info.FullMethod)
+		if err != nil {
+			logCall(ctx, start, err)
+			return nil, err
+		}
+		ctx = authCtx
+		return handler(ctx, req)
+	}
+}
+
+func streamAuth(authenticator auth.Authenticator) grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		start := time.Now()
+		ctx, err := authenticate(ss.Context(), authenticator, info.FullMethod)
+		if err != nil {
+			logCall(ss.Context(), start, err)
+			return err
+		}
+		return handler(srv, &serverStream{ServerStream: ss, ctx: ctx})
+	}
+}
+
+// serverStream replaces the context of the stream.
+type serverStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *serverStream) Context() context.Context {
+	return s.ctx
+}
+
+func logging(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	start := time.Now()
+	resp, err := handler(ctx, req)
+	logCall(ctx, start, err)
+	return resp, err
+}
+
+func streamLogging(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	start := time.Now()
+	err := handler(srv, ss)
+	logCall(ss.Context(), start, err)
+	return err
+}
+
+// logCall logs the call with the request id and the method of ctx.
+func logCall(ctx context.Context, start time.Time, err error) {
+	slog.InfoContext(ctx, "Incoming call:",
+		"rpc.server.duration", time.Since(start).String(),
+		"rpc.system", "grpc",
+		"rpc.grpc.status_code", status.Code(err).String(),
+	)
+}
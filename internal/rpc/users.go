@@ -0,0 +1,140 @@
+package rpc
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"cruder/internal/model"
+	"cruder/internal/service"
+	"cruder/pkg/patch"
+	userv1 "cruder/pkg/pb/user/v1"
+
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// UserServer serves the users over gRPC. Users are addressed by UUID or
+// username, as the numeric id is deprecated.
+type UserServer struct {
+	userv1.UnimplementedUserServiceServer
+
+	service service.UserService
+}
+
+func NewUserServer(service service.UserService) *UserServer {
+	return &UserServer{service: service}
+}
+
+func (s *UserServer) GetUser(ctx context.Context, req *userv1.GetUserRequest) (*userv1.User, error) {
+	var (
+		user *model.User
+		err  error
+	)
+
+	switch key := req.GetKey().(type) {
+	case *userv1.GetUserRequest_Username:
+		user, err = s.service.GetByUsername(ctx, key.Username)
+	default:
+		user, err = s.service.GetByUUID(ctx, req.GetUuid())
+	}
+	if err != nil {
+		return nil, Error(ctx, err)
+	}
+
+	return toProto(user), nil
+}
+
+// ListUsers streams the users from a server-side cursor, so the stream is not
+// paginated.
+func (s *UserServer) ListUsers(req *userv1.ListUsersRequest, stream userv1.UserService_ListUsersServer) error {
+	query := &model.UserQuery{
+		Sort:           req.GetSort(),
+		Order:          req.GetOrder(),
+		UsernamePrefix: req.GetUsernamePrefix(),
+		EmailDomain:    req.GetEmailDomain(),
+		CreatedAfter:   toTime(req.GetCreatedAfter()),
+		CreatedBefore:  toTime(req.GetCreatedBefore()),
+		UpdatedAfter:   toTime(req.GetUpdatedAfter()),
+		UpdatedBefore:  toTime(req.GetUpdatedBefore()),
+		IncludeDeleted: req.GetIncludeDeleted(),
+	}
+
+	ctx := stream.Context()
+	err := s.service.Export(ctx, query, func(user *model.User) error {
+		return stream.Send(toProto(user))
+	})
+	if err != nil {
+		return Error(ctx, err)
+	}
+	return nil
+}
+
+func (s *UserServer) CreateUser(ctx context.Context, req *userv1.CreateUserRequest) (*userv1.User, error) {
+	user := &model.User{
+		Username: req.GetUsername(),
+		Email:    req.GetEmail(),
+		FullName: req.GetFullName(),
+	}
+
+	if _, err := s.service.Post(ctx, user); err != nil {
+		return nil, Error(ctx, err)
+	}
+
+	return toProto(user), nil
+}
+
+// UpdateUser applies the set fields of the request as a merge patch.
+func (s *UserServer) UpdateUser(ctx context.Context, req *userv1.UpdateUserRequest) (*userv1.User, error) {
+	user, err := s.service.GetByUUID(ctx, req.GetUuid())
+	if err != nil {
+		return nil, Error(ctx, err)
+	}
+
+	changes := make(map[string]string)
+	if req.Username != nil {
+		changes["username"] = req.GetUsername()
+	}
+	if req.Email != nil {
+		changes["email"] = req.GetEmail()
+	}
+	if req.FullName != nil {
+		changes["full_name"] = req.GetFullName()
+	}
+	body, _ := json.Marshal(changes)
+
+	p := &model.UserPatch{ContentType: patch.MergePatchType, Body: body, IfMatch: req.GetIfMatch()}
+	if err = s.service.Patch(ctx, user, p); err != nil {
+		return nil, Error(ctx, err)
+	}
+
+	return toProto(user), nil
+}
+
+func (s *UserServer) DeleteUser(ctx context.Context, req *userv1.DeleteUserRequest) (*emptypb.Empty, error) {
+	if err := s.service.DeleteByUUID(ctx, req.GetUuid(), req.GetIfMatch()); err != nil {
+		return nil, Error(ctx, err)
+	}
+	return new(emptypb.Empty), nil
+}
+
+func toProto(user *model.User) *userv1.User {
+	return &userv1.User{
+		Id:        user.ID,
+		Uuid:      user.UUID,
+		Username:  user.Username,
+		Email:     user.Email,
+		FullName:  user.FullName,
+		CreatedAt: timestamppb.New(user.CreatedAt),
+		UpdatedAt: timestamppb.New(user.UpdatedAt),
+		Version:   user.Version,
+	}
+}
+
+func toTime(ts *timestamppb.Timestamp) *time.Time {
+	if ts == nil {
+		return nil
+	}
+	t := ts.AsTime()
+	return &t
+}
@@ -0,0 +1,508 @@
+package rpc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"cruder/internal/audit"
+	"cruder/internal/auth"
+	"cruder/internal/events"
+	"cruder/internal/model"
+	"cruder/internal/repository"
+	"cruder/internal/service"
+	"cruder/pkg/logger"
+	userv1 "cruder/pkg/pb/user/v1"
+	"cruder/pkg/validation"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	testApiKey      = "secret"
+	testReadKey     = "read-only"
+	testOperatorKey = "operator"
+	testNoRoleKey   = "no-role"
+)
+
+// testKeys accepts the admin key, a read-only key granted only users:read,
+// an operator key and a key without any role.
+var testKeys = auth.APIKey(auth.Keys(auth.StaticKey(testApiKey), auth.KeyAuthenticatorFunc(
+	func(_ context.Context, key string) (*model.Principal, error) {
+		switch key {
+		case testReadKey:
+			return &model.Principal{ID: "api-key:reader", Scopes: []string{model.ScopeUsersRead}, Roles: []string{model.RoleReadOnly}}, nil
+		case testOperatorKey:
+			return &model.Principal{
+				ID:     "api-key:operator",
+				Scopes: []string{model.ScopeUsersRead, model.ScopeUsersWrite},
+				Roles:  []string{model.RoleOperator},
+			}, nil
+		case testNoRoleKey:
+			return &model.Principal{ID: "api-key:nobody", Scopes: []string{model.ScopeUsersRead}, Roles: []string{}}, nil
+		}
+		return nil, validation.ErrInvalidAPIKey
+	},
+)))
+
+// fakeRepository keeps the users in memory. Only the methods used by the
+// gRPC transport are implemented.
+type fakeRepository struct {
+	repository.UserRepository
+	users []model.User
+	audit []model.AuditEntry
+}
+
+func (f *fakeRepository) get(match func(u *model.User) bool) (*model.User, error) {
+	for i := range f.users {
+		if f.users[i].DeletedAt == nil && match(&f.users[i]) {
+			user := f.users[i]
+			return &user, nil
+		}
+	}
+	return nil, validation.ErrUserNotFound
+}
+
+func (f *fakeRepository) GetByUsername(_ context.Context, username string) (*model.User, error) {
+	return f.get(func(u *model.User) bool { return u.Username == username })
+}
+
+func (f *fakeRepository) GetByUUID(_ context.Context, uuid string) (*model.User, error) {
+	return f.get(func(u *model.User) bool { return u.UUID == uuid })
+}
+
+func (f *fakeRepository) Post(_ context.Context, user *model.User) (int64, error) {
+	for _, u := range f.users {
+		if u.Username == user.Username {
+			return 0, validation.ErrConflict{Field: "username"}
+		}
+	}
+
+	now := time.Now().UTC()
+	user.ID = int64(len(f.users) + 1)
+	user.UUID = "00000000-0000-4000-8000-" + strings.Repeat("0", 11) + strconv.Itoa(len(f.users)+1)
+	user.CreatedAt, user.UpdatedAt, user.Version = now, now, 1
+	f.users = append(f.users, *user)
+	return user.ID, nil
+}
+
+func (f *fakeRepository) Patch(_ context.Context, id, version int64, changes map[string]any) (int64, error) {
+	user := &f.users[id-1]
+	if version != 0 && version != user.Version {
+		return 0, validation.ErrPreconditionFailed
+	}
+	if v, ok := changes["username"]; ok {
+		user.Username = v.(string)
+	}
+	if v, ok := changes["email"]; ok {
+		user.Email = v.(string)
+	}
+	if v, ok := changes["full_name"]; ok {
+		user.FullName = v.(string)
+	}
+	user.Version++
+	return user.Version, nil
+}
+
+func (f *fakeRepository) DeleteByUUID(ctx context.Context, uuid string, version int64) (*model.User, error) {
+	user, err := f.GetByUUID(ctx, uuid)
+	if err != nil {
+		return nil, nil
+	}
+	if version != 0 && version != user.Version {
+		return nil, validation.ErrPreconditionFailed
+	}
+	now := time.Now().UTC()
+	f.users[user.ID-1].DeletedAt = &now
+	return &f.users[user.ID-1], nil
+}
+
+func (f *fakeRepository) AppendEvent(context.Context, *model.UserEvent) error {
+	return nil
+}
+
+func (f *fakeRepository) AppendAudit(_ context.Context, entry *model.AuditEntry) error {
+	f.audit = append(f.audit, *entry)
+	return nil
+}
+
+func (f *fakeRepository) WithTx(_ context.Context, fn func(repo repository.UserRepository) error) error {
+	return fn(f)
+}
+
+func (f *fakeRepository) Export(_ context.Context, query *model.UserQuery, fn func(user *model.User) error) error {
+	for i := range f.users {
+		if f.users[i].DeletedAt != nil || !strings.HasPrefix(f.users[i].Username, query.UsernamePrefix) {
+			continue
+		}
+		if query.UpdatedAfter != nil && !f.users[i].UpdatedAt.After(*query.UpdatedAfter) ||
+			query.UpdatedBefore != nil && !f.users[i].UpdatedAt.Before(*query.UpdatedBefore) {
+			continue
+		}
+		if err := fn(&f.users[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func setupClient(t *testing.T) userv1.UserServiceClient {
+	t.Helper()
+	client, _ := setupServer(t)
+	return client
+}
+
+func setupServer(t *testing.T) (userv1.UserServiceClient, *fakeRepository) {
+	t.Helper()
+
+	repo := new(fakeRepository)
+	for _, name := range []string{"jdoe", "asmith", "jsmith"} {
+		if _, err := repo.Post(t.Context(), &model.User{Username: name, Email: name + "@example.com"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	lis := bufconn.Listen(1 << 20)
+	server := NewServer(testKeys, service.NewUserService(repo, events.NewBroker()))
+	go func() { _ = server.Serve(lis) }()
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) { return lis.Dial() }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+
+	return userv1.NewUserServiceClient(conn), repo
+}
+
+func withKey(ctx context.Context, key string) context.Context {
+	return metadata.AppendToOutgoingContext(ctx, APIKeyHeader, key)
+}
+
+func TestAuth(t *testing.T) {
+	client := setupClient(t)
+	req := &userv1.GetUserRequest{Key: &userv1.GetUserRequest_Username{Username: "jdoe"}}
+
+	tests := []struct {
+		name string
+		ctx  context.Context
+		code codes.Code
+	}{
+		{"missing key", t.Context(), codes.Unauthenticated},
+		{"wrong key", withKey(t.Context(), "wrong"), codes.PermissionDenied},
+		{"valid key", withKey(t.Context(), testApiKey), codes.OK},
+		{"read-only key", withKey(t.Context(), testReadKey), codes.OK},
+		{"no role", withKey(t.Context(), testNoRoleKey), codes.PermissionDenied},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := client.GetUser(tt.ctx, req)
+			if got := status.Code(err); got != tt.code {
+				t.Fatalf("unary: expected %v, got %v", tt.code, got)
+			}
+
+			stream, err := client.ListUsers(tt.ctx, &userv1.ListUsersRequest{})
+			if err == nil {
+				_, err = stream.Recv()
+			}
+			if got := status.Code(err); got != tt.code {
+				t.Fatalf("stream: expected %v, got %v", tt.code, got)
+			}
+		})
+	}
+}
+
+func TestScopes(t *testing.T) {
+	client := setupClient(t)
+	ctx := withKey(t.Context(), testReadKey)
+
+	_, err := client.CreateUser(ctx, &userv1.CreateUserRequest{Username: "bjones", Email: "bjones@example.com"})
+	if st := status.Convert(err); st.Code() != codes.PermissionDenied || st.Message() != "missing scope users:write" {
+		t.Fatalf("expected the missing scope to be denied, got %v", err)
+	}
+
+	_, err = client.DeleteUser(ctx, &userv1.DeleteUserRequest{Uuid: "00000000-0000-4000-8000-000000000001"})
+	if status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("expected the delete to be denied, got %v", err)
+	}
+}
+
+func TestPermissions(t *testing.T) {
+	client := setupClient(t)
+	ctx := withKey(t.Context(), testOperatorKey)
+
+	_, err := client.CreateUser(ctx, &userv1.CreateUserRequest{Username: "bjones", Email: "bjones@example.com"})
+	if err != nil {
+		t.Fatalf("expected the operator to create the user, got %v", err)
+	}
+
+	_, err = client.DeleteUser(ctx, &userv1.DeleteUserRequest{Uuid: "00000000-0000-4000-8000-000000000001"})
+	if st := status.Convert(err); st.Code() != codes.PermissionDenied || st.Message() != "missing permission users.delete" {
+		t.Fatalf("expected the missing permission to be denied, got %v", err)
+	}
+}
+
+func TestGetUser(t *testing.T) {
+	client := setupClient(t)
+	ctx := withKey(t.Context(), testApiKey)
+
+	tests := []struct {
+		name     string
+		req      *userv1.GetUserRequest
+		code     codes.Code
+		username string
+	}{
+		{"by username", &userv1.GetUserRequest{Key: &userv1.GetUserRequest_Username{Username: "asmith"}}, codes.OK, "asmith"},
+		{"by uuid", &userv1.GetUserRequest{Key: &userv1.GetUserRequest_Uuid{Uuid: "00000000-0000-4000-8000-000000000003"}}, codes.OK, "jsmith"},
+		{"unknown username", &userv1.GetUserRequest{Key: &userv1.GetUserRequest_Username{Username: "nobody"}}, codes.NotFound, ""},
+		{"invalid uuid", &userv1.GetUserRequest{Key: &userv1.GetUserRequest_Uuid{Uuid: "42"}}, codes.InvalidArgument, ""},
+		{"no key", &userv1.GetUserRequest{}, codes.InvalidArgument, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			user, err := client.GetUser(ctx, tt.req)
+			if got := status.Code(err); got != tt.code {
+				t.Fatalf("expected %v, got %v: %v", tt.code, got, err)
+			}
+			if err == nil && user.GetUsername() != tt.username {
+				t.Errorf("expected username %q, got %q", tt.username, user.GetUsername())
+			}
+		})
+	}
+}
+
+func TestListUsers(t *testing.T) {
+	client := setupClient(t)
+	ctx := withKey(t.Context(), testApiKey)
+
+	stream, err := client.ListUsers(ctx, &userv1.ListUsersRequest{UsernamePrefix: "j"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var usernames []string
+	for {
+		user, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		usernames = append(usernames, user.GetUsername())
+	}
+	if got := strings.Join(usernames, ","); got != "jdoe,jsmith" {
+		t.Errorf("expected jdoe,jsmith, got %s", got)
+	}
+
+	// The timestamps are instants, whatever the zone of the caller.
+	for _, tt := range []struct {
+		req *userv1.ListUsersRequest
+		exp int
+	}{
+		{&userv1.ListUsersRequest{UpdatedAfter: timestamppb.New(time.Now().In(time.FixedZone("", -4*60*60)).Add(-time.Hour))}, 3},
+		{&userv1.ListUsersRequest{UpdatedBefore: timestamppb.New(time.Now().In(time.FixedZone("", 2*60*60)).Add(-time.Hour))}, 0},
+	} {
+		stream, err = client.ListUsers(ctx, tt.req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n := 0
+		for _, err = stream.Recv(); err == nil; _, err = stream.Recv() {
+			n++
+		}
+		if err != io.EOF || n != tt.exp {
+			t.Errorf("expected %d users, got %d %v", tt.exp, n, err)
+		}
+	}
+
+	stream, err = client.ListUsers(ctx, &userv1.ListUsersRequest{Sort: "password"})
+	if err == nil {
+		_, err = stream.Recv()
+	}
+	if got := status.Code(err); got != codes.InvalidArgument {
+		t.Errorf("expected InvalidArgument, got %v", got)
+	}
+}
+
+func TestCreateUser(t *testing.T) {
+	client := setupClient(t)
+	ctx := withKey(t.Context(), testApiKey)
+
+	user, err := client.CreateUser(ctx, &userv1.CreateUserRequest{Username: "bwhite", Email: "bwhite@example.com", FullName: "Bob White"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.GetUuid() == "" || user.GetFullName() != "Bob White" || user.GetCreatedAt() == nil {
+		t.Errorf("unexpected user %v", user)
+	}
+
+	_, err = client.CreateUser(ctx, &userv1.CreateUserRequest{Username: "jdoe", Email: "other@example.com"})
+	if got := status.Code(err); got != codes.AlreadyExists {
+		t.Errorf("expected AlreadyExists, got %v", got)
+	}
+
+	_, err = client.CreateUser(ctx, &userv1.CreateUserRequest{Username: "x", Email: "invalid"})
+	st := status.Convert(err)
+	if st.Code() != codes.InvalidArgument {
+		t.Fatalf("expected InvalidArgument, got %v", st.Code())
+	}
+
+	var fields []string
+	for _, detail := range st.Details() {
+		if br, ok := detail.(*errdetails.BadRequest); ok {
+			for _, v := range br.GetFieldViolations() {
+				fields = append(fields, v.GetField()+":"+v.GetReason())
+			}
+		}
+	}
+	if got := strings.Join(fields, ","); got != "username:too_short,email:invalid_format" {
+		t.Errorf("unexpected field violations %s", got)
+	}
+}
+
+func TestUpdateUser(t *testing.T) {
+	client := setupClient(t)
+	ctx := withKey(t.Context(), testApiKey)
+	uuid := "00000000-0000-4000-8000-000000000001"
+
+	user, err := client.UpdateUser(ctx, &userv1.UpdateUserRequest{Uuid: uuid, FullName: proto.String("John Doe"), IfMatch: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.GetFullName() != "John Doe" || user.GetUsername() != "jdoe" || user.GetVersion() != 2 {
+		t.Errorf("unexpected user %v", user)
+	}
+
+	_, err = client.UpdateUser(ctx, &userv1.UpdateUserRequest{Uuid: uuid, Email: proto.String("john@example.com"), IfMatch: 1})
+	if got := status.Code(err); got != codes.FailedPrecondition {
+		t.Errorf("expected FailedPrecondition, got %v", got)
+	}
+
+	_, err = client.UpdateUser(ctx, &userv1.UpdateUserRequest{Uuid: uuid, Email: proto.String("")})
+	if got := status.Code(err); got != codes.InvalidArgument {
+		t.Errorf("expected InvalidArgument, got %v", got)
+	}
+
+	_, err = client.UpdateUser(ctx, &userv1.UpdateUserRequest{Uuid: "00000000-0000-4000-8000-000000000009", FullName: proto.String("Nobody")})
+	if got := status.Code(err); got != codes.NotFound {
+		t.Errorf("expected NotFound, got %v", got)
+	}
+}
+
+func TestDeleteUser(t *testing.T) {
+	client := setupClient(t)
+	ctx := withKey(t.Context(), testApiKey)
+	uuid := "00000000-0000-4000-8000-000000000002"
+
+	_, err := client.DeleteUser(ctx, &userv1.DeleteUserRequest{Uuid: uuid, IfMatch: 5})
+	if got := status.Code(err); got != codes.FailedPrecondition {
+		t.Errorf("expected FailedPrecondition, got %v", got)
+	}
+
+	if _, err = client.DeleteUser(ctx, &userv1.DeleteUserRequest{Uuid: uuid}); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = client.GetUser(ctx, &userv1.GetUserRequest{Key: &userv1.GetUserRequest_Uuid{Uuid: uuid}})
+	if got := status.Code(err); got != codes.NotFound {
+		t.Errorf("expected NotFound, got %v", got)
+	}
+}
+
+func TestAuditMeta(t *testing.T) {
+	client, repo := setupServer(t)
+	ctx := metadata.AppendToOutgoingContext(withKey(t.Context(), testApiKey), RequestIDHeader, "req-1")
+
+	if _, err := client.CreateUser(ctx, &userv1.CreateUserRequest{Username: "bwhite", Email: "bwhite@example.com"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(repo.audit) != 1 {
+		t.Fatalf("expected 1 audit entry, got %d", len(repo.audit))
+	}
+	entry := repo.audit[0]
+	if entry.Action != model.AuditCreate || entry.Actor != audit.KeyActor("api-key", testApiKey) || entry.RequestID != "req-1" {
+		t.Errorf("unexpected entry %+v", entry)
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	client := setupClient(t)
+	req := &userv1.GetUserRequest{Key: &userv1.GetUserRequest_Username{Username: "jdoe"}}
+
+	var logs bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(logger.NewHandler(slog.NewJSONHandler(&logs, nil))))
+
+	var header metadata.MD
+	ctx := metadata.AppendToOutgoingContext(withKey(t.Context(), testApiKey), RequestIDHeader, "req-1")
+	if _, err := client.GetUser(ctx, req, grpc.Header(&header)); err != nil || first(header, RequestIDHeader) != "req-1" {
+		t.Errorf("expected the request id to be echoed, got %v %v", header, err)
+	}
+
+	// A request id is generated for the calls without one, even if refused.
+	header = nil
+	if _, err := client.GetUser(t.Context(), req, grpc.Header(&header)); status.Code(err) != codes.Unauthenticated || first(header, RequestIDHeader) == "" {
+		t.Errorf("expected a new request id, got %v %v", header, err)
+	}
+
+	// The calls are logged with the principal once authenticated, and the
+	// refused ones without.
+	var lines []map[string]any
+	for _, raw := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+		var line map[string]any
+		if err := json.Unmarshal([]byte(raw), &line); err != nil {
+			t.Fatalf("unexpected log line %q", raw)
+		}
+		lines = append(lines, line)
+	}
+	if len(lines) != 2 || lines[0]["msg"] != "Incoming call:" || lines[0]["request_id"] != "req-1" ||
+		lines[0]["principal"] != audit.KeyActor("api-key", testApiKey) || lines[0]["rpc.method"] != userv1.UserService_GetUser_FullMethodName {
+		t.Fatalf("unexpected log lines %v", lines)
+	}
+	if lines[1]["msg"] != "Incoming call:" || lines[1]["principal"] != nil || lines[1]["rpc.grpc.status_code"] != codes.Unauthenticated.String() {
+		t.Errorf("expected the refused call to be logged, got %v", lines[1])
+	}
+}
+
+func TestListDeletedUsers(t *testing.T) {
+	client := setupClient(t)
+
+	stream, err := client.ListUsers(withKey(t.Context(), testReadKey), &userv1.ListUsersRequest{IncludeDeleted: true})
+	if err == nil {
+		_, err = stream.Recv()
+	}
+	if st := status.Convert(err); st.Code() != codes.PermissionDenied || st.Message() != "missing scope admin" {
+		t.Errorf("expected the deleted users to be refused, got %v", err)
+	}
+
+	stream, err = client.ListUsers(withKey(t.Context(), testApiKey), &userv1.ListUsersRequest{IncludeDeleted: true})
+	if err == nil {
+		_, err = stream.Recv()
+	}
+	if err != nil {
+		t.Errorf("expected an admin to list the deleted users, got %v", err)
+	}
+}
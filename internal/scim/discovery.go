@@ -0,0 +1,101 @@
+package scim
+
+// The discovery resources of RFC 7643 sections 5 to 7. base is the URL of the
+// SCIM root, such as https://example.com/scim/v2.
+
+func ServiceProviderConfig(base string) map[string]any {
+	return map[string]any{
+		"schemas":          []string{ConfigSchema},
+		"documentationUri": "https://datatracker.ietf.org/doc/html/rfc7644",
+		"patch":            map[string]any{"supported": true},
+		"bulk":             map[string]any{"supported": false, "maxOperations": 0, "maxPayloadSize": 0},
+		"filter":           map[string]any{"supported": true, "maxResults": 1000},
+		"changePassword":   map[string]any{"supported": false},
+		"sort":             map[string]any{"supported": false},
+		"etag":             map[string]any{"supported": true},
+		"authenticationSchemes": []map[string]any{{
+			"type":        "oauthbearertoken",
+			"name":        "OAuth Bearer Token",
+			"description": "Authentication with the SCIM bearer token in the Authorization header",
+			"primary":     true,
+		}},
+		"meta": map[string]any{
+			"resourceType": "ServiceProviderConfig",
+			"location":     base + "/ServiceProviderConfig",
+		},
+	}
+}
+
+func attribute(name, typ string, required bool, mutability, uniqueness string) map[string]any {
+	return map[string]any{
+		"name":        name,
+		"type":        typ,
+		"multiValued": false,
+		"required":    required,
+		"caseExact":   false,
+		"mutability":  mutability,
+		"returned":    "default",
+		"uniqueness":  uniqueness,
+	}
+}
+
+func UserSchemaResource(base string) map[string]any {
+	name := attribute("name", "complex", false, "readWrite", "none")
+	name["subAttributes"] = []map[string]any{
+		attribute("formatted", "string", false, "readWrite", "none"),
+		attribute("givenName", "string", false, "writeOnly", "none"),
+		attribute("familyName", "string", false, "writeOnly", "none"),
+	}
+
+	emails := attribute("emails", "complex", true, "readWrite", "server")
+	emails["multiValued"] = true
+	emails["subAttributes"] = []map[string]any{
+		attribute("value", "string", true, "readWrite", "server"),
+		attribute("type", "string", false, "readWrite", "none"),
+		attribute("primary", "boolean", false, "readWrite", "none"),
+	}
+
+	return map[string]any{
+		"schemas":     []string{SchemaSchema},
+		"id":          UserSchema,
+		"name":        "User",
+		"description": "User Account",
+		"attributes": []map[string]any{
+			attribute("userName", "string", true, "readWrite", "server"),
+			name,
+			attribute("displayName", "string", false, "readWrite", "none"),
+			emails,
+			attribute("active", "boolean", false, "readWrite", "none"),
+		},
+		"meta": map[string]any{
+			"resourceType": "Schema",
+			"location":     base + "/Schemas/" + UserSchema,
+		},
+	}
+}
+
+func UserResourceType(base string) map[string]any {
+	return map[string]any{
+		"schemas":     []string{ResourceSchema},
+		"id":          "User",
+		"name":        "User",
+		"endpoint":    "/Users",
+		"description": "User Account",
+		"schema":      UserSchema,
+		"meta": map[string]any{
+			"resourceType": "ResourceType",
+			"location":     base + "/ResourceTypes/User",
+		},
+	}
+}
+
+// List wraps the resources in a list response.
+func List(resources ...map[string]any) *ListResponse {
+	return &ListResponse{
+		Schemas:      []string{ListSchema},
+		TotalResults: int64(len(resources)),
+		StartIndex:   1,
+		ItemsPerPage: len(resources),
+		Resources:    resources,
+	}
+}
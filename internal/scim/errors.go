@@ -0,0 +1,85 @@
+package scim
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"cruder/internal/problem"
+	"cruder/pkg/logger"
+	"cruder/pkg/validation"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The scimType of the errors, RFC 7644 section 3.12.
+const (
+	TypeInvalidFilter = "invalidFilter"
+	TypeInvalidSyntax = "invalidSyntax"
+	TypeInvalidPath   = "invalidPath"
+	TypeInvalidValue  = "invalidValue"
+	TypeUniqueness    = "uniqueness"
+	TypeMutability    = "mutability"
+	TypeNoTarget      = "noTarget"
+)
+
+// Error is a SCIM error response. It is also returned by the parsers of the
+// package for requests that are invalid in SCIM terms.
+type Error struct {
+	Schemas  []string `json:"schemas"`
+	Status   string   `json:"status"`
+	ScimType string   `json:"scimType,omitempty"`
+	Detail   string   `json:"detail,omitempty"`
+	// RequestID is not part of SCIM, which clients ignore.
+	RequestID string `json:"request_id,omitempty"`
+}
+
+func (e *Error) Error() string {
+	return e.Detail
+}
+
+func NewError(status int, scimType, detail string) *Error {
+	return &Error{Schemas: []string{ErrorSchema}, Status: strconv.Itoa(status), ScimType: scimType, Detail: detail}
+}
+
+// Write renders err as a SCIM error. Errors of the service are mapped as by
+// problem.From.
+func Write(ctx *gin.Context, err error) {
+	var e *Error
+	if !errors.As(err, &e) {
+		p := problem.From(ctx, err)
+		e = NewError(p.Status, scimType(err), p.Detail)
+	}
+
+	e.RequestID = logger.RequestID(ctx)
+	status, _ := strconv.Atoi(e.Status)
+	if status == http.StatusUnauthorized {
+		ctx.Header("WWW-Authenticate", `Bearer realm="scim"`)
+	}
+	Render(ctx, status, e)
+}
+
+func scimType(err error) string {
+	var (
+		invalid  validation.InvalidRequest
+		errs     validation.ValidationErrors
+		conflict validation.ErrConflict
+	)
+	switch {
+	case errors.As(err, &conflict):
+		return TypeUniqueness
+	case errors.As(err, &invalid):
+		if invalid.Code == validation.CodeReadOnly {
+			return TypeMutability
+		}
+		return TypeInvalidValue
+	case errors.As(err, &errs):
+		return TypeInvalidValue
+	}
+	return ""
+}
+
+func Render(ctx *gin.Context, status int, v any) {
+	ctx.Header("Content-Type", ContentType)
+	ctx.JSON(status, v)
+}
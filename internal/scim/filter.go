@@ -0,0 +1,46 @@
+package scim
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"cruder/internal/model"
+)
+
+const maxFilterValue = 100
+
+// ApplyFilter narrows the query by a filter of the form `attribute op "value"`.
+// Only the filters identity providers use to look up a user are supported:
+// userName eq and sw, emails.value eq and co.
+func ApplyFilter(query *model.UserQuery, filter string) error {
+	filter = strings.TrimSpace(filter)
+	if filter == "" {
+		return nil
+	}
+
+	attr, rest, _ := strings.Cut(filter, " ")
+	op, value, _ := strings.Cut(strings.TrimSpace(rest), " ")
+
+	var v string
+	if err := json.Unmarshal([]byte(strings.TrimSpace(value)), &v); err != nil {
+		return NewError(http.StatusBadRequest, TypeInvalidFilter, "filter value must be a quoted string")
+	}
+	if v == "" || len(v) > maxFilterValue {
+		return NewError(http.StatusBadRequest, TypeInvalidFilter, "filter value must contain between 1 and 100 characters")
+	}
+
+	switch strings.ToLower(attr) + " " + strings.ToLower(op) {
+	case "username eq":
+		query.Username = v
+	case "username sw":
+		query.UsernamePrefix = v
+	case "emails.value eq", "emails eq":
+		query.Email = v
+	case "emails.value co", "emails co":
+		query.EmailContains = v
+	default:
+		return NewError(http.StatusBadRequest, TypeInvalidFilter, "filter must be one of userName eq, userName sw, emails.value eq, emails.value co")
+	}
+	return nil
+}
@@ -0,0 +1,178 @@
+package scim
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+type PatchOp struct {
+	Schemas    []string    `json:"schemas"`
+	Operations []Operation `json:"Operations"`
+}
+
+type Operation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path,omitempty"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// Apply applies the operations to the resource in order. Operation names and
+// attribute paths are case-insensitive, as sent by some identity providers.
+func (p *PatchOp) Apply(u *User) error {
+	if !slices.Contains(p.Schemas, PatchOpSchema) {
+		return NewError(http.StatusBadRequest, TypeInvalidSyntax, "schemas must contain "+PatchOpSchema)
+	}
+	if len(p.Operations) == 0 {
+		return NewError(http.StatusBadRequest, TypeInvalidSyntax, "Operations must not be empty")
+	}
+
+	for _, op := range p.Operations {
+		var err error
+		switch strings.ToLower(op.Op) {
+		case "add", "replace":
+			err = u.set(op.Path, op.Value)
+		case "remove":
+			err = u.remove(op.Path)
+		default:
+			err = NewError(http.StatusBadRequest, TypeInvalidSyntax, "op must be one of add, replace, remove")
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// set replaces the attribute at path. Without a path the value is an object
+// of attributes.
+func (u *User) set(path string, value json.RawMessage) error {
+	if path == "" {
+		var attrs map[string]json.RawMessage
+		if err := json.Unmarshal(value, &attrs); err != nil {
+			return invalidValue("value must be an object of attributes")
+		}
+		for attr, v := range attrs {
+			if err := u.set(attr, v); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	path = strings.ToLower(path)
+	switch {
+	case path == "username":
+		return decodeString(value, &u.UserName)
+	case path == "externalid":
+		return decodeString(value, &u.ExternalID)
+	case path == "displayname", path == "name.formatted":
+		var v string
+		if err := decodeString(value, &v); err != nil {
+			return err
+		}
+		u.DisplayName = v
+		u.name().Formatted = v
+	case path == "name":
+		var n Name
+		if err := json.Unmarshal(value, &n); err != nil {
+			return invalidValue("name must be an object")
+		}
+		u.Name, u.DisplayName = &n, ""
+	case path == "name.givenname":
+		u.DisplayName, u.name().Formatted = "", ""
+		return decodeString(value, &u.name().GivenName)
+	case path == "name.familyname":
+		u.DisplayName, u.name().Formatted = "", ""
+		return decodeString(value, &u.name().FamilyName)
+	case path == "emails":
+		var emails []Email
+		if err := json.Unmarshal(value, &emails); err != nil {
+			return invalidValue("emails must be an array of objects")
+		}
+		u.Emails = emails
+	case path == "emails.value", strings.HasPrefix(path, "emails[") && strings.HasSuffix(path, "].value"):
+		// Every filter addresses the single email of the user.
+		var v string
+		if err := decodeString(value, &v); err != nil {
+			return err
+		}
+		u.setEmail(v)
+	case path == "active":
+		return decodeBool(value, &u.Active)
+	default:
+		return NewError(http.StatusBadRequest, TypeInvalidPath, "path "+path+" is not supported")
+	}
+	return nil
+}
+
+func (u *User) remove(path string) error {
+	switch strings.ToLower(path) {
+	case "":
+		return NewError(http.StatusBadRequest, TypeNoTarget, "remove requires a path")
+	case "username":
+		u.UserName = ""
+	case "externalid":
+		u.ExternalID = ""
+	case "displayname", "name", "name.formatted":
+		u.DisplayName, u.Name = "", nil
+	case "emails", "emails.value":
+		u.Emails = nil
+	case "active":
+		u.Active = nil
+	default:
+		return NewError(http.StatusBadRequest, TypeInvalidPath, "path "+path+" is not supported")
+	}
+	return nil
+}
+
+func (u *User) name() *Name {
+	if u.Name == nil {
+		u.Name = new(Name)
+	}
+	return u.Name
+}
+
+// setEmail replaces the primary email, or else the first one.
+func (u *User) setEmail(value string) {
+	for i := range u.Emails {
+		if u.Emails[i].Primary {
+			u.Emails[i].Value = value
+			return
+		}
+	}
+	if len(u.Emails) > 0 {
+		u.Emails[0].Value = value
+		return
+	}
+	u.Emails = []Email{{Value: value, Type: emailType, Primary: true}}
+}
+
+func decodeString(value json.RawMessage, v *string) error {
+	if err := json.Unmarshal(value, v); err != nil {
+		return invalidValue("value must be a string")
+	}
+	return nil
+}
+
+// decodeBool accepts "True" and "False" strings too, as sent by Azure AD.
+func decodeBool(value json.RawMessage, v **bool) error {
+	var b bool
+	if err := json.Unmarshal(value, &b); err != nil {
+		var s string
+		if json.Unmarshal(value, &s) != nil {
+			return invalidValue("value must be a boolean")
+		}
+		if b, err = strconv.ParseBool(s); err != nil {
+			return invalidValue("value must be a boolean")
+		}
+	}
+	*v = &b
+	return nil
+}
+
+func invalidValue(detail string) error {
+	return NewError(http.StatusBadRequest, TypeInvalidValue, detail)
+}
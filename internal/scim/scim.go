@@ -0,0 +1,125 @@
+package scim
+
+import (
+	"strings"
+	"time"
+
+	"cruder/internal/model"
+)
+
+const ContentType = "application/scim+json"
+
+const (
+	UserSchema     = "urn:ietf:params:scim:schemas:core:2.0:User"
+	ListSchema     = "urn:ietf:params:scim:api:messages:2.0:ListResponse"
+	PatchOpSchema  = "urn:ietf:params:scim:api:messages:2.0:PatchOp"
+	ErrorSchema    = "urn:ietf:params:scim:api:messages:2.0:Error"
+	ConfigSchema   = "urn:ietf:params:scim:schemas:core:2.0:ServiceProviderConfig"
+	SchemaSchema   = "urn:ietf:params:scim:schemas:core:2.0:Schema"
+	ResourceSchema = "urn:ietf:params:scim:schemas:core:2.0:ResourceType"
+)
+
+// DefaultCount is the page size if the client does not ask for one.
+const DefaultCount = 100
+
+const emailType = "work"
+
+type Name struct {
+	Formatted  string `json:"formatted,omitempty"`
+	GivenName  string `json:"givenName,omitempty"`
+	FamilyName string `json:"familyName,omitempty"`
+}
+
+type Email struct {
+	Value   string `json:"value"`
+	Type    string `json:"type,omitempty"`
+	Primary bool   `json:"primary,omitempty"`
+}
+
+type Meta struct {
+	ResourceType string    `json:"resourceType"`
+	Created      time.Time `json:"created"`
+	LastModified time.Time `json:"lastModified"`
+	Location     string    `json:"location"`
+	Version      string    `json:"version"`
+}
+
+// User is the SCIM core User resource. Only the attributes backed by
+// model.User are kept, the others are accepted and ignored.
+type User struct {
+	Schemas     []string `json:"schemas"`
+	ID          string   `json:"id,omitempty"`
+	ExternalID  string   `json:"externalId,omitempty"`
+	UserName    string   `json:"userName"`
+	Name        *Name    `json:"name,omitempty"`
+	DisplayName string   `json:"displayName,omitempty"`
+	Emails      []Email  `json:"emails,omitempty"`
+	Active      *bool    `json:"active,omitempty"`
+	Meta        *Meta    `json:"meta,omitempty"`
+}
+
+type ListResponse struct {
+	Schemas      []string `json:"schemas"`
+	TotalResults int64    `json:"totalResults"`
+	StartIndex   int      `json:"startIndex"`
+	ItemsPerPage int      `json:"itemsPerPage"`
+	Resources    any      `json:"Resources"`
+}
+
+// FromUser maps the user to a resource served at location. A soft-deleted
+// user is inactive.
+func FromUser(user *model.User, location, version string) *User {
+	active := user.DeletedAt == nil
+	u := &User{
+		Schemas:  []string{UserSchema},
+		ID:       user.UUID,
+		UserName: user.Username,
+		Emails:   []Email{{Value: user.Email, Type: emailType, Primary: true}},
+		Active:   &active,
+		Meta: &Meta{
+			ResourceType: "User",
+			Created:      user.CreatedAt,
+			LastModified: user.UpdatedAt,
+			Location:     location,
+			Version:      version,
+		},
+	}
+	if user.FullName != "" {
+		u.Name = &Name{Formatted: user.FullName}
+		u.DisplayName = user.FullName
+	}
+	return u
+}
+
+// ToUser maps the resource to the fields of a user. The email is the primary
+// one, or else the first. The full name is the formatted name, or else the
+// display name, or else made of the given and family names.
+func (u *User) ToUser() model.User {
+	user := model.User{Username: u.UserName, FullName: u.DisplayName}
+
+	for i, e := range u.Emails {
+		if i == 0 || e.Primary {
+			user.Email = e.Value
+		}
+		if e.Primary {
+			break
+		}
+	}
+
+	if u.Name != nil {
+		switch {
+		case u.Name.Formatted != "":
+			user.FullName = u.Name.Formatted
+		case user.FullName == "":
+			user.FullName = strings.TrimSpace(u.Name.GivenName + " " + u.Name.FamilyName)
+		}
+	}
+
+	return user
+}
+
+// IsActive reports whether the resource is active, which it is unless set
+// otherwise.
+func (u *User) IsActive() bool {
+	return u.Active == nil || *u.Active
+}
@@ -0,0 +1,158 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"strings"
+	"time"
+
+	"cruder/internal/model"
+	"cruder/internal/repository"
+	"cruder/pkg/validation"
+)
+
+type APIKeyService interface {
+	GetAll(ctx context.Context) ([]model.APIKey, error)
+	Get(ctx context.Context, uuid string) (*model.APIKey, error)
+	Post(ctx context.Context, key *model.APIKey) error
+	Rotate(ctx context.Context, uuid string, grace time.Duration) (*model.APIKey, error)
+	Revoke(ctx context.Context, uuid string) error
+	Authenticate(ctx context.Context, key string) (*model.Principal, error)
+}
+
+type apiKeyService struct {
+	repo repository.APIKeyRepository
+}
+
+// NewAPIKeyService returns the service managing the API keys, which also
+// authenticates them.
+func NewAPIKeyService(repo repository.APIKeyRepository) APIKeyService {
+	return &apiKeyService{repo: repo}
+}
+
+const (
+	// A key reads ck_<prefix>_<secret>. The prefix is hex, so the first
+	// underscore after it ends it.
+	keyScheme = "ck_"
+	// touchInterval is how stale last_used_at may get.
+	touchInterval = time.Minute
+)
+
+func (s *apiKeyService) GetAll(ctx context.Context) ([]model.APIKey, error) {
+	keys, err := s.repo.GetAll(ctx)
+	if keys == nil {
+		keys = []model.APIKey{}
+	}
+	return keys, err
+}
+
+func (s *apiKeyService) Get(ctx context.Context, uuid string) (*model.APIKey, error) {
+	if err := validation.ValidateUUID(uuid); err != nil {
+		return nil, err
+	}
+	return s.repo.GetByUUID(ctx, uuid)
+}
+
+// Post creates the key. Its plaintext is set in key.Key and returned only
+// here.
+func (s *apiKeyService) Post(ctx context.Context, key *model.APIKey) error {
+	if err := validation.ValidateAPIKey(key, time.Now()); err != nil {
+		return err
+	}
+	if err := generateKey(key); err != nil {
+		return err
+	}
+	return s.repo.Post(ctx, key)
+}
+
+// Rotate creates a key with the name, owner, scopes and expiry of the key,
+// which remains valid for the grace period so that the clients can switch
+// over.
+func (s *apiKeyService) Rotate(ctx context.Context, uuid string, grace time.Duration) (*model.APIKey, error) {
+	if err := validation.ValidateGrace(grace); err != nil {
+		return nil, err
+	}
+
+	key, err := s.Get(ctx, uuid)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	if !key.Active(now) {
+		return nil, validation.ErrInactiveAPIKey
+	}
+
+	replacement := &model.APIKey{Name: key.Name, Owner: key.Owner, Scopes: key.Scopes, ExpiresAt: key.ExpiresAt}
+	if err = generateKey(replacement); err != nil {
+		return nil, err
+	}
+	if err = s.repo.Rotate(ctx, key.ID, now.Add(grace), replacement); err != nil {
+		return nil, err
+	}
+	return replacement, nil
+}
+
+func (s *apiKeyService) Revoke(ctx context.Context, uuid string) error {
+	if err := validation.ValidateUUID(uuid); err != nil {
+		return err
+	}
+	return s.repo.Revoke(ctx, uuid)
+}
+
+// Authenticate looks the key up by its prefix and compares the hash of its
+// secret in constant time.
+func (s *apiKeyService) Authenticate(ctx context.Context, key string) (*model.Principal, error) {
+	prefix, secret, ok := strings.Cut(strings.TrimPrefix(key, keyScheme), "_")
+	if !ok || !strings.HasPrefix(key, keyScheme) {
+		return nil, validation.ErrInvalidAPIKey
+	}
+
+	stored, err := s.repo.GetByPrefix(ctx, prefix)
+	if errors.Is(err, validation.ErrAPIKeyNotFound) {
+		return nil, validation.ErrInvalidAPIKey
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if subtle.ConstantTimeCompare(hashSecret(stored.Salt, secret), stored.Hash) != 1 || !stored.Active(time.Now()) {
+		return nil, validation.ErrInvalidAPIKey
+	}
+
+	// A failure to record the use must not fail the request.
+	if err = s.repo.Touch(ctx, stored.ID, touchInterval); err != nil {
+		slog.ErrorContext(ctx, "Failed to record the use of an api key:", "error", err.Error())
+	}
+
+	return &model.Principal{ID: "api-key:" + stored.UUID, Name: stored.Name, Scopes: stored.Scopes}, nil
+}
+
+// generateKey sets a random prefix, salt and secret of the key.
+func generateKey(key *model.APIKey) error {
+	prefix, salt, secret := make([]byte, 6), make([]byte, 16), make([]byte, 32)
+	for _, b := range [][]byte{prefix, salt, secret} {
+		if _, err := rand.Read(b); err != nil {
+			return err
+		}
+	}
+
+	key.Prefix = hex.EncodeToString(prefix)
+	key.Salt = salt
+	plain := base64.RawURLEncoding.EncodeToString(secret)
+	key.Hash = hashSecret(salt, plain)
+	key.Key = keyScheme + key.Prefix + "_" + plain
+	return nil
+}
+
+func hashSecret(salt []byte, secret string) []byte {
+	h := sha256.New()
+	h.Write(salt)
+	h.Write([]byte(secret))
+	return h.Sum(nil)
+}
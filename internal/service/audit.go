@@ -0,0 +1,101 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"strconv"
+
+	"cruder/internal/audit"
+	"cruder/internal/model"
+	"cruder/internal/repository"
+	"cruder/pkg/validation"
+)
+
+// errBrokenChain stops the walk of the audit log at the first broken link.
+var errBrokenChain = errors.New("broken audit chain")
+
+type AuditService interface {
+	GetAll(ctx context.Context, query *model.AuditQuery) ([]model.AuditEntry, error)
+	Verify(ctx context.Context) (*model.AuditVerification, error)
+}
+
+type auditService struct {
+	repo repository.UserRepository
+}
+
+// NewAuditService returns the reader of the audit log, which is written by
+// the user service in the transaction of every change.
+func NewAuditService(repo repository.UserRepository) AuditService {
+	return &auditService{repo: repo}
+}
+
+// appendAudit records the change of the user with the metadata of the
+// request in ctx. before is nil for a creation or restoration, and after for
+// a deletion.
+func appendAudit(ctx context.Context, repo repository.UserRepository, action string, before, after *model.User) error {
+	meta := audit.FromContext(ctx)
+	entry := &model.AuditEntry{Action: action, Actor: meta.Actor, RequestID: meta.RequestID, ClientIP: meta.ClientIP}
+
+	switch {
+	case before == nil:
+		entry.UserID, entry.UserUUID, entry.After = after.ID, after.UUID, fields(after)
+	case after == nil:
+		entry.UserID, entry.UserUUID, entry.Before = before.ID, before.UUID, fields(before)
+	default:
+		entry.UserID, entry.UserUUID = after.ID, after.UUID
+		entry.After = diff(before, after)
+		entry.Before = make(map[string]any, len(entry.After))
+		previous := fields(before)
+		for field := range entry.After {
+			entry.Before[field] = previous[field]
+		}
+	}
+
+	return repo.AppendAudit(ctx, entry)
+}
+
+func (s *auditService) GetAll(ctx context.Context, query *model.AuditQuery) ([]model.AuditEntry, error) {
+	if query.Limit == 0 {
+		query.Limit = defaultLimit
+	}
+	if query.UserID != "" {
+		if id, err := strconv.ParseInt(query.UserID, 10, 64); err == nil {
+			query.ID = id
+		} else {
+			query.UUID = query.UserID
+		}
+	}
+	if err := validation.ValidateAuditQuery(query); err != nil {
+		return nil, err
+	}
+
+	entries, err := s.repo.GetAudit(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	if entries == nil {
+		entries = []model.AuditEntry{}
+	}
+	return entries, nil
+}
+
+// Verify checks the hash chain from the first entry and stops at the first
+// broken link.
+func (s *auditService) Verify(ctx context.Context) (*model.AuditVerification, error) {
+	res := &model.AuditVerification{Valid: true}
+	prev := model.AuditGenesis
+
+	err := s.repo.WalkAudit(ctx, func(entry *model.AuditEntry) error {
+		res.Entries++
+		if entry.PrevHash != prev || entry.ComputeHash() != entry.Hash {
+			res.Valid, res.BrokenAt = false, entry.ID
+			return errBrokenChain
+		}
+		prev = entry.Hash
+		return nil
+	})
+	if err != nil && !errors.Is(err, errBrokenChain) {
+		return nil, err
+	}
+	return res, nil
+}
@@ -0,0 +1,69 @@
+package service
+
+import (
+	"context"
+	"time"
+
+	"cruder/internal/model"
+)
+
+// eventBatch is the number of events read from the log at once.
+const eventBatch = 100
+
+func newEvent(typ string, user *model.User, changes map[string]any) *model.UserEvent {
+	return &model.UserEvent{Type: typ, UUID: user.UUID, Version: user.Version, Changes: changes}
+}
+
+// fields returns every field of the user that can be changed.
+func fields(user *model.User) map[string]any {
+	return map[string]any{
+		"username":  user.Username,
+		"email":     user.Email,
+		"full_name": user.FullName,
+	}
+}
+
+// Watch calls fn for every event after the given id, and then for every new
+// event until ctx is done or fn fails. A negative id starts with the next new
+// event.
+func (s *userService) Watch(ctx context.Context, after int64, fn func(event *model.UserEvent) error) error {
+	// Subscribing first makes sure no event appended meanwhile is missed.
+	wake, cancel := s.events.Subscribe()
+	defer cancel()
+
+	if after < 0 {
+		var err error
+		if after, err = s.repo.LastEventID(ctx); err != nil {
+			return err
+		}
+	}
+
+	for {
+		for {
+			events, err := s.repo.GetEvents(ctx, after, eventBatch)
+			if err != nil {
+				return err
+			}
+			for i := range events {
+				if err = fn(&events[i]); err != nil {
+					return err
+				}
+				after = events[i].ID
+			}
+			if len(events) < eventBatch {
+				break
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-wake:
+		}
+	}
+}
+
+// PurgeEvents deletes the events older than retention from the log.
+func (s *userService) PurgeEvents(ctx context.Context, retention time.Duration) (int64, error) {
+	return s.repo.PurgeEvents(ctx, retention)
+}
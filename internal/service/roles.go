@@ -0,0 +1,72 @@
+package service
+
+import (
+	"context"
+	"sort"
+
+	"cruder/internal/model"
+	"cruder/internal/repository"
+	"cruder/pkg/validation"
+)
+
+type RoleService interface {
+	Roles() []model.Role
+	GetAssignments(ctx context.Context, principal string) ([]model.RoleAssignment, error)
+	Assign(ctx context.Context, assignment *model.RoleAssignment) error
+	Unassign(ctx context.Context, principal, role string) error
+	// RolesOf returns the roles assigned to the principal.
+	RolesOf(ctx context.Context, principal string) ([]string, error)
+}
+
+type roleService struct {
+	repo repository.RoleRepository
+}
+
+// NewRoleService returns the service managing the role assignments. The
+// roles themselves and their permissions are fixed.
+func NewRoleService(repo repository.RoleRepository) RoleService {
+	return &roleService{repo: repo}
+}
+
+func (s *roleService) Roles() []model.Role {
+	roles := make([]model.Role, 0, len(model.RolePermissions))
+	for name, permissions := range model.RolePermissions {
+		roles = append(roles, model.Role{Name: name, Permissions: permissions})
+	}
+	sort.Slice(roles, func(i, j int) bool { return roles[i].Name < roles[j].Name })
+	return roles
+}
+
+func (s *roleService) GetAssignments(ctx context.Context, principal string) ([]model.RoleAssignment, error) {
+	assignments, err := s.repo.GetAssignments(ctx, principal)
+	if assignments == nil {
+		assignments = []model.RoleAssignment{}
+	}
+	return assignments, err
+}
+
+func (s *roleService) Assign(ctx context.Context, assignment *model.RoleAssignment) error {
+	if err := validation.ValidateRoleAssignment(assignment); err != nil {
+		return err
+	}
+	return s.repo.Assign(ctx, assignment)
+}
+
+func (s *roleService) Unassign(ctx context.Context, principal, role string) error {
+	if err := validation.ValidateRoleAssignment(&model.RoleAssignment{Principal: principal, Role: role}); err != nil {
+		return err
+	}
+	return s.repo.Unassign(ctx, principal, role)
+}
+
+func (s *roleService) RolesOf(ctx context.Context, principal string) ([]string, error) {
+	assignments, err := s.repo.GetAssignments(ctx, principal)
+	if err != nil {
+		return nil, err
+	}
+	roles := make([]string, len(assignments))
+	for i, a := range assignments {
+		roles[i] = a.Role
+	}
+	return roles, nil
+}
@@ -1,13 +1,28 @@
 package service
 
-import "cruder/internal/repository"
+import (
+	"cruder/internal/events"
+	"cruder/internal/repository"
+)
 
 type Service struct {
-	Users UserService
+	Users    UserService
+	Webhooks WebhookService
+	Audit    AuditService
+	APIKeys  APIKeyService
+	Roles    RoleService
+	// Events wakes up the watchers of the user event log.
+	Events *events.Broker
 }
 
 func NewService(repos *repository.Repository) *Service {
+	broker := events.NewBroker()
 	return &Service{
-		Users: NewUserService(repos.Users),
+		Users:    NewUserService(repos.Users, broker),
+		Webhooks: NewWebhookService(repos.Webhooks),
+		Audit:    NewAuditService(repos.Users),
+		APIKeys:  NewAPIKeyService(repos.APIKeys),
+		Roles:    NewRoleService(repos.Roles),
+		Events:   broker,
 	}
 }
@@ -1,32 +1,181 @@
 package service
 
 import (
+	"bytes"
 	"context"
+	"errors"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
 
+	"cruder/internal/auth"
+	"cruder/internal/events"
 	"cruder/internal/model"
 	"cruder/internal/repository"
+	"cruder/pkg/patch"
 	"cruder/pkg/validation"
 )
 
 type UserService interface {
-	GetAll(ctx context.Context) ([]model.User, error)
+	GetAll(ctx context.Context, query *model.UserQuery) (*model.UserPage, error)
+	GetRange(ctx context.Context, query *model.UserQuery) ([]model.User, int64, error)
 	GetByUsername(ctx context.Context, username string) (*model.User, error)
 	GetByID(ctx context.Context, id int64) (*model.User, error)
+	GetByUUID(ctx context.Context, uuid string) (*model.User, error)
 	Post(ctx context.Context, user *model.User) (int64, error)
-	Patch(ctx context.Context, user *model.User) error
-	Delete(ctx context.Context, id int64) error
+	Patch(ctx context.Context, user *model.User, patch *model.UserPatch) error
+	Delete(ctx context.Context, id, ifMatch int64) error
+	DeleteByUUID(ctx context.Context, uuid string, ifMatch int64) error
+	Restore(ctx context.Context, id int64) (*model.User, error)
+	RestoreByUUID(ctx context.Context, uuid string) (*model.User, error)
+	Purge(ctx context.Context, retention time.Duration) (int64, error)
+	Batch(ctx context.Context, ops []model.BatchOperation, atomic bool) ([]model.BatchResult, error)
+	Import(ctx context.Context, rows []model.ImportRow, dryRun bool) (*model.ImportReport, error)
+	Export(ctx context.Context, query *model.UserQuery, fn func(user *model.User) error) error
+	Search(ctx context.Context, search *model.UserSearch) ([]model.UserMatch, error)
+	Watch(ctx context.Context, after int64, fn func(event *model.UserEvent) error) error
+	PurgeEvents(ctx context.Context, retention time.Duration) (int64, error)
 }
 
 type userService struct {
-	repo repository.UserRepository
+	repo   repository.UserRepository
+	events *events.Broker
 }
 
-func NewUserService(repo repository.UserRepository) UserService {
-	return &userService{repo: repo}
+// NewUserService returns the user service. Every change of a user is
+// appended to the event log in the transaction of the change, and the
+// watchers are woken up through the broker after the commit. The changes
+// require the permission of the principal of the context, whatever the
+// transport.
+func NewUserService(repo repository.UserRepository, broker *events.Broker) UserService {
+	return &userService{repo: repo, events: broker}
 }
 
-func (s *userService) GetAll(ctx context.Context) ([]model.User, error) {
-	return s.repo.GetAll(ctx)
+const defaultLimit = 50
+
+func (s *userService) GetAll(ctx context.Context, query *model.UserQuery) (*model.UserPage, error) {
+	if err := authorizeDeleted(ctx, query); err != nil {
+		return nil, err
+	}
+	if query.Limit == 0 {
+		query.Limit = defaultLimit
+	}
+	if query.Sort == "" {
+		query.Sort = "id"
+	}
+	if query.Order == "" {
+		query.Order = "asc"
+	}
+	if err := validation.ValidateUserQuery(query); err != nil {
+		return nil, err
+	}
+
+	if query.Cursor != "" {
+		after, err := model.DecodeCursor(query.Cursor)
+		if err != nil {
+			return nil, validation.ErrInvalidCursor
+		}
+		if err = validation.ValidateCursor(query, after); err != nil {
+			return nil, err
+		}
+		query.After = after
+	}
+
+	// One extra row tells whether there is a next page.
+	users, err := s.repo.GetAll(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	page := &model.UserPage{Users: users}
+	if len(users) > query.Limit {
+		page.Users = users[:query.Limit]
+		page.HasMore = true
+		page.NextCursor = model.NewCursor(query.Sort, query.Order, &page.Users[query.Limit-1]).Encode()
+	}
+	if page.Users == nil {
+		page.Users = []model.User{}
+	}
+
+	return page, nil
+}
+
+// GetRange returns the users at the offset of the query rather than after a
+// cursor, along with the number of all the matching users.
+func (s *userService) GetRange(ctx context.Context, query *model.UserQuery) ([]model.User, int64, error) {
+	query.Cursor = ""
+	if query.Limit == 0 {
+		query.Limit = defaultLimit
+	}
+	if query.Sort == "" {
+		query.Sort = "id"
+	}
+	if query.Order == "" {
+		query.Order = "asc"
+	}
+	if err := validation.ValidateUserQuery(query); err != nil {
+		return nil, 0, err
+	}
+
+	total, err := s.repo.Count(ctx, query)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	users, err := s.repo.GetAll(ctx, query)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(users) > query.Limit {
+		users = users[:query.Limit]
+	}
+	if users == nil {
+		users = []model.User{}
+	}
+
+	return users, total, nil
+}
+
+// Export calls fn for every user matching the filters of the query. The
+// pagination parameters do not apply.
+func (s *userService) Export(ctx context.Context, query *model.UserQuery, fn func(user *model.User) error) error {
+	if err := authorizeDeleted(ctx, query); err != nil {
+		return err
+	}
+	query.Limit, query.Cursor = defaultLimit, ""
+	if query.Sort == "" {
+		query.Sort = "id"
+	}
+	if query.Order == "" {
+		query.Order = "asc"
+	}
+	if err := validation.ValidateUserQuery(query); err != nil {
+		return err
+	}
+	return s.repo.Export(ctx, query, fn)
+}
+
+const defaultSearchLimit = 20
+
+// Search returns the users best matching the query, ranked by relevance.
+func (s *userService) Search(ctx context.Context, search *model.UserSearch) ([]model.UserMatch, error) {
+	search.Q = strings.TrimSpace(search.Q)
+	if search.Limit == 0 {
+		search.Limit = defaultSearchLimit
+	}
+	if err := validation.ValidateUserSearch(search); err != nil {
+		return nil, err
+	}
+
+	matches, err := s.repo.Search(ctx, search)
+	if err != nil {
+		return nil, err
+	}
+	if matches == nil {
+		matches = []model.UserMatch{}
+	}
+	return matches, nil
 }
 
 func (s *userService) GetByUsername(ctx context.Context, username string) (*model.User, error) {
@@ -43,26 +192,485 @@ func (s *userService) GetByID(ctx context.Context, id int64) (*model.User, error
 	return s.repo.GetByID(ctx, id)
 }
 
+func (s *userService) GetByUUID(ctx context.Context, uuid string) (*model.User, error) {
+	if err := validation.ValidateUUID(uuid); err != nil {
+		return nil, err
+	}
+	return s.repo.GetByUUID(ctx, uuid)
+}
+
 func (s *userService) Post(ctx context.Context, user *model.User) (int64, error) {
+	if err := authorize(ctx, model.PermUsersCreate); err != nil {
+		return 0, err
+	}
 	if err := validation.ValidateUser(user); err != nil {
 		return 0, err
 	}
-	return s.repo.Post(ctx, user)
+
+	err := s.repo.WithTx(ctx, func(repo repository.UserRepository) error {
+		if _, err := repo.Post(ctx, user); err != nil {
+			return err
+		}
+		if err := repo.AppendEvent(ctx, newEvent(model.UserCreated, user, fields(user))); err != nil {
+			return err
+		}
+		return appendAudit(ctx, repo, model.AuditCreate, nil, user)
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	s.events.Publish()
+	return user.ID, nil
 }
 
-func (s *userService) Patch(ctx context.Context, user *model.User) error {
+// Patch applies the patch to the current state of the user and stores the
+// changed fields only.
+func (s *userService) Patch(ctx context.Context, user *model.User, p *model.UserPatch) error {
+	if err := authorize(ctx, model.PermUsersUpdate); err != nil {
+		return err
+	}
 	if err := validation.ValidateID(user.ID); err != nil {
 		return err
 	}
-	if err := validation.ValidateUser(user); err != nil {
+
+	if p.IfMatch != 0 && p.IfMatch != user.Version {
+		return validation.ErrPreconditionFailed
+	}
+
+	patched, err := applyPatch(user, p)
+	if err != nil {
+		return err
+	}
+
+	if err = validation.ValidateUser(patched); err != nil {
+		return err
+	}
+
+	changes := diff(user, patched)
+	if len(changes) == 0 {
+		return nil
+	}
+
+	err = s.repo.WithTx(ctx, func(repo repository.UserRepository) error {
+		var err error
+		if patched.Version, err = repo.Patch(ctx, user.ID, p.IfMatch, changes); err != nil {
+			return err
+		}
+		if err = repo.AppendEvent(ctx, newEvent(model.UserUpdated, patched, changes)); err != nil {
+			return err
+		}
+		return appendAudit(ctx, repo, model.AuditUpdate, user, patched)
+	})
+	if err != nil {
+		return err
+	}
+
+	s.events.Publish()
+	*user = *patched
+	return nil
+}
+
+func applyPatch(user *model.User, p *model.UserPatch) (*model.User, error) {
+	doc, err := patch.Document(user)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = patch.Apply(doc, p.ContentType, p.Body); err != nil {
+		return nil, err
+	}
+
+	patched := new(model.User)
+	if err = patch.Decode(doc, patched); err != nil {
+		return nil, err
+	}
+
+	if patched.ID != user.ID {
+		return nil, validation.ErrReadOnlyID
+	}
+	if patched.UUID != user.UUID {
+		return nil, validation.ErrReadOnlyUUID
+	}
+	if !patched.CreatedAt.Equal(user.CreatedAt) {
+		return nil, validation.ErrReadOnlyCreatedAt
+	}
+	if !patched.UpdatedAt.Equal(user.UpdatedAt) {
+		return nil, validation.ErrReadOnlyUpdatedAt
+	}
+	if patched.DeletedAt != nil {
+		return nil, validation.ErrReadOnlyDeletedAt
+	}
+	patched.Version = user.Version
+
+	return patched, nil
+}
+
+// diff returns the changed columns and their new values.
+func diff(before, after *model.User) map[string]any {
+	changes := make(map[string]any)
+	if before.Username != after.Username {
+		changes["username"] = after.Username
+	}
+	if before.Email != after.Email {
+		changes["email"] = after.Email
+	}
+	if before.FullName != after.FullName {
+		changes["full_name"] = after.FullName
+	}
+	return changes
+}
+
+func (s *userService) Delete(ctx context.Context, id, ifMatch int64) error {
+	if err := authorize(ctx, model.PermUsersDelete); err != nil {
+		return err
+	}
+	if err := validation.ValidateID(id); err != nil {
+		return err
+	}
+	return s.delete(ctx, func(repo repository.UserRepository) (*model.User, error) {
+		return repo.Delete(ctx, id, ifMatch)
+	})
+}
+
+func (s *userService) DeleteByUUID(ctx context.Context, uuid string, ifMatch int64) error {
+	if err := authorize(ctx, model.PermUsersDelete); err != nil {
 		return err
 	}
-	return s.repo.Patch(ctx, user)
+	if err := validation.ValidateUUID(uuid); err != nil {
+		return err
+	}
+	return s.delete(ctx, func(repo repository.UserRepository) (*model.User, error) {
+		return repo.DeleteByUUID(ctx, uuid, ifMatch)
+	})
+}
+
+// delete records the deletion unless the user was already missing.
+func (s *userService) delete(ctx context.Context, del func(repo repository.UserRepository) (*model.User, error)) error {
+	err := s.repo.WithTx(ctx, func(repo repository.UserRepository) error {
+		user, err := del(repo)
+		if err != nil || user == nil {
+			return err
+		}
+		if err = repo.AppendEvent(ctx, newEvent(model.UserDeleted, user, map[string]any{"deleted_at": user.DeletedAt})); err != nil {
+			return err
+		}
+		return appendAudit(ctx, repo, model.AuditDelete, user, nil)
+	})
+	if err != nil {
+		return err
+	}
+
+	s.events.Publish()
+	return nil
 }
 
-func (s *userService) Delete(ctx context.Context, id int64) error {
+func (s *userService) Restore(ctx context.Context, id int64) (*model.User, error) {
+	if err := authorize(ctx, model.PermUsersDelete); err != nil {
+		return nil, err
+	}
 	if err := validation.ValidateID(id); err != nil {
+		return nil, err
+	}
+	return s.restore(ctx, func(repo repository.UserRepository) (*model.User, error) {
+		return repo.Restore(ctx, id)
+	})
+}
+
+func (s *userService) RestoreByUUID(ctx context.Context, uuid string) (*model.User, error) {
+	if err := authorize(ctx, model.PermUsersDelete); err != nil {
+		return nil, err
+	}
+	if err := validation.ValidateUUID(uuid); err != nil {
+		return nil, err
+	}
+	return s.restore(ctx, func(repo repository.UserRepository) (*model.User, error) {
+		return repo.RestoreByUUID(ctx, uuid)
+	})
+}
+
+// restore records the restored user as updated with every field, as the
+// readers may have dropped it when it was deleted.
+func (s *userService) restore(ctx context.Context, res func(repo repository.UserRepository) (*model.User, error)) (*model.User, error) {
+	var user *model.User
+	err := s.repo.WithTx(ctx, func(repo repository.UserRepository) error {
+		var err error
+		if user, err = res(repo); err != nil {
+			return err
+		}
+		changes := fields(user)
+		changes["deleted_at"] = nil
+		if err = repo.AppendEvent(ctx, newEvent(model.UserUpdated, user, changes)); err != nil {
+			return err
+		}
+		return appendAudit(ctx, repo, model.AuditRestore, nil, user)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	s.events.Publish()
+	return user, nil
+}
+
+func (s *userService) Purge(ctx context.Context, retention time.Duration) (int64, error) {
+	return s.repo.Purge(ctx, retention)
+}
+
+// Batch applies the operations in order. An atomic batch runs in a single
+// transaction and stops at the first failure, marking every other operation
+// as rolled back. Otherwise each operation succeeds or fails on its own.
+func (s *userService) Batch(ctx context.Context, ops []model.BatchOperation, atomic bool) ([]model.BatchResult, error) {
+	if err := validation.ValidateBatch(ops); err != nil {
+		return nil, err
+	}
+
+	results := make([]model.BatchResult, len(ops))
+	if !atomic {
+		for i := range ops {
+			results[i] = s.apply(ctx, i, &ops[i])
+		}
+		return results, nil
+	}
+
+	failed := -1
+	err := s.repo.WithTx(ctx, func(repo repository.UserRepository) error {
+		tx := &userService{repo: repo, events: s.events}
+		for i := range ops {
+			if results[i] = tx.apply(ctx, i, &ops[i]); results[i].Err != nil {
+				failed = i
+				return validation.ErrBatchRolledBack
+			}
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, validation.ErrBatchRolledBack) {
+		return nil, err
+	}
+
+	if failed >= 0 {
+		for i := range results {
+			if i != failed {
+				results[i] = model.BatchResult{Index: i, Op: ops[i].Op, Err: validation.ErrBatchRolledBack}
+			}
+		}
+		return results, nil
+	}
+
+	// The operations woke the watchers before the commit.
+	s.events.Publish()
+	return results, nil
+}
+
+func (s *userService) apply(ctx context.Context, i int, op *model.BatchOperation) model.BatchResult {
+	res := model.BatchResult{Index: i, Op: op.Op}
+	if res.Err = validation.ValidateBatchOperation(op); res.Err != nil {
+		return res
+	}
+
+	switch op.Op {
+	case model.BatchCreate:
+		user := *op.User
+		if _, res.Err = s.Post(ctx, &user); res.Err == nil {
+			res.User = &user
+		}
+	case model.BatchPatch:
+		var user *model.User
+		if user, res.Err = s.lookup(ctx, op.ID); res.Err != nil {
+			return res
+		}
+		p := &model.UserPatch{ContentType: patch.MergePatchType, Body: op.Patch, IfMatch: op.IfMatch}
+		if bytes.HasPrefix(bytes.TrimSpace(op.Patch), []byte("[")) {
+			p.ContentType = patch.JSONPatchType
+		}
+		if res.Err = s.Patch(ctx, user, p); res.Err == nil {
+			res.User = user
+		}
+	case model.BatchDelete:
+		if id, err := strconv.ParseInt(op.ID, 10, 64); err == nil {
+			res.Err = s.Delete(ctx, id, op.IfMatch)
+		} else {
+			res.Err = s.DeleteByUUID(ctx, op.ID, op.IfMatch)
+		}
+	}
+	return res
+}
+
+// lookup finds the user by UUID or by the deprecated numeric id.
+func (s *userService) lookup(ctx context.Context, id string) (*model.User, error) {
+	if n, err := strconv.ParseInt(id, 10, 64); err == nil {
+		return s.GetByID(ctx, n)
+	}
+	return s.GetByUUID(ctx, id)
+}
+
+// Import creates the users of the rows and updates those whose username is
+// already taken. A row is rejected if it is invalid, repeats a username or
+// email of an earlier row, or takes the email of another user. A dry run
+// only reports what would happen.
+func (s *userService) Import(ctx context.Context, rows []model.ImportRow, dryRun bool) (*model.ImportReport, error) {
+	if err := authorize(ctx, model.PermUsersCreate, model.PermUsersUpdate); err != nil {
+		return nil, err
+	}
+
+	report := &model.ImportReport{DryRun: dryRun, Results: make([]model.ImportResult, len(rows))}
+
+	var (
+		valid     []int
+		usernames = make(map[string]bool)
+		emails    = make(map[string]bool)
+	)
+	for i := range rows {
+		row := &rows[i]
+		res := &report.Results[i]
+		*res = model.ImportResult{Line: row.Line, Username: row.User.Username, Action: model.ImportReject, Err: row.Err}
+
+		if res.Err == nil {
+			res.Err = validation.ValidateUser(&row.User)
+		}
+		if res.Err == nil && usernames[row.User.Username] {
+			res.Err = validation.ErrDuplicateUsername
+		}
+		if res.Err == nil && emails[row.User.Email] {
+			res.Err = validation.ErrDuplicateEmail
+		}
+		if res.Err != nil {
+			continue
+		}
+
+		usernames[row.User.Username] = true
+		emails[row.User.Email] = true
+		valid = append(valid, i)
+	}
+
+	err := s.repo.WithTx(ctx, func(repo repository.UserRepository) error {
+		existing, err := repo.GetByUsernamesOrEmails(ctx, keys(usernames), keys(emails))
+		if err != nil {
+			return err
+		}
+
+		byUsername := make(map[string]*model.User, len(existing))
+		byEmail := make(map[string]*model.User, len(existing))
+		for i := range existing {
+			byUsername[existing[i].Username] = &existing[i]
+			byEmail[existing[i].Email] = &existing[i]
+		}
+
+		var create, update []model.User
+		for _, i := range valid {
+			user, res := rows[i].User, &report.Results[i]
+			current := byUsername[user.Username]
+			owner := byEmail[user.Email]
+
+			switch {
+			case owner != nil && owner != current:
+				res.Err = validation.ErrTakenEmail
+			case current == nil:
+				res.Action = model.ImportCreate
+				create = append(create, user)
+			case current.Email == user.Email && current.FullName == user.FullName:
+				res.Action = model.ImportUnchanged
+			default:
+				res.Action = model.ImportUpdate
+				user.ID = current.ID
+				update = append(update, user)
+			}
+		}
+
+		if dryRun {
+			return nil
+		}
+		if err = repo.Import(ctx, create, update); err != nil {
+			return err
+		}
+		return appendImportEvents(ctx, repo, byUsername, create, update)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !dryRun {
+		s.events.Publish()
+	}
+
+	for _, res := range report.Results {
+		switch res.Action {
+		case model.ImportCreate:
+			report.Created++
+		case model.ImportUpdate:
+			report.Updated++
+		case model.ImportUnchanged:
+			report.Unchanged++
+		default:
+			report.Rejected++
+		}
+	}
+	return report, nil
+}
+
+// appendImportEvents records the imported users in the event and audit logs. Their ids and versions are
+// read back, as the import does not return them.
+func appendImportEvents(ctx context.Context, repo repository.UserRepository, previous map[string]*model.User, create, update []model.User) error {
+	if len(create) == 0 && len(update) == 0 {
+		return nil
+	}
+
+	usernames := make([]string, 0, len(create)+len(update))
+	for _, users := range [][]model.User{create, update} {
+		for i := range users {
+			usernames = append(usernames, users[i].Username)
+		}
+	}
+
+	imported, err := repo.GetByUsernamesOrEmails(ctx, usernames, nil)
+	if err != nil {
+		return err
+	}
+
+	for i := range imported {
+		user := &imported[i]
+		before := previous[user.Username]
+		event, action := newEvent(model.UserCreated, user, fields(user)), model.AuditCreate
+		if before != nil {
+			event, action = newEvent(model.UserUpdated, user, diff(before, user)), model.AuditUpdate
+		}
+		if err = repo.AppendEvent(ctx, event); err != nil {
+			return err
+		}
+		if err = appendAudit(ctx, repo, action, before, user); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func keys(m map[string]bool) []string {
+	s := make([]string, 0, len(m))
+	for k := range m {
+		s = append(s, k)
+	}
+	return s
+}
+
+// authorize checks that the principal of ctx has the permissions. A denial is
+// logged with the request it comes from.
+func authorize(ctx context.Context, permissions ...string) error {
+	for _, permission := range permissions {
+		if err := auth.Authorize(ctx, permission); err != nil {
+			slog.WarnContext(ctx, "Permission denied:", "permission", permission)
+			return err
+		}
+	}
+	return nil
+}
+
+// authorizeDeleted lets only admins list the soft-deleted users: the caller
+// needs both the admin scope and the permission to manage.
+func authorizeDeleted(ctx context.Context, query *model.UserQuery) error {
+	if !query.IncludeDeleted {
+		return nil
+	}
+	if err := auth.Require(ctx, model.ScopeAdmin); err != nil {
 		return err
 	}
-	return s.repo.Delete(ctx, id)
+	return authorize(ctx, model.PermManage)
 }
@@ -0,0 +1,140 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+
+	"cruder/internal/model"
+	"cruder/internal/repository"
+	"cruder/pkg/validation"
+)
+
+type WebhookService interface {
+	GetAll(ctx context.Context) ([]model.Webhook, error)
+	Get(ctx context.Context, uuid string) (*model.Webhook, error)
+	Post(ctx context.Context, webhook *model.Webhook) error
+	Update(ctx context.Context, uuid string, update *model.WebhookUpdate) (*model.Webhook, error)
+	Delete(ctx context.Context, uuid string) error
+	GetDeliveries(ctx context.Context, uuid string, query *model.DeliveryQuery) ([]model.WebhookDelivery, error)
+	GetDelivery(ctx context.Context, uuid string, id int64) (*model.WebhookDelivery, error)
+	Redeliver(ctx context.Context, uuid string, id int64) (*model.WebhookDelivery, error)
+}
+
+type webhookService struct {
+	repo repository.WebhookRepository
+}
+
+// NewWebhookService returns the service managing the webhooks. The
+// deliveries are queued by the user repository and sent by the dispatcher.
+func NewWebhookService(repo repository.WebhookRepository) WebhookService {
+	return &webhookService{repo: repo}
+}
+
+const defaultDeliveryLimit = 20
+
+func (s *webhookService) GetAll(ctx context.Context) ([]model.Webhook, error) {
+	webhooks, err := s.repo.GetAll(ctx)
+	if webhooks == nil {
+		webhooks = []model.Webhook{}
+	}
+	return webhooks, err
+}
+
+func (s *webhookService) Get(ctx context.Context, uuid string) (*model.Webhook, error) {
+	if err := validation.ValidateUUID(uuid); err != nil {
+		return nil, err
+	}
+	return s.repo.GetByUUID(ctx, uuid)
+}
+
+// Post creates the webhook with a new secret, which is returned only here.
+func (s *webhookService) Post(ctx context.Context, webhook *model.Webhook) error {
+	if webhook.Events == nil {
+		webhook.Events = []string{}
+	}
+	if err := validation.ValidateWebhook(webhook); err != nil {
+		return err
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return err
+	}
+	webhook.Secret = "whsec_" + hex.EncodeToString(secret)
+
+	return s.repo.Post(ctx, webhook)
+}
+
+func (s *webhookService) Update(ctx context.Context, uuid string, update *model.WebhookUpdate) (*model.Webhook, error) {
+	webhook, err := s.Get(ctx, uuid)
+	if err != nil {
+		return nil, err
+	}
+
+	if update.URL != nil {
+		webhook.URL = *update.URL
+	}
+	if update.Events != nil {
+		webhook.Events = *update.Events
+		if webhook.Events == nil {
+			webhook.Events = []string{}
+		}
+	}
+	if update.Active != nil {
+		webhook.Active = *update.Active
+	}
+	if err = validation.ValidateWebhook(webhook); err != nil {
+		return nil, err
+	}
+
+	if err = s.repo.Update(ctx, webhook); err != nil {
+		return nil, err
+	}
+	return webhook, nil
+}
+
+func (s *webhookService) Delete(ctx context.Context, uuid string) error {
+	if err := validation.ValidateUUID(uuid); err != nil {
+		return err
+	}
+	return s.repo.Delete(ctx, uuid)
+}
+
+func (s *webhookService) GetDeliveries(ctx context.Context, uuid string, query *model.DeliveryQuery) ([]model.WebhookDelivery, error) {
+	if query.Limit == 0 {
+		query.Limit = defaultDeliveryLimit
+	}
+	if err := validation.ValidateDeliveryQuery(query); err != nil {
+		return nil, err
+	}
+
+	webhook, err := s.Get(ctx, uuid)
+	if err != nil {
+		return nil, err
+	}
+
+	deliveries, err := s.repo.GetDeliveries(ctx, webhook.ID, query)
+	if deliveries == nil {
+		deliveries = []model.WebhookDelivery{}
+	}
+	return deliveries, err
+}
+
+func (s *webhookService) GetDelivery(ctx context.Context, uuid string, id int64) (*model.WebhookDelivery, error) {
+	webhook, err := s.Get(ctx, uuid)
+	if err != nil {
+		return nil, err
+	}
+	return s.repo.GetDelivery(ctx, webhook.ID, id)
+}
+
+// Redeliver queues the delivery again with a fresh backoff, typically after
+// it has been dead-lettered.
+func (s *webhookService) Redeliver(ctx context.Context, uuid string, id int64) (*model.WebhookDelivery, error) {
+	webhook, err := s.Get(ctx, uuid)
+	if err != nil {
+		return nil, err
+	}
+	return s.repo.Redeliver(ctx, webhook.ID, id)
+}
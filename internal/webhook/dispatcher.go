@@ -0,0 +1,181 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"cruder/internal/events"
+	"cruder/internal/model"
+	"cruder/internal/repository"
+)
+
+const (
+	// MaxAttempts is the number of failed attempts after which a delivery
+	// is dead-lettered. With the backoff, that is about three hours, well
+	// within the retention of the event log.
+	MaxAttempts = 10
+
+	baseDelay = 30 * time.Second
+	maxDelay  = time.Hour
+
+	batchSize    = 20
+	timeout      = 10 * time.Second
+	pollInterval = 5 * time.Second
+	// lease outlasts the timeout, so a delivery is only claimed again if
+	// its dispatcher died.
+	lease = time.Minute
+
+	maxErrorLength = 1000
+)
+
+// Dispatcher sends the queued deliveries. Every instance can run one, as the
+// deliveries are claimed with row locks.
+type Dispatcher struct {
+	repo   repository.WebhookRepository
+	broker *events.Broker
+	client *http.Client
+}
+
+// NewDispatcher returns a dispatcher woken up by the broker on new events.
+// Redirects are not followed, so they count as failures.
+func NewDispatcher(repo repository.WebhookRepository, broker *events.Broker) *Dispatcher {
+	client := &http.Client{
+		Timeout: timeout,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	return &Dispatcher{repo: repo, broker: broker, client: client}
+}
+
+// Run dispatches until ctx is done. It polls for the due retries in between
+// the new events.
+func (d *Dispatcher) Run(ctx context.Context) {
+	wake, cancel := d.broker.Subscribe()
+	defer cancel()
+
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		for {
+			n, err := d.Dispatch(ctx)
+			if err != nil && ctx.Err() == nil {
+				slog.ErrorContext(ctx, "Webhook dispatch failed:", "error", err.Error())
+			}
+			if err != nil || n < batchSize {
+				break
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// Dispatch sends a batch of due deliveries concurrently and returns their
+// number.
+func (d *Dispatcher) Dispatch(ctx context.Context) (int, error) {
+	messages, err := d.repo.Claim(ctx, batchSize, lease)
+	if err != nil {
+		return 0, err
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(messages))
+	for i := range messages {
+		wg.Go(func() { errs[i] = d.deliver(ctx, &messages[i]) })
+	}
+	wg.Wait()
+
+	return len(messages), errors.Join(errs...)
+}
+
+// deliver sends the message and records the attempt. An attempt cut short by
+// ctx is not recorded, and the delivery is retried when the lease expires.
+func (d *Dispatcher) deliver(ctx context.Context, m *model.WebhookMessage) error {
+	attempt := d.send(ctx, m)
+	if ctx.Err() != nil {
+		return nil
+	}
+
+	status, retryIn := model.DeliveryDelivered, time.Duration(0)
+	if attempt.Error != "" {
+		if m.Attempts+1 >= MaxAttempts {
+			status = model.DeliveryDead
+		} else {
+			status, retryIn = model.DeliveryPending, Backoff(m.Attempts+1)
+		}
+	}
+	return d.repo.RecordAttempt(ctx, m.DeliveryID, attempt, status, retryIn)
+}
+
+// send POSTs the event and reports any response other than 2xx as an error.
+func (d *Dispatcher) send(ctx context.Context, m *model.WebhookMessage) *model.WebhookAttempt {
+	attempt := new(model.WebhookAttempt)
+
+	body, err := json.Marshal(&m.Event)
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, m.URL, bytes.NewReader(body))
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt
+	}
+
+	timestamp := time.Now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(EventHeader, m.Event.Type)
+	req.Header.Set(DeliveryHeader, strconv.FormatInt(m.DeliveryID, 10))
+	req.Header.Set(TimestampHeader, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(SignatureHeader, Sign(m.Secret, timestamp, body))
+
+	start := time.Now()
+	resp, err := d.client.Do(req)
+	attempt.DurationMS = time.Since(start).Milliseconds()
+	if err != nil {
+		attempt.Error = truncate(err.Error())
+		return attempt
+	}
+	defer func(body io.ReadCloser) { _ = body.Close() }(resp.Body)
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+
+	attempt.StatusCode = resp.StatusCode
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		attempt.Error = fmt.Sprintf("unexpected status %s", resp.Status)
+	}
+	return attempt
+}
+
+// Backoff returns the delay after the given number of failed attempts. It
+// starts at 30 seconds and doubles up to an hour.
+func Backoff(failed int) time.Duration {
+	delay := baseDelay
+	for i := 1; i < failed && delay < maxDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, maxDelay)
+}
+
+func truncate(s string) string {
+	if len(s) > maxErrorLength {
+		return s[:maxErrorLength]
+	}
+	return s
+}
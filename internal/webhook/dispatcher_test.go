@@ -0,0 +1,225 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"cruder/internal/events"
+	"cruder/internal/model"
+	"cruder/internal/repository"
+)
+
+const testSecret = "whsec_test"
+
+type recorded struct {
+	attempt *model.WebhookAttempt
+	status  string
+	retryIn time.Duration
+}
+
+// fakeRepository hands out the messages once and records the attempts.
+type fakeRepository struct {
+	repository.WebhookRepository
+
+	mu       sync.Mutex
+	messages []model.WebhookMessage
+	attempts map[int64]recorded
+}
+
+func (f *fakeRepository) Claim(_ context.Context, limit int, _ time.Duration) ([]model.WebhookMessage, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	n := min(limit, len(f.messages))
+	claimed := f.messages[:n]
+	f.messages = f.messages[n:]
+	return claimed, nil
+}
+
+func (f *fakeRepository) RecordAttempt(_ context.Context, id int64, attempt *model.WebhookAttempt, status string, retryIn time.Duration) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.attempts == nil {
+		f.attempts = make(map[int64]recorded)
+	}
+	f.attempts[id] = recorded{attempt: attempt, status: status, retryIn: retryIn}
+	return nil
+}
+
+func message(id int64, attempts int, url string) model.WebhookMessage {
+	return model.WebhookMessage{
+		DeliveryID: id,
+		Attempts:   attempts,
+		URL:        url,
+		Secret:     testSecret,
+		Event: model.UserEvent{
+			ID:      id,
+			Type:    model.UserUpdated,
+			UUID:    "00000000-0000-4000-8000-000000000001",
+			Version: 2,
+			Changes: map[string]any{"full_name": "John Doe"},
+		},
+	}
+}
+
+func TestDispatch(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		received []model.UserEvent
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/fail":
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		case "/redirect":
+			http.Redirect(w, r, "/ok", http.StatusFound)
+			return
+		}
+
+		body, _ := io.ReadAll(r.Body)
+		timestamp, _ := strconv.ParseInt(r.Header.Get(TimestampHeader), 10, 64)
+		if !Verify(testSecret, timestamp, body, r.Header.Get(SignatureHeader)) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.Header.Get(EventHeader) != model.UserUpdated || r.Header.Get(DeliveryHeader) == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		var event model.UserEvent
+		if err := json.Unmarshal(body, &event); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		received = append(received, event)
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	repo := &fakeRepository{messages: []model.WebhookMessage{
+		message(1, 0, server.URL+"/ok"),
+		message(2, 0, server.URL+"/fail"),
+		message(3, 3, server.URL+"/fail"),
+		message(4, MaxAttempts-1, server.URL+"/fail"),
+		message(5, 0, server.URL+"/redirect"),
+		message(6, 0, "http://127.0.0.1:0/unreachable"),
+	}}
+	dispatcher := NewDispatcher(repo, events.NewBroker())
+
+	n, err := dispatcher.Dispatch(t.Context())
+	if err != nil || n != 6 {
+		t.Fatalf("expected 6 deliveries, got %d: %v", n, err)
+	}
+
+	tests := []struct {
+		name       string
+		id         int64
+		status     string
+		statusCode int
+		retryIn    time.Duration
+	}{
+		{"delivered", 1, model.DeliveryDelivered, http.StatusOK, 0},
+		{"first failure", 2, model.DeliveryPending, http.StatusServiceUnavailable, 30 * time.Second},
+		{"later failure", 3, model.DeliveryPending, http.StatusServiceUnavailable, 4 * time.Minute},
+		{"last failure", 4, model.DeliveryDead, http.StatusServiceUnavailable, 0},
+		{"redirect", 5, model.DeliveryPending, http.StatusFound, 30 * time.Second},
+		{"no response", 6, model.DeliveryPending, 0, 30 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := repo.attempts[tt.id]
+			if got.status != tt.status || got.attempt.StatusCode != tt.statusCode || got.retryIn != tt.retryIn {
+				t.Errorf("expected %s %d retry in %s, got %s %d retry in %s",
+					tt.status, tt.statusCode, tt.retryIn, got.status, got.attempt.StatusCode, got.retryIn)
+			}
+			if (tt.status == model.DeliveryDelivered) != (got.attempt.Error == "") {
+				t.Errorf("unexpected error %q", got.attempt.Error)
+			}
+		})
+	}
+
+	if len(received) != 1 || received[0].ID != 1 || received[0].Changes["full_name"] != "John Doe" {
+		t.Errorf("unexpected events received %v", received)
+	}
+}
+
+func TestRun(t *testing.T) {
+	delivered := make(chan struct{}, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+		delivered <- struct{}{}
+	}))
+	defer server.Close()
+
+	repo := new(fakeRepository)
+	broker := events.NewBroker()
+
+	ctx, cancel := context.WithCancel(t.Context())
+	done := make(chan struct{})
+	go func() {
+		NewDispatcher(repo, broker).Run(ctx)
+		close(done)
+	}()
+
+	// Nothing is due until the event wakes the dispatcher up.
+	time.Sleep(50 * time.Millisecond)
+	repo.mu.Lock()
+	repo.messages = append(repo.messages, message(1, 0, server.URL))
+	repo.mu.Unlock()
+	broker.Publish()
+
+	select {
+	case <-delivered:
+	case <-time.After(pollInterval / 2):
+		t.Fatal("the event did not wake the dispatcher up")
+	}
+
+	cancel()
+	<-done
+}
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		failed int
+		delay  time.Duration
+	}{
+		{1, 30 * time.Second},
+		{2, time.Minute},
+		{5, 8 * time.Minute},
+		{8, time.Hour},
+		{100, time.Hour},
+	}
+	for _, tt := range tests {
+		if got := Backoff(tt.failed); got != tt.delay {
+			t.Errorf("Backoff(%d): expected %s, got %s", tt.failed, tt.delay, got)
+		}
+	}
+}
+
+func TestSign(t *testing.T) {
+	body := []byte(`{"id":1}`)
+	signature := Sign(testSecret, 1700000000, body)
+
+	if !Verify(testSecret, 1700000000, body, signature) {
+		t.Error("expected the signature to verify")
+	}
+	if Verify(testSecret, 1700000001, body, signature) {
+		t.Error("expected another timestamp to fail")
+	}
+	if Verify("other", 1700000000, body, signature) {
+		t.Error("expected another secret to fail")
+	}
+	if Verify(testSecret, 1700000000, []byte(`{"id":2}`), signature) {
+		t.Error("expected another body to fail")
+	}
+}
@@ -0,0 +1,16 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE users ADD COLUMN IF NOT EXISTS uuid UUID;
+
+UPDATE users SET uuid = gen_random_uuid() WHERE uuid IS NULL;
+
+ALTER TABLE users
+    ALTER COLUMN uuid SET DEFAULT gen_random_uuid(),
+    ALTER COLUMN uuid SET NOT NULL,
+    ADD CONSTRAINT users_uuid_key UNIQUE (uuid);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE users DROP COLUMN IF EXISTS uuid;
+-- +goose StatementEnd
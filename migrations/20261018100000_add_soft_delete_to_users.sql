@@ -0,0 +1,29 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE users ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMP;
+
+-- Usernames and emails are unique among live users only, so a soft-deleted
+-- user does not block the signup of a new one. Restoring such a user fails
+-- with a conflict.
+ALTER TABLE users
+    DROP CONSTRAINT IF EXISTS users_username_key,
+    DROP CONSTRAINT IF EXISTS users_email_key;
+
+CREATE UNIQUE INDEX IF NOT EXISTS users_username_key ON users (username) WHERE deleted_at IS NULL;
+CREATE UNIQUE INDEX IF NOT EXISTS users_email_key ON users (email) WHERE deleted_at IS NULL;
+CREATE INDEX IF NOT EXISTS users_deleted_at_idx ON users (deleted_at) WHERE deleted_at IS NOT NULL;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DELETE FROM users WHERE deleted_at IS NOT NULL;
+
+DROP INDEX IF EXISTS users_deleted_at_idx;
+DROP INDEX IF EXISTS users_email_key;
+DROP INDEX IF EXISTS users_username_key;
+
+ALTER TABLE users
+    ADD CONSTRAINT users_username_key UNIQUE (username),
+    ADD CONSTRAINT users_email_key UNIQUE (email),
+    DROP COLUMN IF EXISTS deleted_at;
+-- +goose StatementEnd
@@ -0,0 +1,24 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
+
+ALTER TABLE users ADD COLUMN IF NOT EXISTS search TSVECTOR
+    GENERATED ALWAYS AS (
+        to_tsvector('simple', coalesce(username, '') || ' ' || coalesce(email, '') || ' ' || coalesce(full_name, ''))
+    ) STORED;
+
+CREATE INDEX IF NOT EXISTS users_search_idx ON users USING GIN (search);
+CREATE INDEX IF NOT EXISTS users_username_trgm_idx ON users USING GIN (username gin_trgm_ops);
+CREATE INDEX IF NOT EXISTS users_email_trgm_idx ON users USING GIN (email gin_trgm_ops);
+CREATE INDEX IF NOT EXISTS users_full_name_trgm_idx ON users USING GIN (full_name gin_trgm_ops);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX IF EXISTS users_full_name_trgm_idx;
+DROP INDEX IF EXISTS users_email_trgm_idx;
+DROP INDEX IF EXISTS users_username_trgm_idx;
+DROP INDEX IF EXISTS users_search_idx;
+
+ALTER TABLE users DROP COLUMN IF EXISTS search;
+-- +goose StatementEnd
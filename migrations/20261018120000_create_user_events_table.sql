@@ -0,0 +1,35 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE IF NOT EXISTS user_events (
+    id BIGSERIAL PRIMARY KEY,
+    type VARCHAR(32) NOT NULL,
+    user_uuid UUID NOT NULL,
+    version BIGINT NOT NULL,
+    -- the changed fields with their new values
+    changes JSONB NOT NULL DEFAULT '{}',
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS user_events_created_at_idx ON user_events (created_at);
+
+-- The payload is the id of the event. NOTIFY is delivered on commit, so the
+-- listeners of every instance can read the event right away.
+CREATE OR REPLACE FUNCTION notify_user_event() RETURNS TRIGGER AS $$
+BEGIN
+    PERFORM pg_notify('user_events', NEW.id::text);
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER user_events_notify
+    AFTER INSERT ON user_events
+    FOR EACH ROW
+    EXECUTE FUNCTION notify_user_event();
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TRIGGER IF EXISTS user_events_notify ON user_events;
+DROP FUNCTION IF EXISTS notify_user_event();
+DROP TABLE IF EXISTS user_events;
+-- +goose StatementEnd
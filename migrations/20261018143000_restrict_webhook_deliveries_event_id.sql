@@ -0,0 +1,16 @@
+-- +goose Up
+-- +goose StatementBegin
+-- A delivery no longer goes away with its event: the purge of the event log
+-- keeps the events of the pending and dead deliveries, and deletes the
+-- delivered ones itself.
+ALTER TABLE webhook_deliveries
+    DROP CONSTRAINT IF EXISTS webhook_deliveries_event_id_fkey,
+    ADD CONSTRAINT webhook_deliveries_event_id_fkey FOREIGN KEY (event_id) REFERENCES user_events (id);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE webhook_deliveries
+    DROP CONSTRAINT IF EXISTS webhook_deliveries_event_id_fkey,
+    ADD CONSTRAINT webhook_deliveries_event_id_fkey FOREIGN KEY (event_id) REFERENCES user_events (id) ON DELETE CASCADE;
+-- +goose StatementEnd
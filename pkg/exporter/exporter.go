@@ -0,0 +1,115 @@
+package exporter
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"cruder/internal/model"
+	"cruder/pkg/validation"
+)
+
+// Writer writes users one by one. Close must be called after the last user
+// to complete the file.
+type Writer interface {
+	Write(user *model.User) error
+	Close() error
+}
+
+type Format struct {
+	Name        string
+	ContentType string
+	newWriter   func(w io.Writer) (Writer, error)
+}
+
+var formats = map[string]*Format{
+	"csv":    {Name: "csv", ContentType: "text/csv", newWriter: newCSVWriter},
+	"ndjson": {Name: "ndjson", ContentType: "application/x-ndjson", newWriter: newNDJSONWriter},
+	"xlsx":   {Name: "xlsx", ContentType: "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet", newWriter: newXLSXWriter},
+}
+
+func Lookup(name string) (*Format, error) {
+	if name == "" {
+		name = "csv"
+	}
+	f, ok := formats[name]
+	if !ok {
+		return nil, validation.ErrInvalidExportFormat
+	}
+	return f, nil
+}
+
+// NewWriter starts the file, writing its header if the format has one.
+func (f *Format) NewWriter(w io.Writer) (Writer, error) {
+	return f.newWriter(w)
+}
+
+var header = []string{"id", "uuid", "username", "email", "full_name", "created_at", "updated_at", "deleted_at"}
+
+func record(user *model.User) []string {
+	var deletedAt string
+	if user.DeletedAt != nil {
+		deletedAt = user.DeletedAt.UTC().Format(time.RFC3339)
+	}
+	return []string{
+		strconv.FormatInt(user.ID, 10),
+		user.UUID,
+		user.Username,
+		user.Email,
+		user.FullName,
+		user.CreatedAt.UTC().Format(time.RFC3339),
+		user.UpdatedAt.UTC().Format(time.RFC3339),
+		deletedAt,
+	}
+}
+
+type csvWriter struct {
+	w *csv.Writer
+}
+
+func newCSVWriter(w io.Writer) (Writer, error) {
+	cw := csv.NewWriter(w)
+	return &csvWriter{w: cw}, cw.Write(header)
+}
+
+func (c *csvWriter) Write(user *model.User) error {
+	rec := record(user)
+	for i, cell := range rec {
+		rec[i] = escapeFormula(cell)
+	}
+	return c.w.Write(rec)
+}
+
+// escapeFormula prefixes a cell that a spreadsheet would run as a formula
+// with a quote, which makes it text. The cells of the XLSX sheet are typed
+// as text already.
+func escapeFormula(cell string) string {
+	if cell != "" && strings.ContainsRune("=+-@\t\r", rune(cell[0])) {
+		return "'" + cell
+	}
+	return cell
+}
+
+func (c *csvWriter) Close() error {
+	c.w.Flush()
+	return c.w.Error()
+}
+
+type ndjsonWriter struct {
+	enc *json.Encoder
+}
+
+func newNDJSONWriter(w io.Writer) (Writer, error) {
+	return &ndjsonWriter{enc: json.NewEncoder(w)}, nil
+}
+
+func (n *ndjsonWriter) Write(user *model.User) error {
+	return n.enc.Encode(user)
+}
+
+func (n *ndjsonWriter) Close() error {
+	return nil
+}
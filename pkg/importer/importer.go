@@ -0,0 +1,194 @@
+package importer
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+
+	"cruder/internal/model"
+	"cruder/pkg/validation"
+)
+
+const (
+	CSVType    = "text/csv"
+	NDJSONType = "application/x-ndjson"
+)
+
+var fields = map[string]bool{"username": true, "email": true, "full_name": true}
+
+// ParseMapping parses a list of column:field pairs, such as
+// "Login:username,E-mail:email". Columns named after a field need no mapping.
+func ParseMapping(s string) (map[string]string, error) {
+	mapping := make(map[string]string)
+	if s == "" {
+		return mapping, nil
+	}
+
+	for _, pair := range strings.Split(s, ",") {
+		column, field, ok := strings.Cut(pair, ":")
+		column, field = strings.TrimSpace(column), strings.TrimSpace(field)
+		if !ok || column == "" || !fields[field] {
+			return nil, validation.ErrInvalidMapping
+		}
+		mapping[column] = field
+	}
+	return mapping, nil
+}
+
+// Read reads the users from a CSV file with a header line or from NDJSON.
+// A line that cannot be parsed is returned as a row with an error, so that
+// it can be reported along with the invalid users.
+func Read(contentType string, r io.Reader, mapping map[string]string) ([]model.ImportRow, error) {
+	var (
+		rows []model.ImportRow
+		err  error
+	)
+	switch contentType {
+	case CSVType:
+		rows, err = readCSV(r, mapping)
+	case NDJSONType:
+		rows, err = readNDJSON(r, mapping)
+	default:
+		return nil, validation.ErrUnsupportedImport
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if len(rows) == 0 {
+		return nil, validation.ErrEmptyImport
+	}
+	return rows, nil
+}
+
+// field returns the user field the column is mapped to, if any.
+func field(mapping map[string]string, column string) string {
+	if f, ok := mapping[column]; ok {
+		return f
+	}
+	if fields[column] {
+		return column
+	}
+	return ""
+}
+
+func set(user *model.User, field, value string) {
+	switch field {
+	case "username":
+		user.Username = value
+	case "email":
+		user.Email = value
+	case "full_name":
+		user.FullName = value
+	}
+}
+
+func readCSV(r io.Reader, mapping map[string]string) ([]model.ImportRow, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.TrimLeadingSpace = true
+
+	header, err := cr.Read()
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, validation.ErrEmptyImport
+		}
+		return nil, readError(err)
+	}
+
+	columns := make([]string, len(header))
+	for i, h := range header {
+		if i == 0 {
+			h = strings.TrimPrefix(h, "\ufeff")
+		}
+		columns[i] = field(mapping, strings.TrimSpace(h))
+	}
+
+	var rows []model.ImportRow
+	for {
+		record, err := cr.Read()
+		if errors.Is(err, io.EOF) {
+			return rows, nil
+		}
+		if len(rows) == validation.MaxImportRows {
+			return nil, validation.ErrLongImport
+		}
+
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			rows = append(rows, model.ImportRow{Line: parseErr.Line, Err: validation.MalformedRequest(parseErr.Err)})
+			continue
+		}
+		if err != nil {
+			return nil, readError(err)
+		}
+
+		line, _ := cr.FieldPos(0)
+		row := model.ImportRow{Line: line}
+		if len(record) != len(columns) {
+			row.Err = validation.MalformedRequest(csv.ErrFieldCount)
+		} else {
+			for i, value := range record {
+				set(&row.User, columns[i], strings.TrimSpace(value))
+			}
+		}
+		rows = append(rows, row)
+	}
+}
+
+func readNDJSON(r io.Reader, mapping map[string]string) ([]model.ImportRow, error) {
+	scanner := bufio.NewScanner(r)
+
+	var rows []model.ImportRow
+	for line := 1; scanner.Scan(); line++ {
+		data := bytes.TrimSpace(scanner.Bytes())
+		if len(data) == 0 {
+			continue
+		}
+		if len(rows) == validation.MaxImportRows {
+			return nil, validation.ErrLongImport
+		}
+
+		row := model.ImportRow{Line: line}
+		var object map[string]any
+		if err := json.Unmarshal(data, &object); err != nil || object == nil {
+			row.Err = validation.ErrInvalidRow
+			rows = append(rows, row)
+			continue
+		}
+
+		for key, v := range object {
+			f := field(mapping, key)
+			if f == "" {
+				continue
+			}
+			value, ok := v.(string)
+			if !ok {
+				row.Err = validation.ErrInvalidRow
+				break
+			}
+			set(&row.User, f, strings.TrimSpace(value))
+		}
+		rows = append(rows, row)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, readError(err)
+	}
+	return rows, nil
+}
+
+// readError returns an error of reading the file as malformed, except for
+// the file being over the size limit of the body, which is returned as is.
+func readError(err error) error {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return err
+	}
+	return validation.MalformedRequest(err)
+}
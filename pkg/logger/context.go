@@ -0,0 +1,86 @@
+package logger
+
+import (
+	"context"
+	"crypto/rand"
+	"log/slog"
+)
+
+// The keys of the attributes of the context.
+const (
+	RequestIDKey = "request_id"
+	RouteKey     = "http.route"
+	MethodKey    = "rpc.method"
+	PrincipalKey = "principal"
+)
+
+const maxRequestID = 128
+
+type (
+	requestIDKey struct{}
+	attrsKey     struct{}
+)
+
+// EnsureRequestID returns id if it is a valid request id, up to 128
+// printable ASCII characters that can neither forge log lines nor bloat them,
+// or a new one.
+func EnsureRequestID(id string) string {
+	valid := id != "" && len(id) <= maxRequestID
+	for i := 0; valid && i < len(id); i++ {
+		valid = id[i] > 0x20 && id[i] < 0x7f
+	}
+	if !valid {
+		return rand.Text()
+	}
+	return id
+}
+
+// WithRequestID returns ctx carrying the request id, which is added to the
+// log lines.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return WithAttrs(context.WithValue(ctx, requestIDKey{}, id), slog.String(RequestIDKey, id))
+}
+
+// RequestID returns the request id of ctx, if any.
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// WithAttrs returns ctx carrying attributes, such as the route or the
+// principal, which are added to the log lines written with ctx.
+func WithAttrs(ctx context.Context, attrs ...slog.Attr) context.Context {
+	prev := attrsFrom(ctx)
+	return context.WithValue(ctx, attrsKey{}, append(prev[:len(prev):len(prev)], attrs...))
+}
+
+func attrsFrom(ctx context.Context) []slog.Attr {
+	attrs, _ := ctx.Value(attrsKey{}).([]slog.Attr)
+	return attrs
+}
+
+// NewHandler wraps h to add the attributes of the context to the records, so
+// that any slog.InfoContext and the like is correlated with the request.
+func NewHandler(h slog.Handler) slog.Handler {
+	return contextHandler{h}
+}
+
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if attrs := attrsFrom(ctx); len(attrs) > 0 {
+		r = r.Clone()
+		r.AddAttrs(attrs...)
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
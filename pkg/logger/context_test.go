@@ -0,0 +1,67 @@
+package logger
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestEnsureRequestID(t *testing.T) {
+	tests := []struct {
+		name string
+		id   string
+		keep bool
+	}{
+		{"valid", "req-42", true},
+		{"uuid", "6f1c2d9e-7b3a-4c8e-9f0a-1b2c3d4e5f60", true},
+		{"empty", "", false},
+		{"space", "req 42", false},
+		{"newline", "req\n{\"level\":\"ERROR\"}", false},
+		{"too long", strings.Repeat("a", 129), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := EnsureRequestID(tt.id)
+			if tt.keep && got != tt.id || !tt.keep && (got == tt.id || got == "") {
+				t.Errorf("unexpected request id %q for %q", got, tt.id)
+			}
+		})
+	}
+}
+
+func TestHandler(t *testing.T) {
+	var buf bytes.Buffer
+	log := slog.New(NewHandler(slog.NewJSONHandler(&buf, nil)))
+
+	ctx := WithRequestID(context.Background(), "req-42")
+	ctx = WithAttrs(ctx, slog.String(RouteKey, "/api/v1/users/:id"))
+	// A context derived from another does not change the attributes of the
+	// one it is derived from.
+	_ = WithAttrs(ctx, slog.String(PrincipalKey, "jwt:asmith"))
+	ctx = WithAttrs(ctx, slog.String(PrincipalKey, "jwt:jdoe"))
+
+	log.InfoContext(ctx, "User updated:", "user_id", 1)
+	log.Info("Started")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 lines, got %q", buf.String())
+	}
+
+	var line map[string]any
+	if err := json.Unmarshal([]byte(lines[0]), &line); err != nil {
+		t.Fatal(err)
+	}
+	if line[RequestIDKey] != "req-42" || line[RouteKey] != "/api/v1/users/:id" || line[PrincipalKey] != "jwt:jdoe" || line["user_id"] != 1.0 {
+		t.Errorf("expected the attributes of the context, got %v", line)
+	}
+	if RequestID(ctx) != "req-42" || RequestID(context.Background()) != "" {
+		t.Errorf("unexpected request id %q", RequestID(ctx))
+	}
+	if strings.Contains(lines[1], RequestIDKey) {
+		t.Errorf("expected no attributes without a context, got %s", lines[1])
+	}
+}
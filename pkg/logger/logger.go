@@ -20,6 +20,8 @@ func (l *LogLevel) SetENV() ([]byte, error) {
 	return l.level.MarshalText()
 }
 
+// SetLogger sets the default logger, which adds the attributes of the context
+// of the log lines written with one, such as the request id.
 func SetLogger(level LogLevel) {
 	handler := slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{
 		AddSource:   level.level <= slog.LevelDebug,
@@ -27,7 +29,7 @@ func SetLogger(level LogLevel) {
 		ReplaceAttr: replaceAttr,
 	})
 
-	slog.SetDefault(slog.New(handler))
+	slog.SetDefault(slog.New(NewHandler(handler)))
 }
 
 func replaceAttr(_ []string, a slog.Attr) slog.Attr {
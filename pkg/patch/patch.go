@@ -0,0 +1,146 @@
+package patch
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+
+	"cruder/pkg/validation"
+)
+
+const (
+	MergePatchType = "application/merge-patch+json"
+	JSONPatchType  = "application/json-patch+json"
+)
+
+// Apply applies a JSON Merge Patch (RFC 7396) or a JSON Patch (RFC 6902)
+// to a flat JSON object. A plain JSON body is treated as a merge patch.
+func Apply(doc map[string]any, contentType string, body []byte) error {
+	switch contentType {
+	case MergePatchType, "application/json", "":
+		return MergePatch(doc, body)
+	case JSONPatchType:
+		return JSONPatch(doc, body)
+	default:
+		return validation.ErrUnsupportedPatch
+	}
+}
+
+func MergePatch(doc map[string]any, body []byte) error {
+	var p map[string]any
+	if err := unmarshal(body, &p); err != nil {
+		return err
+	}
+
+	if p == nil {
+		return validation.ErrInvalidPatch
+	}
+
+	for k, v := range p {
+		if v == nil {
+			delete(doc, k)
+			continue
+		}
+		doc[k] = v
+	}
+
+	return nil
+}
+
+type Operation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	Value json.RawMessage `json:"value"`
+}
+
+func JSONPatch(doc map[string]any, body []byte) error {
+	var ops []Operation
+	if err := unmarshal(body, &ops); err != nil {
+		return err
+	}
+
+	for _, op := range ops {
+		key, err := member(op.Path)
+		if err != nil {
+			return err
+		}
+
+		switch op.Op {
+		case "test":
+			var v any
+			if err = unmarshal(op.Value, &v); err != nil {
+				return err
+			}
+			if got, ok := doc[key]; !ok || !reflect.DeepEqual(got, v) {
+				return validation.ErrPatchTestFailed
+			}
+		case "replace":
+			if _, ok := doc[key]; !ok {
+				return validation.InvalidRequest{Field: key, Code: validation.CodeInvalidValue, Message: "path " + op.Path + " does not exist"}
+			}
+			var v any
+			if err = unmarshal(op.Value, &v); err != nil {
+				return err
+			}
+			doc[key] = v
+		case "remove":
+			if _, ok := doc[key]; !ok {
+				return validation.InvalidRequest{Field: key, Code: validation.CodeInvalidValue, Message: "path " + op.Path + " does not exist"}
+			}
+			delete(doc, key)
+		default:
+			return validation.ErrUnsupportedOp
+		}
+	}
+
+	return nil
+}
+
+// member resolves a JSON Pointer (RFC 6901) to a top-level member name.
+func member(path string) (string, error) {
+	if !strings.HasPrefix(path, "/") || strings.Count(path, "/") != 1 {
+		return "", validation.ErrInvalidPath
+	}
+	return strings.NewReplacer("~1", "/", "~0", "~").Replace(path[1:]), nil
+}
+
+func unmarshal(data []byte, v any) error {
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+	if err := d.Decode(v); err != nil {
+		return validation.MalformedRequest(err)
+	}
+	return nil
+}
+
+// Document converts v into a JSON object the patches can be applied to.
+func Document(v any) (map[string]any, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	var doc map[string]any
+	if err = unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+
+	return doc, nil
+}
+
+// Decode converts the patched document back into v, rejecting unknown members.
+func Decode(doc map[string]any, v any) error {
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.DisallowUnknownFields()
+	if err = d.Decode(v); err != nil {
+		return validation.MalformedRequest(err)
+	}
+
+	return nil
+}
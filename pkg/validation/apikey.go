@@ -0,0 +1,55 @@
+package validation
+
+import (
+	"time"
+
+	"cruder/internal/model"
+)
+
+const (
+	maxKeyNameLength = 100
+	maxOwnerLength   = 255
+	// MaxGrace is how long a rotated key may remain valid.
+	MaxGrace = 30 * 24 * time.Hour
+)
+
+var scopes = map[string]bool{model.ScopeUsersRead: true, model.ScopeUsersWrite: true, model.ScopeAdmin: true}
+
+func ValidateScopes(s []string) error {
+	if len(s) == 0 {
+		return ErrNoScopes
+	}
+	for _, scope := range s {
+		if !scopes[scope] {
+			return ErrInvalidScope
+		}
+	}
+	return nil
+}
+
+// ValidateAPIKey checks a key to be created at the given time.
+func ValidateAPIKey(key *model.APIKey, now time.Time) error {
+	var errs ValidationErrors
+	switch {
+	case key.Name == "":
+		errs.add(ErrNoKeyName)
+	case len(key.Name) > maxKeyNameLength:
+		errs.add(ErrLongKeyName)
+	}
+	if len(key.Owner) > maxOwnerLength {
+		errs.add(ErrLongOwner)
+	}
+	errs.add(ValidateScopes(key.Scopes))
+	if key.ExpiresAt != nil && !key.ExpiresAt.After(now) {
+		errs.add(ErrPastExpiry)
+	}
+	return errs.err()
+}
+
+// ValidateGrace checks how long a rotated key remains valid.
+func ValidateGrace(grace time.Duration) error {
+	if grace < 0 || grace > MaxGrace {
+		return ErrInvalidGrace
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package validation
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"cruder/internal/model"
+)
+
+func TestValidateAPIKey(t *testing.T) {
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	future, past := now.Add(time.Hour), now.Add(-time.Hour)
+
+	tests := []struct {
+		name   string
+		key    model.APIKey
+		expErr error
+	}{
+		{
+			name: "key is valid",
+			key:  model.APIKey{Name: "billing", Owner: "billing-team@example.com", Scopes: []string{model.ScopeUsersRead}, ExpiresAt: &future},
+		},
+		{
+			name: "every scope",
+			key:  model.APIKey{Name: "ops", Scopes: []string{model.ScopeUsersRead, model.ScopeUsersWrite, model.ScopeAdmin}},
+		},
+		{
+			name:   "nothing specified",
+			key:    model.APIKey{},
+			expErr: ValidationErrors{ErrNoKeyName, ErrNoScopes},
+		},
+		{
+			name:   "name and owner are too long",
+			key:    model.APIKey{Name: strings.Repeat("a", 101), Owner: strings.Repeat("a", 256), Scopes: []string{model.ScopeAdmin}},
+			expErr: ValidationErrors{ErrLongKeyName, ErrLongOwner},
+		},
+		{
+			name:   "unknown scope",
+			key:    model.APIKey{Name: "billing", Scopes: []string{model.ScopeUsersRead, "users:delete"}},
+			expErr: ValidationErrors{ErrInvalidScope},
+		},
+		{
+			name:   "already expired",
+			key:    model.APIKey{Name: "billing", Scopes: []string{model.ScopeUsersRead}, ExpiresAt: &past},
+			expErr: ValidationErrors{ErrPastExpiry},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotErr := ValidateAPIKey(&tt.key, now)
+			equal(t, tt.expErr, gotErr)
+		})
+	}
+}
+
+func TestValidateGrace(t *testing.T) {
+	tests := []struct {
+		grace  time.Duration
+		expErr error
+	}{
+		{0, nil},
+		{24 * time.Hour, nil},
+		{MaxGrace, nil},
+		{-time.Second, ErrInvalidGrace},
+		{MaxGrace + time.Second, ErrInvalidGrace},
+	}
+	for _, tt := range tests {
+		equal(t, tt.expErr, ValidateGrace(tt.grace))
+	}
+}
@@ -0,0 +1,20 @@
+package validation
+
+import "cruder/internal/model"
+
+func ValidateAuditQuery(query *model.AuditQuery) error {
+	var errs ValidationErrors
+	if query.Limit < 1 || query.Limit > MaxLimit {
+		errs.add(ErrInvalidLimit)
+	}
+	if query.UUID != "" && ValidateUUID(query.UUID) != nil || query.UserID != "" && query.UUID == "" && query.ID < 1 {
+		errs.add(ErrInvalidUserID)
+	}
+	if len(query.Actor) > 255 {
+		errs.add(ErrLongActor)
+	}
+	if query.Before < 0 {
+		errs.add(ErrInvalidBefore)
+	}
+	return errs.err()
+}
@@ -0,0 +1,45 @@
+package validation
+
+import (
+	"testing"
+
+	"cruder/internal/model"
+)
+
+func TestValidateAuditQuery(t *testing.T) {
+	tests := []struct {
+		name   string
+		query  model.AuditQuery
+		expErr error
+	}{
+		{
+			name:  "query by uuid is valid",
+			query: model.AuditQuery{UserID: "123e4567-e89b-12d3-a456-426614174000", UUID: "123e4567-e89b-12d3-a456-426614174000", Limit: 50},
+		},
+		{
+			name:  "query by id is valid",
+			query: model.AuditQuery{UserID: "42", ID: 42, Actor: "api-key:00052645bc0d", Limit: 50},
+		},
+		{
+			name:   "invalid uuid",
+			query:  model.AuditQuery{UserID: "abc", UUID: "abc", Limit: 50},
+			expErr: ValidationErrors{ErrInvalidUserID},
+		},
+		{
+			name:   "id out of range",
+			query:  model.AuditQuery{UserID: "0", Limit: 50},
+			expErr: ValidationErrors{ErrInvalidUserID},
+		},
+		{
+			name:   "limit and before out of range",
+			query:  model.AuditQuery{Limit: 1001, Before: -1},
+			expErr: ValidationErrors{ErrInvalidLimit, ErrInvalidBefore},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotErr := ValidateAuditQuery(&tt.query)
+			equal(t, tt.expErr, gotErr)
+		})
+	}
+}
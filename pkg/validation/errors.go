@@ -1,23 +1,194 @@
 package validation
 
-import "errors"
+import (
+	"errors"
+	"strings"
+)
+
+const (
+	CodeRequired      = "required"
+	CodeTooShort      = "too_short"
+	CodeTooLong       = "too_long"
+	CodeOutOfRange    = "out_of_range"
+	CodeInvalidFormat = "invalid_format"
+	CodeInvalidValue  = "invalid_value"
+	CodeReadOnly      = "read_only"
+	CodeConflict      = "conflict"
+)
 
 var (
-	ErrUserNotFound = errors.New("users not found")
-
-	ErrInvalidID     = InvalidRequest{Message: "id cannot be less than 1"}
-	ErrShortUsername = InvalidRequest{Message: "username must contain at least 3 characters"}
-	ErrLongUsername  = InvalidRequest{Message: "username must not contain more than 50 characters"}
-	ErrLongFirstName = InvalidRequest{Message: "full_name must not contain more than 100 characters"}
-	ErrLongEmail     = InvalidRequest{Message: "email must not contain more than 100 characters"}
-	ErrNoEmail       = InvalidRequest{Message: "email address not specified"}
-	ErrInvalidEmail  = InvalidRequest{Message: "email address is invalid"}
+	ErrUserNotFound       = errors.New("users not found")
+	ErrUnsupportedPatch   = errors.New("patch content type must be application/merge-patch+json or application/json-patch+json")
+	ErrPatchTestFailed    = errors.New("patch test operation failed")
+	ErrPreconditionFailed = errors.New("user has been modified since it was retrieved")
+
+	ErrIdempotencyKeyReused  = errors.New("idempotency key has already been used for a different request")
+	ErrIdempotencyInProgress = errors.New("a request with the same idempotency key is in progress")
+
+	ErrBatchRolledBack = errors.New("operation rolled back because another operation of the atomic batch failed")
+
+	ErrUnsupportedImport = errors.New("import content type must be text/csv or application/x-ndjson")
+
+	ErrWebhookNotFound  = errors.New("webhook not found")
+	ErrDeliveryNotFound = errors.New("delivery not found")
+
+	ErrNoCredentials  = errors.New("missing api key or bearer token")
+	ErrInvalidAPIKey  = errors.New("invalid api key")
+	ErrInvalidToken   = errors.New("invalid bearer token")
+	ErrAPIKeyNotFound = errors.New("api key not found")
+	ErrInactiveAPIKey = errors.New("api key has been revoked or has expired")
+
+	ErrRoleAssignmentNotFound = errors.New("role assignment not found")
+
+	ErrRateLimited = errors.New("rate limit exceeded")
+
+	ErrMalformedID   = InvalidRequest{Field: "id", Code: CodeInvalidFormat, Message: "invalid id"}
+	ErrInvalidID     = InvalidRequest{Field: "id", Code: CodeOutOfRange, Message: "id cannot be less than 1"}
+	ErrInvalidUUID   = InvalidRequest{Field: "uuid", Code: CodeInvalidFormat, Message: "uuid is invalid"}
+	ErrShortUsername = InvalidRequest{Field: "username", Code: CodeTooShort, Message: "username must contain at least 3 characters"}
+	ErrLongUsername  = InvalidRequest{Field: "username", Code: CodeTooLong, Message: "username must not contain more than 50 characters"}
+	ErrLongFirstName = InvalidRequest{Field: "full_name", Code: CodeTooLong, Message: "full_name must not contain more than 100 characters"}
+	ErrLongEmail     = InvalidRequest{Field: "email", Code: CodeTooLong, Message: "email must not contain more than 100 characters"}
+	ErrNoEmail       = InvalidRequest{Field: "email", Code: CodeRequired, Message: "email address not specified"}
+	ErrInvalidEmail  = InvalidRequest{Field: "email", Code: CodeInvalidFormat, Message: "email address is invalid"}
+
+	ErrInvalidLimit       = InvalidRequest{Field: "limit", Code: CodeOutOfRange, Message: "limit must be between 1 and 1000"}
+	ErrInvalidSort        = InvalidRequest{Field: "sort", Code: CodeInvalidValue, Message: "sort must be one of id, username, email, created_at, updated_at"}
+	ErrInvalidOrder       = InvalidRequest{Field: "order", Code: CodeInvalidValue, Message: "order must be asc or desc"}
+	ErrInvalidCursor      = InvalidRequest{Field: "cursor", Code: CodeInvalidFormat, Message: "cursor is invalid"}
+	ErrLongPrefix         = InvalidRequest{Field: "username_prefix", Code: CodeTooLong, Message: "username_prefix must not contain more than 50 characters"}
+	ErrLongDomain         = InvalidRequest{Field: "email_domain", Code: CodeTooLong, Message: "email_domain must not contain more than 100 characters"}
+	ErrInvalidDateRange   = InvalidRequest{Field: "created_after", Code: CodeOutOfRange, Message: "created_after must be before created_before"}
+	ErrInvalidUpdateRange = InvalidRequest{Field: "updated_after", Code: CodeOutOfRange, Message: "updated_after must be before updated_before"}
+
+	ErrShortSearch        = InvalidRequest{Field: "q", Code: CodeTooShort, Message: "q must contain at least 2 characters"}
+	ErrLongSearch         = InvalidRequest{Field: "q", Code: CodeTooLong, Message: "q must not contain more than 100 characters"}
+	ErrInvalidSearchLimit = InvalidRequest{Field: "limit", Code: CodeOutOfRange, Message: "limit must be between 1 and 100"}
+
+	ErrInvalidIdempotencyKey = InvalidRequest{Field: "Idempotency-Key", Code: CodeTooLong, Message: "Idempotency-Key must not contain more than 255 characters"}
+
+	ErrInvalidLastEventID = InvalidRequest{Field: "Last-Event-ID", Code: CodeInvalidFormat, Message: "Last-Event-ID must be a non-negative integer"}
+
+	ErrEmptyBatch     = InvalidRequest{Field: "operations", Code: CodeRequired, Message: "operations must not be empty"}
+	ErrLongBatch      = InvalidRequest{Field: "operations", Code: CodeTooLong, Message: "operations must not contain more than 100 items"}
+	ErrInvalidBatchOp = InvalidRequest{Field: "op", Code: CodeInvalidValue, Message: "op must be one of create, patch, delete"}
+	ErrNoBatchUser    = InvalidRequest{Field: "user", Code: CodeRequired, Message: "user not specified"}
+	ErrNoBatchID      = InvalidRequest{Field: "id", Code: CodeRequired, Message: "id not specified"}
+	ErrNoBatchPatch   = InvalidRequest{Field: "patch", Code: CodeRequired, Message: "patch not specified"}
+	ErrInvalidAtomic  = InvalidRequest{Field: "atomic", Code: CodeInvalidValue, Message: "atomic must be true or false"}
+
+	ErrEmptyImport       = InvalidRequest{Code: CodeRequired, Message: "import contains no rows"}
+	ErrLongImport        = InvalidRequest{Code: CodeTooLong, Message: "import must not contain more than 10000 rows"}
+	ErrInvalidMapping    = InvalidRequest{Field: "mapping", Code: CodeInvalidFormat, Message: "mapping must be a list of column:field pairs with field one of username, email, full_name"}
+	ErrInvalidDryRun     = InvalidRequest{Field: "dry_run", Code: CodeInvalidValue, Message: "dry_run must be true or false"}
+	ErrInvalidRow        = InvalidRequest{Code: CodeInvalidFormat, Message: "row must be a JSON object of strings"}
+	ErrDuplicateUsername = InvalidRequest{Field: "username", Code: CodeInvalidValue, Message: "username appears more than once in the import"}
+	ErrDuplicateEmail    = InvalidRequest{Field: "email", Code: CodeInvalidValue, Message: "email appears more than once in the import"}
+	ErrTakenEmail        = InvalidRequest{Field: "email", Code: CodeConflict, Message: "email already exists"}
+
+	ErrNoWebhookURL         = InvalidRequest{Field: "url", Code: CodeRequired, Message: "url not specified"}
+	ErrInvalidWebhookURL    = InvalidRequest{Field: "url", Code: CodeInvalidFormat, Message: "url must be an absolute http or https URL"}
+	ErrLongWebhookURL       = InvalidRequest{Field: "url", Code: CodeTooLong, Message: "url must not contain more than 2048 characters"}
+	ErrInvalidWebhookEvent  = InvalidRequest{Field: "events", Code: CodeInvalidValue, Message: "events must be some of user.created, user.updated, user.deleted"}
+	ErrMalformedDeliveryID  = InvalidRequest{Field: "delivery_id", Code: CodeInvalidFormat, Message: "invalid delivery id"}
+	ErrInvalidStatus        = InvalidRequest{Field: "status", Code: CodeInvalidValue, Message: "status must be one of pending, delivered, dead"}
+	ErrInvalidDeliveryLimit = InvalidRequest{Field: "limit", Code: CodeOutOfRange, Message: "limit must be between 1 and 100"}
+	ErrInvalidBefore        = InvalidRequest{Field: "before", Code: CodeOutOfRange, Message: "before cannot be less than 0"}
+
+	ErrInvalidUserID = InvalidRequest{Field: "user_id", Code: CodeInvalidFormat, Message: "user_id must be a UUID or a positive id"}
+	ErrLongActor     = InvalidRequest{Field: "actor", Code: CodeTooLong, Message: "actor must not contain more than 255 characters"}
+
+	ErrNoKeyName    = InvalidRequest{Field: "name", Code: CodeRequired, Message: "name not specified"}
+	ErrLongKeyName  = InvalidRequest{Field: "name", Code: CodeTooLong, Message: "name must not contain more than 100 characters"}
+	ErrLongOwner    = InvalidRequest{Field: "owner", Code: CodeTooLong, Message: "owner must not contain more than 255 characters"}
+	ErrNoScopes     = InvalidRequest{Field: "scopes", Code: CodeRequired, Message: "scopes not specified"}
+	ErrInvalidScope = InvalidRequest{Field: "scopes", Code: CodeInvalidValue, Message: "scopes must be some of users:read, users:write, admin"}
+	ErrPastExpiry   = InvalidRequest{Field: "expires_at", Code: CodeOutOfRange, Message: "expires_at must be in the future"}
+	ErrInvalidGrace = InvalidRequest{Field: "grace", Code: CodeOutOfRange, Message: "grace must be a duration between 0s and 720h"}
+
+	ErrNoPrincipal   = InvalidRequest{Field: "principal", Code: CodeRequired, Message: "principal not specified"}
+	ErrLongPrincipal = InvalidRequest{Field: "principal", Code: CodeTooLong, Message: "principal must not contain more than 255 characters"}
+	ErrInvalidRole   = InvalidRequest{Field: "role", Code: CodeInvalidValue, Message: "role must be one of admin, operator, read-only"}
+
+	ErrInvalidExportFormat = InvalidRequest{Field: "format", Code: CodeInvalidValue, Message: "format must be one of csv, ndjson, xlsx"}
+
+	ErrInvalidPatch      = InvalidRequest{Code: CodeInvalidFormat, Message: "patch must be a JSON object"}
+	ErrInvalidPath       = InvalidRequest{Code: CodeInvalidFormat, Message: "patch path must point to a top-level member"}
+	ErrUnsupportedOp     = InvalidRequest{Code: CodeInvalidValue, Message: "patch op must be one of test, replace, remove"}
+	ErrReadOnlyID        = InvalidRequest{Field: "id", Code: CodeReadOnly, Message: "id cannot be changed"}
+	ErrReadOnlyUUID      = InvalidRequest{Field: "uuid", Code: CodeReadOnly, Message: "uuid cannot be changed"}
+	ErrReadOnlyCreatedAt = InvalidRequest{Field: "created_at", Code: CodeReadOnly, Message: "created_at cannot be changed"}
+	ErrReadOnlyUpdatedAt = InvalidRequest{Field: "updated_at", Code: CodeReadOnly, Message: "updated_at cannot be changed"}
+	ErrReadOnlyDeletedAt = InvalidRequest{Field: "deleted_at", Code: CodeReadOnly, Message: "deleted_at cannot be changed, use delete and restore instead"}
 )
 
 type InvalidRequest struct {
-	Message string
+	Field   string `json:"field,omitempty"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
 }
 
 func (i InvalidRequest) Error() string {
 	return i.Message
 }
+
+// MalformedRequest wraps an error of decoding the request body or query.
+func MalformedRequest(err error) InvalidRequest {
+	return InvalidRequest{Code: CodeInvalidFormat, Message: err.Error()}
+}
+
+// ValidationErrors collects every failed rule of a request.
+type ValidationErrors []InvalidRequest
+
+func (v ValidationErrors) Error() string {
+	messages := make([]string, len(v))
+	for i, e := range v {
+		messages[i] = e.Message
+	}
+	return strings.Join(messages, "; ")
+}
+
+func (v *ValidationErrors) add(err error) {
+	var i InvalidRequest
+	if errors.As(err, &i) {
+		*v = append(*v, i)
+	}
+}
+
+// err returns nil rather than an empty ValidationErrors, so the result can be
+// compared with nil by the callers.
+func (v ValidationErrors) err() error {
+	if len(v) == 0 {
+		return nil
+	}
+	return v
+}
+
+// ErrConflict reports that a unique field of the user is already taken.
+type ErrConflict struct {
+	Field string
+}
+
+func (e ErrConflict) Error() string {
+	return e.Field + " already exists"
+}
+
+// ErrMissingScope reports that the caller is not granted the scope the
+// operation requires.
+type ErrMissingScope struct {
+	Scope string
+}
+
+func (e ErrMissingScope) Error() string {
+	return "missing scope " + e.Scope
+}
+
+// ErrMissingPermission reports that no role of the caller grants the
+// permission the operation requires.
+type ErrMissingPermission struct {
+	Permission string
+}
+
+func (e ErrMissingPermission) Error() string {
+	return "missing permission " + e.Permission
+}
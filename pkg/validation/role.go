@@ -0,0 +1,24 @@
+package validation
+
+import "cruder/internal/model"
+
+const maxPrincipalLength = 255
+
+func ValidateRole(role string) error {
+	if _, ok := model.RolePermissions[role]; !ok {
+		return ErrInvalidRole
+	}
+	return nil
+}
+
+func ValidateRoleAssignment(assignment *model.RoleAssignment) error {
+	var errs ValidationErrors
+	switch {
+	case assignment.Principal == "":
+		errs.add(ErrNoPrincipal)
+	case len(assignment.Principal) > maxPrincipalLength:
+		errs.add(ErrLongPrincipal)
+	}
+	errs.add(ValidateRole(assignment.Role))
+	return errs.err()
+}
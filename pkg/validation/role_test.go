@@ -0,0 +1,42 @@
+package validation
+
+import (
+	"strings"
+	"testing"
+
+	"cruder/internal/model"
+)
+
+func TestValidateRoleAssignment(t *testing.T) {
+	tests := []struct {
+		name       string
+		assignment model.RoleAssignment
+		expErr     error
+	}{
+		{
+			name:       "assignment is valid",
+			assignment: model.RoleAssignment{Principal: "jwt:jdoe", Role: model.RoleOperator},
+		},
+		{
+			name:       "nothing specified",
+			assignment: model.RoleAssignment{},
+			expErr:     ValidationErrors{ErrNoPrincipal, ErrInvalidRole},
+		},
+		{
+			name:       "principal is too long",
+			assignment: model.RoleAssignment{Principal: strings.Repeat("a", 256), Role: model.RoleAdmin},
+			expErr:     ValidationErrors{ErrLongPrincipal},
+		},
+		{
+			name:       "unknown role",
+			assignment: model.RoleAssignment{Principal: "jwt:jdoe", Role: "owner"},
+			expErr:     ValidationErrors{ErrInvalidRole},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotErr := ValidateRoleAssignment(&tt.assignment)
+			equal(t, tt.expErr, gotErr)
+		})
+	}
+}
@@ -2,6 +2,8 @@ package validation
 
 import (
 	"net/mail"
+	"strings"
+	"unicode"
 
 	"cruder/internal/model"
 )
@@ -13,6 +15,25 @@ func ValidateID(id int64) error {
 	return nil
 }
 
+func ValidateUUID(uuid string) error {
+	if len(uuid) != 36 {
+		return ErrInvalidUUID
+	}
+	for i, r := range uuid {
+		switch i {
+		case 8, 13, 18, 23:
+			if r != '-' {
+				return ErrInvalidUUID
+			}
+		default:
+			if !unicode.Is(unicode.ASCII_Hex_Digit, r) {
+				return ErrInvalidUUID
+			}
+		}
+	}
+	return nil
+}
+
 func ValidateUsername(username string) error {
 	if len(username) < 3 {
 		return ErrShortUsername
@@ -44,14 +65,104 @@ func ValidateFullName(fullName string) error {
 }
 
 func ValidateUser(user *model.User) error {
-	if err := ValidateUsername(user.Username); err != nil {
-		return err
+	var errs ValidationErrors
+	errs.add(ValidateUsername(user.Username))
+	errs.add(ValidateEmail(user.Email))
+	errs.add(ValidateFullName(user.FullName))
+	return errs.err()
+}
+
+const MaxLimit = 1000
+
+var sortable = map[string]bool{"id": true, "username": true, "email": true, "created_at": true, "updated_at": true}
+
+func ValidateUserQuery(query *model.UserQuery) error {
+	var errs ValidationErrors
+	if query.Limit < 1 || query.Limit > MaxLimit {
+		errs.add(ErrInvalidLimit)
+	}
+	if !sortable[query.Sort] {
+		errs.add(ErrInvalidSort)
+	}
+	if query.Order != "asc" && query.Order != "desc" {
+		errs.add(ErrInvalidOrder)
+	}
+	if len(query.UsernamePrefix) > 50 {
+		errs.add(ErrLongPrefix)
+	}
+	if len(query.EmailDomain) > 100 {
+		errs.add(ErrLongDomain)
+	}
+	if query.CreatedAfter != nil && query.CreatedBefore != nil && !query.CreatedAfter.Before(*query.CreatedBefore) {
+		errs.add(ErrInvalidDateRange)
+	}
+	if query.UpdatedAfter != nil && query.UpdatedBefore != nil && !query.UpdatedAfter.Before(*query.UpdatedBefore) {
+		errs.add(ErrInvalidUpdateRange)
+	}
+	return errs.err()
+}
+
+func ValidateCursor(query *model.UserQuery, cursor *model.Cursor) error {
+	if cursor.Sort != query.Sort || cursor.Order != query.Order {
+		return ErrInvalidCursor
 	}
-	if err := ValidateEmail(user.Email); err != nil {
-		return err
+	return nil
+}
+
+const (
+	MinSearchLength  = 2
+	MaxSearchLength  = 100
+	MaxSearchResults = 100
+)
+
+func ValidateUserSearch(search *model.UserSearch) error {
+	var errs ValidationErrors
+	if n := len(strings.TrimSpace(search.Q)); n < MinSearchLength {
+		errs.add(ErrShortSearch)
+	} else if n > MaxSearchLength {
+		errs.add(ErrLongSearch)
+	}
+	if search.Limit < 1 || search.Limit > MaxSearchResults {
+		errs.add(ErrInvalidSearchLimit)
+	}
+	return errs.err()
+}
+
+const MaxBatchSize = 100
+
+func ValidateBatch(ops []model.BatchOperation) error {
+	if len(ops) == 0 {
+		return ErrEmptyBatch
 	}
-	if err := ValidateFullName(user.FullName); err != nil {
-		return err
+	if len(ops) > MaxBatchSize {
+		return ErrLongBatch
 	}
 	return nil
 }
+
+// ValidateBatchOperation checks that the operation carries what its op needs.
+// The user or patch itself is validated when the operation is applied.
+func ValidateBatchOperation(op *model.BatchOperation) error {
+	switch op.Op {
+	case model.BatchCreate:
+		if op.User == nil {
+			return ErrNoBatchUser
+		}
+	case model.BatchPatch:
+		if op.ID == "" {
+			return ErrNoBatchID
+		}
+		if len(op.Patch) == 0 {
+			return ErrNoBatchPatch
+		}
+	case model.BatchDelete:
+		if op.ID == "" {
+			return ErrNoBatchID
+		}
+	default:
+		return ErrInvalidBatchOp
+	}
+	return nil
+}
+
+const MaxImportRows = 10000
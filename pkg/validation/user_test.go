@@ -3,6 +3,9 @@ package validation
 import (
 	"reflect"
 	"testing"
+	"time"
+
+	"cruder/internal/model"
 )
 
 func equal(t *testing.T, exp, got any) {
@@ -40,6 +43,40 @@ func TestValidateID(t *testing.T) {
 	}
 }
 
+func TestValidateUUID(t *testing.T) {
+	tests := []struct {
+		name   string
+		uuid   string
+		expErr error
+	}{
+		{
+			name: "uuid is valid",
+			uuid: "123e4567-e89b-12d3-a456-426614174000",
+		},
+		{
+			name:   "uuid is too short",
+			uuid:   "123e4567-e89b-12d3-a456",
+			expErr: ErrInvalidUUID,
+		},
+		{
+			name:   "uuid is not hex",
+			uuid:   "123e4567-e89b-12d3-a456-42661417400z",
+			expErr: ErrInvalidUUID,
+		},
+		{
+			name:   "uuid has misplaced hyphens",
+			uuid:   "123e4567e-89b-12d3-a456-426614174000",
+			expErr: ErrInvalidUUID,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotErr := ValidateUUID(tt.uuid)
+			equal(t, tt.expErr, gotErr)
+		})
+	}
+}
+
 func TestValidateEmail(t *testing.T) {
 	tests := []struct {
 		name   string
@@ -78,3 +115,113 @@ func TestValidateEmail(t *testing.T) {
 		})
 	}
 }
+
+func TestValidateUserQuery(t *testing.T) {
+	now := time.Now()
+	earlier := now.Add(-time.Hour)
+
+	tests := []struct {
+		name   string
+		query  model.UserQuery
+		expErr error
+	}{
+		{
+			name:  "query is valid",
+			query: model.UserQuery{Limit: 10, Sort: "created_at", Order: "desc", CreatedAfter: &earlier, CreatedBefore: &now},
+		},
+		{
+			name:   "limit is too big",
+			query:  model.UserQuery{Limit: MaxLimit + 1, Sort: "id", Order: "asc"},
+			expErr: ValidationErrors{ErrInvalidLimit},
+		},
+		{
+			name:   "sort is unknown",
+			query:  model.UserQuery{Limit: 10, Sort: "full_name", Order: "asc"},
+			expErr: ValidationErrors{ErrInvalidSort},
+		},
+		{
+			name:   "order is unknown",
+			query:  model.UserQuery{Limit: 10, Sort: "id", Order: "up"},
+			expErr: ValidationErrors{ErrInvalidOrder},
+		},
+		{
+			name:   "date range is empty",
+			query:  model.UserQuery{Limit: 10, Sort: "id", Order: "asc", CreatedAfter: &now, CreatedBefore: &earlier},
+			expErr: ValidationErrors{ErrInvalidDateRange},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotErr := ValidateUserQuery(&tt.query)
+			equal(t, tt.expErr, gotErr)
+		})
+	}
+}
+
+func TestValidateUser(t *testing.T) {
+	tests := []struct {
+		name   string
+		user   model.User
+		expErr error
+	}{
+		{
+			name: "user is valid",
+			user: model.User{Username: "jdoe", Email: "jdoe@example.com", FullName: "John Doe"},
+		},
+		{
+			name:   "username is too short",
+			user:   model.User{Username: "jd", Email: "jdoe@example.com"},
+			expErr: ValidationErrors{ErrShortUsername},
+		},
+		{
+			name:   "every invalid field is reported",
+			user:   model.User{Username: "jd", Email: "mail.com"},
+			expErr: ValidationErrors{ErrShortUsername, ErrInvalidEmail},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotErr := ValidateUser(&tt.user)
+			equal(t, tt.expErr, gotErr)
+		})
+	}
+}
+
+func TestValidateBatchOperation(t *testing.T) {
+	tests := []struct {
+		name   string
+		op     model.BatchOperation
+		expErr error
+	}{
+		{
+			name: "create is valid",
+			op:   model.BatchOperation{Op: model.BatchCreate, User: &model.User{}},
+		},
+		{
+			name:   "create without user",
+			op:     model.BatchOperation{Op: model.BatchCreate},
+			expErr: ErrNoBatchUser,
+		},
+		{
+			name:   "patch without patch",
+			op:     model.BatchOperation{Op: model.BatchPatch, ID: "1"},
+			expErr: ErrNoBatchPatch,
+		},
+		{
+			name:   "delete without id",
+			op:     model.BatchOperation{Op: model.BatchDelete},
+			expErr: ErrNoBatchID,
+		},
+		{
+			name:   "op is unknown",
+			op:     model.BatchOperation{Op: "rename"},
+			expErr: ErrInvalidBatchOp,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotErr := ValidateBatchOperation(&tt.op)
+			equal(t, tt.expErr, gotErr)
+		})
+	}
+}
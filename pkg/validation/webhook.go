@@ -0,0 +1,59 @@
+package validation
+
+import (
+	"net/url"
+
+	"cruder/internal/model"
+)
+
+const maxWebhookURLLength = 2048
+
+var eventTypes = map[string]bool{model.UserCreated: true, model.UserUpdated: true, model.UserDeleted: true}
+
+func ValidateWebhookURL(rawURL string) error {
+	if rawURL == "" {
+		return ErrNoWebhookURL
+	}
+	if len(rawURL) > maxWebhookURLLength {
+		return ErrLongWebhookURL
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return ErrInvalidWebhookURL
+	}
+	return nil
+}
+
+func ValidateWebhookEvents(events []string) error {
+	for _, event := range events {
+		if !eventTypes[event] {
+			return ErrInvalidWebhookEvent
+		}
+	}
+	return nil
+}
+
+func ValidateWebhook(webhook *model.Webhook) error {
+	var errs ValidationErrors
+	errs.add(ValidateWebhookURL(webhook.URL))
+	errs.add(ValidateWebhookEvents(webhook.Events))
+	return errs.err()
+}
+
+const MaxDeliveries = 100
+
+var deliveryStatuses = map[string]bool{model.DeliveryPending: true, model.DeliveryDelivered: true, model.DeliveryDead: true}
+
+func ValidateDeliveryQuery(query *model.DeliveryQuery) error {
+	var errs ValidationErrors
+	if query.Status != "" && !deliveryStatuses[query.Status] {
+		errs.add(ErrInvalidStatus)
+	}
+	if query.Limit < 1 || query.Limit > MaxDeliveries {
+		errs.add(ErrInvalidDeliveryLimit)
+	}
+	if query.Before < 0 {
+		errs.add(ErrInvalidBefore)
+	}
+	return errs.err()
+}
@@ -0,0 +1,85 @@
+package validation
+
+import (
+	"strings"
+	"testing"
+
+	"cruder/internal/model"
+)
+
+func TestValidateWebhook(t *testing.T) {
+	tests := []struct {
+		name    string
+		webhook model.Webhook
+		expErr  error
+	}{
+		{
+			name:    "webhook is valid",
+			webhook: model.Webhook{URL: "https://crm.example.com/hooks/users", Events: []string{model.UserCreated, model.UserDeleted}},
+		},
+		{
+			name:    "every event type",
+			webhook: model.Webhook{URL: "http://billing:8080/hooks"},
+		},
+		{
+			name:    "url not specified",
+			webhook: model.Webhook{},
+			expErr:  ValidationErrors{ErrNoWebhookURL},
+		},
+		{
+			name:    "relative url",
+			webhook: model.Webhook{URL: "/hooks"},
+			expErr:  ValidationErrors{ErrInvalidWebhookURL},
+		},
+		{
+			name:    "unsupported scheme",
+			webhook: model.Webhook{URL: "ftp://example.com/hooks"},
+			expErr:  ValidationErrors{ErrInvalidWebhookURL},
+		},
+		{
+			name:    "url is too long",
+			webhook: model.Webhook{URL: "https://example.com/" + strings.Repeat("a", 2048)},
+			expErr:  ValidationErrors{ErrLongWebhookURL},
+		},
+		{
+			name:    "unknown event type",
+			webhook: model.Webhook{URL: "https://example.com", Events: []string{model.UserCreated, "user.renamed"}},
+			expErr:  ValidationErrors{ErrInvalidWebhookEvent},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotErr := ValidateWebhook(&tt.webhook)
+			equal(t, tt.expErr, gotErr)
+		})
+	}
+}
+
+func TestValidateDeliveryQuery(t *testing.T) {
+	tests := []struct {
+		name   string
+		query  model.DeliveryQuery
+		expErr error
+	}{
+		{
+			name:  "query is valid",
+			query: model.DeliveryQuery{Status: model.DeliveryDead, Limit: 20, Before: 42},
+		},
+		{
+			name:   "unknown status",
+			query:  model.DeliveryQuery{Status: "failed", Limit: 20},
+			expErr: ValidationErrors{ErrInvalidStatus},
+		},
+		{
+			name:   "limit and before out of range",
+			query:  model.DeliveryQuery{Limit: 101, Before: -1},
+			expErr: ValidationErrors{ErrInvalidDeliveryLimit, ErrInvalidBefore},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotErr := ValidateDeliveryQuery(&tt.query)
+			equal(t, tt.expErr, gotErr)
+		})
+	}
+}